@@ -0,0 +1,73 @@
+// bitcask-http は ShardedDB を HTTP/JSON API として公開します。
+//
+//	bitcask-http -addr :8080 -dir ./data -shards 8
+//	curl -X PUT --data-binary world localhost:8080/kv/hello
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"bitcask-go/internal/httpapi"
+	"bitcask-go/internal/storage"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "listen address")
+	dir := flag.String("dir", "data", "data directory")
+	shards := flag.Int("shards", 8, "number of shards")
+	syncAlways := flag.Bool("sync", false, "fsync every write (SyncAlways)")
+	compression := flag.String("compression", "none", "value compression for new writes: none, lz4 or flate")
+	keyFile := flag.String("key-file", "", "encrypt data at rest with the keys in this file (lines of \"<id> <hex key>\")")
+	blobThreshold := flag.Int("blob-threshold", 0, "store values of at least this many bytes in separate blob files (0 disables)")
+	maxValue := flag.Int64("max-value", httpapi.DefaultMaxValueSize, "maximum value size accepted by PUT (bytes)")
+	flag.Parse()
+
+	var err error
+	opts := storage.DefaultOptions()
+	if *syncAlways {
+		opts.SyncPolicy = storage.SyncAlways
+	}
+	if opts.Compression, err = storage.ParseCompression(*compression); err != nil {
+		log.Fatal(err)
+	}
+	opts.BlobThreshold = *blobThreshold
+	if *keyFile != "" {
+		if opts.KeyProvider, err = storage.LoadKeyFile(*keyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	db, err := storage.NewShardedDBWithOptions(*dir, *shards, opts)
+	if err != nil {
+		log.Fatalf("open %s: %v", *dir, err)
+	}
+
+	api := httpapi.NewServer(db)
+	api.MaxValueSize = *maxValue
+	srv := &http.Server{Addr: *addr, Handler: api, ReadHeaderTimeout: 10 * time.Second}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}()
+
+	log.Printf("listening on %s (dir=%s, shards=%d)", *addr, *dir, *shards)
+	err = srv.ListenAndServe()
+	if closeErr := db.Close(); closeErr != nil {
+		log.Printf("close: %v", closeErr)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
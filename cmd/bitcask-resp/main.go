@@ -0,0 +1,64 @@
+// bitcask-resp は ShardedDB を Redis 互換 (RESP2) のサーバーとして公開します。
+//
+//	bitcask-resp -addr :6380 -dir ./data -shards 8
+//	redis-cli -p 6380 SET hello world
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"bitcask-go/internal/resp"
+	"bitcask-go/internal/storage"
+)
+
+func main() {
+	addr := flag.String("addr", ":6380", "listen address")
+	dir := flag.String("dir", "data", "data directory")
+	shards := flag.Int("shards", 8, "number of shards")
+	syncAlways := flag.Bool("sync", false, "fsync every write (SyncAlways)")
+	compression := flag.String("compression", "none", "value compression for new writes: none, lz4 or flate")
+	keyFile := flag.String("key-file", "", "encrypt data at rest with the keys in this file (lines of \"<id> <hex key>\")")
+	blobThreshold := flag.Int("blob-threshold", 0, "store values of at least this many bytes in separate blob files (0 disables)")
+	flag.Parse()
+
+	var err error
+	opts := storage.DefaultOptions()
+	if *syncAlways {
+		opts.SyncPolicy = storage.SyncAlways
+	}
+	if opts.Compression, err = storage.ParseCompression(*compression); err != nil {
+		log.Fatal(err)
+	}
+	opts.BlobThreshold = *blobThreshold
+	if *keyFile != "" {
+		if opts.KeyProvider, err = storage.LoadKeyFile(*keyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	db, err := storage.NewShardedDBWithOptions(*dir, *shards, opts)
+	if err != nil {
+		log.Fatalf("open %s: %v", *dir, err)
+	}
+
+	srv := resp.NewServer(db)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		_ = srv.Close()
+	}()
+
+	log.Printf("listening on %s (dir=%s, shards=%d)", *addr, *dir, *shards)
+	err = srv.ListenAndServe(*addr)
+	if closeErr := db.Close(); closeErr != nil {
+		log.Printf("close: %v", closeErr)
+	}
+	if err != nil && !errors.Is(err, resp.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,454 @@
+// bitcask はデータディレクトリを調査・操作するコマンドです。
+// 単一の DB のディレクトリと、ShardedDB の shard-N レイアウトの両方を扱えます。
+//
+//	bitcask get    -dir DIR KEY
+//	bitcask put    -dir DIR [-ttl 10m] KEY VALUE   (VALUE が - なら標準入力)
+//	bitcask delete -dir DIR KEY
+//	bitcask scan   -dir DIR [-prefix P] [-limit N] [-values]
+//	bitcask stats  -dir DIR [-segments]
+//	bitcask merge  -dir DIR [-compression lz4 -recompress] [-blobs]
+//	bitcask verify -dir DIR [-repair]
+//	bitcask dump   [-values] FILE.data|FILE.hint|FILE.blob
+//
+// 暗号化されたディレクトリは -key-file で鍵ファイル (storage.LoadKeyFile を参照) を指定して開きます。
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"bitcask-go/internal/storage"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"get", "get -dir DIR KEY", runGet},
+	{"put", "put -dir DIR [-ttl DURATION] KEY VALUE|-", runPut},
+	{"delete", "delete -dir DIR KEY", runDelete},
+	{"scan", "scan -dir DIR [-prefix PREFIX] [-limit N] [-values]", runScan},
+	{"stats", "stats -dir DIR [-segments]", runStats},
+	{"merge", "merge -dir DIR [-compression none|lz4|flate -recompress] [-blobs]", runMerge},
+	{"verify", "verify -dir DIR [-repair]", runVerify},
+	{"dump", "dump [-values] FILE", runDump},
+}
+
+// errUsage は引数の誤りを表します。main は使い方を表示して終了コード 2 で終了します。
+var errUsage = errors.New("usage")
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: bitcask <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr)
+	for _, c := range commands {
+		fmt.Fprintln(os.Stderr, "  bitcask "+c.usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "get, scan and stats accept -nolock to read a directory that a server has open.")
+	fmt.Fprintln(os.Stderr, "All commands except dump accept -key-file FILE to open an encrypted directory.")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+		err := c.run(os.Args[2:])
+		switch {
+		case errors.Is(err, errUsage):
+			fmt.Fprintln(os.Stderr, "usage: bitcask "+c.usage)
+			os.Exit(2)
+		case errors.Is(err, flag.ErrHelp):
+			os.Exit(0)
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "bitcask %s: %v\n", c.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	usage()
+	os.Exit(2)
+}
+
+// dirFlags は -dir と -key-file (と参照系の -nolock) を持つ FlagSet を作成します。
+func dirFlags(name string, readOnly bool) (fs *flag.FlagSet, dir, keyFile *string, noLock *bool) {
+	fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	dir = fs.String("dir", "data", "data directory (a DB or a ShardedDB with shard-N subdirectories)")
+	keyFile = fs.String("key-file", "", "encryption key file (lines of \"<id> <hex key>\"; the largest id encrypts new files)")
+	noLock = new(bool)
+	if readOnly {
+		fs.BoolVar(noLock, "nolock", false, "do not take the directory lock (read while a writer is running)")
+	}
+	return fs, dir, keyFile, noLock
+}
+
+// loadKeys は -key-file の鍵を読み込みます。指定が無ければ nil (暗号化しない) です。
+func loadKeys(keyFile string) (storage.KeyProvider, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+	return storage.LoadKeyFile(keyFile)
+}
+
+func withStore(dir, keyFile string, opts storage.Options, fn func(store) error) error {
+	keys, err := loadKeys(keyFile)
+	if err != nil {
+		return err
+	}
+	opts.KeyProvider = keys
+	s, err := openStore(dir, opts)
+	if err != nil {
+		return err
+	}
+	if err := fn(s); err != nil {
+		_ = s.Close()
+		return err
+	}
+	return s.Close()
+}
+
+func runGet(args []string) error {
+	fs, dir, keyFile, noLock := dirFlags("get", true)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	opts, err := storeOptions(*dir, true, *noLock)
+	if err != nil {
+		return err
+	}
+	return withStore(*dir, *keyFile, opts, func(s store) error {
+		value, err := s.Get([]byte(fs.Arg(0)))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(value)
+		return err
+	})
+}
+
+func runPut(args []string) error {
+	fs, dir, keyFile, _ := dirFlags("put", false)
+	ttl := fs.Duration("ttl", 0, "expire the key after this duration")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+	value := []byte(fs.Arg(1))
+	if fs.Arg(1) == "-" {
+		var err error
+		if value, err = io.ReadAll(os.Stdin); err != nil {
+			return err
+		}
+	}
+	opts, err := storeOptions(*dir, false, false)
+	if err != nil {
+		return err
+	}
+	return withStore(*dir, *keyFile, opts, func(s store) error {
+		if *ttl > 0 {
+			return s.PutWithTTL([]byte(fs.Arg(0)), value, *ttl)
+		}
+		return s.Put([]byte(fs.Arg(0)), value)
+	})
+}
+
+func runDelete(args []string) error {
+	fs, dir, keyFile, _ := dirFlags("delete", false)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	opts, err := storeOptions(*dir, false, false)
+	if err != nil {
+		return err
+	}
+	return withStore(*dir, *keyFile, opts, func(s store) error {
+		return s.Delete([]byte(fs.Arg(0)))
+	})
+}
+
+func runScan(args []string) error {
+	fs, dir, keyFile, noLock := dirFlags("scan", true)
+	prefix := fs.String("prefix", "", "only keys with this prefix")
+	limit := fs.Int("limit", 0, "maximum number of keys (0 = no limit)")
+	values := fs.Bool("values", false, "print values (tab separated, Go-quoted)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+	opts, err := storeOptions(*dir, true, *noLock)
+	if err != nil {
+		return err
+	}
+	return withStore(*dir, *keyFile, opts, func(s store) error {
+		it := scanStore(s, []byte(*prefix))
+		defer func() { _ = it.Close() }()
+		for n := 0; it.Valid() && (*limit <= 0 || n < *limit); it.Next() {
+			line := string(it.Key())
+			if *values {
+				value, err := it.Value()
+				if err != nil {
+					return fmt.Errorf("key %q: %w", it.Key(), err)
+				}
+				line += "\t" + fmt.Sprintf("%q", value)
+			}
+			fmt.Println(line)
+			n++
+		}
+		return it.Err()
+	})
+}
+
+func runStats(args []string) error {
+	fs, dir, keyFile, noLock := dirFlags("stats", true)
+	segments := fs.Bool("segments", false, "show per-segment statistics")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+	opts, err := storeOptions(*dir, true, *noLock)
+	if err != nil {
+		return err
+	}
+	return withStore(*dir, *keyFile, opts, func(s store) error {
+		shards := storeStats(s)
+		var total storage.Stats
+		fmt.Printf("%-8s %10s %14s %14s %14s %8s %9s\n", "SHARD", "KEYS", "TOTAL", "LIVE", "DEAD", "RATIO", "SEGMENTS")
+		for i, st := range shards {
+			printStats(fmt.Sprint(i), st)
+			total.Keys += st.Keys
+			total.TotalBytes += st.TotalBytes
+			total.LiveBytes += st.LiveBytes
+			total.DeadBytes += st.DeadBytes
+			total.Segments = append(total.Segments, st.Segments...)
+			total.BlobTotalBytes += st.BlobTotalBytes
+			total.BlobLiveBytes += st.BlobLiveBytes
+			total.BlobDeadBytes += st.BlobDeadBytes
+		}
+		if len(shards) > 1 {
+			if total.TotalBytes > 0 {
+				total.DeadRatio = float64(total.DeadBytes) / float64(total.TotalBytes)
+			}
+			printStats("total", total)
+		}
+
+		if *segments {
+			for i, st := range shards {
+				fmt.Printf("\nshard %d\n", i)
+				fmt.Printf("%-8s %7s %14s %14s %14s %10s %10s\n", "SEGMENT", "FORMAT", "TOTAL", "LIVE", "DEAD", "LIVEKEYS", "DEADKEYS")
+				for _, seg := range st.Segments {
+					fmt.Printf("%-8d %7s %14d %14d %14d %10d %10d\n", seg.FileID, formatName(seg.FormatVersion), seg.TotalBytes, seg.LiveBytes, seg.DeadBytes, seg.LiveKeys, seg.DeadKeys)
+				}
+				if len(st.Blobs) > 0 {
+					fmt.Printf("%-8s %7s %14s %14s %14s %10s %7s\n", "BLOB", "", "TOTAL", "LIVE", "DEAD", "VALUES", "RATIO")
+					for _, b := range st.Blobs {
+						fmt.Printf("%-8d %7s %14d %14d %14d %10d %6.1f%%\n", b.FileID, "", b.TotalBytes, b.LiveBytes, b.DeadBytes, b.LiveValues, b.DeadRatio*100)
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// formatName はファイル形式のバージョンを表示用の名前にします (0 はヘッダの無い旧形式)。
+func formatName(version uint16) string {
+	if version == 0 {
+		return "legacy"
+	}
+	return fmt.Sprintf("v%d", version)
+}
+
+func printStats(name string, st storage.Stats) {
+	fmt.Printf("%-8s %10d %14d %14d %14d %7.1f%% %9d\n", name, st.Keys, st.TotalBytes, st.LiveBytes, st.DeadBytes, st.DeadRatio*100, len(st.Segments))
+	if st.BlobTotalBytes > 0 {
+		fmt.Printf("%-8s %10s %14d %14d %14d\n", "  blobs", "", st.BlobTotalBytes, st.BlobLiveBytes, st.BlobDeadBytes)
+	}
+}
+
+func runMerge(args []string) error {
+	fs, dir, keyFile, _ := dirFlags("merge", false)
+	compression := fs.String("compression", "", "compression for rewritten records: none, lz4 or flate (default: the directory's recorded compression)")
+	recompress := fs.Bool("recompress", false, "recompress records stored with a different codec")
+	blobs := fs.Bool("blobs", false, "also rewrite fragmented blob files (BlobGC)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+	opts, err := storeOptions(*dir, false, false)
+	if err != nil {
+		return err
+	}
+	if *compression != "" {
+		if opts.Compression, err = storage.ParseCompression(*compression); err != nil {
+			return err
+		}
+	}
+	opts.MergeRecompress = *recompress
+	return withStore(*dir, *keyFile, opts, func(s store) error {
+		if err := s.Merge(); err != nil {
+			return err
+		}
+		if *blobs {
+			return s.BlobGC()
+		}
+		return nil
+	})
+}
+
+// runVerify は全データファイルと Hint File を検査し、-repair の場合は問題のあったディレクトリを修復します。
+func runVerify(args []string) error {
+	fs, dir, keyFile, _ := dirFlags("verify", false)
+	repair := fs.Bool("repair", false, "salvage valid records into fresh segments when problems are found")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+	keys, err := loadKeys(*keyFile)
+	if err != nil {
+		return err
+	}
+	dirs, err := storeDirs(*dir)
+	if err != nil {
+		return err
+	}
+
+	var bad int
+	for _, d := range dirs {
+		report, err := storage.Verify(d)
+		if err != nil {
+			return err
+		}
+		for _, issue := range report.Issues {
+			fmt.Printf("%s: %v\n", d, issue)
+		}
+		fmt.Printf("%s: %d data files, %d hint files, %d records, %d hint entries, %d issues\n",
+			d, report.DataFiles, report.HintFiles, report.Records, report.HintEntries, len(report.Issues))
+		if report.BlobFiles > 0 {
+			fmt.Printf("%s: %d blob files, %d blob records\n", d, report.BlobFiles, report.BlobRecords)
+		}
+		if report.LegacyFiles > 0 {
+			fmt.Printf("%s: %d files in the legacy format without a header (run merge to upgrade)\n", d, report.LegacyFiles)
+		}
+		if report.OK() {
+			continue
+		}
+		if !*repair {
+			bad++
+			continue
+		}
+		result, err := storage.Repair(d, keys)
+		if err != nil {
+			return fmt.Errorf("repair %s: %w", d, err)
+		}
+		fmt.Printf("%s: repaired: %d keys rewritten into segments %v, %d bytes dropped\n", d, result.Keys, result.Segments, result.DroppedBytes)
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d directories have problems (run with -repair to fix)", bad, len(dirs))
+	}
+	return nil
+}
+
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	values := fs.Bool("values", false, "print values (data files only, Go-quoted)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	path := fs.Arg(0)
+
+	header, err := storage.ReadFileHeader(path)
+	if err != nil {
+		return err
+	}
+	if header.Version == 0 {
+		fmt.Println("header: none (legacy format)")
+	} else {
+		line := fmt.Sprintf("header: format=%s kind=%s file_id=%d created=%s", formatName(header.Version), header.Kind, header.FileID,
+			time.Unix(0, header.CreatedAt).UTC().Format(time.RFC3339Nano))
+		if header.Encrypted {
+			line += fmt.Sprintf(" encrypted key_id=%d", header.KeyID)
+		}
+		fmt.Println(line)
+	}
+
+	var bad int
+	printRecord := func(r storage.FileRecord) error {
+		crc := "ok"
+		if r.Unfinished {
+			crc = "unfinished"
+		} else if !r.CRCValid {
+			crc = "BAD"
+			bad++
+		}
+		line := fmt.Sprintf("offset=%d size=%d crc=%08x(%s) ts=%s ksz=%d vsz=%d", r.Offset, r.Size, r.CRC, crc,
+			time.Unix(0, r.Timestamp).UTC().Format(time.RFC3339Nano), r.KeySize, r.ValueSize)
+		if r.Tombstone {
+			line += " tombstone"
+		}
+		if flags := r.FlagNames(); len(flags) > 0 {
+			line += " flags=" + strings.Join(flags, ",")
+		}
+		if r.Expiry != 0 {
+			line += " expiry=" + time.Unix(0, r.Expiry).UTC().Format(time.RFC3339Nano)
+		}
+		if strings.HasSuffix(path, ".hint") {
+			line += fmt.Sprintf(" data_offset=%d", r.DataOffset)
+		}
+		if r.Blob.Size > 0 {
+			line += fmt.Sprintf(" blob=%d@%d/%d", r.Blob.FileID, r.Blob.Offset, r.Blob.Size)
+		}
+		line += fmt.Sprintf(" key=%q", r.Key)
+		if *values && !strings.HasSuffix(path, ".hint") {
+			line += fmt.Sprintf(" value=%q", r.Value)
+		}
+		fmt.Println(line)
+		return nil
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".data"), strings.HasSuffix(path, ".blob"):
+		err = storage.WalkDataFile(path, printRecord)
+	case strings.HasSuffix(path, ".hint"):
+		err = storage.WalkHintFile(path, printRecord)
+	default:
+		return fmt.Errorf("%s: expected a .data, .hint or .blob file", path)
+	}
+	if err != nil {
+		return err
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d entries with bad CRC", bad)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bitcask-go/internal/storage"
+)
+
+// store は DB と ShardedDB に共通する操作です。
+type store interface {
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	PutWithTTL(key, value []byte, ttl time.Duration) error
+	Delete(key []byte) error
+	Merge() error
+	BlobGC() error
+	Close() error
+}
+
+// iterator は storage.Iterator と storage.ShardedIterator に共通する操作です。
+type iterator interface {
+	Valid() bool
+	Next() bool
+	Key() []byte
+	Value() ([]byte, error)
+	Err() error
+	Close() error
+}
+
+// shardCount は dir が ShardedDB のレイアウト (shard-0, shard-1, ...) なら Shard 数を、
+// 単一の DB なら 0 を返します。
+func shardCount(dir string) (int, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return 0, err
+	}
+	n := 0
+	for {
+		info, err := os.Stat(filepath.Join(dir, fmt.Sprintf("shard-%d", n)))
+		if err != nil || !info.IsDir() {
+			return n, nil
+		}
+		n++
+	}
+}
+
+// storeDirs は dir に含まれる DB のディレクトリ (ShardedDB なら各 Shard) を返します。
+func storeDirs(dir string) ([]string, error) {
+	shards, err := shardCount(dir)
+	if err != nil {
+		return nil, err
+	}
+	if shards == 0 {
+		return []string{dir}, nil
+	}
+	dirs := make([]string, shards)
+	for i := range dirs {
+		dirs[i] = filepath.Join(dir, fmt.Sprintf("shard-%d", i))
+	}
+	return dirs, nil
+}
+
+// storeOptions はコマンドが DB を開く際のオプションです。
+// 既存のディレクトリでは OPTIONS に記録された SegmentSize / Compression / BlobThreshold を引き継ぎ
+// (ShardedDB は shard-0 の記録を使います)、書き込み系のコマンドがディレクトリの設定を既定値で上書きしないようにします。
+// 参照系のコマンドは readOnly で開くので同時に複数実行でき、noLock を指定すると
+// 書き込みプロセス (サーバーなど) が開いている DB も読めます。
+func storeOptions(dir string, readOnly, noLock bool) (storage.Options, error) {
+	opts := storage.DefaultOptions()
+	opts.ReadOnly = readOnly
+	opts.NoLock = noLock
+	dirs, err := storeDirs(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return opts, nil
+	}
+	if err != nil {
+		return opts, err
+	}
+	return storage.LoadOptions(dirs[0], opts)
+}
+
+// openStore は dir のレイアウトを判定して開きます。存在しないディレクトリは書き込み用なら単一の DB として作成します。
+func openStore(dir string, opts storage.Options) (store, error) {
+	shards := 0
+	if _, err := os.Stat(dir); err == nil || opts.ReadOnly {
+		var err error
+		if shards, err = shardCount(dir); err != nil {
+			return nil, err
+		}
+	}
+	if shards > 0 {
+		return storage.NewShardedDBWithOptions(dir, shards, opts)
+	}
+	return storage.OpenWithOptions(dir, opts)
+}
+
+func scanStore(s store, prefix []byte) iterator {
+	switch db := s.(type) {
+	case *storage.ShardedDB:
+		return db.Scan(prefix)
+	case *storage.DB:
+		return db.Scan(prefix)
+	}
+	panic(fmt.Sprintf("unexpected store %T", s))
+}
+
+// storeStats は Shard ごとの統計を返します。単一の DB の場合は要素が 1 つです。
+func storeStats(s store) []storage.Stats {
+	switch db := s.(type) {
+	case *storage.ShardedDB:
+		return db.Stats().Shards
+	case *storage.DB:
+		return []storage.Stats{db.Stats()}
+	}
+	panic(fmt.Sprintf("unexpected store %T", s))
+}
@@ -0,0 +1,108 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+
+	"bitcask-go/internal/storage"
+)
+
+// scanResponse は GET /kv のレスポンスです。NextCursor が空なら走査は完了しています。
+// キーは任意のバイト列なので、JSON の文字列で壊れないよう cursor と同じ base64url (パディング無し) で符号化します。
+type scanResponse struct {
+	Keys       []string `json:"keys"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// handleScan は prefix に一致するキーを昇順に最大 limit 件返します。
+// cursor は前回返した最後のキーを base64url で符号化したもので、サーバー側に状態を持ちません。
+func (s *Server) handleScan(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := []byte(q.Get("prefix"))
+
+	limit := defaultScanLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxScanLimit {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxScanLimit))
+			return
+		}
+		limit = n
+	}
+
+	var after []byte
+	if v := q.Get("cursor"); v != "" {
+		var err error
+		after, err = base64.RawURLEncoding.DecodeString(v)
+		if err != nil || !bytes.HasPrefix(after, prefix) {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+
+	it := s.db.Scan(prefix)
+	defer func() { _ = it.Close() }()
+	if after != nil {
+		it.Seek(after)
+		if it.Valid() && bytes.Equal(it.Key(), after) {
+			it.Next()
+		}
+	}
+
+	resp := scanResponse{Keys: []string{}}
+	var lastKey []byte
+	for ; it.Valid() && len(resp.Keys) < limit; it.Next() {
+		lastKey = it.Key()
+		resp.Keys = append(resp.Keys, base64.RawURLEncoding.EncodeToString(lastKey))
+	}
+	if err := it.Err(); err != nil {
+		s.writeStorageError(w, r, err)
+		return
+	}
+	if it.Valid() {
+		resp.NextCursor = base64.RawURLEncoding.EncodeToString(lastKey)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// statsJSON は storage.Stats の JSON 表現です。
+type statsJSON struct {
+	Keys       int     `json:"keys"`
+	TotalBytes int64   `json:"total_bytes"`
+	LiveBytes  int64   `json:"live_bytes"`
+	DeadBytes  int64   `json:"dead_bytes"`
+	LiveKeys   int64   `json:"live_keys"`
+	DeadKeys   int64   `json:"dead_keys"`
+	DeadRatio  float64 `json:"dead_ratio"`
+	Segments   int     `json:"segments,omitempty"`
+}
+
+func toStatsJSON(st storage.Stats) statsJSON {
+	return statsJSON{
+		Keys:       st.Keys,
+		TotalBytes: st.TotalBytes,
+		LiveBytes:  st.LiveBytes,
+		DeadBytes:  st.DeadBytes,
+		LiveKeys:   st.LiveKeys,
+		DeadKeys:   st.DeadKeys,
+		DeadRatio:  st.DeadRatio,
+		Segments:   len(st.Segments),
+	}
+}
+
+// statsResponse は GET /stats のレスポンスです。
+type statsResponse struct {
+	Total  statsJSON   `json:"total"`
+	Shards []statsJSON `json:"shards"`
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	st := s.db.Stats()
+	resp := statsResponse{Total: toStatsJSON(st.Total), Shards: make([]statsJSON, len(st.Shards))}
+	for i, shard := range st.Shards {
+		resp.Shards[i] = toStatsJSON(shard)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
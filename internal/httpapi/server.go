@@ -0,0 +1,293 @@
+// Package httpapi は storage.ShardedDB を HTTP/JSON で公開するハンドラーです。
+//
+//	GET    /kv/{key}                 値を取得 (ETag 付き、If-None-Match で 304)
+//	PUT    /kv/{key}                 値を保存 (If-Match / If-None-Match で条件付き更新)
+//	DELETE /kv/{key}                 キーを削除 (If-Match で条件付き削除)
+//	GET    /kv?prefix=&cursor=&limit= キーを昇順に列挙
+//	GET    /stats                    断片化の統計
+//	POST   /admin/merge              全 Shard を Merge し、不要データの多い Blob File を BlobGC で書き直す
+//
+// ETag はレコードの Timestamp と CRC (storage.Version) から作るため、同じキーへ書き込むたびに変わります。
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bitcask-go/internal/storage"
+)
+
+const (
+	// DefaultMaxValueSize は PUT で受け付ける値の既定の上限 (bytes) です。
+	DefaultMaxValueSize = 64 << 20
+	// defaultScanLimit と maxScanLimit は GET /kv の limit の既定値と上限です。
+	defaultScanLimit = 100
+	maxScanLimit     = 10000
+)
+
+// Server は ShardedDB を公開する http.Handler です。
+type Server struct {
+	db  *storage.ShardedDB
+	mux *http.ServeMux
+
+	// MaxValueSize は PUT で受け付ける値の上限 (bytes) です。超えた場合は 413 を返します。
+	MaxValueSize int64
+	// Logger は内部エラーの出力先です。nil の場合は log.Default() を使います。
+	Logger *log.Logger
+}
+
+// NewServer は db を公開するハンドラーを作成します。db の Close は呼び出し側の責任です。
+func NewServer(db *storage.ShardedDB) *Server {
+	s := &Server{
+		db:           db,
+		mux:          http.NewServeMux(),
+		MaxValueSize: DefaultMaxValueSize,
+	}
+	s.mux.HandleFunc("GET /kv/{key...}", s.handleGet)
+	s.mux.HandleFunc("PUT /kv/{key...}", s.handlePut)
+	s.mux.HandleFunc("DELETE /kv/{key...}", s.handleDelete)
+	s.mux.HandleFunc("GET /kv", s.handleScan)
+	s.mux.HandleFunc("GET /stats", s.handleStats)
+	s.mux.HandleFunc("POST /admin/merge", s.handleMerge)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) logger() *log.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return log.Default()
+}
+
+// errorResponse はエラー時のレスポンスボディです。
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
+
+// writeStorageError は storage のエラーを HTTP ステータスに対応付けて返します。
+func (s *Server) writeStorageError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, storage.ErrKeyNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, storage.ErrVersionMismatch):
+		writeError(w, http.StatusPreconditionFailed, err.Error())
+	case errors.Is(err, storage.ErrValueTooLarge), errors.As(err, &maxBytesErr):
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+	case errors.Is(err, storage.ErrKeyTooLarge), errors.Is(err, storage.ErrShortStream):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, storage.ErrReadOnly):
+		writeError(w, http.StatusForbidden, err.Error())
+	default:
+		s.logger().Printf("httpapi: %s %s: %v", r.Method, r.URL.Path, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// formatETag は Version を強い ETag に変換します。
+func formatETag(v storage.Version) string {
+	return fmt.Sprintf(`"%x-%x"`, v.Timestamp, v.CRC)
+}
+
+// etagMatches は If-Match / If-None-Match ヘッダーの値が etag を含むかを返します。
+// weak が true の場合は弱い比較 (W/ を無視) を行います。
+func etagMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// precondition は書き込み系リクエストの If-Match / If-None-Match を現在の Version で評価します。
+// 条件付きの場合は conditional が true になり、expected (評価に使った Version、キーが無ければゼロ値) で
+// CompareAndPut / CompareAndDelete することで、評価から書き込みまでの間の更新も検出します。
+// 条件を満たさない場合は ok が false です。
+func (s *Server) precondition(r *http.Request, key []byte) (expected storage.Version, conditional, ok bool, err error) {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return storage.Version{}, false, true, nil
+	}
+
+	current, err := s.db.Version(key)
+	exists := err == nil
+	if err != nil && !errors.Is(err, storage.ErrKeyNotFound) {
+		return storage.Version{}, true, false, err
+	}
+	etag := formatETag(current)
+	if ifMatch != "" && (!exists || !etagMatches(ifMatch, etag, false)) {
+		return storage.Version{}, true, false, nil
+	}
+	if ifNoneMatch != "" && exists && etagMatches(ifNoneMatch, etag, true) {
+		return storage.Version{}, true, false, nil
+	}
+	if !exists {
+		current = storage.Version{}
+	}
+	return current, true, true, nil
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	key := []byte(r.PathValue("key"))
+	value, ver, err := s.db.GetReaderWithVersion(key)
+	if err != nil {
+		if errors.Is(err, storage.ErrKeyNotFound) && r.Header.Get("If-Match") != "" {
+			writeError(w, http.StatusPreconditionFailed, storage.ErrVersionMismatch.Error())
+			return
+		}
+		s.writeStorageError(w, r, err)
+		return
+	}
+	defer func() { _ = value.Close() }()
+
+	etag := formatETag(ver)
+	w.Header().Set("ETag", etag)
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagMatches(ifMatch, etag, false) {
+		writeError(w, http.StatusPreconditionFailed, storage.ErrVersionMismatch.Error())
+		return
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(value.Size(), 10))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	// 値はセグメントから読みながら送る。CRC の不一致は最後まで読んだ時点で分かるので、
+	// 壊れた値を完全な応答として受け取らせないように接続を切る
+	if _, err := io.Copy(w, value); errors.Is(err, storage.ErrDataCorruption) {
+		s.logger().Printf("httpapi: %s %s: %v", r.Method, r.URL.Path, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
+	key := []byte(r.PathValue("key"))
+	if r.ContentLength > s.MaxValueSize {
+		writeError(w, http.StatusRequestEntityTooLarge, storage.ErrValueTooLarge.Error())
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, s.MaxValueSize)
+
+	expected, conditional, ok, err := s.precondition(r, key)
+	if err != nil {
+		s.writeStorageError(w, r, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusPreconditionFailed, storage.ErrVersionMismatch.Error())
+		return
+	}
+
+	// 条件なしで長さの分かっている値は、ボディを読みながら書き込む (メモリに読み込まない)
+	if !conditional && r.ContentLength >= 0 {
+		if err := s.db.PutStream(key, body, r.ContentLength); err != nil {
+			s.writeStorageError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	value, err := readBody(body, r.ContentLength)
+	if err != nil {
+		s.writeStorageError(w, r, err)
+		return
+	}
+	if conditional {
+		ver, err := s.db.CompareAndPut(key, value, expected)
+		if err != nil {
+			s.writeStorageError(w, r, err)
+			return
+		}
+		w.Header().Set("ETag", formatETag(ver))
+	} else if err := s.db.Put(key, value); err != nil {
+		s.writeStorageError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readBody はリクエストボディを読み込みます。Content-Length が分かっている場合は一度に確保します。
+func readBody(body io.Reader, contentLength int64) ([]byte, error) {
+	if contentLength < 0 {
+		return io.ReadAll(body)
+	}
+	buf := make([]byte, contentLength)
+	if _, err := io.ReadFull(body, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	key := []byte(r.PathValue("key"))
+	expected, conditional, ok, err := s.precondition(r, key)
+	if err != nil {
+		s.writeStorageError(w, r, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusPreconditionFailed, storage.ErrVersionMismatch.Error())
+		return
+	}
+
+	switch {
+	case conditional && expected.IsZero():
+		// 条件を満たしたがキーが存在しない (If-None-Match のみ指定) ので削除するものが無い
+	case conditional:
+		err = s.db.CompareAndDelete(key, expected)
+	default:
+		err = s.db.Delete(key)
+	}
+	if err != nil {
+		s.writeStorageError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleMerge(w http.ResponseWriter, r *http.Request) {
+	if err := s.db.Merge(); err != nil {
+		s.writeStorageError(w, r, err)
+		return
+	}
+	if err := s.db.BlobGC(); err != nil {
+		s.writeStorageError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,303 @@
+package httpapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"bitcask-go/internal/storage"
+)
+
+func startTestServer(t *testing.T, dir string) (*httptest.Server, *Server) {
+	t.Helper()
+	db, err := storage.NewShardedDB(dir, 4)
+	if err != nil {
+		t.Fatalf("NewShardedDB failed: %v", err)
+	}
+	srv := NewServer(db)
+	ts := httptest.NewServer(srv)
+	t.Cleanup(func() {
+		ts.Close()
+		_ = db.Close()
+	})
+	return ts, srv
+}
+
+// do はリクエストを送り、ステータス・ボディ・ETag を返します。headers は "Name", "Value" の組です。
+func do(t *testing.T, method, url, body string, headers ...string) (int, string, string) {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data), resp.Header.Get("ETag")
+}
+
+func expectStatus(t *testing.T, got, want int, what string) {
+	t.Helper()
+	if got != want {
+		t.Fatalf("%s: status = %d, want %d", what, got, want)
+	}
+}
+
+func TestKV(t *testing.T) {
+	dir := "test_httpapi_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	ts, _ := startTestServer(t, dir)
+
+	status, _, _ := do(t, "GET", ts.URL+"/kv/missing", "")
+	expectStatus(t, status, http.StatusNotFound, "GET missing")
+
+	status, _, _ = do(t, "PUT", ts.URL+"/kv/hello", "world")
+	expectStatus(t, status, http.StatusNoContent, "PUT")
+
+	status, body, etag := do(t, "GET", ts.URL+"/kv/hello", "")
+	expectStatus(t, status, http.StatusOK, "GET")
+	if body != "world" || etag == "" {
+		t.Fatalf("GET = %q (ETag %q), want world with ETag", body, etag)
+	}
+
+	// スラッシュやエスケープが必要な文字を含むキー
+	key := "users/42/name with space"
+	status, _, _ = do(t, "PUT", ts.URL+"/kv/"+url.PathEscape(key), "alice")
+	expectStatus(t, status, http.StatusNoContent, "PUT nested")
+	if status, body, _ := do(t, "GET", ts.URL+"/kv/"+url.PathEscape(key), ""); status != http.StatusOK || body != "alice" {
+		t.Fatalf("GET nested = %d %q", status, body)
+	}
+
+	status, _, _ = do(t, "DELETE", ts.URL+"/kv/hello", "")
+	expectStatus(t, status, http.StatusNoContent, "DELETE")
+	status, _, _ = do(t, "GET", ts.URL+"/kv/hello", "")
+	expectStatus(t, status, http.StatusNotFound, "GET deleted")
+
+	status, _, _ = do(t, "POST", ts.URL+"/kv/hello", "x")
+	expectStatus(t, status, http.StatusMethodNotAllowed, "POST /kv")
+}
+
+func TestConditionalRequests(t *testing.T) {
+	dir := "test_httpapi_etag_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	ts, _ := startTestServer(t, dir)
+	u := ts.URL + "/kv/doc"
+
+	// If-None-Match: * は作成のみ
+	status, _, etag1 := do(t, "PUT", u, "v1", "If-None-Match", "*")
+	expectStatus(t, status, http.StatusNoContent, "create")
+	if etag1 == "" {
+		t.Fatal("expected ETag on conditional PUT")
+	}
+	status, _, _ = do(t, "PUT", u, "again", "If-None-Match", "*")
+	expectStatus(t, status, http.StatusPreconditionFailed, "create existing")
+
+	status, _, etag := do(t, "GET", u, "")
+	expectStatus(t, status, http.StatusOK, "GET")
+	if etag != etag1 {
+		t.Fatalf("GET ETag = %q, want %q", etag, etag1)
+	}
+	status, _, _ = do(t, "GET", u, "", "If-None-Match", etag1)
+	expectStatus(t, status, http.StatusNotModified, "GET If-None-Match")
+
+	status, _, etag2 := do(t, "PUT", u, "v2", "If-Match", etag1)
+	expectStatus(t, status, http.StatusNoContent, "update")
+	if etag2 == "" || etag2 == etag1 {
+		t.Fatalf("ETag after update = %q, want new value", etag2)
+	}
+
+	// 古い ETag での更新・削除は失敗し、値は変わらない
+	status, _, _ = do(t, "PUT", u, "lost update", "If-Match", etag1)
+	expectStatus(t, status, http.StatusPreconditionFailed, "stale update")
+	status, _, _ = do(t, "DELETE", u, "", "If-Match", etag1)
+	expectStatus(t, status, http.StatusPreconditionFailed, "stale delete")
+	if _, body, _ := do(t, "GET", u, ""); body != "v2" {
+		t.Fatalf("value = %q, want v2", body)
+	}
+
+	status, _, _ = do(t, "PUT", ts.URL+"/kv/absent", "x", "If-Match", "*")
+	expectStatus(t, status, http.StatusPreconditionFailed, "If-Match on missing key")
+
+	status, _, _ = do(t, "DELETE", u, "", "If-Match", etag2)
+	expectStatus(t, status, http.StatusNoContent, "conditional delete")
+	status, _, _ = do(t, "GET", u, "")
+	expectStatus(t, status, http.StatusNotFound, "GET after delete")
+}
+
+func TestValueTooLarge(t *testing.T) {
+	dir := "test_httpapi_large_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	ts, srv := startTestServer(t, dir)
+	srv.MaxValueSize = 1024
+
+	status, _, _ := do(t, "PUT", ts.URL+"/kv/big", strings.Repeat("x", 2048))
+	expectStatus(t, status, http.StatusRequestEntityTooLarge, "PUT too large")
+
+	// Content-Length の無い (chunked) ボディも上限で打ち切る
+	req, _ := http.NewRequest("PUT", ts.URL+"/kv/big", strings.NewReader(strings.Repeat("x", 2048)))
+	req.ContentLength = -1
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	expectStatus(t, resp.StatusCode, http.StatusRequestEntityTooLarge, "chunked PUT too large")
+
+	status, _, _ = do(t, "PUT", ts.URL+"/kv/small", strings.Repeat("x", 1024))
+	expectStatus(t, status, http.StatusNoContent, "PUT at limit")
+}
+
+func TestLargeValueStreaming(t *testing.T) {
+	dir := "test_httpapi_stream_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	ts, _ := startTestServer(t, dir)
+
+	// 条件なしの PUT はボディを読みながら書き込み、GET はセグメントから読みながら返す
+	big := strings.Repeat("0123456789abcdef", 1<<19) // 8MB
+	status, _, _ := do(t, "PUT", ts.URL+"/kv/blob", big)
+	expectStatus(t, status, http.StatusNoContent, "PUT blob")
+
+	status, body, etag := do(t, "GET", ts.URL+"/kv/blob", "")
+	expectStatus(t, status, http.StatusOK, "GET blob")
+	if body != big || etag == "" {
+		t.Fatalf("GET blob returned %d bytes (ETag %q), want %d bytes with ETag", len(body), etag, len(big))
+	}
+	status, _, _ = do(t, "GET", ts.URL+"/kv/blob", "", "If-None-Match", etag)
+	expectStatus(t, status, http.StatusNotModified, "GET blob If-None-Match")
+}
+
+func TestScan(t *testing.T) {
+	dir := "test_httpapi_scan_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	ts, _ := startTestServer(t, dir)
+
+	for i := 0; i < 25; i++ {
+		do(t, "PUT", fmt.Sprintf("%s/kv/user:%02d", ts.URL, i), "v")
+	}
+	do(t, "PUT", ts.URL+"/kv/other", "v")
+
+	var keys []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("scan did not terminate")
+		}
+		status, body, _ := do(t, "GET", ts.URL+"/kv?prefix=user:&limit=10&cursor="+cursor, "")
+		expectStatus(t, status, http.StatusOK, "scan")
+		var resp scanResponse
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("decode %q: %v", body, err)
+		}
+		for _, k := range resp.Keys {
+			key, err := base64.RawURLEncoding.DecodeString(k)
+			if err != nil {
+				t.Fatalf("decode key %q: %v", k, err)
+			}
+			keys = append(keys, string(key))
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		cursor = resp.NextCursor
+	}
+	if len(keys) != 25 {
+		t.Fatalf("scan returned %d keys, want 25: %v", len(keys), keys)
+	}
+	for i, k := range keys {
+		if want := fmt.Sprintf("user:%02d", i); k != want {
+			t.Fatalf("keys[%d] = %q, want %q", i, k, want)
+		}
+	}
+
+	status, _, _ := do(t, "GET", ts.URL+"/kv?limit=0", "")
+	expectStatus(t, status, http.StatusBadRequest, "invalid limit")
+	status, _, _ = do(t, "GET", ts.URL+"/kv?cursor=!!", "")
+	expectStatus(t, status, http.StatusBadRequest, "invalid cursor")
+}
+
+func TestScanNonUTF8Key(t *testing.T) {
+	dir := "test_httpapi_scan_binary_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	ts, _ := startTestServer(t, dir)
+
+	// JSON の文字列にそのまま入れると U+FFFD に置き換えられてしまうキー
+	key := "bin:\xff\xfe\x00"
+	do(t, "PUT", ts.URL+"/kv/"+url.PathEscape(key), "v")
+
+	status, body, _ := do(t, "GET", ts.URL+"/kv?prefix=bin:", "")
+	expectStatus(t, status, http.StatusOK, "scan")
+	var resp scanResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("decode %q: %v", body, err)
+	}
+	if len(resp.Keys) != 1 {
+		t.Fatalf("scan returned %v, want 1 key", resp.Keys)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(resp.Keys[0])
+	if err != nil || string(got) != key {
+		t.Fatalf("key = %q (%v), want %q", got, err, key)
+	}
+
+	// 返したキーでそのまま値を取得できる
+	status, body, _ = do(t, "GET", ts.URL+"/kv/"+url.PathEscape(string(got)), "")
+	expectStatus(t, status, http.StatusOK, "GET binary key")
+	if body != "v" {
+		t.Fatalf("GET binary key = %q, want %q", body, "v")
+	}
+}
+
+func TestStatsAndMerge(t *testing.T) {
+	dir := "test_httpapi_stats_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	ts, _ := startTestServer(t, dir)
+
+	for i := 0; i < 10; i++ {
+		do(t, "PUT", ts.URL+"/kv/key", fmt.Sprintf("value%d", i))
+	}
+
+	stats := func() statsResponse {
+		status, body, _ := do(t, "GET", ts.URL+"/stats", "")
+		expectStatus(t, status, http.StatusOK, "stats")
+		var resp statsResponse
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("decode %q: %v", body, err)
+		}
+		return resp
+	}
+
+	before := stats()
+	if before.Total.Keys != 1 || before.Total.DeadKeys != 9 || len(before.Shards) != 4 {
+		t.Fatalf("unexpected stats before merge: %+v", before)
+	}
+
+	status, _, _ := do(t, "POST", ts.URL+"/admin/merge", "")
+	expectStatus(t, status, http.StatusNoContent, "merge")
+
+	after := stats()
+	if after.Total.Keys != 1 || after.Total.DeadKeys != 0 {
+		t.Fatalf("unexpected stats after merge: %+v", after)
+	}
+	if _, body, _ := do(t, "GET", ts.URL+"/kv/key", ""); body != "value9" {
+		t.Fatalf("value after merge = %q, want value9", body)
+	}
+}
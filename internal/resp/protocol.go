@@ -0,0 +1,204 @@
+// Package resp は Redis の RESP2 プロトコルで storage.ShardedDB を公開するサーバーです。
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	// maxBulkLen は 1 つの引数 (Bulk String) の最大長です (Redis の proto-max-bulk-len と同じ)。
+	maxBulkLen = 512 * 1024 * 1024
+	// maxArrayLen は 1 コマンドの最大引数数です。
+	maxArrayLen = 1024 * 1024
+	// maxInlineLen はインラインコマンド 1 行の最大長です。
+	maxInlineLen = 64 * 1024
+)
+
+// ErrProtocol はクライアントから不正な RESP を受け取った場合のエラーです。接続は閉じられます。
+var ErrProtocol = errors.New("protocol error")
+
+func protocolError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrProtocol, fmt.Sprintf(format, args...))
+}
+
+// Reader はクライアントのコマンドを読み込みます。
+// RESP の配列 (*N\r\n$len\r\n...) と、redis-cli や telnet が送るインラインコマンド (空白区切りの 1 行) に対応します。
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Buffered は読み込み済みで未処理のバイト数を返します。
+// 0 になった時点で応答をフラッシュすれば、パイプラインされたコマンドの応答をまとめて送れます。
+func (r *Reader) Buffered() int {
+	return r.r.Buffered()
+}
+
+// ReadCommand は 1 コマンド分の引数を読み込みます。空行は読み飛ばします。
+func (r *Reader) ReadCommand() ([][]byte, error) {
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '*' {
+			args := splitInline(line)
+			if len(args) == 0 {
+				continue
+			}
+			return args, nil
+		}
+
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n > maxArrayLen {
+			return nil, protocolError("invalid multibulk length")
+		}
+		if n <= 0 {
+			continue
+		}
+		args := make([][]byte, n)
+		for i := range args {
+			if args[i], err = r.readBulk(); err != nil {
+				return nil, err
+			}
+		}
+		return args, nil
+	}
+}
+
+func (r *Reader) readBulk() ([]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return nil, protocolError("expected '$', got %q", line)
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxBulkLen {
+		return nil, protocolError("invalid bulk length")
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return nil, protocolError("bulk string not terminated by CRLF")
+	}
+	return buf[:n], nil
+}
+
+// readLine は CRLF (または LF) までの 1 行を読み込みます。
+func (r *Reader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxInlineLen {
+			return nil, protocolError("too big inline request")
+		}
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
+// splitInline はインラインコマンドを空白で分割します。ダブルクォートで囲んだ引数に対応します。
+func splitInline(line []byte) [][]byte {
+	var args [][]byte
+	for i := 0; i < len(line); {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i >= len(line) {
+			break
+		}
+		var arg []byte
+		if line[i] == '"' {
+			i++
+			for i < len(line) && line[i] != '"' {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				arg = append(arg, line[i])
+				i++
+			}
+			i++ // closing quote
+		} else {
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				arg = append(arg, line[i])
+				i++
+			}
+		}
+		if arg == nil {
+			arg = []byte{}
+		}
+		args = append(args, arg)
+	}
+	return args
+}
+
+// Writer は RESP2 の応答を書き込みます。Flush するまで送信されません。
+type Writer struct {
+	w *bufio.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// WriteSimpleString は +<s>\r\n を書き込みます。
+func (w *Writer) WriteSimpleString(s string) {
+	w.writeLine('+', s)
+}
+
+// WriteError は -<msg>\r\n を書き込みます。msg は "ERR ..." のようにエラー種別から始めます。
+func (w *Writer) WriteError(msg string) {
+	w.writeLine('-', msg)
+}
+
+// WriteInt は :<n>\r\n を書き込みます。
+func (w *Writer) WriteInt(n int64) {
+	w.writeLine(':', strconv.FormatInt(n, 10))
+}
+
+// WriteBulk は $<len>\r\n<b>\r\n を書き込みます。
+func (w *Writer) WriteBulk(b []byte) {
+	w.writeLine('$', strconv.Itoa(len(b)))
+	_, _ = w.w.Write(b)
+	_, _ = w.w.WriteString("\r\n")
+}
+
+// WriteNull は Null Bulk String ($-1) を書き込みます。
+func (w *Writer) WriteNull() {
+	_, _ = w.w.WriteString("$-1\r\n")
+}
+
+// WriteArrayHeader は *<n>\r\n を書き込みます。続けて n 個の要素を書き込みます。
+func (w *Writer) WriteArrayHeader(n int) {
+	w.writeLine('*', strconv.Itoa(n))
+}
+
+func (w *Writer) writeLine(prefix byte, s string) {
+	_ = w.w.WriteByte(prefix)
+	_, _ = w.w.WriteString(s)
+	_, _ = w.w.WriteString("\r\n")
+}
+
+// Flush はバッファした応答を送信します。
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,157 @@
+package resp
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxCursorsPerConn は 1 つの接続が同時に保持できる SCAN カーソルの数です。
+	// 超えた場合はその接続が発行した古いものから破棄し、他の接続のカーソルには影響しません。
+	maxCursorsPerConn = 1000
+	// defaultScanCount は SCAN の COUNT の既定値です。
+	defaultScanCount = 10
+)
+
+// cursorTable は SCAN のカーソル番号と、次に返すキーの位置 (前回返した最後のキー) を対応付けます。
+// Redis のカーソルは整数でなければならないため、走査位置はサーバー側で保持します。
+// カーソルは何度でも使え (再試行しても同じ位置から続きを返す)、接続プールのクライアントのために
+// 他の接続からも使えます。発行した接続が閉じた時点でまとめて破棄します。
+type cursorTable struct {
+	mu      sync.Mutex
+	next    uint64
+	perConn int
+	last    map[uint64][]byte
+	owned   map[uint64][]uint64 // 接続 ID ごとの発行したカーソル (作成順)
+}
+
+func newCursorTable(perConn int) *cursorTable {
+	return &cursorTable{next: 1, perConn: perConn, last: make(map[uint64][]byte), owned: make(map[uint64][]uint64)}
+}
+
+// put は接続 owner のために lastKey の続きから走査するカーソルを発行します。
+func (t *cursorTable) put(owner uint64, lastKey []byte) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := t.owned[owner]
+	for len(ids) >= t.perConn {
+		delete(t.last, ids[0])
+		ids = ids[1:]
+	}
+	id := t.next
+	t.next++
+	if t.next == 0 { // 0 は走査の開始・終了を表すので使わない
+		t.next = 1
+	}
+	t.last[id] = lastKey
+	t.owned[owner] = append(ids, id)
+	return id
+}
+
+// get はカーソルの位置を返します。カーソルは使った後も有効です。
+func (t *cursorTable) get(id uint64) ([]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lastKey, ok := t.last[id]
+	return lastKey, ok
+}
+
+// release は接続 owner が発行したカーソルをすべて破棄します。
+func (t *cursorTable) release(owner uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, id := range t.owned[owner] {
+		delete(t.last, id)
+	}
+	delete(t.owned, owner)
+}
+
+// cmdScan は SCAN cursor [MATCH pattern] [COUNT count] を実行します。
+// キーは昇順に返し、走査中に追加・削除されたキーが返るかどうかは保証しません (Redis と同じ)。
+func (s *Server) cmdScan(sess *session, w *Writer, args [][]byte) {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		w.WriteError("ERR invalid cursor")
+		return
+	}
+
+	var pattern []byte
+	count := defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			w.WriteError("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				w.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			if n < 1 {
+				w.WriteError("ERR syntax error")
+				return
+			}
+			count = n
+		default:
+			w.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	var after []byte
+	if cursor != 0 {
+		lastKey, ok := s.cursors.get(cursor)
+		if !ok {
+			w.WriteError("ERR invalid cursor")
+			return
+		}
+		after = lastKey
+	}
+
+	prefix := literalPrefix(pattern)
+	it := s.db.Scan(prefix)
+	defer func() { _ = it.Close() }()
+	if after != nil {
+		it.Seek(after)
+		if it.Valid() && bytes.Equal(it.Key(), after) {
+			it.Next()
+		}
+	}
+
+	// COUNT は Redis と同様に「調べるキーの数」の目安で、MATCH に一致した数ではない
+	var keys [][]byte
+	var lastKey []byte
+	for examined := 0; examined < count && it.Valid(); it.Next() {
+		key := it.Key()
+		lastKey = key
+		examined++
+		if pattern == nil || globMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	if err := it.Err(); err != nil {
+		s.writeStorageError(w, err)
+		return
+	}
+
+	var nextCursor uint64
+	if it.Valid() {
+		nextCursor = s.cursors.put(sess.id, lastKey)
+	}
+
+	w.WriteArrayHeader(2)
+	w.WriteBulk([]byte(strconv.FormatUint(nextCursor, 10)))
+	w.WriteArrayHeader(len(keys))
+	for _, key := range keys {
+		w.WriteBulk(key)
+	}
+}
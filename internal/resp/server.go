@@ -0,0 +1,422 @@
+package resp
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bitcask-go/internal/storage"
+)
+
+// ErrServerClosed は Close 後の Serve が返すエラーです。
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Server は RESP2 プロトコルで ShardedDB を公開する TCP サーバーです。
+// 接続ごとに goroutine を起動し、パイプラインされたコマンドは順に実行して応答をまとめて返します。
+type Server struct {
+	db     *storage.ShardedDB
+	Logger *log.Logger // nil の場合は log.Default()
+
+	cursors  *cursorTable
+	sessions atomic.Uint64 // 接続 ID の採番
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer は db を公開するサーバーを作成します。db の Close は呼び出し側の責任です。
+func NewServer(db *storage.ShardedDB) *Server {
+	return &Server{
+		db:        db,
+		cursors:   newCursorTable(maxCursorsPerConn),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *Server) logger() *log.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return log.Default()
+}
+
+// ListenAndServe は addr で待ち受けて Serve します。
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve は l で接続を受け付けます。Close されるまで戻りません (戻り値は ErrServerClosed)。
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close は待ち受けと全接続を閉じ、実行中のコマンドの完了を待ちます。
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// session は接続ごとの状態です。
+type session struct {
+	id uint64 // 発行した SCAN カーソルの所有者
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	sess := &session{id: s.sessions.Add(1)}
+	defer func() {
+		s.cursors.release(sess.id)
+		_ = conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	r := NewReader(conn)
+	w := NewWriter(conn)
+	for {
+		args, err := r.ReadCommand()
+		if err != nil {
+			if errors.Is(err, ErrProtocol) {
+				w.WriteError("ERR " + err.Error())
+				_ = w.Flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger().Printf("resp: %s: read failed: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		quit := s.execute(sess, w, args)
+
+		// パイプラインの途中ではフラッシュせず、受信済みのコマンドを処理し終えてから送る
+		if quit || r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// command はコマンドの実装です。arity は引数 (コマンド名を含む) の数で、負の値は「以上」を表します。
+type command struct {
+	arity int
+	fn    func(s *Server, sess *session, w *Writer, args [][]byte)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"PING":    {-1, (*Server).cmdPing},
+		"GET":     {2, (*Server).cmdGet},
+		"SET":     {-3, (*Server).cmdSet},
+		"DEL":     {-2, (*Server).cmdDel},
+		"EXISTS":  {-2, (*Server).cmdExists},
+		"MGET":    {-2, (*Server).cmdMGet},
+		"MSET":    {-3, (*Server).cmdMSet},
+		"SCAN":    {-2, (*Server).cmdScan},
+		"TTL":     {2, (*Server).cmdTTL},
+		"PTTL":    {2, (*Server).cmdPTTL},
+		"EXPIRE":  {3, (*Server).cmdExpire},
+		"COMMAND": {-1, (*Server).cmdCommand},
+	}
+}
+
+// execute は 1 コマンドを実行して応答を書き込みます。接続を閉じる場合は true を返します。
+func (s *Server) execute(sess *session, w *Writer, args [][]byte) bool {
+	name := strings.ToUpper(string(args[0]))
+	if name == "QUIT" {
+		w.WriteSimpleString("OK")
+		return true
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		w.WriteError("ERR unknown command '" + string(args[0]) + "'")
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		w.WriteError("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		return false
+	}
+	cmd.fn(s, sess, w, args)
+	return false
+}
+
+func (s *Server) writeStorageError(w *Writer, err error) {
+	switch {
+	case errors.Is(err, storage.ErrReadOnly):
+		w.WriteError("READONLY " + err.Error())
+	default:
+		w.WriteError("ERR " + err.Error())
+	}
+}
+
+func (s *Server) cmdPing(_ *session, w *Writer, args [][]byte) {
+	switch len(args) {
+	case 1:
+		w.WriteSimpleString("PONG")
+	case 2:
+		w.WriteBulk(args[1])
+	default:
+		w.WriteError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (s *Server) cmdGet(_ *session, w *Writer, args [][]byte) {
+	value, err := s.db.Get(args[1])
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		w.WriteNull()
+		return
+	}
+	if err != nil {
+		s.writeStorageError(w, err)
+		return
+	}
+	w.WriteBulk(value)
+}
+
+// cmdSet は SET key value [EX seconds | PX milliseconds] を実行します。
+func (s *Server) cmdSet(_ *session, w *Writer, args [][]byte) {
+	var ttl time.Duration
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		if (opt != "EX" && opt != "PX") || ttl != 0 || i+1 >= len(args) {
+			w.WriteError("ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil {
+			w.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+		if n <= 0 {
+			w.WriteError("ERR invalid expire time in 'set' command")
+			return
+		}
+		unit := time.Second
+		if opt == "PX" {
+			unit = time.Millisecond
+		}
+		var ok bool
+		if ttl, ok = expireDuration(n, unit); !ok {
+			w.WriteError("ERR invalid expire time in 'set' command")
+			return
+		}
+		i++
+	}
+
+	var err error
+	if ttl > 0 {
+		err = s.db.PutWithTTL(args[1], args[2], ttl)
+	} else {
+		err = s.db.Put(args[1], args[2])
+	}
+	if err != nil {
+		s.writeStorageError(w, err)
+		return
+	}
+	w.WriteSimpleString("OK")
+}
+
+func (s *Server) cmdDel(_ *session, w *Writer, args [][]byte) {
+	var n int64
+	for _, key := range args[1:] {
+		deleted, err := s.db.DeleteExisting(key)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		if deleted {
+			n++
+		}
+	}
+	w.WriteInt(n)
+}
+
+func (s *Server) cmdExists(_ *session, w *Writer, args [][]byte) {
+	var n int64
+	for _, key := range args[1:] {
+		if s.db.Has(key) {
+			n++
+		}
+	}
+	w.WriteInt(n)
+}
+
+// cmdMGet は MGET key [key ...] を実行します。存在しないキーは nil として返します。
+// それ以外のエラー (データ破損など) は配列を返さずにエラーで応答します。
+func (s *Server) cmdMGet(_ *session, w *Writer, args [][]byte) {
+	values := make([][]byte, len(args)-1)
+	found := make([]bool, len(values))
+	for i, key := range args[1:] {
+		value, err := s.db.Get(key)
+		if errors.Is(err, storage.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		values[i], found[i] = value, true
+	}
+	w.WriteArrayHeader(len(values))
+	for i, value := range values {
+		if !found[i] {
+			w.WriteNull()
+			continue
+		}
+		w.WriteBulk(value)
+	}
+}
+
+// cmdMSet は MSET key value [key value ...] を実行します。
+// キーは複数の Shard にまたがるため、全体としては原子的ではありません。
+func (s *Server) cmdMSet(_ *session, w *Writer, args [][]byte) {
+	if len(args)%2 != 1 {
+		w.WriteError("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	for i := 1; i < len(args); i += 2 {
+		if err := s.db.Put(args[i], args[i+1]); err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+	}
+	w.WriteSimpleString("OK")
+}
+
+func (s *Server) cmdTTL(_ *session, w *Writer, args [][]byte) {
+	s.writeTTL(w, args[1], time.Second)
+}
+
+func (s *Server) cmdPTTL(_ *session, w *Writer, args [][]byte) {
+	s.writeTTL(w, args[1], time.Millisecond)
+}
+
+// writeTTL は Redis と同じく、存在しないキーは -2、有効期限の無いキーは -1 を返します。
+func (s *Server) writeTTL(w *Writer, key []byte, unit time.Duration) {
+	ttl, err := s.db.TTL(key)
+	switch {
+	case errors.Is(err, storage.ErrKeyNotFound):
+		w.WriteInt(-2)
+	case err != nil:
+		s.writeStorageError(w, err)
+	case ttl == storage.NoTTL:
+		w.WriteInt(-1)
+	default:
+		// 四捨五入 (Redis と同じ)
+		w.WriteInt(int64((ttl + unit/2) / unit))
+	}
+}
+
+// cmdExpire は EXPIRE key seconds を実行します。0 以下の秒数はキーを削除します。
+func (s *Server) cmdExpire(_ *session, w *Writer, args [][]byte) {
+	seconds, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		w.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+	if seconds <= 0 {
+		deleted, err := s.db.DeleteExisting(args[1])
+		switch {
+		case err != nil:
+			s.writeStorageError(w, err)
+		case deleted:
+			w.WriteInt(1)
+		default:
+			w.WriteInt(0)
+		}
+		return
+	}
+
+	ttl, ok := expireDuration(seconds, time.Second)
+	if !ok {
+		w.WriteError("ERR invalid expire time in 'expire' command")
+		return
+	}
+	err = s.db.Expire(args[1], ttl)
+	switch {
+	case errors.Is(err, storage.ErrKeyNotFound):
+		w.WriteInt(0)
+	case err != nil:
+		s.writeStorageError(w, err)
+	default:
+		w.WriteInt(1)
+	}
+}
+
+// expireDuration は n (unit 単位の正の値) を time.Duration に変換します。
+// 現在時刻に足した有効期限が UnixNano で表せない (オーバーフローする) 場合は false を返します。
+func expireDuration(n int64, unit time.Duration) (time.Duration, bool) {
+	if n > (math.MaxInt64-time.Now().UnixNano())/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// cmdCommand は redis-cli が接続時に送る COMMAND (DOCS) に空の配列で応答します。
+func (s *Server) cmdCommand(_ *session, w *Writer, args [][]byte) {
+	w.WriteArrayHeader(0)
+}
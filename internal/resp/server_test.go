@@ -0,0 +1,454 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"bitcask-go/internal/storage"
+)
+
+// testClient はテスト用の最小限の RESP2 クライアントです。
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// respError はサーバーが返したエラー応答です。
+type respError string
+
+func (e respError) Error() string { return string(e) }
+
+func dialTest(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// send はコマンドを RESP 配列として送信します (応答は読みません)。
+func (c *testClient) send(args ...string) {
+	c.t.Helper()
+	buf := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, a := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		c.t.Fatalf("write failed: %v", err)
+	}
+}
+
+// reply は応答を 1 つ読みます。bulk は string、null は nil、整数は int64、配列は []any、エラーは respError です。
+func (c *testClient) reply() any {
+	c.t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	v, err := readReply(c.r)
+	if err != nil {
+		c.t.Fatalf("read reply failed: %v", err)
+	}
+	return v
+}
+
+func (c *testClient) do(args ...string) any {
+	c.t.Helper()
+	c.send(args...)
+	return c.reply()
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed line %q", line)
+	}
+	body := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return respError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", line[0])
+}
+
+// startTestServer は一時ディレクトリの ShardedDB を公開するサーバーを起動し、アドレスを返します。
+func startTestServer(t *testing.T, dir string) (string, *storage.ShardedDB) {
+	t.Helper()
+	db, err := storage.NewShardedDB(dir, 4)
+	if err != nil {
+		t.Fatalf("NewShardedDB failed: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	srv := NewServer(db)
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(l) }()
+	t.Cleanup(func() {
+		_ = srv.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+		_ = db.Close()
+	})
+	return l.Addr().String(), db
+}
+
+func expectReply(t *testing.T, got, want any) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("reply = %#v, want %#v", got, want)
+	}
+}
+
+func TestServerCommands(t *testing.T) {
+	dir := "test_resp_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	addr, _ := startTestServer(t, dir)
+	c := dialTest(t, addr)
+
+	expectReply(t, c.do("PING"), "PONG")
+	expectReply(t, c.do("ping", "hello"), "hello")
+
+	expectReply(t, c.do("SET", "k1", "v1"), "OK")
+	expectReply(t, c.do("GET", "k1"), "v1")
+	expectReply(t, c.do("GET", "missing"), nil)
+
+	expectReply(t, c.do("MSET", "k2", "v2", "k3", "v3"), "OK")
+	expectReply(t, c.do("MGET", "k1", "missing", "k3"), []any{"v1", nil, "v3"})
+	expectReply(t, c.do("EXISTS", "k1", "k2", "missing", "k1"), int64(3))
+
+	expectReply(t, c.do("DEL", "k1", "missing"), int64(1))
+	expectReply(t, c.do("GET", "k1"), nil)
+
+	// TTL / EXPIRE
+	expectReply(t, c.do("TTL", "missing"), int64(-2))
+	expectReply(t, c.do("TTL", "k2"), int64(-1))
+	expectReply(t, c.do("EXPIRE", "k2", "100"), int64(1))
+	expectReply(t, c.do("TTL", "k2"), int64(100))
+	expectReply(t, c.do("EXPIRE", "missing", "100"), int64(0))
+	expectReply(t, c.do("SET", "k4", "v4", "EX", "50"), "OK")
+	expectReply(t, c.do("TTL", "k4"), int64(50))
+	expectReply(t, c.do("SET", "k5", "v5", "PX", "50"), "OK")
+	time.Sleep(100 * time.Millisecond)
+	expectReply(t, c.do("GET", "k5"), nil)
+	expectReply(t, c.do("EXPIRE", "k3", "0"), int64(1))
+	expectReply(t, c.do("EXISTS", "k3"), int64(0))
+
+	// エラー応答 (接続は維持される)
+	expectReply(t, c.do("NOPE"), respError("ERR unknown command 'NOPE'"))
+	expectReply(t, c.do("GET"), respError("ERR wrong number of arguments for 'get' command"))
+	expectReply(t, c.do("MSET", "a", "1", "b"), respError("ERR wrong number of arguments for 'mset' command"))
+	expectReply(t, c.do("SET", "k", "v", "XX"), respError("ERR syntax error"))
+	expectReply(t, c.do("SET", "k", "v", "EX", "abc"), respError("ERR value is not an integer or out of range"))
+	expectReply(t, c.do("EXPIRE", "k2", "abc"), respError("ERR value is not an integer or out of range"))
+	// time.Duration に収まらない有効期限はオーバーフローさせずにエラー
+	expectReply(t, c.do("SET", "k", "v", "EX", "9223372036854775807"), respError("ERR invalid expire time in 'set' command"))
+	expectReply(t, c.do("SET", "k", "v", "PX", "9223372036854"), respError("ERR invalid expire time in 'set' command"))
+	expectReply(t, c.do("EXPIRE", "k2", "9223372036"), respError("ERR invalid expire time in 'expire' command"))
+	expectReply(t, c.do("TTL", "k2"), int64(100))
+	expectReply(t, c.do("SCAN", "12345"), respError("ERR invalid cursor"))
+	expectReply(t, c.do("PING"), "PONG")
+
+	expectReply(t, c.do("QUIT"), "OK")
+}
+
+// MGET は存在しないキーだけを nil にし、読み込みエラーはエラー応答で返す
+func TestServerMGetErrors(t *testing.T) {
+	dir := "test_resp_mget_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	addr, db := startTestServer(t, dir)
+	c := dialTest(t, addr)
+
+	expectReply(t, c.do("SET", "k1", "v1"), "OK")
+	expectReply(t, c.do("SET", "empty", ""), "OK")
+	expectReply(t, c.do("MGET", "k1", "empty", "missing"), []any{"v1", "", nil})
+
+	_ = db.Close()
+	expectReply(t, c.do("MGET", "missing", "k1"), respError("ERR "+storage.ErrClosed.Error()))
+}
+
+func TestServerInlineCommand(t *testing.T) {
+	dir := "test_resp_inline_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	addr, _ := startTestServer(t, dir)
+	c := dialTest(t, addr)
+
+	if _, err := c.conn.Write([]byte("SET greeting \"hello world\"\r\nGET greeting\r\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	expectReply(t, c.reply(), "OK")
+	expectReply(t, c.reply(), "hello world")
+}
+
+func TestServerScan(t *testing.T) {
+	dir := "test_resp_scan_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	addr, _ := startTestServer(t, dir)
+	c := dialTest(t, addr)
+
+	want := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("user:%03d", i)
+		expectReply(t, c.do("SET", key, "v"), "OK")
+		want[key] = true
+	}
+	for i := 0; i < 10; i++ {
+		expectReply(t, c.do("SET", fmt.Sprintf("other:%d", i), "v"), "OK")
+	}
+
+	// カーソルを辿り、全キーがちょうど 1 回ずつ返ることを確認する
+	scanAll := func(args ...string) []string {
+		var keys []string
+		cursor := "0"
+		for i := 0; ; i++ {
+			if i > 100 {
+				t.Fatal("SCAN did not terminate")
+			}
+			reply, ok := c.do(append([]string{"SCAN", cursor}, args...)...).([]any)
+			if !ok || len(reply) != 2 {
+				t.Fatalf("unexpected SCAN reply %#v", reply)
+			}
+			for _, k := range reply[1].([]any) {
+				keys = append(keys, k.(string))
+			}
+			cursor = reply[0].(string)
+			if cursor == "0" {
+				return keys
+			}
+		}
+	}
+
+	keys := scanAll("MATCH", "user:*", "COUNT", "7")
+	if len(keys) != len(want) {
+		t.Fatalf("SCAN returned %d keys, want %d", len(keys), len(want))
+	}
+	for i, k := range keys {
+		if !want[k] {
+			t.Fatalf("unexpected key %q", k)
+		}
+		if i > 0 && keys[i-1] >= k {
+			t.Fatalf("keys not in order: %q then %q", keys[i-1], k)
+		}
+	}
+
+	if keys := scanAll(); len(keys) != 60 {
+		t.Fatalf("SCAN without MATCH returned %d keys, want 60", len(keys))
+	}
+	expectReply(t, len(scanAll("MATCH", "*:00?")), 10) // user:000-009
+	expectReply(t, scanAll("MATCH", "nothing*"), []string(nil))
+
+	// カーソルは再試行でき、他の接続からも使える
+	first := c.do("SCAN", "0", "COUNT", "5").([]any)
+	cursor := first[0].(string)
+	scanKeys := func(c *testClient, cursor string) any {
+		t.Helper()
+		reply, ok := c.do("SCAN", cursor, "COUNT", "5").([]any)
+		if !ok || len(reply) != 2 {
+			t.Fatalf("unexpected SCAN reply %#v", reply)
+		}
+		return reply[1]
+	}
+	retry := scanKeys(c, cursor)
+	expectReply(t, scanKeys(c, cursor), retry)
+	other := dialTest(t, addr)
+	expectReply(t, scanKeys(other, cursor), retry)
+
+	// 他の接続が上限を超えてカーソルを発行しても、この接続のカーソルは破棄されない
+	for i := 0; i < maxCursorsPerConn+10; i++ {
+		other.do("SCAN", "0", "COUNT", "1")
+	}
+	expectReply(t, scanKeys(c, cursor), retry)
+
+	// 発行した接続を閉じるとカーソルは破棄される
+	_ = c.conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reply := other.do("SCAN", cursor, "COUNT", "5")
+		if reply == respError("ERR invalid cursor") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cursor still valid after its connection closed: %#v", reply)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerConcurrentDel(t *testing.T) {
+	dir := "test_resp_concurrent_del_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	addr, _ := startTestServer(t, dir)
+
+	const clients = 8
+	conns := make([]*testClient, clients)
+	for i := range conns {
+		conns[i] = dialTest(t, addr)
+	}
+	// 同じキーを同時に DEL / EXPIRE 0 しても、削除を報告するのは 1 つだけ
+	for round := 0; round < 20; round++ {
+		expectReply(t, conns[0].do("SET", "k", "v"), "OK")
+		var wg sync.WaitGroup
+		counts := make([]int64, clients)
+		for i, c := range conns {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.send("DEL", "k")
+				if i%2 == 1 {
+					c.send("EXPIRE", "k", "0")
+				}
+			}()
+		}
+		wg.Wait()
+		var total int64
+		for i, c := range conns {
+			counts[i] = c.reply().(int64)
+			if i%2 == 1 {
+				counts[i] += c.reply().(int64)
+			}
+			total += counts[i]
+		}
+		if total != 1 {
+			t.Fatalf("round %d: %d deletions reported (%v), want 1", round, total, counts)
+		}
+	}
+}
+
+func TestServerPipelining(t *testing.T) {
+	dir := "test_resp_pipeline_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	addr, _ := startTestServer(t, dir)
+	c := dialTest(t, addr)
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		c.send("SET", fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+		c.send("GET", fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < n; i++ {
+		expectReply(t, c.reply(), "OK")
+		expectReply(t, c.reply(), fmt.Sprintf("value%d", i))
+	}
+}
+
+func TestServerConcurrentClients(t *testing.T) {
+	dir := "test_resp_concurrent_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	addr, db := startTestServer(t, dir)
+
+	const clients, perClient = 8, 100
+	var wg sync.WaitGroup
+	errCh := make(chan error, clients)
+	for g := 0; g < clients; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer func() { _ = conn.Close() }()
+			r := bufio.NewReader(conn)
+			for i := 0; i < perClient; i++ {
+				key := fmt.Sprintf("c%d-k%d", g, i)
+				cmd := fmt.Sprintf("*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$1\r\nv\r\n", len(key), key)
+				if _, err := conn.Write([]byte(cmd)); err != nil {
+					errCh <- err
+					return
+				}
+				if v, err := readReply(r); err != nil || v != "OK" {
+					errCh <- fmt.Errorf("SET %s: reply %v, err %v", key, v, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	for g := 0; g < clients; g++ {
+		for i := 0; i < perClient; i++ {
+			if !db.Has(fmt.Appendf(nil, "c%d-k%d", g, i)) {
+				t.Fatalf("key c%d-k%d missing", g, i)
+			}
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "admin:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"*a*b", "xxaxxb", true},
+		{"*a*b", "xxaxxc", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch([]byte(tt.pattern), []byte(tt.s)); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+
+	prefixes := map[string]string{"user:*": "user:", "a\\*b*": "a*b", "*x": "", "ab?c": "ab", "": ""}
+	for pattern, want := range prefixes {
+		if got := string(literalPrefix([]byte(pattern))); got != want {
+			t.Errorf("literalPrefix(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ErrBatchSpansShards は ShardedDB で複数 Shard にまたがるバッチを書き込もうとした場合のエラーです。
+var ErrBatchSpansShards = errors.New("batch spans multiple shards")
+
+// Batch は複数の Put/Delete をまとめて原子的に書き込むための操作列です。
+// ゼロ値のまま使えます。同一キーへの操作は後に追加したものが優先されます。
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key       []byte
+	value     []byte
+	tombstone bool
+	expiry    int64 // 有効期限 (UnixNano)。0 なら無期限
+}
+
+// NewBatch は空のバッチを作成します。
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Put はキーと値の保存をバッチに追加します。key と value はコピーされます。
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	})
+}
+
+// PutWithTTL は ttl 経過後に期限切れとなるキーと値の保存をバッチに追加します。
+// 期限はバッチへの追加時点から計算します。ttl が 0 以下の場合は Write が ErrInvalidTTL を返します。
+func (b *Batch) PutWithTTL(key, value []byte, ttl time.Duration) {
+	expiry := int64(-1) // 不正な TTL の印
+	if ttl > 0 {
+		expiry = time.Now().Add(ttl).UnixNano()
+	}
+	b.ops = append(b.ops, batchOp{
+		key:    append([]byte(nil), key...),
+		value:  append([]byte(nil), value...),
+		expiry: expiry,
+	})
+}
+
+// Delete はキーの削除をバッチに追加します。key はコピーされます。
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{
+		key:       append([]byte(nil), key...),
+		tombstone: true,
+	})
+}
+
+// Len はバッチ内の操作数を返します。
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset はバッチを空にします。
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write はバッチ内の全操作を 1 回のロック取得で追記します。
+// レコードは Begin/Commit マーカーで囲まれて書き込まれるため、クラッシュ後の復旧では
+// バッチ全体が反映されるか、まったく反映されないかのどちらかになります。
+func (d *DB) Write(b *Batch) error {
+	seq, err := d.write(b)
+	if err != nil {
+		return err
+	}
+	return d.waitDurable(seq)
+}
+
+func (d *DB) write(b *Batch) (uint64, error) {
+	if b == nil || len(b.ops) == 0 {
+		return 0, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.opts.ReadOnly {
+		return 0, &ReadOnlyError{Op: "write"}
+	}
+	for _, op := range b.ops {
+		if op.expiry < 0 {
+			return 0, ErrInvalidTTL
+		}
+		if err := checkEntrySize(op.key, op.value); err != nil {
+			return 0, err
+		}
+	}
+
+	// [Begin][Record...][Commit] をエンコードする
+	ts := time.Now().UnixNano()
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], uint32(len(b.ops)))
+
+	// BlobThreshold 以上の値は先に Blob File へ書き込み、バッチにはその位置を持つレコードを入れる
+	// (Commit まで書けなかったバッチの値は参照されない不要データになる)
+	blobs := make([]BlobPos, len(b.ops))
+	records := make([][]byte, 0, len(b.ops)+2)
+	records = append(records, appendRecord(nil, ts, flagBatchBegin, nil, count[:], false))
+	for i, op := range b.ops {
+		flags, value := uint8(0), op.value
+		if !op.tombstone {
+			flags, value = compressValue(d.opts.Compression, d.opts.CompressionThreshold, op.value)
+		}
+		if !op.tombstone && d.separatesValue(int64(len(op.value))) {
+			blob, err := d.writeBlobLocked(op.key, flags, value)
+			if err != nil {
+				return 0, err
+			}
+			blobs[i] = blob
+			flags, value = flagBlob, appendBlobPointer(nil, blob)
+		}
+		if op.expiry != 0 {
+			records = append(records, appendRecordWithExpiry(nil, ts, flags, op.key, value, op.expiry))
+		} else {
+			records = append(records, appendRecord(nil, ts, flags, op.key, value, op.tombstone))
+		}
+	}
+	records = append(records, appendRecord(nil, ts, flagBatchCommit, nil, count[:], false))
+
+	total := int64(len(records)) * d.encryptionOverhead()
+	for _, rec := range records {
+		total += int64(len(rec))
+	}
+
+	// バッチは 1 つのセグメントに収める (セグメントサイズを超える場合もそのまま書く)
+	if err := d.ensureCapacity(total); err != nil {
+		return 0, err
+	}
+
+	// 書き込む位置が決まってから暗号化し、1 つのバッファにまとめる
+	buf := make([]byte, 0, total)
+	offsets := make([]int64, len(records))
+	for i, rec := range records {
+		offsets[i] = int64(len(buf))
+		buf = append(buf, d.sealRecord(rec, d.writeOffset+offsets[i])...)
+	}
+
+	seq, err := d.writeRecord(buf, len(b.ops))
+	if err != nil {
+		return 0, err
+	}
+
+	// records[0] は Begin マーカーなので、op i のレコードは records[i+1]
+	for i, op := range b.ops {
+		d.supersedeStreams(string(op.key))
+		if op.tombstone {
+			d.deleteKey(string(op.key))
+		} else {
+			size := offsets[i+2] - offsets[i+1]
+			d.setKey(string(op.key), RecordPos{FileID: d.activeFileID, Offset: d.writeOffset + offsets[i+1], Size: size, Expiry: op.expiry, Blob: blobs[i]})
+		}
+	}
+	d.writeOffset += int64(len(buf))
+	// バッチ全体を 1 度に公開する (Get が途中の状態を見ないように)
+	d.publishLocked()
+
+	d.maybeTriggerMerge()
+	return seq, nil
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBatchWrite(t *testing.T) {
+	dbDir := "test_batch_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	if err := db.Put([]byte("old"), []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	b := NewBatch()
+	b.Put([]byte("key1"), []byte("value1"))
+	b.Put([]byte("key2"), []byte("value2"))
+	b.Delete([]byte("old"))
+	b.Put([]byte("key1"), []byte("value1-new")) // 同一キーは後勝ち
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	check := func(db *DB) {
+		t.Helper()
+		if val, err := db.Get([]byte("key1")); err != nil || string(val) != "value1-new" {
+			t.Errorf("Get key1 = %q, %v", val, err)
+		}
+		if val, err := db.Get([]byte("key2")); err != nil || string(val) != "value2" {
+			t.Errorf("Get key2 = %q, %v", val, err)
+		}
+		if _, err := db.Get([]byte("old")); err != ErrKeyNotFound {
+			t.Errorf("Expected old to be deleted, got %v", err)
+		}
+	}
+	check(db)
+
+	// 空のバッチは何もしない
+	if err := db.Write(NewBatch()); err != nil {
+		t.Errorf("Empty batch failed: %v", err)
+	}
+	_ = db.Close()
+
+	db, err = NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	check(db)
+}
+
+func TestBatchTornOnRecovery(t *testing.T) {
+	dbDir := "test_batch_torn_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if err := db.Put([]byte("before"), []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	path := filepath.Join(dbDir, "0.data")
+	batchStart := db.writeOffset
+
+	b := NewBatch()
+	for i := 0; i < 3; i++ {
+		b.Put([]byte(fmt.Sprintf("batch-%d", i)), []byte("value"))
+	}
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	_ = db.Close()
+
+	// Commit マーカーを含む末尾を切り落とす (バッチの途中でクラッシュ)
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	if val, err := db.Get([]byte("before")); err != nil || string(val) != "value" {
+		t.Errorf("Get before = %q, %v", val, err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("batch-%d", i))); err != ErrKeyNotFound {
+			t.Errorf("Expected batch-%d to be discarded, got %v", i, err)
+		}
+	}
+	if recovered := db.Recovered(); len(recovered) != 1 || recovered[0].Offset != batchStart {
+		t.Errorf("Expected truncation at batch start %d, got %v", batchStart, recovered)
+	}
+}
+
+func TestBatchRotation(t *testing.T) {
+	dbDir := "test_batch_rotation_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 100
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	_ = db.Put([]byte("key0"), []byte("value0"))
+	// セグメントサイズを超えるバッチも 1 つのセグメントに書かれる
+	b := NewBatch()
+	for i := 1; i <= 5; i++ {
+		b.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	_ = db.Put([]byte("key6"), []byte("value6"))
+	_ = db.Close()
+
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	for i := 0; i <= 6; i++ {
+		want := fmt.Sprintf("value%d", i)
+		if val, err := db.Get([]byte(fmt.Sprintf("key%d", i))); err != nil || string(val) != want {
+			t.Errorf("Get key%d = %q, %v", i, val, err)
+		}
+	}
+}
+
+func TestShardedBatch(t *testing.T) {
+	dir := "test_sharded_batch"
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	db, err := NewShardedDB(dir, 4)
+	if err != nil {
+		t.Fatalf("Failed to create db: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	// 同じ Shard に入るキーを集める
+	target := db.getShard([]byte("key-0"))
+	var sameShard, otherShard [][]byte
+	for i := 0; len(sameShard) < 3 || len(otherShard) < 1; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if db.getShard(key) == target {
+			sameShard = append(sameShard, key)
+		} else {
+			otherShard = append(otherShard, key)
+		}
+	}
+
+	b := NewBatch()
+	for _, key := range sameShard[:3] {
+		b.Put(key, []byte("value"))
+	}
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	for _, key := range sameShard[:3] {
+		if _, err := db.Get(key); err != nil {
+			t.Errorf("Get %s failed: %v", key, err)
+		}
+	}
+
+	b = NewBatch()
+	b.Put(sameShard[0], []byte("x"))
+	b.Put(otherShard[0], []byte("x"))
+	if err := db.Write(b); err != ErrBatchSpansShards {
+		t.Errorf("Expected ErrBatchSpansShards, got %v", err)
+	}
+}
@@ -0,0 +1,537 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Blob File (N.blob) は Options.BlobThreshold 以上の大きさの値を書き込むファイルです (キーと値の分離)。
+//
+// Blob File はデータファイルと同じファイルヘッダ (Kind は Blob) とレコード形式を持ち、
+// 値のレコード (有効期限は持たない) だけが並びます。ID はデータファイルとは独立に割り当てます。
+// データファイルには値の代わりに Blob File 内の位置を持つ flagBlob のレコードを書き込みます。
+//
+//	[Expiry(8)][BlobFileID(4)][Offset(8)][Size(8)]   (flagBlob のレコードの値。Expiry は flagExpiry の場合のみ)
+//
+// 値のレコードを書いてからデータファイルのレコードを書くので、インデックスが参照する値は必ず書き込み済みです。
+// fsync も Blob File を先に行います。Blob File はオープンごとに新しいファイルへ書き込み、既存のファイルには
+// 追記しません (書きかけの末尾は参照されない不要データとして残り、BlobGC で取り除かれます)。
+//
+// Merge はデータファイルのレコード (Blob File の位置) だけを書き直し、Blob File はそのまま残します。
+// 上書き・削除された値の領域は BlobGC が Blob File ごとの不要データ比率に基づいて回収します。
+
+// blobPointerSize は flagBlob のレコードが値の代わりに持つ Blob File の位置のサイズです。
+const blobPointerSize = 20
+
+// BlobPos は Blob File に書き込んだ値のレコードの位置です。ゼロ値は値を分離していないことを表します。
+type BlobPos struct {
+	FileID int
+	Offset int64
+	Size   int64 // ヘッダを含むレコード全体のサイズ
+}
+
+// valid は Blob File の位置を持つか (値を分離したレコードか) を返します。
+func (b BlobPos) valid() bool {
+	return b.Size > 0
+}
+
+// recordPos は Blob File 内の値のレコードの位置を RecordPos として返します。
+func (b BlobPos) recordPos() RecordPos {
+	return RecordPos{FileID: b.FileID, Offset: b.Offset, Size: b.Size}
+}
+
+// appendBlobPointer は Blob File の位置をエンコードして buf に追記します。
+func appendBlobPointer(buf []byte, b BlobPos) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(b.FileID))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(b.Offset))
+	return binary.BigEndian.AppendUint64(buf, uint64(b.Size))
+}
+
+// decodeBlobPointer は flagBlob のレコードの値 (有効期限を除いたもの) から Blob File の位置を取り出します。
+func decodeBlobPointer(value []byte) (BlobPos, error) {
+	if len(value) != blobPointerSize {
+		return BlobPos{}, fmt.Errorf("blob pointer has %d bytes, want %d", len(value), blobPointerSize)
+	}
+	b := BlobPos{
+		FileID: int(binary.BigEndian.Uint32(value[0:4])),
+		Offset: int64(binary.BigEndian.Uint64(value[4:12])),
+		Size:   int64(binary.BigEndian.Uint64(value[12:20])),
+	}
+	if b.Size < recordHeaderSize {
+		return BlobPos{}, fmt.Errorf("blob record size %d too small", b.Size)
+	}
+	return b, nil
+}
+
+func blobPath(dirPath string, id int) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%d.blob", id))
+}
+
+// listBlobIDs はディレクトリ内の Blob File (N.blob) の ID を昇順で返します。
+func listBlobIDs(dirPath string) ([]int, error) {
+	return listFileIDs(dirPath, ".blob")
+}
+
+// separatesValue は size バイトの値を Blob File に書き込むかを返します。
+func (d *DB) separatesValue(size int64) bool {
+	return d.opts.BlobThreshold > 0 && size >= int64(d.opts.BlobThreshold)
+}
+
+// openBlobFile は Blob File を Options.UseMmap に応じた Reader で開き、ファイルヘッダを検証します。
+// ヘッダが途中で途切れている (作成直後にクラッシュした) 場合は io.ErrUnexpectedEOF を返します。
+func (d *DB) openBlobFile(id int) (*segment, error) {
+	reader, err := d.openReader(blobPath(d.dirPath, id))
+	if err != nil {
+		return nil, err
+	}
+	header, err := readFileHeader(reader, reader.Size(), FileKindBlob, id)
+	if err == nil && header.Version == 0 {
+		// Blob File は常にヘッダを持つ
+		err = io.ErrUnexpectedEOF
+		if reader.Size() >= fileHeaderSize {
+			err = corruptionError(FileKindBlob, id, 0, "missing file header")
+		}
+	}
+	if err != nil {
+		_ = reader.Close()
+		return nil, err
+	}
+	cipher, err := openFileCipher(d.opts.KeyProvider, header)
+	if err != nil {
+		_ = reader.Close()
+		return nil, err
+	}
+	seg := newSegment(id, reader)
+	seg.header = header
+	seg.cipher = cipher
+	return seg, nil
+}
+
+// loadBlobFiles はディレクトリの Blob File を不変のファイルとして開き、削除されたファイルを取り除きます。
+// オープン時と Refresh で呼び出します。読み込み済みのファイルは伸びていれば開き直します
+// (read-only で開いた DB が、書き込みプロセスの書き込み中の Blob File を読むため)。
+// ヘッダが途切れた Blob File は作成直後のもので、値は書かれていないので削除します (read-only では読み飛ばします)。
+func (d *DB) loadBlobFiles() error {
+	ids, err := listBlobIDs(d.dirPath)
+	if err != nil {
+		return err
+	}
+	onDisk := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		onDisk[id] = true
+		d.nextBlobID = max(d.nextBlobID, id+1)
+	}
+	for id, seg := range d.blobFiles {
+		if !onDisk[id] {
+			// BlobGC で削除された
+			d.retireSegment(seg)
+			delete(d.blobFiles, id)
+		}
+	}
+
+	for _, id := range ids {
+		old, known := d.blobFiles[id]
+		if known {
+			info, err := os.Stat(blobPath(d.dirPath, id))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if info.Size() <= old.reader.Size() {
+				continue
+			}
+		}
+		seg, err := d.openBlobFile(id)
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, os.ErrNotExist) {
+			if !d.opts.ReadOnly {
+				if err := os.Remove(blobPath(d.dirPath, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if known {
+			// Get やイテレータが参照中なら、Reader は最後の参照の解放時に閉じられる
+			d.retireSegment(old)
+		}
+		d.blobFiles[id] = seg
+	}
+	return nil
+}
+
+// ensureBlobCapacity は size バイトの値のレコードを書き込める Blob File を用意します。
+// オープン後の最初の書き込みで新しい Blob File を作成し、セグメントサイズを超える場合はローテーションします。
+func (d *DB) ensureBlobCapacity(size int64) error {
+	if d.blobFile == nil {
+		return d.newBlobFile()
+	}
+	written := d.blobOffset - d.blobSeg.header.size()
+	if written > 0 && written+size > d.opts.SegmentSize {
+		return d.newBlobFile()
+	}
+	return nil
+}
+
+// newBlobFile は書き込み中の Blob File を fsync して不変のファイルとして開き直し、新しい Blob File を作成します。
+func (d *DB) newBlobFile() error {
+	if d.blobFile != nil {
+		if err := d.blobFile.Sync(); err != nil {
+			return err
+		}
+		seg, err := d.openBlobFile(d.blobFileID)
+		if err != nil {
+			return err
+		}
+		d.blobFiles[d.blobFileID] = seg
+		// DiskReader がファイルを所有するので、参照中の Get が読み終えた時点でファイルも閉じられる
+		d.retireSegment(d.blobSeg)
+		d.blobFile, d.blobSeg = nil, nil
+	}
+
+	id := d.nextBlobID
+	header, cipher, err := createFileHeader(FileKindBlob, id, d.opts.KeyProvider)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(blobPath(d.dirPath, id), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(header, 0); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if d.opts.SyncPolicy != SyncNever {
+		if err := syncDir(d.dirPath); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	decoded, err := decodeFileHeader(header)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	d.blobFile = file
+	d.blobSeg = newSegment(id, NewDiskReader(file))
+	d.blobSeg.header = decoded
+	d.blobSeg.cipher = cipher
+	d.blobFileID = id
+	d.blobOffset = int64(len(header))
+	d.nextBlobID = id + 1
+	d.publishSegmentsLocked()
+	return nil
+}
+
+// writeBlobLocked は格納する値 stored (flags の方式で圧縮済み) のレコードを Blob File に書き込み、その位置を返します。
+// d.mu を保持した状態で、データファイルに位置を持つレコードを書く前に呼び出します。
+func (d *DB) writeBlobLocked(key []byte, flags uint8, stored []byte) (BlobPos, error) {
+	rec := appendRecord(nil, time.Now().UnixNano(), flags, key, stored, false)
+	size := int64(len(rec))
+	if d.opts.KeyProvider != nil {
+		size += gcmTagSize
+	}
+	if err := d.ensureBlobCapacity(size); err != nil {
+		return BlobPos{}, err
+	}
+	if d.blobSeg.cipher != nil {
+		rec = d.blobSeg.cipher.sealRecord(rec, d.blobOffset)
+	}
+	if _, err := d.blobFile.WriteAt(rec, d.blobOffset); err != nil {
+		return BlobPos{}, err
+	}
+	return d.commitBlob(int64(len(rec))), nil
+}
+
+// commitBlob は Blob File の blobOffset の位置に n バイトの値のレコードを書き終えたことを記録し、その位置を返します。
+// SyncByBytes では値の分も未同期の書き込み量に含めます (fsync は続くデータファイルへの書き込みで判定します)。
+func (d *DB) commitBlob(n int64) BlobPos {
+	b := BlobPos{FileID: d.blobFileID, Offset: d.blobOffset, Size: n}
+	d.blobOffset += n
+	if d.opts.SyncPolicy == SyncByBytes {
+		d.unsyncedBytes += n
+	}
+	return b
+}
+
+// syncBlobFile は書き込み中の Blob File を fsync します。データファイルの fsync の前に呼び出し、
+// 永続化したレコードが参照する値が失われないようにします。
+func (d *DB) syncBlobFile() error {
+	if d.blobFile == nil {
+		return nil
+	}
+	return d.blobFile.Sync()
+}
+
+// blobNeedsGC は不変の Blob File を BlobGC で書き直すべきかを判定します。
+// 不要データの比率が BlobGCMinDeadRatio 以上のファイルに加え、暗号化した DB では現在の鍵と異なる鍵
+// (または平文) のファイルも書き直します (Merge が Blob File を書き直さないため、鍵のローテーションは BlobGC で進みます)。
+func (d *DB) blobNeedsGC(st BlobStats, seg *segment) bool {
+	if st.Active {
+		return false
+	}
+	if st.TotalBytes <= 0 || st.LiveBytes <= 0 {
+		return true // 参照されている値が無い
+	}
+	if st.DeadBytes > 0 && st.DeadRatio >= d.opts.BlobGCMinDeadRatio {
+		return true
+	}
+	if d.opts.KeyProvider != nil {
+		keyID, _, err := d.opts.KeyProvider.CurrentKey()
+		return err == nil && (!seg.header.Encrypted || seg.header.KeyID != keyID)
+	}
+	return false
+}
+
+// shouldCollectBlobs は BlobGC で書き直すべき Blob File があるかを返します。
+func (d *DB) shouldCollectBlobs() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, st := range d.blobStatsLocked() {
+		if seg, ok := d.blobFiles[st.FileID]; ok && d.blobNeedsGC(st, seg) {
+			return true
+		}
+	}
+	return false
+}
+
+// blobMove は BlobGC で書き写した値の移動元と移動先です。
+type blobMove struct {
+	key     string
+	oldBlob BlobPos
+	blob    BlobPos // 書き写した先
+	expired bool    // 期限切れのため書き写さずに破棄した値
+}
+
+// BlobGC は不要データの比率が Options.BlobGCMinDeadRatio 以上の Blob File (書き込み中のものを除く) の有効な値を
+// 新しい Blob File へ書き写し、元のファイルを削除します。
+//
+// Merge と同様に、d.mu を保持するのは対象の選択と最後の差し替えの間だけです。
+//  1. (ロック) 対象の Blob File とインデックスのスナップショットを取得
+//  2. (ロックなし) スナップショット上で対象のファイルを参照している値を新しい Blob File へコピーして fsync
+//  3. (ロック) コピー中に上書きされなかったキーについて、新しい位置を持つレコードをデータファイルに追記し、
+//     fsync してから元の Blob File を削除
+//
+// 位置を書き直したキーはレコードが変わるため、Version (HTTP API の ETag) も変わります。
+// 途中でクラッシュした場合、書き写した Blob File は参照されない不要データとして次回の BlobGC で削除されます。
+// Merge とは同時に実行しません。
+func (d *DB) BlobGC() error {
+	d.mergeMu.Lock()
+	defer d.mergeMu.Unlock()
+
+	// 1. 対象の選択
+	d.mu.Lock()
+	if d.opts.ReadOnly {
+		d.mu.Unlock()
+		return &ReadOnlyError{Op: "blob gc"}
+	}
+	if d.closed {
+		d.mu.Unlock()
+		return ErrClosed
+	}
+	inputs := make(map[int]*segment)
+	for _, st := range d.blobStatsLocked() {
+		seg, ok := d.blobFiles[st.FileID]
+		if ok && d.blobNeedsGC(st, seg) && seg.acquire() {
+			inputs[st.FileID] = seg
+		}
+	}
+	snapshot := d.keyDir.clone()
+	d.mu.Unlock()
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	// コピーが終わるまで入力の Blob File を閉じさせない
+	defer func() {
+		for _, seg := range inputs {
+			_ = seg.release()
+		}
+	}()
+
+	// 2. 新しい Blob File へのコピー (ロックなし)
+	moves, outputIDs, err := d.copyLiveBlobs(snapshot, inputs)
+	committed := false
+	defer func() {
+		// 失敗した場合、書き写した Blob File はどこからも参照されない
+		if !committed {
+			for _, id := range outputIDs {
+				_ = os.Remove(blobPath(d.dirPath, id))
+			}
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	if err := syncDir(d.dirPath); err != nil {
+		return err
+	}
+
+	// 3. 差し替え (ロック)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+	// 差し替えた状態を公開してから入力の Blob File の参照を解放する (途中で失敗した場合も公開する)
+	defer d.publishSegmentsLocked()
+
+	for _, id := range outputIDs {
+		seg, err := d.openBlobFile(id)
+		if err != nil {
+			return err
+		}
+		d.blobFiles[id] = seg
+	}
+	committed = true
+
+	// コピー中に上書き・削除されていないキーだけ、新しい位置を持つレコードを追記する
+	// (上書きされたキーのコピーは新しい Blob File 内の不要データとして計上される)。
+	// Expire で有効期限だけ変わったキーは現在の有効期限で書き直す
+	now := time.Now().UnixNano()
+	for _, m := range moves {
+		cur, ok := d.keyDir.get(m.key)
+		if !ok || cur.Blob != m.oldBlob {
+			continue
+		}
+		if m.expired || cur.expired(now) {
+			// 期限切れのキーは復旧時と同様にインデックスから取り除く (データファイルのレコードは Merge が削除する)
+			d.deleteKey(m.key)
+			continue
+		}
+		if _, _, err := d.putBlobPointerLocked([]byte(m.key), m.blob, cur.Expiry); err != nil {
+			return err
+		}
+	}
+
+	// 新しい位置を永続化してから元の Blob File を削除する
+	if err := d.activeFile.Sync(); err != nil {
+		return err
+	}
+	d.commit.markSynced(d.writeSeq)
+	d.unsyncedBytes = 0
+
+	for id, seg := range inputs {
+		// Get やイテレータが参照中なら、Reader は最後の参照の解放時に閉じられる
+		d.retireSegment(seg)
+		delete(d.blobFiles, id)
+		delete(d.blobLive, id)
+		if err := os.Remove(blobPath(d.dirPath, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return syncDir(d.dirPath)
+}
+
+// copyLiveBlobs はスナップショット上で inputs の Blob File を参照している値を新しい Blob File へ書き写します。
+// 出力は SegmentSize ごとに新しい ID の Blob File に分割し、作成した ID を返します (エラーの場合も返します)。
+func (d *DB) copyLiveBlobs(snapshot *keyIndex, inputs map[int]*segment) ([]blobMove, []int, error) {
+	var moves []blobMove
+	var outputIDs []int
+	var out *mergeOutput
+	var copyErr error
+	defer func() {
+		if out != nil {
+			out.close()
+		}
+	}()
+	now := time.Now().UnixNano()
+
+	snapshot.ascend(func(key string, pos RecordPos) bool {
+		seg, ok := inputs[pos.Blob.FileID]
+		if !pos.Blob.valid() || !ok {
+			return true
+		}
+		if pos.expired(now) {
+			moves = append(moves, blobMove{key: key, oldBlob: pos.Blob, expired: true})
+			return true
+		}
+
+		// 暗号化された値は平文に戻し、書き込む位置で暗号化し直す
+		rec, err := readPlainRecord(seg, pos.Blob.recordPos())
+		if err != nil {
+			copyErr = err
+			return false
+		}
+		size := int64(len(rec))
+		if d.opts.KeyProvider != nil {
+			size += gcmTagSize
+		}
+
+		if out != nil && out.size > 0 && out.size+size > d.opts.SegmentSize {
+			err := out.finish()
+			out = nil
+			if err != nil {
+				copyErr = err
+				return false
+			}
+		}
+		if out == nil {
+			id := d.allocBlobID()
+			outputIDs = append(outputIDs, id)
+			if out, err = createBlobOutput(d.dirPath, id, d.opts.KeyProvider); err != nil {
+				copyErr = err
+				return false
+			}
+		}
+
+		offset, n, err := out.append(rec, []byte(key), 0)
+		if err != nil {
+			copyErr = err
+			return false
+		}
+		moves = append(moves, blobMove{key: key, oldBlob: pos.Blob, blob: BlobPos{FileID: out.id, Offset: offset, Size: n}})
+		return true
+	})
+	if copyErr != nil {
+		return nil, outputIDs, copyErr
+	}
+
+	if out != nil {
+		err := out.finish()
+		out = nil
+		if err != nil {
+			return nil, outputIDs, err
+		}
+	}
+	return moves, outputIDs, nil
+}
+
+// allocBlobID は新しい Blob File の ID を割り当てます。
+func (d *DB) allocBlobID() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := d.nextBlobID
+	d.nextBlobID++
+	return id
+}
+
+// createBlobOutput は BlobGC の出力先の Blob File id を作成します。
+// 書き込みは Merge の出力と同じく mergeOutput で行います (Hint File は作りません)。
+func createBlobOutput(dirPath string, id int, keys KeyProvider) (*mergeOutput, error) {
+	header, cipher, err := createFileHeader(FileKindBlob, id, keys)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(blobPath(dirPath, id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	out := &mergeOutput{id: id, dataFile: file, dataWriter: bufio.NewWriter(file), dataCipher: cipher}
+	// 書き込みエラーは finish の Flush で返る
+	_, _ = out.dataWriter.Write(header)
+	return out, nil
+}
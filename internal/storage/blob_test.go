@@ -0,0 +1,428 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blobFileIDs はディレクトリ内の Blob File の ID を返します。
+func blobFileIDs(t *testing.T, dir string) []int {
+	t.Helper()
+	ids, err := listBlobIDs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestBlobSeparation(t *testing.T) {
+	dbDir := "test_blob_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 64 * 1024
+	opts.BlobThreshold = 1024
+	opts.BlobGCMinDeadRatio = 0.3
+	opts.Compression = CompressionLZ4
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	values := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		value := make([]byte, 8*1024)
+		rnd.Read(value)
+		key := fmt.Sprintf("big%02d", i)
+		values[key] = value
+		if err := db.Put([]byte(key), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	// 圧縮される値、閾値未満の値、ストリームとバッチで書いた値
+	values["compressible"] = []byte(strings.Repeat("compressible;", 200))
+	values["small"] = []byte("value")
+	values["stream"] = bytes.Repeat([]byte{7}, 4096)
+	values["batch"] = bytes.Repeat([]byte("batch;"), 500)
+	_ = db.Put([]byte("compressible"), values["compressible"])
+	_ = db.Put([]byte("small"), values["small"])
+	if err := db.PutStream([]byte("stream"), bytes.NewReader(values["stream"]), 4096); err != nil {
+		t.Fatalf("PutStream failed: %v", err)
+	}
+	b := NewBatch()
+	b.Put([]byte("batch"), values["batch"])
+	b.Put([]byte("batch-small"), []byte("x"))
+	values["batch-small"] = []byte("x")
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for key, want := range values {
+			if got, err := db.Get([]byte(key)); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%s: Get %s returned %d bytes, %v", stage, key, len(got), err)
+			}
+		}
+	}
+	check("before merge")
+
+	pos, _ := db.keyDir.get("big00")
+	if !pos.Blob.valid() {
+		t.Fatal("Expected big00 to be stored in a blob file")
+	}
+	if pos, _ := db.keyDir.get("small"); pos.Blob.valid() {
+		t.Error("Expected small not to be stored in a blob file")
+	}
+	if len(blobFileIDs(t, dbDir)) < 2 {
+		t.Errorf("Expected blob files to rotate at SegmentSize, got %v", blobFileIDs(t, dbDir))
+	}
+
+	// GetInto / View / GetReader / GetWithVersion / イテレータも Blob File の値を読む
+	want := values["big00"]
+	if got, err := db.GetInto([]byte("big00"), nil); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("GetInto failed: %v", err)
+	}
+	if err := db.View([]byte("big00"), func(v []byte) error {
+		if !bytes.Equal(v, want) {
+			t.Error("View returned a different value")
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("View failed: %v", err)
+	}
+	r, ver, err := db.GetReaderWithVersion([]byte("big00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("GetReader returned %d bytes, %v", len(got), err)
+	}
+	_ = r.Close()
+	if current, _ := db.Version([]byte("big00")); ver != current {
+		t.Errorf("GetReaderWithVersion version %+v, want %+v", ver, current)
+	}
+	if got, ver, err := db.GetWithVersion([]byte("big00")); err != nil || !bytes.Equal(got, want) || ver.IsZero() {
+		t.Errorf("GetWithVersion returned %d bytes, %+v, %v", len(got), ver, err)
+	}
+	it := db.Scan([]byte("big"))
+	n := 0
+	for ; it.Valid(); it.Next() {
+		if v, err := it.Value(); err != nil || !bytes.Equal(v, values[string(it.Key())]) {
+			t.Errorf("Iterator value of %s failed: %v", it.Key(), err)
+		}
+		n++
+	}
+	_ = it.Close()
+	if n != 20 {
+		t.Errorf("Expected 20 keys, got %d", n)
+	}
+
+	// Merge は値を書き直さない
+	before := blobFileIDs(t, dbDir)
+	st := db.Stats()
+	if st.BlobLiveBytes == 0 || st.BlobDeadBytes != 0 || st.LiveBytes >= st.BlobLiveBytes {
+		t.Errorf("Unexpected blob stats %+v", st)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if after := blobFileIDs(t, dbDir); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("Merge changed blob files: %v -> %v", before, after)
+	}
+	if after := db.Stats(); after.BlobLiveBytes != st.BlobLiveBytes {
+		t.Errorf("Merge changed blob live bytes: %d -> %d", st.BlobLiveBytes, after.BlobLiveBytes)
+	}
+	check("after merge")
+
+	// 上書き・削除した値は BlobGC で回収される
+	for i := 0; i < 20; i += 2 {
+		key := fmt.Sprintf("big%02d", i)
+		if i%4 == 0 {
+			_ = db.Delete([]byte(key))
+			delete(values, key)
+			continue
+		}
+		values[key] = bytes.Repeat([]byte{byte(i)}, 2048)
+		_ = db.Put([]byte(key), values[key])
+	}
+	versions := make(map[string]Version)
+	for key := range values {
+		versions[key], _ = db.Version([]byte(key))
+	}
+	blobIDs := make(map[string]int)
+	for key := range values {
+		pos, _ := db.keyDir.get(key)
+		blobIDs[key] = pos.Blob.FileID
+	}
+	st = db.Stats()
+	if st.BlobDeadBytes == 0 {
+		t.Fatalf("Expected dead blob bytes, got %+v", st)
+	}
+	// BlobGC と並行した Get は、入れ替わる前後どちらかの Blob File から読める
+	done := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(readErr)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if got, err := db.Get([]byte("big19")); err != nil || !bytes.Equal(got, values["big19"]) {
+				readErr <- fmt.Errorf("concurrent Get returned %d bytes, %v", len(got), err)
+				return
+			}
+		}
+	}()
+	err = db.BlobGC()
+	close(done)
+	if err != nil {
+		t.Fatalf("BlobGC failed: %v", err)
+	}
+	if err := <-readErr; err != nil {
+		t.Error(err)
+	}
+	after := db.Stats()
+	if after.BlobTotalBytes >= st.BlobTotalBytes || after.BlobLiveBytes != st.BlobLiveBytes {
+		t.Errorf("BlobGC did not reclaim space: %+v -> %+v", st, after)
+	}
+	for _, b := range after.Blobs {
+		if !b.Active && b.DeadRatio >= opts.BlobGCMinDeadRatio {
+			t.Errorf("Blob file %d still has dead ratio %.2f", b.FileID, b.DeadRatio)
+		}
+	}
+	// 書き写した値は Version が変わる
+	moved := 0
+	for key := range values {
+		pos, _ := db.keyDir.get(key)
+		if !pos.Blob.valid() || pos.Blob.FileID == blobIDs[key] {
+			continue
+		}
+		moved++
+		if ver, _ := db.Version([]byte(key)); ver == versions[key] {
+			t.Errorf("Expected the version of moved %s to change", key)
+		}
+	}
+	if moved == 0 {
+		t.Error("Expected BlobGC to move some values")
+	}
+	check("after blob gc")
+	_ = db.Close()
+
+	// Hint File の有無にかかわらず、再オープン後も Blob File から読める
+	for _, hints := range []bool{true, false} {
+		opts.LoadHintFiles = hints
+		db, err = OpenWithOptions(dbDir, opts)
+		if err != nil {
+			t.Fatalf("Failed to reopen DB: %v", err)
+		}
+		if len(db.Recovered()) != 0 {
+			t.Errorf("Expected a clean reopen, got %v", db.Recovered())
+		}
+		check(fmt.Sprintf("reopen (hints=%v)", hints))
+		if st := db.Stats(); st.BlobLiveBytes != after.BlobLiveBytes {
+			t.Errorf("Blob live bytes after reopen %d, want %d", st.BlobLiveBytes, after.BlobLiveBytes)
+		}
+		_ = db.Close()
+	}
+
+	report, err := Verify(dbDir)
+	if err != nil || !report.OK() || report.BlobFiles == 0 {
+		t.Errorf("Verify reported %+v, %v", report, err)
+	}
+}
+
+func TestBlobTTL(t *testing.T) {
+	dbDir := "test_blob_ttl_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.BlobThreshold = 16
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	value := []byte(strings.Repeat("v", 100))
+	if err := db.PutWithTTL([]byte("key"), value, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL([]byte("short"), value, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	blob := db.Stats().BlobTotalBytes
+
+	// Expire は値を書き直さずに有効期限だけを書き直す
+	if err := db.Expire([]byte("key"), 2*time.Hour); err != nil {
+		t.Fatalf("Expire failed: %v", err)
+	}
+	if ttl, err := db.TTL([]byte("key")); err != nil || ttl <= time.Hour {
+		t.Errorf("Unexpected TTL %v, %v", ttl, err)
+	}
+	if got, err := db.Get([]byte("key")); err != nil || !bytes.Equal(got, value) {
+		t.Errorf("Get after Expire = %q, %v", got, err)
+	}
+	if st := db.Stats(); st.BlobTotalBytes != blob {
+		t.Errorf("Expire rewrote the value: blob bytes %d -> %d", blob, st.BlobTotalBytes)
+	}
+
+	// 期限切れの値は BlobGC で破棄される
+	time.Sleep(100 * time.Millisecond)
+	if _, err := db.Get([]byte("short")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for an expired key, got %v", err)
+	}
+	_ = db.Put([]byte("other"), value) // BlobGC の対象は書き込み中でない Blob File
+	db.mu.Lock()
+	err = db.newBlobFile()
+	db.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.opts.BlobGCMinDeadRatio = 0
+	if err := db.BlobGC(); err != nil {
+		t.Fatalf("BlobGC failed: %v", err)
+	}
+	if db.Has([]byte("short")) {
+		t.Error("Expected the expired key to be dropped")
+	}
+	if ttl, err := db.TTL([]byte("key")); err != nil || ttl <= time.Hour {
+		t.Errorf("Unexpected TTL after BlobGC %v, %v", ttl, err)
+	}
+	for _, key := range []string{"key", "other"} {
+		if got, err := db.Get([]byte(key)); err != nil || !bytes.Equal(got, value) {
+			t.Errorf("Get %s after BlobGC = %q, %v", key, got, err)
+		}
+	}
+}
+
+func TestBlobEncrypted(t *testing.T) {
+	dbDir := "test_blob_encrypted_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.BlobThreshold = 64
+	opts.KeyProvider = testKeys(t, 1, 1)
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	secret := strings.Repeat("secret-blob;", 100)
+	if err := db.Put([]byte("key"), []byte(secret)); err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Close()
+	checkNoPlaintext(t, dbDir, "secret-blob")
+
+	// 鍵を追加した BlobGC は古い鍵の Blob File を書き直す
+	opts.KeyProvider = testKeys(t, 2, 1, 2)
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	if err := db.BlobGC(); err != nil {
+		t.Fatalf("BlobGC failed: %v", err)
+	}
+	for _, id := range blobFileIDs(t, dbDir) {
+		header, err := ReadFileHeader(filepath.Join(dbDir, fmt.Sprintf("%d.blob", id)))
+		if err != nil || !header.Encrypted || header.KeyID != 2 {
+			t.Errorf("Blob file %d header %+v, %v", id, header, err)
+		}
+	}
+	if got, err := db.Get([]byte("key")); err != nil || string(got) != secret {
+		t.Errorf("Get after rekey failed: %v", err)
+	}
+	checkNoPlaintext(t, dbDir, "secret-blob")
+}
+
+func TestBlobReadOnlyRefresh(t *testing.T) {
+	dbDir := "test_blob_readonly_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.BlobThreshold = 64
+	writer, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open writer: %v", err)
+	}
+	defer func() { _ = writer.Close() }()
+	_ = writer.Put([]byte("a"), bytes.Repeat([]byte("a"), 100))
+
+	roOpts := opts
+	roOpts.ReadOnly = true
+	roOpts.NoLock = true
+	ro, err := OpenWithOptions(dbDir, roOpts)
+	if err != nil {
+		t.Fatalf("Failed to open read-only alongside writer: %v", err)
+	}
+	defer func() { _ = ro.Close() }()
+
+	// 書き込み中の Blob File に追記された値も Refresh で読める
+	_ = writer.Put([]byte("b"), bytes.Repeat([]byte("b"), 100))
+	if err := ro.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if got, err := ro.Get([]byte(key)); err != nil || !bytes.Equal(got, bytes.Repeat([]byte(key), 100)) {
+			t.Errorf("Get %s = %q, %v", key, got, err)
+		}
+	}
+	if err := ro.BlobGC(); err == nil {
+		t.Error("Expected BlobGC to fail on a read-only DB")
+	}
+}
+
+func TestCloseReleasesAllFilesOnError(t *testing.T) {
+	dbDir := "test_blob_close_error_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 1024
+	opts.BlobThreshold = 64
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		_ = db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(strings.Repeat("v", 40)))
+	}
+	_ = db.Put([]byte("big"), bytes.Repeat([]byte("b"), 100))
+	if len(db.olderFiles) == 0 || db.blobFile == nil {
+		t.Fatalf("expected older segments and an active blob file")
+	}
+	segments := []*segment{db.activeSeg}
+	for _, seg := range db.olderFiles {
+		segments = append(segments, seg)
+	}
+
+	// Blob File の Sync を失敗させても、残りのセグメントは閉じられる
+	_ = db.blobFile.Close()
+	if err := db.Close(); err == nil {
+		t.Fatal("Expected Close to report the blob file error")
+	}
+	for _, seg := range segments {
+		if n := seg.refs.Load(); n != 0 {
+			t.Errorf("segment %d still has %d refs after Close", seg.id, n)
+		}
+	}
+
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	if got, err := db.Get([]byte("key19")); err != nil || len(got) != 40 {
+		t.Errorf("Get after reopen = %q, %v", got, err)
+	}
+}
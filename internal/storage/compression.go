@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+)
+
+// Compression は値の圧縮方式です。方式はレコードごとにフラグとして記録されるため、
+// 途中で Options.Compression を変更しても既存のレコードはそのまま読めます。
+type Compression int
+
+const (
+	// CompressionNone は値を圧縮しません。
+	CompressionNone Compression = iota
+	// CompressionLZ4 は LZ4 ブロック形式で圧縮します。高速ですが圧縮率は控えめです。
+	CompressionLZ4
+	// CompressionFlate は compress/flate で圧縮します。LZ4 より低速ですが圧縮率が高くなります。
+	CompressionFlate
+)
+
+// DefaultCompressionThreshold は Options.CompressionThreshold のデフォルト値です。
+const DefaultCompressionThreshold = 256
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionLZ4:
+		return "lz4"
+	case CompressionFlate:
+		return "flate"
+	default:
+		return fmt.Sprintf("Compression(%d)", int(c))
+	}
+}
+
+// ParseCompression は "none" / "lz4" / "flate" を Compression に変換します。
+func ParseCompression(s string) (Compression, error) {
+	for _, c := range []Compression{CompressionNone, CompressionLZ4, CompressionFlate} {
+		if s == c.String() {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression %q (want none, lz4 or flate)", s)
+}
+
+// flag は圧縮方式のレコードフラグです (CompressionNone は 0)。
+func (c Compression) flag() uint8 {
+	switch c {
+	case CompressionLZ4:
+		return flagLZ4
+	case CompressionFlate:
+		return flagFlate
+	}
+	return 0
+}
+
+var errDecompress = errors.New("cannot decompress value")
+
+// flate の Writer / Reader は確保が大きいため使い回す
+var (
+	flateWriters = sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	flateReaders = sync.Pool{New: func() any { return flate.NewReader(nil) }}
+)
+
+// compressValue は value を c で圧縮し、追加するレコードフラグとファイルに格納する値を返します。
+// value が threshold バイト未満の場合や、圧縮しても小さくならない場合は無圧縮 (フラグ 0) のまま返します。
+//
+// 圧縮した値は [元の長さ (uvarint)][圧縮データ] の形式で格納します。
+func compressValue(c Compression, threshold int, value []byte) (uint8, []byte) {
+	if c == CompressionNone || len(value) < threshold || len(value) == 0 {
+		return 0, value
+	}
+	buf := binary.AppendUvarint(make([]byte, 0, len(value)), uint64(len(value)))
+	switch c {
+	case CompressionLZ4:
+		buf = lz4Compress(buf, value)
+	case CompressionFlate:
+		out := bytes.NewBuffer(buf)
+		w := flateWriters.Get().(*flate.Writer)
+		w.Reset(out)
+		_, _ = w.Write(value) // bytes.Buffer への書き込みは失敗しない
+		_ = w.Close()
+		flateWriters.Put(w)
+		buf = out.Bytes()
+	}
+	if len(buf) >= len(value) {
+		return 0, value
+	}
+	return c.flag(), buf
+}
+
+// decompressValue はレコードフラグに従って、ファイルに格納された値を展開します。
+// 圧縮されていない値はそのまま返します。
+func decompressValue(flags uint8, stored []byte) ([]byte, error) {
+	if flags&(flagLZ4|flagFlate) == 0 {
+		return stored, nil
+	}
+	return appendDecompressed(nil, flags, stored)
+}
+
+// appendDecompressed は圧縮された値 stored を展開して dst の末尾に追加します。
+func appendDecompressed(dst []byte, flags uint8, stored []byte) ([]byte, error) {
+	size, n := binary.Uvarint(stored)
+	if n <= 0 || size > uint64(tombstoneValueSize) {
+		return nil, fmt.Errorf("%w: bad length prefix", errDecompress)
+	}
+	stored = stored[n:]
+	start := len(dst)
+	dst = slices.Grow(dst, int(size))[:start+int(size)]
+	value := dst[start:]
+
+	switch {
+	case flags&flagLZ4 != 0:
+		if err := lz4Decompress(value, stored); err != nil {
+			return nil, fmt.Errorf("%w: %v", errDecompress, err)
+		}
+	case flags&flagFlate != 0:
+		r := flateReaders.Get().(io.ReadCloser)
+		defer flateReaders.Put(r)
+		if err := r.(flate.Resetter).Reset(bytes.NewReader(stored), nil); err != nil {
+			return nil, fmt.Errorf("%w: %v", errDecompress, err)
+		}
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, fmt.Errorf("%w: %v", errDecompress, err)
+		}
+		// 元の長さより長いデータが続いていれば壊れている
+		if n, _ := r.Read(make([]byte, 1)); n != 0 {
+			return nil, fmt.Errorf("%w: longer than recorded length", errDecompress)
+		}
+	}
+	return dst, nil
+}
+
+// needsRecompress は Merge で c に圧縮し直すべきレコードかを判定します。
+// 無圧縮のレコードは値が threshold 以上の場合のみ対象です (圧縮しても小さくならない値は毎回対象になります)。
+func needsRecompress(h recordHeader, c Compression, threshold int) bool {
+	current := h.flags & (flagLZ4 | flagFlate)
+	// flagBlob のレコードの値は Blob File の位置 (値は Blob File に書いたときの方式のまま)
+	if h.isTombstone() || h.flags&flagBlob != 0 || current == c.flag() {
+		return false
+	}
+	if current != 0 {
+		return true
+	}
+	size := h.valueLen()
+	if h.hasExpiry() {
+		size -= expirySize
+	}
+	return size >= int64(threshold)
+}
+
+// recompressRecord はエンコード済みのレコードの値を c で圧縮し直したレコードを返します。
+// Timestamp・有効期限・その他のフラグは元のレコードのままです。
+func recompressRecord(data []byte, h recordHeader, c Compression, threshold int) ([]byte, error) {
+	key := data[recordHeaderSize : recordHeaderSize+h.keySize]
+	expiry, stored, err := splitExpiry(h, data[recordHeaderSize+h.keySize:])
+	if err != nil {
+		return nil, err
+	}
+	value, err := decompressValue(h.flags, stored)
+	if err != nil {
+		return nil, err
+	}
+	flags, stored := compressValue(c, threshold, value)
+	flags |= h.flags &^ (flagLZ4 | flagFlate | flagExpiry)
+	if h.hasExpiry() {
+		return appendRecordWithExpiry(nil, int64(h.timestamp), flags, key, stored, expiry), nil
+	}
+	return appendRecord(nil, int64(h.timestamp), flags, key, stored, false), nil
+}
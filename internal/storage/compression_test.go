@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLZ4RoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 5000)
+	rnd.Read(random)
+	inputs := map[string][]byte{
+		"empty":    {},
+		"short":    []byte("abc"),
+		"repeat":   bytes.Repeat([]byte("a"), 100000),
+		"json":     []byte(strings.Repeat(`{"id":12345,"name":"bitcask","tags":["kv","log"]},`, 200)),
+		"random":   random,
+		"mixed":    append(append([]byte(nil), random[:300]...), bytes.Repeat(random[:40], 50)...),
+		"boundary": []byte("0123456789abcdef0123456789abcdef"),
+	}
+	for name, src := range inputs {
+		compressed := lz4Compress(nil, src)
+		got := make([]byte, len(src))
+		if err := lz4Decompress(got, compressed); err != nil || !bytes.Equal(got, src) {
+			t.Errorf("%s: round trip failed: %v", name, err)
+		}
+	}
+	if c := lz4Compress(nil, inputs["json"]); len(c)*5 > len(inputs["json"]) {
+		t.Errorf("Expected JSON to compress at least 5x, got %d -> %d", len(inputs["json"]), len(c))
+	}
+
+	// 壊れたブロックや長さの不一致はエラーになる (パニックしない)
+	compressed := lz4Compress(nil, inputs["json"])
+	for i := range compressed {
+		bad := append([]byte(nil), compressed...)
+		bad[i] ^= 0xFF
+		_ = lz4Decompress(make([]byte, len(inputs["json"])), bad)
+	}
+	if err := lz4Decompress(make([]byte, len(inputs["json"])+1), compressed); !errors.Is(err, errLZ4Corrupt) {
+		t.Errorf("Expected errLZ4Corrupt for wrong length, got %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dbDir := "test_compression_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	big := []byte(strings.Repeat(`{"user":"alice","role":"admin","active":true},`, 100))
+	small := []byte(`{"user":"bob"}`)
+
+	opts := DefaultOptions()
+	opts.Compression = CompressionLZ4
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Put([]byte("big"), big)
+	_ = db.Put([]byte("small"), small)
+	_ = db.PutWithTTL([]byte("ttl"), big, time.Hour)
+	b := NewBatch()
+	b.Put([]byte("batch"), big)
+	b.Delete([]byte("small"))
+	if err := db.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Put([]byte("small"), small)
+	if st := db.Stats(); st.LiveBytes > int64(len(big)) {
+		t.Errorf("Expected compressed values, live bytes %d", st.LiveBytes)
+	}
+	for _, key := range []string{"big", "ttl", "batch"} {
+		if v, err := db.Get([]byte(key)); err != nil || !bytes.Equal(v, big) {
+			t.Errorf("Get %s failed: %v", key, err)
+		}
+	}
+	_ = db.Close()
+
+	flagsByKey := func() map[string][]string {
+		flags := make(map[string][]string)
+		ids, _ := listSegmentIDs(dbDir)
+		for _, id := range ids {
+			_ = WalkDataFile(filepath.Join(dbDir, fmt.Sprintf("%d.data", id)), func(r FileRecord) error {
+				if len(r.Key) > 0 && !r.Tombstone {
+					flags[string(r.Key)] = r.FlagNames()
+				}
+				return nil
+			})
+		}
+		return flags
+	}
+	flags := flagsByKey()
+	if fmt.Sprint(flags["big"]) != "[lz4]" || fmt.Sprint(flags["ttl"]) != "[expiry lz4]" || len(flags["small"]) != 0 {
+		t.Errorf("Unexpected record flags: %v", flags)
+	}
+
+	// 方式を変えても既存のレコードは読め、Merge で現在の方式へ圧縮し直す
+	opts.Compression = CompressionFlate
+	opts.MergeRecompress = true
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	_ = db.Put([]byte("new"), big)
+	if v, err := db.Get([]byte("big")); err != nil || !bytes.Equal(v, big) {
+		t.Errorf("Get big after switching codec failed: %v", err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	_ = db.Close()
+
+	flags = flagsByKey()
+	for _, key := range []string{"big", "batch", "new"} {
+		if fmt.Sprint(flags[key]) != "[flate]" {
+			t.Errorf("Expected %s to be recompressed with flate, got %v", key, flags[key])
+		}
+	}
+	if fmt.Sprint(flags["ttl"]) != "[expiry flate]" || len(flags["small"]) != 0 {
+		t.Errorf("Unexpected record flags after merge: %v", flags)
+	}
+
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen merged DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	for key, want := range map[string][]byte{"big": big, "ttl": big, "batch": big, "new": big, "small": small} {
+		if v, err := db.Get([]byte(key)); err != nil || !bytes.Equal(v, want) {
+			t.Errorf("Get %s after merge failed: %v", key, err)
+		}
+	}
+	if ttl, err := db.TTL([]byte("ttl")); err != nil || ttl <= 0 {
+		t.Errorf("Expected ttl to keep its expiry, got %v, %v", ttl, err)
+	}
+}
+
+// 展開して大きくなったレコードで出力セグメントが予約した ID を使い切っても、
+// マージ中のアクティブファイルを上書きしないことを確認する
+func TestMergeRecompressExpandsBeyondReservedOutputs(t *testing.T) {
+	dbDir := "test_merge_expand_dir"
+	_ = os.RemoveAll(dbDir)
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 4096
+	opts.Compression = CompressionFlate
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	value := bytes.Repeat([]byte("x"), 3000)
+	for i := 0; i < 50; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%02d", i)), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	_ = db.Close()
+
+	opts.Compression = CompressionNone
+	opts.MergeRecompress = true
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if err := db.Put([]byte("after"), []byte("merged")); err != nil {
+		t.Fatalf("Put after merge failed: %v", err)
+	}
+	_ = db.Close()
+
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen merged DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	if v, err := db.Get([]byte("after")); err != nil || string(v) != "merged" {
+		t.Errorf("Get after = %q, %v; want merged", v, err)
+	}
+	for i := 0; i < 50; i++ {
+		if v, err := db.Get([]byte(fmt.Sprintf("key%02d", i))); err != nil || !bytes.Equal(v, value) {
+			t.Errorf("Get key%02d after merge failed: %v", i, err)
+		}
+	}
+}
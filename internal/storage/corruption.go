@@ -0,0 +1,49 @@
+package storage
+
+import "fmt"
+
+// FileKind は破損を検出したファイルの種類です。
+type FileKind string
+
+const (
+	FileKindData FileKind = "data"
+	FileKindHint FileKind = "hint"
+	FileKindBlob FileKind = "blob"
+)
+
+// CorruptionError は破損したレコードの位置と内容を表します。
+// ErrDataCorruption を wrap しているので errors.Is(err, ErrDataCorruption) で判定でき、
+// 詳細は errors.As で取り出せます。
+type CorruptionError struct {
+	FileID int
+	Kind   FileKind
+	Offset int64 // 破損したレコード (Hint File の場合はエントリ) の位置
+	// ExpectedCRC は記録されている CRC、ActualCRC は内容から計算した CRC です。
+	// CRC 以外の理由 (Reason) の場合はどちらも 0 です。
+	ExpectedCRC uint32
+	ActualCRC   uint32
+	// Reason は CRC 不一致以外の破損の理由です (キーの不一致など)。
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("data corruption: %d.%s offset %d: %s", e.FileID, e.Kind, e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("data corruption: %d.%s offset %d: crc mismatch (expected %08x, actual %08x)",
+		e.FileID, e.Kind, e.Offset, e.ExpectedCRC, e.ActualCRC)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrDataCorruption
+}
+
+// crcError は CRC 不一致の CorruptionError を作成します。
+func crcError(kind FileKind, fileID int, offset int64, expected, actual uint32) *CorruptionError {
+	return &CorruptionError{FileID: fileID, Kind: kind, Offset: offset, ExpectedCRC: expected, ActualCRC: actual}
+}
+
+// corruptionError は CRC 以外の理由の CorruptionError を作成します。
+func corruptionError(kind FileKind, fileID int, offset int64, reason string) *CorruptionError {
+	return &CorruptionError{FileID: fileID, Kind: kind, Offset: offset, Reason: reason}
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCorruptionError(t *testing.T) {
+	dbDir := "test_corruption_error_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 100
+	opts.UseMmap = false
+
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	// 0.data: key1, key2, key3 (各 30 bytes) / 1.data: key4
+	_ = db.Put([]byte("key1"), []byte("value1"))
+	_ = db.Put([]byte("key2"), []byte("value2"))
+	_ = db.Put([]byte("key3"), []byte("value3"))
+	_ = db.Put([]byte("key4"), []byte("value4"))
+
+	// 開いたまま 0.data の key2 の値を壊す
+	corruptByte(t, filepath.Join(dbDir, "0.data"), fileHeaderSize+30+25)
+
+	var ce *CorruptionError
+	_, err = db.Get([]byte("key2"))
+	if !errors.Is(err, ErrDataCorruption) || !errors.As(err, &ce) {
+		t.Fatalf("Expected CorruptionError from Get, got %v", err)
+	}
+	if ce.FileID != 0 || ce.Kind != FileKindData || ce.Offset != fileHeaderSize+30 || ce.ExpectedCRC == ce.ActualCRC || ce.Reason != "" {
+		t.Errorf("Unexpected CorruptionError: %+v", ce)
+	}
+
+	// Merge も同じレコードで失敗する
+	err = db.Merge()
+	if !errors.As(err, &ce) || ce.FileID != 0 || ce.Offset != fileHeaderSize+30 {
+		t.Errorf("Expected CorruptionError from Merge, got %v", err)
+	}
+	_ = db.Close()
+
+	// 古いセグメントの破損はオープン時に位置付きで報告する
+	_, err = OpenWithOptions(dbDir, opts)
+	if !errors.As(err, &ce) || ce.FileID != 0 || ce.Offset != fileHeaderSize+30 || ce.Kind != FileKindData {
+		t.Errorf("Expected CorruptionError from open, got %v", err)
+	}
+}
+
+func TestCorruptionErrorHint(t *testing.T) {
+	dbDir := "test_corruption_error_hint_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Put([]byte("key1"), []byte("value1"))
+	_ = db.Put([]byte("key2"), []byte("value2"))
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	_ = db.Close()
+
+	hints, _ := filepath.Glob(filepath.Join(dbDir, "*.hint"))
+	if len(hints) != 1 {
+		t.Fatalf("Expected 1 hint file, got %v", hints)
+	}
+	// 2 番目のエントリ (ヘッダの後ろ 32 bytes 目から) のキーを壊す
+	corruptByte(t, hints[0], fileHeaderSize+32+hintHeaderSize)
+
+	var ce *CorruptionError
+	_, err = NewDB(dbDir)
+	if !errors.Is(err, ErrDataCorruption) || !errors.As(err, &ce) {
+		t.Fatalf("Expected CorruptionError from hint load, got %v", err)
+	}
+	if ce.Kind != FileKindHint || ce.Offset != fileHeaderSize+32 || ce.ExpectedCRC == ce.ActualCRC {
+		t.Errorf("Unexpected CorruptionError: %+v", ce)
+	}
+}
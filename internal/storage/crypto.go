@@ -0,0 +1,482 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 暗号化されたファイル (ヘッダに fileFlagEncrypted) のレコードは、Key と Value を AES-256-GCM で暗号化します。
+//
+//	[CRC(4)][Timestamp(8)][KeySize(4)][ValueSize(4)][暗号化した Key + Value][Tag(16)]
+//
+// KeySize / ValueSize は平文の長さで、レコードフラグに flagEncrypted を立てます。Timestamp から ValueSize までは
+// 追加認証データとして改ざんを検出します。CRC は暗号文に対して計算するため、Verify は鍵なしで破損を検出できます。
+// 圧縮する場合は圧縮してから暗号化します。
+//
+// 鍵はファイルごとに、KeyProvider の鍵とファイルの種類・ID・作成時刻から HMAC-SHA256 で導出します。
+// nonce はファイル ID とファイル内のレコードの位置から作るため、1 つのレコードだけを読んで復号できます
+// (MmapReader からの Get もそのまま動きます)。同じファイルの同じ位置に別のレコードを書くと nonce が
+// 再利用されてしまうため、暗号化した DB はオープン時に既存のセグメントへ追記せず、新しいセグメントを作成します。
+//
+// Hint File はエントリの Key だけを同様に暗号化します (Timestamp から有効期限までが追加認証データ)。
+// Merge は出力を常に KeyProvider.CurrentKey の鍵で書くため、鍵のローテーションは Merge で進みます。
+// 古い鍵は、その鍵で書いたセグメントが Merge で書き直されるまで KeyProvider から返す必要があります。
+
+// gcmTagSize は暗号化によってレコード (Hint File のエントリ) ごとに増えるサイズです。
+const gcmTagSize = 16
+
+// minKeySize は KeyProvider が返す鍵の最小の長さです。
+const minKeySize = 16
+
+var (
+	// ErrKeyProviderRequired は Options.KeyProvider を指定せずに暗号化されたファイルを開こうとした場合のエラーです。
+	ErrKeyProviderRequired = errors.New("encrypted file requires a KeyProvider")
+	// ErrUnknownKey は KeyProvider が鍵の ID を知らない場合のエラーです。
+	ErrUnknownKey = errors.New("unknown encryption key")
+
+	errDecrypt = errors.New("cannot decrypt record: authentication failed")
+)
+
+// KeyProvider は暗号化の鍵を提供します。鍵は minKeySize (16) バイト以上のランダムな値にしてください。
+type KeyProvider interface {
+	// CurrentKey は新しく作成するファイルの暗号化に使う鍵と、その ID を返します。
+	// ID はファイルヘッダに記録され、読み込み時に Key に渡されます。
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key は ID の鍵を返します。
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeyProvider は固定の鍵の一覧を持つ KeyProvider です。
+type StaticKeyProvider struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+// NewStaticKeyProvider は keys を持ち、current の鍵で暗号化する KeyProvider を作成します。
+func NewStaticKeyProvider(current uint32, keys map[uint32][]byte) (*StaticKeyProvider, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("%w: current key %d", ErrUnknownKey, current)
+	}
+	p := &StaticKeyProvider{current: current, keys: make(map[uint32][]byte, len(keys))}
+	for id, key := range keys {
+		if len(key) < minKeySize {
+			return nil, fmt.Errorf("encryption key %d must be at least %d bytes, got %d", id, minKeySize, len(key))
+		}
+		p.keys[id] = append([]byte(nil), key...)
+	}
+	return p, nil
+}
+
+// CurrentKey は current の鍵を返します。
+func (p *StaticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+// Key は ID の鍵を返します。
+func (p *StaticKeyProvider) Key(id uint32) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// LoadKeyFile は鍵ファイルを読み込みます。鍵ファイルは 1 行に 1 つ "<ID> <16 進数の鍵>" を書いたテキストで、
+// 空行と # で始まる行は無視します。ID が最大の鍵で暗号化し、それ以外の鍵は読み込みにだけ使います
+// (鍵をローテーションするには、大きな ID の鍵を追加してから Merge します)。
+func LoadKeyFile(path string) (*StaticKeyProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	keys := make(map[uint32][]byte)
+	var current uint32
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"<id> <hex key>\"", path, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key id: %v", path, line, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key: %v", path, line, err)
+		}
+		if _, dup := keys[uint32(id)]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate key id %d", path, line, id)
+		}
+		keys[uint32(id)] = key
+		current = max(current, uint32(id))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return NewStaticKeyProvider(current, keys)
+}
+
+// fileCipher は 1 つのファイルの暗号です。
+type fileCipher struct {
+	aead   cipher.AEAD
+	block  cipher.Block // aead の AES (recordSealer が使う)
+	fileID int
+}
+
+// newFileCipher は key と h (ファイルの種類・ID・作成時刻) からファイルの鍵を導出します。
+func newFileCipher(key []byte, h FileHeader) (*fileCipher, error) {
+	if len(key) < minKeySize {
+		return nil, fmt.Errorf("encryption key %d must be at least %d bytes, got %d", h.KeyID, minKeySize, len(key))
+	}
+	var info [13]byte
+	info[0] = fileKindCodes[h.Kind]
+	binary.BigEndian.PutUint32(info[1:5], uint32(h.FileID))
+	binary.BigEndian.PutUint64(info[5:13], uint64(h.CreatedAt))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("bitcask file key"))
+	mac.Write(info[:])
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &fileCipher{aead: aead, block: block, fileID: h.FileID}, nil
+}
+
+// openFileCipher はヘッダが暗号化を示すファイルの暗号を keys の鍵から作成します。
+// 暗号化されていないファイルは nil を返します。
+func openFileCipher(keys KeyProvider, h FileHeader) (*fileCipher, error) {
+	if !h.Encrypted {
+		return nil, nil
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("%w: %d.%s", ErrKeyProviderRequired, h.FileID, h.Kind)
+	}
+	key, err := keys.Key(h.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("%d.%s: %w", h.FileID, h.Kind, err)
+	}
+	return newFileCipher(key, h)
+}
+
+// createFileHeader は新しく作成するファイルのヘッダをエンコードします。
+// keys が nil でなければ現在の鍵で暗号化するファイルとし、その暗号も返します。
+func createFileHeader(kind FileKind, fileID int, keys KeyProvider) ([]byte, *fileCipher, error) {
+	if keys == nil {
+		return appendFileHeader(nil, kind, fileID, false, 0), nil, nil
+	}
+	keyID, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	buf := appendFileHeader(nil, kind, fileID, true, keyID)
+	h, err := decodeFileHeader(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := newFileCipher(key, h)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, c, nil
+}
+
+// nonce はファイル内の offset の位置のレコード (エントリ) の nonce です。
+func (c *fileCipher) nonce(offset int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[0:4], uint32(c.fileID))
+	binary.BigEndian.PutUint64(nonce[4:12], uint64(offset))
+	return nonce
+}
+
+// sealRecord は平文のレコード plain を、ファイルの offset の位置に書き込むレコードとして暗号化します。
+func (c *fileCipher) sealRecord(plain []byte, offset int64) []byte {
+	var header [recordHeaderSize]byte
+	copy(header[:], plain[:recordHeaderSize])
+	rawKeySize := binary.BigEndian.Uint32(header[12:16])
+	binary.BigEndian.PutUint32(header[12:16], rawKeySize|uint32(flagEncrypted)<<24)
+
+	rec := make([]byte, recordHeaderSize, len(plain)+gcmTagSize)
+	copy(rec, header[:])
+	rec = c.aead.Seal(rec, c.nonce(offset), plain[recordHeaderSize:], header[4:])
+	binary.BigEndian.PutUint32(rec[0:4], crc32.ChecksumIEEE(rec[4:]))
+	return rec
+}
+
+// openRecord は offset の位置の暗号化されたレコード rec を復号し、Key + Value の平文を返します。
+func (c *fileCipher) openRecord(rec []byte, offset int64) ([]byte, error) {
+	body, err := c.aead.Open(nil, c.nonce(offset), rec[recordHeaderSize:], rec[4:recordHeaderSize])
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return body, nil
+}
+
+// decryptRecord は offset の位置の暗号化されたレコード rec を、同じ内容の平文のレコードに戻します
+// (flagEncrypted を外し、CRC を計算し直します)。Merge と Repair が書き直す際に使います。
+func (c *fileCipher) decryptRecord(rec []byte, offset int64) ([]byte, error) {
+	body, err := c.openRecord(rec, offset)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, recordHeaderSize, recordHeaderSize+len(body))
+	copy(plain, rec[:recordHeaderSize])
+	rawKeySize := binary.BigEndian.Uint32(plain[12:16])
+	binary.BigEndian.PutUint32(plain[12:16], rawKeySize&^(uint32(flagEncrypted)<<24))
+	plain = append(plain, body...)
+	binary.BigEndian.PutUint32(plain[0:4], crc32.ChecksumIEEE(plain[4:]))
+	return plain, nil
+}
+
+// plainHeader は暗号化されたレコードのヘッダ h を、復号した Key + Value (body) から成る平文のレコードのヘッダに戻します
+// (decryptRecord が返すレコードのヘッダと同じです)。
+func plainHeader(h recordHeader, body []byte) recordHeader {
+	h.flags &^= flagEncrypted
+	var header [recordHeaderSize]byte
+	binary.BigEndian.PutUint64(header[4:12], h.timestamp)
+	binary.BigEndian.PutUint32(header[12:16], uint32(h.flags)<<24|h.keySize)
+	binary.BigEndian.PutUint32(header[16:20], h.valueSize)
+	h.crc = crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, body)
+	return h
+}
+
+// recordBody はデータファイルの offset の位置のレコード rec の Key + Value を返します。
+// 暗号化されたレコードは c (rec を含むファイルの暗号。暗号化されていないファイルは nil) で復号します。
+// CRC は検証済みである必要があります。
+func recordBody(c *fileCipher, kind FileKind, fileID int, h recordHeader, rec []byte, offset int64) ([]byte, error) {
+	if h.flags&flagEncrypted == 0 {
+		return rec[recordHeaderSize:], nil
+	}
+	if c == nil {
+		return nil, corruptionError(kind, fileID, offset, "encrypted record in an unencrypted file")
+	}
+	body, err := c.openRecord(rec, offset)
+	if err != nil {
+		return nil, corruptionError(kind, fileID, offset, err.Error())
+	}
+	return body, nil
+}
+
+// sealHintEntry は Hint File の offset の位置に書き込むエントリ (appendHintRecord で Key を平文のまま
+// エンコードしたもの) の Key を暗号化します。
+func (c *fileCipher) sealHintEntry(entry []byte, offset int64) []byte {
+	keyStart := len(entry) - int(binary.BigEndian.Uint32(entry[12:16])&keySizeMask)
+	sealed := make([]byte, keyStart, len(entry)+gcmTagSize)
+	copy(sealed, entry[:keyStart])
+	sealed = c.aead.Seal(sealed, c.nonce(offset), entry[keyStart:], entry[4:keyStart])
+	binary.BigEndian.PutUint32(sealed[0:4], crc32.ChecksumIEEE(sealed[4:]))
+	return sealed
+}
+
+// openHintKey は Hint File の offset の位置のエントリの Key を復号します。
+// prefix は Key より前 (CRC から有効期限まで)、sealed は暗号化された Key です。
+func (c *fileCipher) openHintKey(prefix, sealed []byte, offset int64) ([]byte, error) {
+	key, err := c.aead.Open(nil, c.nonce(offset), sealed, prefix[4:])
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return key, nil
+}
+
+// recordSealer は sealRecord と同じ暗号文を、Key + Value の平文を少しずつ受け取りながら作る io.Writer です。
+// PutStream が値全体をメモリに読み込まずに暗号化するために使います。
+// crypto/cipher の AEAD は平文全体を一度に受け取るため、AES-GCM の CTR と GHASH をここで順に計算します
+// (値は 4GB 未満 (checkEntrySizes) なので、32 ビットのカウンタは桁あふれしません)。
+type recordSealer struct {
+	w       io.Writer
+	ctr     cipher.Stream
+	hash    ghash
+	tagMask [gcmBlockSize]byte
+	n       int64 // 暗号文の長さ
+	buf     []byte
+}
+
+// newRecordSealer は offset の位置に書き込むヘッダ header (CRC を除く部分が追加認証データ) のレコードの
+// Key + Value を暗号化して w に書き込む recordSealer を作成します。最後に tag で認証タグを取り出します。
+func (c *fileCipher) newRecordSealer(w io.Writer, header []byte, offset int64) *recordSealer {
+	var h [gcmBlockSize]byte
+	c.block.Encrypt(h[:], h[:])
+	s := &recordSealer{w: w, hash: newGHash(h[:])}
+
+	// nonce が 12 バイトの場合、カウンタの初期値は nonce || 1 で、その暗号化がタグのマスクになる
+	var counter [gcmBlockSize]byte
+	copy(counter[:], c.nonce(offset))
+	counter[gcmBlockSize-1] = 1
+	c.block.Encrypt(s.tagMask[:], counter[:])
+	counter[gcmBlockSize-1] = 2
+	s.ctr = cipher.NewCTR(c.block, counter[:])
+
+	s.hash.write(header[4:recordHeaderSize])
+	s.hash.pad()
+	return s
+}
+
+// Write は平文 p を暗号化して書き込みます。
+func (s *recordSealer) Write(p []byte) (int, error) {
+	if cap(s.buf) < len(p) {
+		s.buf = make([]byte, len(p))
+	}
+	out := s.buf[:len(p)]
+	s.ctr.XORKeyStream(out, p)
+	s.hash.write(out)
+	s.n += int64(len(out))
+	if _, err := s.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// tag は書き込んだ暗号文の認証タグを返します。
+func (s *recordSealer) tag() []byte {
+	s.hash.pad()
+	var lengths [gcmBlockSize]byte
+	binary.BigEndian.PutUint64(lengths[0:8], uint64(recordHeaderSize-4)*8)
+	binary.BigEndian.PutUint64(lengths[8:16], uint64(s.n)*8)
+	s.hash.write(lengths[:])
+	sum := s.hash.sum()
+	for i := range sum {
+		sum[i] ^= s.tagMask[i]
+	}
+	return sum[:]
+}
+
+// gcmBlockSize は AES と GHASH のブロックサイズです。
+const gcmBlockSize = 16
+
+// gcmElement は GF(2^128) の元です (GCM のビット順で、low が先頭の 64 ビット)。
+type gcmElement struct {
+	low, high uint64
+}
+
+// ghash は AES-GCM の GHASH を 4 ビットずつの表引きで計算します。
+type ghash struct {
+	table [16]gcmElement // H の倍数 (添え字はビットを反転した 4 ビットの値)
+	y     gcmElement
+	buf   [gcmBlockSize]byte
+	nbuf  int
+}
+
+func newGHash(h []byte) ghash {
+	var g ghash
+	x := gcmElement{binary.BigEndian.Uint64(h[:8]), binary.BigEndian.Uint64(h[8:])}
+	g.table[reverseBits4(1)] = x
+	for i := 2; i < 16; i += 2 {
+		g.table[reverseBits4(i)] = g.table[reverseBits4(i/2)].double()
+		d := g.table[reverseBits4(i)]
+		g.table[reverseBits4(i+1)] = gcmElement{d.low ^ x.low, d.high ^ x.high}
+	}
+	return g
+}
+
+// reverseBits4 は 4 ビットの値のビットの順序を反転します。
+func reverseBits4(i int) int {
+	i = ((i << 2) & 0xc) | ((i >> 2) & 0x3)
+	i = ((i << 1) & 0xa) | ((i >> 1) & 0x5)
+	return i
+}
+
+// double は x に GCM の多項式の x を掛けた値を返します。
+func (x gcmElement) double() gcmElement {
+	d := gcmElement{low: x.low >> 1, high: x.high>>1 | x.low<<63}
+	if x.high&1 == 1 {
+		d.low ^= 0xe100000000000000
+	}
+	return d
+}
+
+// gcmReduction は 4 ビットずらしたときにあふれたビットを還元する値の表です。
+var gcmReduction = [16]uint16{
+	0x0000, 0x1c20, 0x3840, 0x2460, 0x7080, 0x6ca0, 0x48c0, 0x54e0,
+	0xe100, 0xfd20, 0xd940, 0xc560, 0x9180, 0x8da0, 0xa9c0, 0xb5e0,
+}
+
+// mul は y に H を掛けます。
+func (g *ghash) mul(y *gcmElement) {
+	var z gcmElement
+	for i := 0; i < 2; i++ {
+		word := y.high
+		if i == 1 {
+			word = y.low
+		}
+		for j := 0; j < 64; j += 4 {
+			msw := z.high & 0xf
+			z.high = z.high>>4 | z.low<<60
+			z.low = z.low>>4 ^ uint64(gcmReduction[msw])<<48
+			t := &g.table[word&0xf]
+			z.low ^= t.low
+			z.high ^= t.high
+			word >>= 4
+		}
+	}
+	*y = z
+}
+
+// block は 1 ブロックを GHASH に加えます。
+func (g *ghash) block(b []byte) {
+	g.y.low ^= binary.BigEndian.Uint64(b[:8])
+	g.y.high ^= binary.BigEndian.Uint64(b[8:])
+	g.mul(&g.y)
+}
+
+// write は p を GHASH に加えます。ブロックに満たない末尾は次の write か pad まで保持します。
+func (g *ghash) write(p []byte) {
+	if g.nbuf > 0 {
+		n := copy(g.buf[g.nbuf:], p)
+		g.nbuf += n
+		p = p[n:]
+		if g.nbuf < gcmBlockSize {
+			return
+		}
+		g.block(g.buf[:])
+		g.nbuf = 0
+	}
+	for len(p) >= gcmBlockSize {
+		g.block(p[:gcmBlockSize])
+		p = p[gcmBlockSize:]
+	}
+	g.nbuf = copy(g.buf[:], p)
+}
+
+// pad は保持している末尾をゼロで埋めて GHASH に加えます (追加認証データと暗号文の区切り)。
+func (g *ghash) pad() {
+	if g.nbuf == 0 {
+		return
+	}
+	clear(g.buf[g.nbuf:])
+	g.block(g.buf[:])
+	g.nbuf = 0
+}
+
+// sum は現在の GHASH の値を返します。
+func (g *ghash) sum() [gcmBlockSize]byte {
+	var out [gcmBlockSize]byte
+	binary.BigEndian.PutUint64(out[:8], g.y.low)
+	binary.BigEndian.PutUint64(out[8:], g.y.high)
+	return out
+}
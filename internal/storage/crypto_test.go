@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKeys(t *testing.T, current uint32, ids ...uint32) *StaticKeyProvider {
+	t.Helper()
+	keys := make(map[uint32][]byte)
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte{byte(id)}, 32)
+	}
+	p, err := NewStaticKeyProvider(current, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// checkNoPlaintext はディレクトリ内のどのファイルにも secret が平文で含まれていないことを確認します。
+func checkNoPlaintext(t *testing.T, dir string, secrets ...string) {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.*"))
+	for _, path := range files {
+		data, _ := os.ReadFile(path)
+		for _, secret := range secrets {
+			if bytes.Contains(data, []byte(secret)) {
+				t.Errorf("Found plaintext %q in %s", secret, filepath.Base(path))
+			}
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dbDir := "test_encryption_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	big := strings.Repeat("confidential-value;", 30)
+	opts := DefaultOptions()
+	opts.KeyProvider = testKeys(t, 1, 1)
+	opts.Compression = CompressionLZ4
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Put([]byte("alice@example.com"), []byte("secret-value-1"))
+	_ = db.Put([]byte("bob@example.com"), []byte(big))
+	_ = db.PutWithTTL([]byte("carol@example.com"), []byte("secret-value-3"), time.Hour)
+	b := NewBatch()
+	b.Put([]byte("dave@example.com"), []byte("secret-value-4"))
+	b.Delete([]byte("alice@example.com"))
+	if err := db.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get([]byte("bob@example.com")); err != nil || string(v) != big {
+		t.Errorf("Get from encrypted active file failed: %v", err)
+	}
+	_ = db.Close()
+	checkNoPlaintext(t, dbDir, "example.com", "secret-value", "confidential")
+
+	if _, err := NewDB(dbDir); !errors.Is(err, ErrKeyProviderRequired) {
+		t.Errorf("Expected ErrKeyProviderRequired, got %v", err)
+	}
+
+	want := map[string]string{"bob@example.com": big, "carol@example.com": "secret-value-3", "dave@example.com": "secret-value-4"}
+	check := func(db *DB, stage string) {
+		t.Helper()
+		for key, value := range want {
+			if v, err := db.Get([]byte(key)); err != nil || string(v) != value {
+				t.Errorf("%s: Get %s = %q, %v", stage, key, v, err)
+			}
+		}
+		if _, err := db.Get([]byte("alice@example.com")); err != ErrKeyNotFound {
+			t.Errorf("%s: expected alice to stay deleted, got %v", stage, err)
+		}
+		if ttl, err := db.TTL([]byte("carol@example.com")); err != nil || ttl <= 0 {
+			t.Errorf("%s: expected carol to keep its expiry, got %v, %v", stage, ttl, err)
+		}
+	}
+
+	// 再オープンでは既存のセグメントに追記しない (同じ位置に同じ鍵で書かない)
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	check(db, "reopen")
+	if db.activeFileID != 1 {
+		t.Errorf("Expected a new active segment 1, got %d", db.activeFileID)
+	}
+	_ = db.Put([]byte("erin@example.com"), []byte("secret-value-5"))
+	want["erin@example.com"] = "secret-value-5"
+
+	// 鍵のローテーション: 新しい鍵を追加して Merge すると全セグメントが新しい鍵で書き直される
+	_ = db.Close()
+	opts.KeyProvider = testKeys(t, 2, 1, 2)
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB with rotated key: %v", err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	check(db, "merge")
+	_ = db.Close()
+	checkNoPlaintext(t, dbDir, "example.com", "secret-value", "confidential")
+
+	files, _ := filepath.Glob(filepath.Join(dbDir, "*.*"))
+	for _, path := range files {
+		if ext := filepath.Ext(path); ext != ".data" && ext != ".hint" {
+			continue
+		}
+		if h, err := ReadFileHeader(path); err != nil || !h.Encrypted || h.KeyID != 2 {
+			t.Errorf("Expected %s to be encrypted with key 2, got %+v, %v", filepath.Base(path), h, err)
+		}
+	}
+
+	// 古い鍵が無くても開ける (Hint File から読み込む)
+	opts.KeyProvider = testKeys(t, 2, 2)
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB without the old key: %v", err)
+	}
+	check(db, "rotated")
+	_ = db.Close()
+
+	report, err := Verify(dbDir)
+	if err != nil || !report.OK() || report.Records != len(want) {
+		t.Errorf("Expected clean report, got %+v, %v", report, err)
+	}
+	if _, err := Repair(dbDir, nil); !errors.Is(err, ErrKeyProviderRequired) {
+		t.Errorf("Expected Repair without keys to fail, got %v", err)
+	}
+	if repair, err := Repair(dbDir, opts.KeyProvider); err != nil || repair.Keys != len(want) {
+		t.Fatalf("Repair failed: %+v, %v", repair, err)
+	}
+	opts.LoadHintFiles = false
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen repaired DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	check(db, "repair")
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	dbDir := "test_encryption_wrong_key_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.KeyProvider = testKeys(t, 1, 1)
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Put([]byte("key1"), []byte("value1"))
+	_ = db.Close()
+	path := filepath.Join(dbDir, "0.data")
+	info, _ := os.Stat(path)
+
+	wrong, _ := NewStaticKeyProvider(1, map[uint32][]byte{1: bytes.Repeat([]byte{9}, 32)})
+	opts.KeyProvider = wrong
+	if _, err := OpenWithOptions(dbDir, opts); !errors.Is(err, ErrDataCorruption) {
+		t.Errorf("Expected ErrDataCorruption for a wrong key, got %v", err)
+	}
+	// 復号できないレコードは書きかけではないので切り詰めない
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Errorf("Expected %s to be left untouched, size %d -> %d", path, info.Size(), after.Size())
+	}
+
+	opts.KeyProvider = testKeys(t, 2, 2)
+	if _, err := OpenWithOptions(dbDir, opts); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	dir := "test_key_file_dir"
+	defer func() { _ = os.RemoveAll(dir) }()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "keys")
+	content := fmt.Sprintf("# keys\n1 %x\n\n3 %x\n", bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{3}, 16))
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatalf("LoadKeyFile failed: %v", err)
+	}
+	if id, key, _ := p.CurrentKey(); id != 3 || len(key) != 16 {
+		t.Errorf("Expected current key 3, got %d (%d bytes)", id, len(key))
+	}
+	if _, err := p.Key(2); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey, got %v", err)
+	}
+
+	for name, bad := range map[string]string{
+		"short key": "1 0011\n",
+		"not hex":   "1 zz\n",
+		"no id":     fmt.Sprintf("%x\n", bytes.Repeat([]byte{1}, 32)),
+		"duplicate": fmt.Sprintf("1 %x\n1 %x\n", bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)),
+		"empty":     "# nothing\n",
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadKeyFile(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// recordSealer は平文を分けて受け取っても sealRecord と同じレコードを作る
+func TestRecordSealerMatchesSealRecord(t *testing.T) {
+	_, c, err := createFileHeader(FileKindData, 7, testKeys(t, 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, 15, 16, 17, 1000, 70000} {
+		value := bytes.Repeat([]byte("0123456789abcdefg"), size/17+1)[:size]
+		plain := appendRecord(nil, time.Now().UnixNano(), 0, []byte("key"), value, false)
+		want := c.sealRecord(plain, 4096)
+
+		var buf bytes.Buffer
+		s := c.newRecordSealer(&buf, want[:recordHeaderSize], 4096)
+		body := plain[recordHeaderSize:]
+		for len(body) > 0 {
+			n := min(len(body), 7+len(body)%13)
+			if _, err := s.Write(body[:n]); err != nil {
+				t.Fatal(err)
+			}
+			body = body[n:]
+		}
+		buf.Write(s.tag())
+		if !bytes.Equal(buf.Bytes(), want[recordHeaderSize:]) {
+			t.Errorf("size %d: streamed ciphertext differs from sealRecord", size)
+		}
+	}
+}
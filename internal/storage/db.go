@@ -9,10 +9,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,70 +18,167 @@ var (
 	ErrKeyNotFound      = errors.New("key not found")
 	ErrDataCorruption   = errors.New("data corruption: crc mismatch")
 	ErrCompactionNotImp = errors.New("compaction not implemented for segmented mode")
-)
-
-var (
-	MaxFileSize = int64(10 * 1024 * 1024) // 10MB (var for testing)
-)
-
-const (
-	tombstoneValueSize = ^uint32(0) // MaxUint32
+	ErrReadOnly         = errors.New("database is opened in read-only mode")
+	ErrKeyTooLarge      = errors.New("key too large")
+	ErrValueTooLarge    = errors.New("value too large")
+	ErrClosed           = errors.New("database closed")
+	ErrInvalidTTL       = errors.New("ttl must be positive")
 )
 
 // RecordPos はファイル内でのレコードの位置情報を保持します。
 type RecordPos struct {
 	FileID int
 	Offset int64
+	Size   int64   // ヘッダを含むレコード全体のサイズ
+	Expiry int64   // 有効期限 (UnixNano)。0 なら無期限
+	Blob   BlobPos // 値を Blob File に分離したレコードの値の位置 (分離していなければゼロ値)
+}
+
+// expired は now (UnixNano) の時点で有効期限が切れているかを返します。
+func (p RecordPos) expired(now int64) bool {
+	return p.Expiry != 0 && now >= p.Expiry
 }
 
 // DB は Bitcask モデルの簡易的な KVS エンジンです。
 type DB struct {
 	mu           sync.RWMutex
 	dirPath      string
+	lock         *dirLock // LOCK ファイルの flock (Close で解放)
 	activeFile   *os.File
+	activeSeg    *segment          // activeFile の読み取りハンドル
+	activeMap    *ActiveMmapReader // Options.UseMmap の場合の activeSeg の Reader (それ以外は nil)
 	activeFileID int
-	olderFiles   map[int]Reader // Changed to Reader interface (DiskReader or MmapReader)
-	keyDir       map[string]RecordPos
+	olderFiles   map[int]*segment // 不変セグメント (DiskReader or MmapReader)
+	keyDir       *keyIndex
 	writeOffset  int64
+	opts         Options
+	recovered    []TruncatedTail // オープン時に切り詰めたセグメント末尾
+	closed       bool
+
+	// 値を書き込み中の PutStream の予約 (キーごとに予約した順。stream.go を参照)
+	streams        map[string][]*streamReservation
+	mergeInputs    map[int]*segment // 実行中の Merge の入力セグメント (ここに予約したレコードは確定できない)
+	unfinishedTail bool             // オープン時に、最新のセグメントに書き終えられなかった PutStream のレコードがあった
+
+	// 読み取り側に公開したスナップショット (Get は d.mu を取らずにこれを読む)。閉じた DB では nil
+	view    atomic.Pointer[readView]
+	recent  *recentIndex // view と共有する、現在のエポックの変更の記録 (recordKey が追記する)
+	viewSeq uint64       // 最後に公開した操作の番号
+	retired []*segment   // 次の公開の後で参照を解放するセグメント
+
+	// 断片化の計測 (セグメントごとの値と、その合計)
+	segStats map[int]*segmentStats
+	stats    segmentStats
+
+	// Blob File (Options.BlobThreshold 以上の値を分離して書き込むファイル)
+	blobFiles  map[int]*segment // 不変の Blob File
+	blobFile   *os.File         // 書き込み中の Blob File (最初の書き込みで作成する。無ければ nil)
+	blobSeg    *segment         // blobFile の読み取りハンドル
+	blobFileID int
+	blobOffset int64
+	nextBlobID int
+	blobLive   map[int]*segmentStats // Blob File ごとの有効データ量 (liveBytes / liveKeys のみ使う)
+
+	mergeMu      sync.Mutex    // Merge を直列化する
+	mergeTrigger chan struct{} // MergeInBackground: 閾値超過をバックグラウンドの Merge に通知する
+
+	// 永続化 (fsync) の管理
+	writeSeq      uint64 // 追記したレコードの通し番号
+	unsyncedBytes int64  // SyncByBytes 用: 前回 fsync 以降の書き込み量
+	commit        *groupCommit
+	closeCh       chan struct{}
+	bgWG          sync.WaitGroup
 }
 
-// NewDB は指定されたディレクトリパスでデータベースを開きます。
+// NewDB は指定されたディレクトリパスでデータベースをデフォルト設定で開きます。
 func NewDB(dirPath string) (*DB, error) {
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
+	return OpenWithOptions(dirPath, DefaultOptions())
+}
+
+// OpenWithOptions は指定されたオプションでデータベースを開きます。
+// オプションは事前に検証され、前回オープン時から互換性に影響する変更があれば警告します。
+func OpenWithOptions(dirPath string, opts Options) (*DB, error) {
+	if err := opts.validate(); err != nil {
 		return nil, err
 	}
 
-	entries, err := os.ReadDir(dirPath)
-	if err != nil {
+	if opts.ReadOnly {
+		// Read-only ではディレクトリを作成しない
+		if _, err := os.Stat(dirPath); err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(dirPath, 0755); err != nil {
 		return nil, err
 	}
 
-	var fileIDs []int
-	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".data") {
-			name := strings.TrimSuffix(entry.Name(), ".data")
-			id, err := strconv.Atoi(name)
-			if err == nil {
-				fileIDs = append(fileIDs, id)
-			}
+	// 他のプロセスと同時に開かないようにディレクトリをロックする (read-only は共有ロック)
+	var lock *dirLock
+	if !opts.NoLock {
+		var err error
+		if lock, err = acquireDirLock(dirPath, opts.ReadOnly); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkPersistedOptions(dirPath, opts); err != nil {
+		_ = lock.release()
+		return nil, err
+	}
+
+	// 前回クラッシュした Merge の後始末 (完了または破棄)
+	if err := recoverMerge(dirPath, opts.ReadOnly); err != nil {
+		_ = lock.release()
+		return nil, err
+	}
+	if !opts.ReadOnly {
+		if err := removeStreamTempFiles(dirPath); err != nil {
+			_ = lock.release()
+			return nil, err
 		}
 	}
-	sort.Ints(fileIDs)
+
+	fileIDs, err := listSegmentIDs(dirPath)
+	if err != nil {
+		_ = lock.release()
+		return nil, err
+	}
 
 	db := &DB{
 		dirPath:    dirPath,
-		olderFiles: make(map[int]Reader),
-		keyDir:     make(map[string]RecordPos),
+		lock:       lock,
+		olderFiles: make(map[int]*segment),
+		keyDir:     newKeyIndex(),
+		segStats:   make(map[int]*segmentStats),
+		blobFiles:  make(map[int]*segment),
+		blobLive:   make(map[int]*segmentStats),
+		opts:       opts,
+		commit:     newGroupCommit(),
+		closeCh:    make(chan struct{}),
 	}
 
 	// 全ファイルをロードしてインデックス構築 (Mmapとしてロードされる)
-	for _, id := range fileIDs {
-		if err := db.loadFile(id); err != nil {
-			_ = db.Close()
-			return nil, err
+	for i, id := range fileIDs {
+		if err := db.loadFile(id, i == len(fileIDs)-1); err != nil {
+			// 最新セグメントの書きかけ末尾は切り詰めて復旧する
+			if err := db.recoverBadRecord(err, i == len(fileIDs)-1); err != nil {
+				_ = db.Close()
+				return nil, err
+			}
 		}
 	}
 
+	// Blob File は追記せずに読むだけなので、すべて不変のファイルとして開く
+	if err := db.loadBlobFiles(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	// Read-only では全ファイルを不変セグメントとして扱い、アクティブファイルを持たない
+	if opts.ReadOnly {
+		db.publishSegmentsLocked()
+		return db, nil
+	}
+
 	// アクティブファイルの設定
 	if len(fileIDs) == 0 {
 		// 新規作成
@@ -94,53 +189,186 @@ func NewDB(dirPath string) (*DB, error) {
 	} else {
 		// 最後のファイルをアクティブにする
 		lastID := fileIDs[len(fileIDs)-1]
-
-		// olderFilesから取り出し、クローズする (Mmap -> Disk への切り替え)
-		if reader, ok := db.olderFiles[lastID]; ok {
-			_ = reader.Close()
-			delete(db.olderFiles, lastID)
+		if opts.KeyProvider != nil {
+			err = db.openEncryptedActiveFile(lastID)
+		} else if db.unfinishedTail {
+			// read-only の DB が書き終えられなかったレコードで走査を止めないよう、その後ろには追記しない
+			err = db.newActiveFile(lastID + 1)
+		} else {
+			err = db.reopenActiveFile(lastID)
 		}
-
-		// Active Fileとして再オープン (RW/Append)
-		path := filepath.Join(db.dirPath, fmt.Sprintf("%d.data", lastID))
-		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
 			_ = db.Close()
 			return nil, err
 		}
+	}
+	db.publishSegmentsLocked()
 
-		db.activeFile = file
-		db.activeFileID = lastID
+	if opts.SyncPolicy == SyncPeriodic {
+		db.bgWG.Add(1)
+		go db.syncLoop(opts.SyncInterval)
+	}
+	if opts.MergeInBackground {
+		db.mergeTrigger = make(chan struct{}, 1)
+		db.bgWG.Add(1)
+		go db.mergeLoop(opts.MergeCheckInterval)
+	}
 
-		info, err := file.Stat()
-		if err != nil {
-			_ = db.Close()
-			return nil, err
+	return db, nil
+}
+
+// reopenActiveFile は最新のセグメント id をアクティブファイルとして開き直し、末尾に追記を続けます。
+func (d *DB) reopenActiveFile(id int) error {
+	// olderFilesから取り出し、クローズする (Mmap -> Disk への切り替え)
+	var header FileHeader
+	var cipher *fileCipher
+	if seg, ok := d.olderFiles[id]; ok {
+		header, cipher = seg.header, seg.cipher
+		_ = seg.release()
+		delete(d.olderFiles, id)
+	}
+
+	// Active Fileとして再オープン (RW/Append)
+	path := filepath.Join(d.dirPath, fmt.Sprintf("%d.data", id))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	d.activeFile = file
+	d.activeSeg = newSegment(id, NewDiskReader(file))
+	d.activeSeg.header = header
+	d.activeSeg.cipher = cipher
+	d.activeFileID = id
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	d.writeOffset = info.Size()
+
+	// 空のファイル (作成直後のクラッシュや、途切れたヘッダを切り詰めたもの) にはヘッダを書く。
+	// 旧形式のファイルはそのまま旧形式で追記を続ける
+	if d.writeOffset == 0 {
+		if err := d.writeActiveHeader(); err != nil {
+			return err
 		}
-		db.writeOffset = info.Size()
 	}
+	return d.mapActiveFile()
+}
 
-	return db, nil
+// openEncryptedActiveFile は暗号化した DB のアクティブファイルを作成します。
+// 前回のプロセスが書いて失われた (または切り詰めた) レコードと同じ位置に同じ鍵で別のレコードを書くと
+// nonce が再利用されるため、最新のセグメント lastID には追記せず次の ID で作成します。
+// lastID にレコードが無ければ、作り直して同じ ID を使います (作成時刻が変わるので鍵も変わります)。
+func (d *DB) openEncryptedActiveFile(lastID int) error {
+	seg, ok := d.olderFiles[lastID]
+	if ok && seg.reader.Size() > seg.header.size() {
+		return d.newActiveFile(lastID + 1)
+	}
+	if ok {
+		_ = seg.release()
+		delete(d.olderFiles, lastID)
+	}
+	d.dropSegmentStats(lastID)
+	if err := os.Remove(filepath.Join(d.dirPath, fmt.Sprintf("%d.data", lastID))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return d.newActiveFile(lastID)
+}
+
+// checkPersistedOptions は記録済みオプションと比較して警告を出し、現在の値を記録します。
+func checkPersistedOptions(dirPath string, opts Options) error {
+	prev, err := readPersistedOptions(dirPath)
+	if err != nil {
+		return err
+	}
+	current := opts.persisted()
+	if prev != nil {
+		for _, change := range current.incompatibleChanges(*prev) {
+			opts.logger().Printf("bitcask: %s: %s", dirPath, change)
+		}
+		if *prev == current {
+			return nil
+		}
+	}
+	if opts.ReadOnly {
+		return nil
+	}
+	return writePersistedOptions(dirPath, current)
+}
+
+// openReader は不変セグメントを Options.UseMmap に応じた Reader で開きます。
+func (d *DB) openReader(path string) (Reader, error) {
+	if d.opts.UseMmap {
+		return NewMmapReader(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewDiskReader(f), nil
+}
+
+// openSegment は不変セグメントを開き、ファイルヘッダを検証します。
+// ヘッダが途中で途切れている場合は io.ErrUnexpectedEOF を返します。
+func (d *DB) openSegment(id int) (*segment, error) {
+	reader, err := d.openReader(filepath.Join(d.dirPath, fmt.Sprintf("%d.data", id)))
+	if err != nil {
+		return nil, err
+	}
+	header, err := readFileHeader(reader, reader.Size(), FileKindData, id)
+	if err != nil {
+		_ = reader.Close()
+		return nil, err
+	}
+	cipher, err := openFileCipher(d.opts.KeyProvider, header)
+	if err != nil {
+		_ = reader.Close()
+		return nil, err
+	}
+	seg := newSegment(id, reader)
+	seg.header = header
+	seg.cipher = cipher
+	return seg, nil
 }
 
-func (d *DB) loadFile(id int) error {
+func (d *DB) loadFile(id int, newest bool) error {
 	dataPath := filepath.Join(d.dirPath, fmt.Sprintf("%d.data", id))
 
 	// Older Files は MmapReader で開く (高速読み込み)
-	mmapReader, err := NewMmapReader(dataPath)
+	seg, err := d.openSegment(id)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// 作成直後に途切れたヘッダ。ファイル全体を書きかけとして扱う (最新セグメントなら切り詰めて復旧する)
+		info, statErr := os.Stat(dataPath)
+		if statErr != nil {
+			return statErr
+		}
+		d.addSegmentBytes(id, info.Size(), 0)
+		return &badRecordError{fileID: id, offset: 0, size: info.Size(), err: err}
+	}
 	if err != nil {
 		return err
 	}
-	d.olderFiles[id] = mmapReader
+	d.olderFiles[id] = seg
+	// 計測値にはヘッダを含めない
+	d.addSegmentBytes(id, seg.reader.Size()-seg.header.size(), 0)
 
 	// Hintファイルの存在確認
-	hintPath := filepath.Join(d.dirPath, fmt.Sprintf("%d.hint", id))
-	if _, err := os.Stat(hintPath); err == nil {
-		return d.loadHintFile(id, hintPath)
+	if d.opts.LoadHintFiles {
+		hintPath := filepath.Join(d.dirPath, fmt.Sprintf("%d.hint", id))
+		if _, err := os.Stat(hintPath); err == nil {
+			return d.loadHintFile(id, hintPath)
+		}
 	}
 
 	// Hintが無ければデータファイルからインデックス構築
-	if err := d.loadKeyDir(id, mmapReader); err != nil {
+	if err := d.loadKeyDir(seg, seg.header.size(), newest); err != nil {
+		// ヘッダが無く、先頭のレコードも読めないファイルは別のファイルとみなし、切り詰めない
+		var bad *badRecordError
+		if seg.header.Version == 0 && errors.As(err, &bad) && bad.offset == 0 {
+			return fmt.Errorf("%w: %s: %v", ErrNotBitcaskFile, dataPath, bad.err)
+		}
 		return err
 	}
 	return nil
@@ -161,13 +389,26 @@ func (d *DB) loadHintFile(fileID int, path string) error {
 		return err
 	}
 	fileSize := stat.Size()
-	var offset int64
 
-	reader := bufio.NewReader(file)
+	header, err := readFileHeader(file, fileSize, FileKindHint, fileID)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return corruptionError(FileKindHint, fileID, 0, "truncated file header")
+	}
+	if err != nil {
+		return err
+	}
+	cipher, err := openFileCipher(d.opts.KeyProvider, header)
+	if err != nil {
+		return err
+	}
+	offset := header.size()
+
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, fileSize-offset))
+	now := time.Now().UnixNano()
 
 	for offset < fileSize {
 		// [CRC(4)][Ts(8)][KSz(4)][VSz(4)][Offset(8)] = 28 bytes
-		header := make([]byte, 28)
+		header := make([]byte, hintHeaderSize)
 		if _, err := io.ReadFull(reader, header); err != nil {
 			if err == io.EOF {
 				break
@@ -175,460 +416,835 @@ func (d *DB) loadHintFile(fileID int, path string) error {
 			return err
 		}
 
-		storedCRC := binary.BigEndian.Uint32(header[0:4])
-		keySize := binary.BigEndian.Uint32(header[12:16])
+		// データファイル側のレコードヘッダ (CRC はエントリのもの)
+		h := decodeRecordHeader(header[:recordHeaderSize])
 		dataOffset := binary.BigEndian.Uint64(header[20:28])
 
-		key := make([]byte, keySize)
-		if _, err := io.ReadFull(reader, key); err != nil {
+		// flagExpiry のエントリは Key の前に有効期限 (8 bytes)、flagBlob のエントリは Blob File の位置 (20 bytes) を持つ
+		var extra int64
+		if h.hasExpiry() {
+			extra = expirySize
+		}
+		if h.flags&flagBlob != 0 {
+			extra += blobPointerSize
+		}
+		entry := make([]byte, hintEntrySize(h))
+		copy(entry, header)
+		if _, err := io.ReadFull(reader, entry[hintHeaderSize:]); err != nil {
 			return err
 		}
 
-		// CRC検証: Header[4:] + Key
-		checkBuf := make([]byte, 24+keySize)
-		copy(checkBuf[0:24], header[4:])
-		copy(checkBuf[24:], key)
+		// CRC検証: Header[4:] + Expiry + Key
+		if crc := crc32.ChecksumIEEE(entry[4:]); crc != h.crc {
+			return crcError(FileKindHint, fileID, offset, h.crc, crc)
+		}
 
-		if crc32.ChecksumIEEE(checkBuf) != storedCRC {
-			return ErrDataCorruption
+		var expiry int64
+		if h.hasExpiry() {
+			expiry = int64(binary.BigEndian.Uint64(entry[hintHeaderSize:]))
+		}
+		keyStart := hintHeaderSize + extra
+		var blob BlobPos
+		if h.flags&flagBlob != 0 {
+			if blob, err = decodeBlobPointer(entry[keyStart-blobPointerSize : keyStart]); err != nil {
+				return corruptionError(FileKindHint, fileID, offset, err.Error())
+			}
+		}
+		key := entry[keyStart:]
+		if h.flags&flagEncrypted != 0 {
+			if cipher == nil {
+				return corruptionError(FileKindHint, fileID, offset, "encrypted entry in an unencrypted file")
+			}
+			if key, err = cipher.openHintKey(entry[:keyStart], key, offset); err != nil {
+				return corruptionError(FileKindHint, fileID, offset, err.Error())
+			}
 		}
 
-		d.keyDir[string(key)] = RecordPos{FileID: fileID, Offset: int64(dataOffset)}
-		offset += 28 + int64(keySize)
+		d.applyEntry(pendingEntry{key: string(key), pos: RecordPos{FileID: fileID, Offset: int64(dataOffset), Size: h.size(), Expiry: expiry, Blob: blob}}, now)
+		offset += int64(len(entry))
 	}
 	return nil
 }
 
 func (d *DB) newActiveFile(id int) error {
 	// 既存のActiveFileがあれば、Olderへ移動 (Disk -> Mmap)
+	oldFile, oldMap := d.activeFile, d.activeMap
 	if d.activeFile != nil {
-		// Sync & Close current active file
-		_ = d.activeFile.Sync()
-		oldPath := d.activeFile.Name()
-		_ = d.activeFile.Close()
+		// 事前確保した領域を切り詰めてから Sync & Close current active file
+		if err := d.truncateActiveFile(); err != nil {
+			return err
+		}
+		// レコードが参照する値を先に永続化する
+		if err := d.syncBlobFile(); err != nil {
+			return err
+		}
+		if err := d.activeFile.Sync(); err != nil {
+			return err
+		}
+		d.commit.markSynced(d.writeSeq)
+		d.unsyncedBytes = 0
 
 		// Reopen as MmapReader
-		mmapReader, err := NewMmapReader(oldPath)
+		seg, err := d.openSegment(d.activeFileID)
 		if err != nil {
 			return err
 		}
-		d.olderFiles[d.activeFileID] = mmapReader
+		d.olderFiles[d.activeFileID] = seg
 	}
 
 	path := filepath.Join(d.dirPath, fmt.Sprintf("%d.data", id))
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return err
 	}
+	// 新しいセグメントのディレクトリエントリを永続化する
+	if d.opts.SyncPolicy != SyncNever {
+		if err := syncDir(d.dirPath); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
 
+	if d.activeSeg != nil {
+		// Get やイテレータが参照中なら、ファイル (mmap) は最後の参照の解放時に閉じられる
+		d.retireSegment(d.activeSeg)
+		if oldMap != nil {
+			// mmap はファイルを閉じても有効なので、ファイルはここで閉じる
+			_ = oldFile.Close()
+		}
+	}
 	d.activeFile = file
+	d.activeSeg = newSegment(id, NewDiskReader(file))
+	d.activeMap = nil
 	d.activeFileID = id
 	d.writeOffset = 0
+	if err := d.writeActiveHeader(); err != nil {
+		return err
+	}
+	if err := d.mapActiveFile(); err != nil {
+		return err
+	}
+	d.publishSegmentsLocked()
 	return nil
 }
 
-// loadKeyDir は単一ファイルを走査してインデックスを更新します。
-// file引数を Reader インターフェースに変更
-func (d *DB) loadKeyDir(fileID int, file Reader) error {
-	fileSize := file.Size()
-	var offset int64
+// writeActiveHeader は空のアクティブファイルにファイルヘッダを書き込みます。
+// ヘッダは次に fsync するレコードと一緒に永続化されます。
+func (d *DB) writeActiveHeader() error {
+	buf, cipher, err := createFileHeader(FileKindData, d.activeFileID, d.opts.KeyProvider)
+	if err != nil {
+		return err
+	}
+	if _, err := d.activeFile.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	header, err := decodeFileHeader(buf)
+	if err != nil {
+		return err
+	}
+	d.activeSeg.header = header
+	d.activeSeg.cipher = cipher
+	d.writeOffset = int64(len(buf))
+	return nil
+}
+
+// mapActiveFile は Options.UseMmap の場合に、アクティブファイルをセグメントサイズまで事前確保して mmap し、
+// 読み取りハンドルを mmap に切り替えます。書き込みは従来どおり pwrite で行い、Get は書き込み済みの
+// writeOffset までを mmap から読みます。事前確保した領域はローテーションと Close で切り詰めます。
+// アクティブファイルを開いた直後 (まだ公開していない状態) に呼び出します。
+func (d *DB) mapActiveFile() error {
+	if !d.opts.UseMmap {
+		return nil
+	}
+	length := d.activeSeg.header.size() + d.opts.SegmentSize
+	if d.writeOffset > length {
+		length = d.writeOffset
+	}
+	if err := d.activeFile.Truncate(length); err != nil {
+		return err
+	}
+	m, err := NewActiveMmapReader(d.activeFile, length, d.writeOffset)
+	if err != nil {
+		return err
+	}
+	// DiskReader はファイルを所有するので閉じずに捨てる (ファイルは DB が閉じる)
+	seg := newSegment(d.activeFileID, m)
+	seg.header = d.activeSeg.header
+	seg.cipher = d.activeSeg.cipher
+	d.activeSeg = seg
+	d.activeMap = m
+	return nil
+}
+
+// growActiveMap は end までの書き込みが mmap に収まらない場合 (セグメントサイズを超えるバッチやレコード) に、
+// アクティブファイルを伸ばして mmap し直します。古い mmap は読み込み中の Get が読み終えるまで残ります。
+func (d *DB) growActiveMap(end int64) error {
+	if d.activeMap == nil || end <= d.activeMap.Cap() {
+		return nil
+	}
+	if err := d.activeFile.Truncate(end); err != nil {
+		return err
+	}
+	m, err := NewActiveMmapReader(d.activeFile, end, d.writeOffset)
+	if err != nil {
+		return err
+	}
+	seg := newSegment(d.activeFileID, m)
+	seg.header = d.activeSeg.header
+	seg.cipher = d.activeSeg.cipher
+	d.retireSegment(d.activeSeg)
+	d.activeSeg = seg
+	d.activeMap = m
+	d.publishSegmentsLocked()
+	return nil
+}
+
+// truncateActiveFile は事前確保したアクティブファイルを書き込み済みの長さに切り詰めます。
+func (d *DB) truncateActiveFile() error {
+	if d.activeMap == nil {
+		return nil
+	}
+	return d.activeFile.Truncate(d.writeOffset)
+}
+
+// loadKeyDir は単一ファイルの start 以降を走査してインデックスを更新します。
+// 途中で途切れたレコードや CRC 不一致のレコードを検出した場合は *badRecordError を返します。
+// その時点までのレコードはインデックスに反映済みです。
+// バッチ (Begin ... Commit) 内のレコードは Commit を読んだ時点でまとめて反映し、
+// Commit が無いバッチは書きかけとして扱います。
+// PutStream が値を書き終えていないレコードは読み飛ばします。ただし read-only で開いた DB の最新のセグメント (newest) では
+// 書き込み中の可能性があるため、そこで走査を止めて errUnfinishedRecord を返します。
+func (d *DB) loadKeyDir(seg *segment, start int64, newest bool) error {
+	fileID, fileSize := seg.id, seg.reader.Size()
+	offset := start
+
+	// Read-only では書き込みプロセスがアクティブファイルの事前確保分を並行して切り詰めることがあるので、
+	// 末尾まで走査するときは mmap を経由しない (切り詰められた範囲に触れると SIGBUS になる)
+	var file io.ReaderAt = seg.reader
+	if m, ok := seg.reader.(*MmapReader); ok && d.opts.ReadOnly {
+		file = m.f
+	}
 
 	// Reader (ReaderAt) から bufio.Reader を作るために SectionReader を使用
-	r := io.NewSectionReader(file, 0, fileSize)
+	r := io.NewSectionReader(file, start, fileSize-start)
 	reader := bufio.NewReader(r)
 
+	// 復旧時点で期限切れのレコードは削除として扱う
+	now := time.Now().UnixNano()
+
+	// コミット待ちのバッチ
+	var (
+		inBatch    bool
+		batchStart int64
+		batchCount uint32
+		pending    []pendingEntry
+	)
+
+	badRecord := func(err error) error {
+		// バッチの途中で壊れていた場合はバッチ全体を無効にする
+		start := offset
+		if inBatch {
+			start = batchStart
+		}
+		return &badRecordError{fileID: fileID, offset: start, at: offset, size: fileSize, err: err}
+	}
+
 	for offset < fileSize {
 		// Header (20 bytes)
-		header := make([]byte, 20)
+		header := make([]byte, recordHeaderSize)
 		if _, err := io.ReadFull(reader, header); err != nil {
 			if err == io.EOF {
 				break
 			}
+			if isTornRead(err) {
+				return badRecord(io.ErrUnexpectedEOF)
+			}
 			return err
 		}
 
-		storedCRC := binary.BigEndian.Uint32(header[0:4])
-		keySize := int64(binary.BigEndian.Uint32(header[12:16]))
-		valSizeRaw := binary.BigEndian.Uint32(header[16:20])
+		h := decodeRecordHeader(header)
+		keySize := int64(h.keySize)
 
-		key := make([]byte, keySize)
-		if _, err := io.ReadFull(reader, key); err != nil {
-			return err
+		// ゼロ埋めの末尾は事前確保したアクティブファイルの未使用領域 (正常なレコードの Timestamp は 0 にならない)
+		if h.timestamp == 0 && h.crc == 0 && isPreallocatedTail(file, offset, fileSize) {
+			if inBatch {
+				return badRecord(io.ErrUnexpectedEOF)
+			}
+			return badRecord(errPreallocated)
 		}
 
-		// CRC Check Logic
-		var valSize int64
-		var isTombstone bool
-		if valSizeRaw == tombstoneValueSize {
-			isTombstone = true
-			valSize = 0
-		} else {
-			valSize = int64(valSizeRaw)
+		// ヘッダが示すサイズがファイル末尾を超える場合は書きかけ (巨大なバッファ確保も避ける)
+		if offset+h.size() > fileSize {
+			return badRecord(io.ErrUnexpectedEOF)
 		}
 
-		checkData := make([]byte, 16+keySize+valSize)
-		copy(checkData[0:16], header[4:])
-		copy(checkData[16:16+keySize], key)
+		// CRC Check Logic
+		rec := make([]byte, h.size())
+		copy(rec, header)
+		if _, err := io.ReadFull(reader, rec[recordHeaderSize:]); err != nil {
+			if isTornRead(err) {
+				return badRecord(io.ErrUnexpectedEOF)
+			}
+			return err
+		}
 
-		if !isTombstone {
-			// Read Value into checkData
-			if _, err := io.ReadFull(reader, checkData[16+keySize:]); err != nil {
-				return err
+		if crc := crc32.ChecksumIEEE(rec[4:]); crc != h.crc {
+			if inBatch || !isUnfinishedRecord(header) {
+				return badRecord(crcError(FileKindData, fileID, offset, h.crc, crc))
+			}
+			if d.opts.ReadOnly && newest {
+				return badRecord(errUnfinishedRecord)
 			}
+			// クラッシュなどで書き終えられなかった PutStream のレコード。後ろに追記しないよう記録しておく
+			d.unfinishedTail = d.unfinishedTail || newest
+			offset += h.size()
+			continue
 		}
 
-		if crc32.ChecksumIEEE(checkData) != storedCRC {
-			return ErrDataCorruption
+		// CRC が一致しても復号できないレコードは書きかけではない (鍵の誤りか改ざん) ので切り詰めない
+		body, err := recordBody(seg.cipher, FileKindData, fileID, h, rec, offset)
+		if err != nil {
+			return err
 		}
+		key := body[:keySize]
+		value := body[keySize:]
 
-		if isTombstone {
-			delete(d.keyDir, string(key))
-		} else {
-			d.keyDir[string(key)] = RecordPos{FileID: fileID, Offset: offset}
+		switch {
+		case h.flags&flagBatchBegin != 0:
+			if inBatch || len(value) != 4 {
+				return badRecord(corruptionError(FileKindData, fileID, offset, "unexpected batch begin marker"))
+			}
+			inBatch = true
+			batchStart = offset
+			batchCount = binary.BigEndian.Uint32(value)
+			pending = pending[:0]
+
+		case h.flags&flagBatchCommit != 0:
+			if !inBatch || len(value) != 4 || binary.BigEndian.Uint32(value) != batchCount || uint32(len(pending)) != batchCount {
+				return badRecord(corruptionError(FileKindData, fileID, offset, "batch commit marker does not match its batch"))
+			}
+			for _, e := range pending {
+				d.applyEntry(e, now)
+			}
+			inBatch = false
+			pending = pending[:0]
+
+		default:
+			expiry, userValue, err := splitExpiry(h, value)
+			if err != nil {
+				return badRecord(corruptionError(FileKindData, fileID, offset, "value too short for expiry"))
+			}
+			e := pendingEntry{key: string(key), tombstone: h.isTombstone(), pos: RecordPos{FileID: fileID, Offset: offset, Size: h.size(), Expiry: expiry}}
+			if h.flags&flagBlob != 0 {
+				if e.pos.Blob, err = decodeBlobPointer(userValue); err != nil {
+					return badRecord(corruptionError(FileKindData, fileID, offset, err.Error()))
+				}
+			}
+			if inBatch {
+				pending = append(pending, e)
+			} else {
+				d.applyEntry(e, now)
+			}
 		}
 
-		offset += 20 + keySize + valSize
+		offset += h.size()
+	}
+
+	if inBatch {
+		// Commit マーカーまで書かれずに終わったバッチ
+		return badRecord(io.ErrUnexpectedEOF)
 	}
 	return nil
 }
 
-// Put はキーと値を保存します。
-func (d *DB) Put(key, value []byte) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	keySize := uint32(len(key))
-	valSize := uint32(len(value))
+// pendingEntry は復旧中にインデックスへ反映するレコードです。
+type pendingEntry struct {
+	key       string
+	tombstone bool
+	pos       RecordPos
+}
 
-	if valSize == tombstoneValueSize {
-		return errors.New("value too large")
+// applyEntry は復旧したレコードをインデックスへ反映します。now の時点で期限切れのレコードは削除として扱います。
+func (d *DB) applyEntry(e pendingEntry, now int64) {
+	d.addSegmentBytes(e.pos.FileID, 0, 1)
+	if e.tombstone || e.pos.expired(now) {
+		d.deleteKey(e.key)
+	} else {
+		d.setKey(e.key, e.pos)
 	}
+}
 
-	// Rotation Check
-	currentSize := d.writeOffset
-	// CRC(4)+Ts(8)+KS(4)+VS(4)+K+V
-	recordSize := 4 + 8 + 4 + 4 + int64(keySize) + int64(valSize)
-
-	if currentSize+recordSize > MaxFileSize {
-		// activeFileを閉じて新しいファイルを作成
-		if err := d.newActiveFile(d.activeFileID + 1); err != nil {
-			return err
-		}
+// setKey はインデックスを更新し、セグメントごとの有効データ量を計上します。
+func (d *DB) setKey(key string, pos RecordPos) {
+	if old, replaced := d.keyDir.set(key, pos); replaced {
+		d.addLive(old, -1)
 	}
+	d.addLive(pos, 1)
+	d.recordKey(key, pos, false)
+}
 
-	ts := time.Now().UnixNano()
-	buf := make([]byte, recordSize)
-	binary.BigEndian.PutUint64(buf[4:12], uint64(ts))
-	binary.BigEndian.PutUint32(buf[12:16], keySize)
-	binary.BigEndian.PutUint32(buf[16:20], valSize)
-	copy(buf[20:20+keySize], key)
-	copy(buf[20+keySize:], value)
-
-	crc := crc32.ChecksumIEEE(buf[4:])
-	binary.BigEndian.PutUint32(buf[0:4], crc)
+// deleteKey はインデックスからキーを削除し、セグメントごとの有効データ量を計上します。
+func (d *DB) deleteKey(key string) {
+	if old, removed := d.keyDir.delete(key); removed {
+		d.addLive(old, -1)
+		d.recordKey(key, RecordPos{}, true)
+	}
+}
 
-	if _, err := d.activeFile.Write(buf); err != nil {
+// Put はキーと値を保存します。SyncPolicy が fsync を要求する場合は永続化まで待ちます。
+func (d *DB) Put(key, value []byte) error {
+	seq, err := d.put(key, value, 0)
+	if err != nil {
 		return err
 	}
+	return d.waitDurable(seq)
+}
 
-	d.keyDir[string(key)] = RecordPos{FileID: d.activeFileID, Offset: d.writeOffset}
-	d.writeOffset += recordSize
-
-	return nil
+// PutWithTTL は ttl 経過後に期限切れとなるキーと値を保存します。
+// 期限切れのキーは Get やイテレータから見えなくなり、Merge と起動時の復旧で削除されます。
+func (d *DB) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	seq, err := d.put(key, value, time.Now().Add(ttl).UnixNano())
+	if err != nil {
+		return err
+	}
+	return d.waitDurable(seq)
 }
 
-// Delete はキーを削除します。
-func (d *DB) Delete(key []byte) error {
+// put は d.mu の下でレコードを追記し、永続化を待つ必要があればそのシーケンス番号を返します。
+// expiry は有効期限 (UnixNano) で、0 なら無期限です。
+func (d *DB) put(key, value []byte, expiry int64) (uint64, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	keySize := uint32(len(key))
-	valSize := tombstoneValueSize
-	recordSize := 4 + 8 + 4 + 4 + int64(keySize)
+	if d.opts.ReadOnly {
+		return 0, &ReadOnlyError{Op: "put"}
+	}
+	_, seq, err := d.putLocked(key, value, expiry)
+	return seq, err
+}
 
-	// Rotation logic included? Yes, simplest is to check active file size for Delete too.
-	if d.writeOffset+recordSize > MaxFileSize {
-		if err := d.newActiveFile(d.activeFileID + 1); err != nil {
-			return err
+// putLocked は d.mu を保持した状態でレコードを追記し、書き込んだレコードの Version を返します。
+// BlobThreshold 以上の値は Blob File に書き込み、データファイルにはその位置を持つレコードを追記します。
+func (d *DB) putLocked(key, value []byte, expiry int64) (Version, uint64, error) {
+	if err := checkEntrySize(key, value); err != nil {
+		return Version{}, 0, err
+	}
+
+	flags, stored := compressValue(d.opts.Compression, d.opts.CompressionThreshold, value)
+	if d.separatesValue(int64(len(value))) {
+		blob, err := d.writeBlobLocked(key, flags, stored)
+		if err != nil {
+			return Version{}, 0, err
 		}
+		return d.putBlobPointerLocked(key, blob, expiry)
 	}
+	return d.appendEntryLocked(key, flags, stored, expiry, BlobPos{})
+}
 
-	ts := time.Now().UnixNano()
-	buf := make([]byte, recordSize)
-	binary.BigEndian.PutUint64(buf[4:12], uint64(ts))
-	binary.BigEndian.PutUint32(buf[12:16], keySize)
-	binary.BigEndian.PutUint32(buf[16:20], valSize)
-	copy(buf[20:20+keySize], key)
+// putBlobPointerLocked は d.mu を保持した状態で、Blob File に書き込み済みの値 blob の位置を持つレコードを追記します。
+func (d *DB) putBlobPointerLocked(key []byte, blob BlobPos, expiry int64) (Version, uint64, error) {
+	return d.appendEntryLocked(key, flagBlob, appendBlobPointer(nil, blob), expiry, blob)
+}
 
-	crc := crc32.ChecksumIEEE(buf[4:])
-	binary.BigEndian.PutUint32(buf[0:4], crc)
+// appendEntryLocked は d.mu を保持した状態で、格納する値 stored (flags の方式で圧縮済み、または Blob File の位置) の
+// レコードを追記してインデックスを更新します。
+func (d *DB) appendEntryLocked(key []byte, flags uint8, stored []byte, expiry int64, blob BlobPos) (Version, uint64, error) {
+	var buf []byte
+	if expiry != 0 {
+		buf = appendRecordWithExpiry(nil, time.Now().UnixNano(), flags, key, stored, expiry)
+	} else {
+		buf = appendRecord(nil, time.Now().UnixNano(), flags, key, stored, false)
+	}
+	recordSize := int64(len(buf)) + d.encryptionOverhead()
 
-	if _, err := d.activeFile.Write(buf); err != nil {
-		return err
+	// Rotation Check
+	if err := d.ensureCapacity(recordSize); err != nil {
+		return Version{}, 0, err
 	}
+	ver := versionOf(decodeRecordHeader(buf)) // Version は平文のレコードから求める
+	buf = d.sealRecord(buf, d.writeOffset)
 
-	delete(d.keyDir, string(key))
+	seq, err := d.writeRecord(buf, 1)
+	if err != nil {
+		return Version{}, 0, err
+	}
+
+	d.supersedeStreams(string(key))
+	d.setKey(string(key), RecordPos{FileID: d.activeFileID, Offset: d.writeOffset, Size: recordSize, Expiry: expiry, Blob: blob})
 	d.writeOffset += recordSize
+	d.publishLocked()
 
-	return nil
+	d.maybeTriggerMerge()
+	return ver, seq, nil
 }
 
-// Get はキーに対応する値を取得します。
-func (d *DB) Get(key []byte) ([]byte, error) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-
-	pos, ok := d.keyDir[string(key)]
-	if !ok {
-		return nil, ErrKeyNotFound
-	}
-
-	// どのファイルから読むか特定
-	var file Reader
-	if pos.FileID == d.activeFileID {
-		// ActiveFile is *os.File, we need to wrap it if we want to use Reader interface?
-		// But activeFile is *os.File. We can just use it directly or wrap.
-		// Wait, ReadAt signature is same.
-		// We can cast? No. *os.File implements Reader interface?
-		// Reader interface requires: ReadAt, Close, Size. *os.File has ReadAt, Close.
-		// Size() is NOT in *os.File. MmapReader has Size().
-		// We need to implement Size() for *os.File wrapper?
-		// Let's use DiskReader wrapper for ActiveFile?
-		// Or just use local variable with type interface{ ReadAt(...) ... }
-		// But simplicity: just call ReadAt directly.
-
-		// The issue: We need a common way to ReadAt.
-		// activeFile (*os.File) has ReadAt.
-		file = NewDiskReader(d.activeFile) // Wait, Size() calls Stat(). It's ok.
-	} else {
-		var exists bool
-		file, exists = d.olderFiles[pos.FileID]
-		if !exists {
-			return nil, errors.New("file not found: internal error")
-		}
-	}
+// checkEntrySize はキーと値がレコード形式で表現できるサイズかを検証します。
+func checkEntrySize(key, value []byte) error {
+	return checkEntrySizes(len(key), int64(len(value)))
+}
 
-	// Read header and data
-	header := make([]byte, 20)
-	if _, err := file.ReadAt(header, pos.Offset); err != nil {
-		return nil, err
+// checkEntrySizes は checkEntrySize と同じ検証をキーと値の長さで行います。
+func checkEntrySizes(keySize int, valueSize int64) error {
+	if keySize > maxKeySize {
+		return ErrKeyTooLarge
 	}
-
-	storedCRC := binary.BigEndian.Uint32(header[0:4])
-	keySize := binary.BigEndian.Uint32(header[12:16])
-	valSize := binary.BigEndian.Uint32(header[16:20])
-
-	dataSize := int64(keySize) + int64(valSize)
-	data := make([]byte, dataSize)
-	if _, err := file.ReadAt(data, pos.Offset+20); err != nil {
-		return nil, err
+	if valueSize+expirySize >= int64(tombstoneValueSize) {
+		return ErrValueTooLarge
 	}
+	return nil
+}
 
-	checkBuf := make([]byte, 16+dataSize)
-	copy(checkBuf[0:16], header[4:])
-	copy(checkBuf[16:], data)
+// ensureCapacity は size バイトを追記するとセグメントサイズを超える場合にローテーションします。
+// セグメントサイズにファイルヘッダは含めません。
+func (d *DB) ensureCapacity(size int64) error {
+	written := d.writeOffset - d.activeSeg.header.size()
+	if written > 0 && written+size > d.opts.SegmentSize {
+		// activeFileを閉じて新しいファイルを作成
+		if err := d.newActiveFile(d.activeFileID + 1); err != nil {
+			return err
+		}
+	}
+	return d.growActiveMap(d.writeOffset + size)
+}
 
-	if crc32.ChecksumIEEE(checkBuf) != storedCRC {
-		return nil, ErrDataCorruption
+// encryptionOverhead はアクティブファイルに書くレコードが暗号化で増えるサイズです (暗号化しなければ 0)。
+// ローテーションしても暗号化の有無は変わりません (暗号化は Options.KeyProvider で決まります)。
+func (d *DB) encryptionOverhead() int64 {
+	if d.activeSeg.cipher == nil {
+		return 0
 	}
+	return gcmTagSize
+}
 
-	if string(data[:keySize]) != string(key) {
-		return nil, errors.New("key mismatch")
+// sealRecord はアクティブファイルが暗号化されていれば、エンコード済みのレコード rec を
+// アクティブファイルの offset の位置に書き込むレコードとして暗号化します。
+func (d *DB) sealRecord(rec []byte, offset int64) []byte {
+	if d.activeSeg.cipher == nil {
+		return rec
 	}
+	return d.activeSeg.cipher.sealRecord(rec, offset)
+}
 
-	result := make([]byte, valSize)
-	copy(result, data[keySize:])
-	return result, nil
+// Delete はキーを削除します。SyncPolicy が fsync を要求する場合は永続化まで待ちます。
+func (d *DB) Delete(key []byte) error {
+	seq, err := d.delete(key)
+	if err != nil {
+		return err
+	}
+	return d.waitDurable(seq)
 }
 
-// Close はデータベースを閉じます。
-func (d *DB) Close() error {
+func (d *DB) delete(key []byte) (uint64, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	if d.activeFile != nil {
-		if err := d.activeFile.Close(); err != nil {
-			return err
-		}
+	if d.opts.ReadOnly {
+		return 0, &ReadOnlyError{Op: "delete"}
 	}
-	for _, f := range d.olderFiles {
-		if err := f.Close(); err != nil {
-			return err // Return first error
-		}
+	return d.deleteLocked(key)
+}
+
+// DeleteExisting はキーが存在する (期限切れでない) 場合だけ削除し、削除したかを返します。
+// 存在の確認と削除を d.mu の下でまとめて行うので、並行する書き込みがあっても結果と実際の削除が一致します。
+// 存在しないキーには Tombstone を書きません。
+func (d *DB) DeleteExisting(key []byte) (bool, error) {
+	seq, deleted, err := d.deleteExisting(key)
+	if err != nil || !deleted {
+		return false, err
 	}
-	return nil
+	return true, d.waitDurable(seq)
 }
 
-// Merge は古いデータファイルを1つに統合し、不要な領域を解放します。
-func (d *DB) Merge() error {
+func (d *DB) deleteExisting(key []byte) (uint64, bool, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	// 1. マージ対象（olderFiles）の確認
-	if len(d.olderFiles) == 0 {
-		return nil // マージするものがない
+	if d.opts.ReadOnly {
+		return 0, false, &ReadOnlyError{Op: "delete"}
 	}
+	if d.closed {
+		return 0, false, ErrClosed
+	}
+	pos, ok := d.keyDir.get(string(key))
+	if !ok || pos.expired(time.Now().UnixNano()) {
+		return 0, false, nil
+	}
+	seq, err := d.deleteLocked(key)
+	return seq, err == nil, err
+}
 
-	var mergeIDs []int
-	for id := range d.olderFiles {
-		mergeIDs = append(mergeIDs, id)
+// deleteLocked は d.mu を保持した状態で Tombstone を追記します。
+func (d *DB) deleteLocked(key []byte) (uint64, error) {
+	if len(key) > maxKeySize {
+		return 0, ErrKeyTooLarge
 	}
-	sort.Ints(mergeIDs)
-	targetID := mergeIDs[0] // 最も若い番号をマージ後のIDとして再利用する
 
-	// 2. 一時ファイルの作成 (Data & Hint)
-	tempDataName := "merge.data"
-	tempHintName := "merge.hint"
-	tempDataPath := filepath.Join(d.dirPath, tempDataName)
-	tempHintPath := filepath.Join(d.dirPath, tempHintName)
+	buf := appendRecord(nil, time.Now().UnixNano(), 0, key, nil, true)
+	recordSize := int64(len(buf)) + d.encryptionOverhead()
 
-	tempDataFile, err := os.OpenFile(tempDataPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
+	// Delete も Tombstone を追記するのでローテーション対象
+	if err := d.ensureCapacity(recordSize); err != nil {
+		return 0, err
 	}
-	tempHintFile, err := os.OpenFile(tempHintPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	buf = d.sealRecord(buf, d.writeOffset)
+
+	seq, err := d.writeRecord(buf, 1)
 	if err != nil {
-		_ = tempDataFile.Close()
-		_ = os.Remove(tempDataPath)
-		return err
+		return 0, err
 	}
 
-	defer func() {
-		// エラーパス用クリーンアップ
-		_ = tempDataFile.Close()
-		_ = tempHintFile.Close()
-		// 成功時はリネームされているため削除は失敗するが無視してよい
-		if _, err := os.Stat(tempDataPath); err == nil {
-			_ = os.Remove(tempDataPath)
-		}
-		if _, err := os.Stat(tempHintPath); err == nil {
-			_ = os.Remove(tempHintPath)
-		}
-	}()
-
-	// 3. 有効なキーを一時ファイルに書き写す
-	newKeyPos := make(map[string]RecordPos)
-	var writeOffset int64
-
-	for key, pos := range d.keyDir {
-		// ActiveFileにあるキーは対象外
-		if pos.FileID == d.activeFileID {
-			continue
-		}
-
-		// 値の読み出し
-		file, ok := d.olderFiles[pos.FileID]
-		if !ok {
-			return errors.New("file not found during merge")
-		}
-
-		// Header Read (20 bytes)
-		header := make([]byte, 20)
-		if _, err := file.ReadAt(header, pos.Offset); err != nil {
-			return err
-		}
-		keySize := binary.BigEndian.Uint32(header[12:16])
-		valSize := binary.BigEndian.Uint32(header[16:20])
+	d.supersedeStreams(string(key))
+	d.deleteKey(string(key))
+	d.writeOffset += recordSize
+	d.publishLocked()
 
-		totalSize := 20 + int64(keySize) + int64(valSize)
-		data := make([]byte, totalSize)
-		if _, err := file.ReadAt(data, pos.Offset); err != nil {
-			return err
-		}
+	d.maybeTriggerMerge()
+	return seq, nil
+}
 
-		// Checksum (Guardian)
-		storedCRC := binary.BigEndian.Uint32(data[0:4])
-		if crc32.ChecksumIEEE(data[4:]) != storedCRC {
-			return ErrDataCorruption
-		}
+// writeRecord はエンコード済みレコードをアクティブファイルへ追記します。
+// records はバッファに含まれるキーを持つレコードの数です (統計用)。
+// SyncPolicy に従って永続化を待つ必要がある場合、そのシーケンス番号を返します (不要なら 0)。
+// fsync 自体は d.mu の外で waitDurable が行います。
+func (d *DB) writeRecord(buf []byte, records int) (uint64, error) {
+	if _, err := d.activeFile.WriteAt(buf, d.writeOffset); err != nil {
+		return 0, err
+	}
+	return d.commitWrite(int64(len(buf)), records), nil
+}
 
-		// --- Data Write ---
-		if _, err := tempDataFile.Write(data); err != nil {
-			return err
+// commitWrite は writeOffset の位置に n バイトを書き終えた後で、読み取り範囲と統計を更新し、
+// writeRecord と同様に永続化を待つ必要があればそのシーケンス番号を返します。writeOffset は進めません。
+func (d *DB) commitWrite(n int64, records int) uint64 {
+	if d.activeMap != nil {
+		d.activeMap.Commit(d.writeOffset + n)
+	}
+	d.writeSeq++
+	d.addSegmentBytes(d.activeFileID, n, int64(records))
+
+	switch d.opts.SyncPolicy {
+	case SyncAlways:
+		return d.writeSeq
+	case SyncByBytes:
+		d.unsyncedBytes += n
+		if d.unsyncedBytes >= d.opts.SyncBytes {
+			d.unsyncedBytes = 0
+			return d.writeSeq
 		}
+	}
+	return 0
+}
 
-		// --- Hint Write ---
-		ts := binary.BigEndian.Uint64(header[4:12])
+// Get はキーに対応する値を取得します。
+// 公開済みのスナップショットから読み、d.mu を取らないため、書き込みや Merge と並行して実行できます。
+// 読み込み中のセグメントは参照カウントで保持され、Merge で置き換えられても読み終えるまで閉じられません。
+func (d *DB) Get(key []byte) ([]byte, error) {
+	pos, seg, err := d.acquireValue(key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = seg.release() }()
+	return readValueAt(seg, pos, key)
+}
 
-		hintBuf := make([]byte, 28)
-		binary.BigEndian.PutUint64(hintBuf[4:12], ts)
-		binary.BigEndian.PutUint32(hintBuf[12:16], keySize)
-		binary.BigEndian.PutUint32(hintBuf[16:20], valSize)
-		binary.BigEndian.PutUint64(hintBuf[20:28], uint64(writeOffset))
+// GetInto はキーに対応する値を dst の末尾に追加して返します。
+// mmap のセグメントから圧縮されていない値を読む場合、dst の容量が足りていればメモリを確保しません。
+func (d *DB) GetInto(key, dst []byte) ([]byte, error) {
+	pos, seg, err := d.acquireValue(key)
+	if err != nil {
+		return dst, err
+	}
+	defer func() { _ = seg.release() }()
 
-		checkBuf := make([]byte, 24+len(key))
-		copy(checkBuf[0:24], hintBuf[4:])
-		copy(checkBuf[24:], key)
-		hintCRC := crc32.ChecksumIEEE(checkBuf)
+	h, stored, err := storedValueAt(seg, pos, key)
+	if err != nil {
+		return dst, err
+	}
+	out, err := appendValue(dst, seg, pos, h, stored)
+	if err != nil {
+		return dst, err
+	}
+	return out, nil
+}
 
-		binary.BigEndian.PutUint32(hintBuf[0:4], hintCRC)
+// View はキーに対応する値を fn に渡します。mmap のセグメントにある圧縮・暗号化されていない値は、
+// コピーせずに mmap 上のバイト列をそのまま渡します。セグメントは fn が戻るまで mmap されたまま保持されます
+// (Merge で置き換えられても閉じられません)。
+// value は読み取り専用で、fn が戻った後は使えません (保持する場合はコピーしてください)。
+// fn が返したエラーはそのまま View の戻り値になります。
+func (d *DB) View(key []byte, fn func(value []byte) error) error {
+	pos, seg, err := d.acquireValue(key)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = seg.release() }()
 
-		// Write Header and Key
-		if _, err := tempHintFile.Write(hintBuf); err != nil {
-			return err
-		}
-		if _, err := tempHintFile.Write([]byte(key)); err != nil {
+	h, value, err := storedValueAt(seg, pos, key)
+	if err != nil {
+		return err
+	}
+	if h.flags&(flagLZ4|flagFlate) != 0 {
+		if value, err = appendValue(nil, seg, pos, h, value); err != nil {
 			return err
 		}
+	}
+	return fn(value)
+}
 
-		newKeyPos[key] = RecordPos{FileID: targetID, Offset: writeOffset}
-		writeOffset += totalSize
+// segmentFor は pos のレコードを含むセグメントを返します。d.mu を保持した状態で呼び出します。
+// 値を Blob File に分離したキーでも、データファイルのレコードのセグメントを返します。
+func (d *DB) segmentFor(pos RecordPos) (*segment, error) {
+	if d.activeFile != nil && pos.FileID == d.activeFileID {
+		return d.activeSeg, nil
 	}
+	seg, exists := d.olderFiles[pos.FileID]
+	if !exists {
+		return nil, corruptionError(FileKindData, pos.FileID, pos.Offset, "index refers to a missing segment")
+	}
+	return seg, nil
+}
 
-	// 4. ファイル操作とスワップ
-	if err := tempDataFile.Sync(); err != nil {
-		return err
+// readValueAt は pos のレコードを読み込み、CRC とキーを検証して値 (暗号化・圧縮されていれば復号・展開したもの) を返します。
+func readValueAt(seg *segment, pos RecordPos, key []byte) ([]byte, error) {
+	_, value, err := readRecordAt(seg, pos, key)
+	return value, err
+}
+
+// readRecordAt は readValueAt と同様に値を読み込み、レコードヘッダ (暗号化されていれば平文のレコードのもの) も返します。
+func readRecordAt(seg *segment, pos RecordPos, key []byte) (recordHeader, []byte, error) {
+	h, stored, err := storedValueAt(seg, pos, key)
+	if err != nil {
+		return recordHeader{}, nil, err
 	}
-	if err := tempHintFile.Sync(); err != nil {
-		return err
+	value, err := appendValue(nil, seg, pos, h, stored)
+	if err != nil {
+		return recordHeader{}, nil, err
 	}
+	return h, value, nil
+}
 
-	if err := tempDataFile.Close(); err != nil {
-		return err
+// storedValueAt は pos のレコードの CRC とキーを検証し、ファイルに格納された (圧縮されたままの) 値を返します。
+// 暗号化されたレコードは復号し、平文のレコードのヘッダを返します。mmap のセグメントではレコードを 1 度もコピーせず、
+// CRC も mmap 上で検証し、mmap 上のスライスを返します。
+// 戻り値はセグメントの参照を保持している間だけ有効で、変更してはいけません。
+func storedValueAt(seg *segment, pos RecordPos, key []byte) (recordHeader, []byte, error) {
+	rec, err := recordAt(seg, pos)
+	if err != nil {
+		return recordHeader{}, nil, err
 	}
-	if err := tempHintFile.Close(); err != nil {
-		return err
+	h := decodeRecordHeader(rec)
+	if h.size() != pos.Size {
+		return recordHeader{}, nil, corruptionError(seg.kind(), pos.FileID, pos.Offset, fmt.Sprintf("record size mismatch: index has %d, header has %d", pos.Size, h.size()))
+	}
+	if crc := crc32.ChecksumIEEE(rec[4:]); crc != h.crc {
+		return recordHeader{}, nil, crcError(seg.kind(), pos.FileID, pos.Offset, h.crc, crc)
+	}
+	data, err := recordBody(seg.cipher, seg.kind(), pos.FileID, h, rec, pos.Offset)
+	if err != nil {
+		return recordHeader{}, nil, err
+	}
+	if h.flags&flagEncrypted != 0 {
+		h = plainHeader(h, data)
 	}
 
-	// 古いデータファイルとヒントファイルを削除
-	for _, id := range mergeIDs {
-		if id == d.activeFileID {
-			continue
-		}
+	keySize := h.keySize
+	if string(data[:keySize]) != string(key) {
+		return recordHeader{}, nil, corruptionError(seg.kind(), pos.FileID, pos.Offset, fmt.Sprintf("key mismatch: expected %q, found %q", key, data[:keySize]))
+	}
+	_, stored, err := splitExpiry(h, data[keySize:])
+	if err != nil {
+		return recordHeader{}, nil, corruptionError(seg.kind(), pos.FileID, pos.Offset, "value too short for expiry")
+	}
+	return h, stored, nil
+}
 
-		f := d.olderFiles[id]
-		_ = f.Close()
-		delete(d.olderFiles, id)
+// recordAt は pos のレコード全体を返します。mmap のセグメントでは mmap 上のスライスをコピーせずに返し、
+// それ以外では 1 回の ReadAt で読み込みます。
+func recordAt(seg *segment, pos RecordPos) ([]byte, error) {
+	if pos.Size < recordHeaderSize {
+		return nil, corruptionError(seg.kind(), pos.FileID, pos.Offset, fmt.Sprintf("record size %d too small", pos.Size))
+	}
+	if s, ok := seg.reader.(sliceReader); ok {
+		return s.Slice(pos.Offset, pos.Size)
+	}
+	rec := make([]byte, pos.Size)
+	if _, err := seg.reader.ReadAt(rec, pos.Offset); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
 
-		oldDataPath := filepath.Join(d.dirPath, fmt.Sprintf("%d.data", id))
-		_ = os.Remove(oldDataPath)
+// appendValue は storedValueAt が返した値を (圧縮されていれば展開して) dst の末尾に追加します。
+func appendValue(dst []byte, seg *segment, pos RecordPos, h recordHeader, stored []byte) ([]byte, error) {
+	if h.flags&(flagLZ4|flagFlate) == 0 {
+		return append(dst, stored...), nil
+	}
+	dst, err := appendDecompressed(dst, h.flags, stored)
+	if err != nil {
+		return nil, corruptionError(seg.kind(), pos.FileID, pos.Offset, err.Error())
+	}
+	return dst, nil
+}
 
-		oldHintPath := filepath.Join(d.dirPath, fmt.Sprintf("%d.hint", id))
-		_ = os.Remove(oldHintPath)
+// Close はデータベースを閉じます。アクティブファイルは閉じる前に fsync し、最後にディレクトリのロックを解放します。
+// 複数回呼んでも安全です。
+func (d *DB) Close() error {
+	select {
+	case <-d.closeCh:
+	default:
+		close(d.closeCh)
 	}
+	d.bgWG.Wait()
 
-	// Rename Temp -> Target
-	targetDataPath := filepath.Join(d.dirPath, fmt.Sprintf("%d.data", targetID))
-	targetHintPath := filepath.Join(d.dirPath, fmt.Sprintf("%d.hint", targetID))
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	if err := os.Rename(tempDataPath, targetDataPath); err != nil {
-		return err
+	if d.closed {
+		return nil
 	}
-	if err := os.Rename(tempHintPath, targetHintPath); err != nil {
-		return err
+	d.closed = true
+	// 以降の Get は ErrClosed を返す。読み込み中のセグメントは読み終えた時点で閉じられる
+	d.view.Store(nil)
+	// 全ファイルを閉じてから、最後にディレクトリのロックを解放する
+	defer func() { _ = d.lock.release() }()
+	for _, seg := range d.retired {
+		_ = seg.release()
 	}
+	d.retired = nil
 
-	// Re-open compacted file as MmapReader
-	newFile, err := NewMmapReader(targetDataPath)
-	if err != nil {
-		return err
+	// 途中でエラーになっても残りのファイルを閉じ、最初のエラーを返す
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	d.olderFiles[targetID] = newFile
-
-	// 5. Update In-Memory Index
-	for key, pos := range newKeyPos {
-		d.keyDir[key] = pos
+	if d.blobFile != nil {
+		keep(d.blobFile.Sync())
+		// DiskReader が blobFile を閉じる
+		keep(d.blobSeg.release())
 	}
-
-	return nil
+	for _, seg := range d.blobFiles {
+		keep(seg.release())
+	}
+	if d.activeFile != nil {
+		if err := d.truncateActiveFile(); err != nil {
+			keep(err)
+		} else if err := d.activeFile.Sync(); err != nil {
+			keep(err)
+		} else {
+			d.commit.markSynced(d.writeSeq)
+		}
+		keep(d.activeSeg.release())
+		if d.activeMap != nil {
+			keep(d.activeFile.Close())
+		}
+	}
+	for _, seg := range d.olderFiles {
+		keep(seg.release())
+	}
+	return firstErr
 }
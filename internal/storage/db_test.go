@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -129,12 +132,11 @@ func TestMerge(t *testing.T) {
 	dbDir := "test_merge_dir"
 	defer func() { _ = os.RemoveAll(dbDir) }()
 
-	// テスト用にファイルサイズ制限を一時的に小さくする
-	originalMax := MaxFileSize
-	MaxFileSize = 100 // 100 bytes
-	defer func() { MaxFileSize = originalMax }()
+	// テスト用にファイルサイズ制限を小さくする
+	opts := DefaultOptions()
+	opts.SegmentSize = 100 // 100 bytes
 
-	db, err := NewDB(dbDir)
+	db, err := OpenWithOptions(dbDir, opts)
 	if err != nil {
 		t.Fatalf("Failed to open DB: %v", err)
 	}
@@ -199,7 +201,7 @@ func TestMerge(t *testing.T) {
 
 	// 5. DB再起動して永続化確認
 	_ = db.Close()
-	db2, err := NewDB(dbDir)
+	db2, err := OpenWithOptions(dbDir, opts)
 	if err != nil {
 		t.Fatalf("Failed to reopen DB: %v", err)
 	}
@@ -279,11 +281,10 @@ func TestHintFile(t *testing.T) {
 	defer func() { _ = os.RemoveAll(dbDir) }()
 
 	// ローテーションしやすく調整
-	originalMax := MaxFileSize
-	MaxFileSize = 100
-	defer func() { MaxFileSize = originalMax }()
+	opts := DefaultOptions()
+	opts.SegmentSize = 100
 
-	db, err := NewDB(dbDir)
+	db, err := OpenWithOptions(dbDir, opts)
 	if err != nil {
 		t.Fatalf("Failed to open DB: %v", err)
 	}
@@ -318,7 +319,7 @@ func TestHintFile(t *testing.T) {
 	_ = db.Close()
 
 	// 再起動 (Hint Fileからのロードを確認)
-	db2, err := NewDB(dbDir)
+	db2, err := OpenWithOptions(dbDir, opts)
 	if err != nil {
 		t.Fatalf("Failed to reopen DB: %v", err)
 	}
@@ -393,13 +394,182 @@ func TestRotation(t *testing.T) {
 	}
 }
 
+func TestActiveSegmentMmap(t *testing.T) {
+	dbDir := "test_active_mmap_dir"
+	crashDir := "test_active_mmap_crash_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+	defer func() { _ = os.RemoveAll(crashDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 4096
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Put([]byte("key1"), []byte("value1"))
+	_ = db.Put([]byte("key2"), []byte("value2"))
+
+	// アクティブファイルはセグメントサイズまで事前確保され、mmap から読む
+	path := filepath.Join(dbDir, "0.data")
+	if info, _ := os.Stat(path); info.Size() != fileHeaderSize+opts.SegmentSize {
+		t.Errorf("Expected active file preallocated to %d, got %d", fileHeaderSize+opts.SegmentSize, info.Size())
+	}
+	if _, ok := db.activeSeg.reader.(*ActiveMmapReader); !ok {
+		t.Errorf("Expected active segment to be mapped, got %T", db.activeSeg.reader)
+	}
+	if val, err := db.Get([]byte("key2")); err != nil || string(val) != "value2" {
+		t.Errorf("Get key2 = %q, %v", val, err)
+	}
+
+	// 開いたままのファイルをコピーしてクラッシュを再現する (ゼロ埋めの末尾が残る)
+	if err := os.MkdirAll(crashDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if err := os.WriteFile(filepath.Join(crashDir, "0.data"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := Verify(crashDir); err != nil || !report.OK() {
+		t.Errorf("Expected preallocated tail to pass verification, got %+v, %v", report, err)
+	}
+
+	// セグメントサイズを超えるバッチは mmap を伸ばして書く
+	big := strings.Repeat("x", 3000)
+	b := NewBatch()
+	b.Put([]byte("big1"), []byte(big))
+	b.Put([]byte("big2"), []byte(big))
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if val, err := db.Get([]byte("big2")); err != nil || string(val) != big {
+		t.Errorf("Get big2 after growing the mapping failed: %v", err)
+	}
+	_ = db.Put([]byte("key3"), []byte("value3")) // ローテーション
+
+	// ローテーションと Close で書き込み済みの長さに切り詰める
+	sizes := map[int]int64{db.activeFileID: db.writeOffset}
+	for id, seg := range db.olderFiles {
+		sizes[id] = seg.reader.Size()
+	}
+	if len(sizes) != 3 || sizes[1] <= fileHeaderSize+opts.SegmentSize {
+		t.Errorf("Expected the batch to grow segment 1, got sizes %v", sizes)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range sizes {
+		if info, _ := os.Stat(filepath.Join(dbDir, fmt.Sprintf("%d.data", id))); info.Size() != want {
+			t.Errorf("Expected %d.data truncated to %d, got %d", id, want, info.Size())
+		}
+	}
+
+	// ゼロ埋めの末尾は書きかけとして報告せずに切り詰める
+	crashed, err := OpenWithOptions(crashDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open crashed DB: %v", err)
+	}
+	defer func() { _ = crashed.Close() }()
+	if len(crashed.Recovered()) != 0 {
+		t.Errorf("Expected no recovered tails, got %v", crashed.Recovered())
+	}
+	for key, want := range map[string]string{"key1": "value1", "key2": "value2"} {
+		if val, err := crashed.Get([]byte(key)); err != nil || string(val) != want {
+			t.Errorf("Get %s after crash = %q, %v", key, val, err)
+		}
+	}
+}
+
+func TestGetIntoAndView(t *testing.T) {
+	dbDir := "test_get_into_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.Compression = CompressionLZ4
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	big := strings.Repeat("compressible;", 100)
+	_ = db.Put([]byte("small"), []byte("value"))
+	_ = db.Put([]byte("big"), []byte(big))
+
+	buf, err := db.GetInto([]byte("small"), []byte("prefix:"))
+	if err != nil || string(buf) != "prefix:value" {
+		t.Errorf("GetInto small = %q, %v", buf, err)
+	}
+	if buf, err = db.GetInto([]byte("big"), buf[:0]); err != nil || string(buf) != big {
+		t.Errorf("GetInto big = %q, %v", buf, err)
+	}
+	if _, err := db.GetInto([]byte("missing"), nil); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// 圧縮されていない値はアクティブファイルの mmap から直接渡す
+	var viewed []byte
+	if err := db.View([]byte("small"), func(value []byte) error {
+		viewed = append(viewed, value...)
+		if _, ok := db.activeSeg.reader.(sliceReader); ok && cap(value) != len(value) {
+			t.Error("Expected the mapped slice to be capped")
+		}
+		return nil
+	}); err != nil || string(viewed) != "value" {
+		t.Errorf("View small = %q, %v", viewed, err)
+	}
+	if err := db.View([]byte("big"), func(value []byte) error {
+		if string(value) != big {
+			t.Errorf("View big = %q", value)
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("View big failed: %v", err)
+	}
+	errStop := errors.New("stop")
+	if err := db.View([]byte("small"), func([]byte) error { return errStop }); err != errStop {
+		t.Errorf("Expected the callback error, got %v", err)
+	}
+
+	// mmap のセグメントから読む GetInto / View はメモリを確保しない
+	key := []byte("small")
+	buf = make([]byte, 0, 16)
+	if allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = db.GetInto(key, buf[:0])
+	}); allocs != 0 {
+		t.Errorf("Expected GetInto not to allocate, got %v allocs", allocs)
+	}
+	fn := func([]byte) error { return nil }
+	if allocs := testing.AllocsPerRun(100, func() {
+		_ = db.View(key, fn)
+	}); allocs != 0 {
+		t.Errorf("Expected View not to allocate, got %v allocs", allocs)
+	}
+
+	// 不変セグメントでも同じ
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if buf, err = db.GetInto(key, buf[:0]); err != nil || string(buf) != "value" {
+		t.Errorf("GetInto after merge = %q, %v", buf, err)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = db.GetInto(key, buf[:0])
+	}); allocs != 0 {
+		t.Errorf("Expected GetInto on a merged segment not to allocate, got %v allocs", allocs)
+	}
+}
+
 func TestChecksum(t *testing.T) {
 	dbDir := "test_checksum_dir"
 	defer func() { _ = os.RemoveAll(dbDir) }()
 
-	// 1. 正常なデータを書き込む
+	// 最新セグメントの末尾は復旧対象になるため、古いセグメントを改ざんする
+	opts := DefaultOptions()
+	opts.SegmentSize = 40
+
+	// 1. 正常なデータを書き込む (0.data -> Older, 1.data -> Active)
 	func() {
-		db, err := NewDB(dbDir)
+		db, err := OpenWithOptions(dbDir, opts)
 		if err != nil {
 			t.Fatalf("Failed to open DB: %v", err)
 		}
@@ -408,6 +578,9 @@ func TestChecksum(t *testing.T) {
 		if err := db.Put([]byte("key"), []byte("value")); err != nil {
 			t.Fatalf("Put failed: %v", err)
 		}
+		if err := db.Put([]byte("key2"), []byte("value2")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
 	}()
 
 	// 2. ファイルを直接改ざんする
@@ -427,12 +600,228 @@ func TestChecksum(t *testing.T) {
 
 	// 3. 起動時チェック (Guardian)
 	// loadKeyDirでCRC不整合を検知してエラーになるはず
-	_, err = NewDB(dbDir)
-	if err != ErrDataCorruption {
+	_, err = OpenWithOptions(dbDir, opts)
+	if !errors.Is(err, ErrDataCorruption) {
 		t.Errorf("Expected ErrDataCorruption during recovery, got %v", err)
 	}
 }
 
+func TestTornTailRecovery(t *testing.T) {
+	cases := []struct {
+		name   string
+		damage func(t *testing.T, path string)
+		reason error
+	}{
+		{
+			// 書き込み途中でクラッシュ: 最後のレコードが途中まで
+			name: "partial",
+			damage: func(t *testing.T, path string) {
+				info, _ := os.Stat(path)
+				if err := os.Truncate(path, info.Size()-3); err != nil {
+					t.Fatal(err)
+				}
+			},
+			reason: io.ErrUnexpectedEOF,
+		},
+		{
+			// 最後のレコードの CRC 不一致
+			name: "badcrc",
+			damage: func(t *testing.T, path string) {
+				f, err := os.OpenFile(path, os.O_RDWR, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() { _ = f.Close() }()
+				info, _ := f.Stat()
+				if _, err := f.WriteAt([]byte{0xFF}, info.Size()-1); err != nil {
+					t.Fatal(err)
+				}
+			},
+			reason: ErrDataCorruption,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dbDir := "test_torn_tail_" + tc.name + "_dir"
+			defer func() { _ = os.RemoveAll(dbDir) }()
+
+			db, err := NewDB(dbDir)
+			if err != nil {
+				t.Fatalf("Failed to open DB: %v", err)
+			}
+			_ = db.Put([]byte("key1"), []byte("value1"))
+			_ = db.Put([]byte("key2"), []byte("value2"))
+			_ = db.Put([]byte("key3"), []byte("value3"))
+			_ = db.Close()
+
+			path := filepath.Join(dbDir, "0.data")
+			before, _ := os.Stat(path)
+			tc.damage(t, path)
+
+			db, err = NewDB(dbDir)
+			if err != nil {
+				t.Fatalf("Expected torn tail to be recovered, got %v", err)
+			}
+
+			recovered := db.Recovered()
+			if len(recovered) != 1 {
+				t.Fatalf("Expected 1 truncated tail, got %v", recovered)
+			}
+			// 3 レコードは同じサイズなので、最後のレコードはヘッダ以降の 2/3 の位置から始まる
+			wantOffset := fileHeaderSize + (before.Size()-fileHeaderSize)/3*2
+			if recovered[0].FileID != 0 || recovered[0].Offset != wantOffset || !errors.Is(recovered[0].Reason, tc.reason) {
+				t.Errorf("Unexpected recovery report: %+v", recovered[0])
+			}
+			// 切り詰めたファイルはアクティブファイルとして事前確保し直されるので、追記位置で確認する
+			if db.writeOffset != wantOffset {
+				t.Errorf("Expected file truncated to %d, got %d", wantOffset, db.writeOffset)
+			}
+
+			if val, err := db.Get([]byte("key2")); err != nil || string(val) != "value2" {
+				t.Errorf("Get key2 = %q, %v", val, err)
+			}
+			if _, err := db.Get([]byte("key3")); err != ErrKeyNotFound {
+				t.Errorf("Expected torn key3 to be dropped, got %v", err)
+			}
+
+			// 切り詰め後の追記が再オープン後も読めること
+			if err := db.Put([]byte("key4"), []byte("value4")); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			_ = db.Close()
+
+			db, err = NewDB(dbDir)
+			if err != nil {
+				t.Fatalf("Failed to reopen DB: %v", err)
+			}
+			defer func() { _ = db.Close() }()
+			if len(db.Recovered()) != 0 {
+				t.Errorf("Expected clean reopen, got %v", db.Recovered())
+			}
+			if val, err := db.Get([]byte("key4")); err != nil || string(val) != "value4" {
+				t.Errorf("Get key4 = %q, %v", val, err)
+			}
+		})
+	}
+}
+
+func TestMidSegmentCorruptionIsNotTruncated(t *testing.T) {
+	cases := []struct {
+		name   string
+		offset int64 // 0.data 内で上書きする位置 (先頭のレコード key1 の中)
+		data   []byte
+	}{
+		// key1 の値の 1 バイト (CRC 不一致)
+		{name: "badcrc", offset: fileHeaderSize + recordHeaderSize + 4 + 1, data: []byte{0xFF}},
+		// key1 の ValueSize (ファイル末尾を超えるので途切れたように見える)
+		{name: "badsize", offset: fileHeaderSize + 16, data: []byte{0x7F}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dbDir := "test_mid_segment_corruption_" + tc.name + "_dir"
+			defer func() { _ = os.RemoveAll(dbDir) }()
+
+			db, err := NewDB(dbDir)
+			if err != nil {
+				t.Fatalf("Failed to open DB: %v", err)
+			}
+			for i := 1; i <= 4; i++ {
+				_ = db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+			}
+			_ = db.Close()
+
+			path := filepath.Join(dbDir, "0.data")
+			f, err := os.OpenFile(path, os.O_RDWR, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteAt(tc.data, tc.offset); err != nil {
+				t.Fatal(err)
+			}
+			_ = f.Close()
+			before, _ := os.Stat(path)
+
+			// 後ろに正常なレコードが続くので、書きかけの末尾として切り詰めずにエラーにする
+			_, err = NewDB(dbDir)
+			var ce *CorruptionError
+			if !errors.As(err, &ce) || ce.FileID != 0 || ce.Offset != fileHeaderSize {
+				t.Fatalf("Expected CorruptionError at offset %d, got %v", fileHeaderSize, err)
+			}
+			if after, _ := os.Stat(path); after.Size() != before.Size() {
+				t.Errorf("Segment was truncated from %d to %d bytes", before.Size(), after.Size())
+			}
+
+			// 修復を指定した場合のみ切り詰める
+			opts := DefaultOptions()
+			opts.RepairCorruption = true
+			db, err = OpenWithOptions(dbDir, opts)
+			if err != nil {
+				t.Fatalf("Expected repair mode to open, got %v", err)
+			}
+			defer func() { _ = db.Close() }()
+			if recovered := db.Recovered(); len(recovered) != 1 || recovered[0].Offset != fileHeaderSize {
+				t.Errorf("Unexpected recovery report: %v", recovered)
+			}
+		})
+	}
+}
+
+func TestRepairCorruption(t *testing.T) {
+	dbDir := "test_repair_corruption_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 100
+
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	// 0.data: key1, key2, key3 / 1.data: key4
+	_ = db.Put([]byte("key1"), []byte("value1"))
+	_ = db.Put([]byte("key2"), []byte("value2"))
+	_ = db.Put([]byte("key3"), []byte("value3"))
+	_ = db.Put([]byte("key4"), []byte("value4"))
+	_ = db.Close()
+
+	// 古いセグメント 0.data の 2 番目のレコードを壊す
+	path := filepath.Join(dbDir, "0.data")
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xFF}, fileHeaderSize+30+25); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	if _, err := OpenWithOptions(dbDir, opts); !errors.Is(err, ErrDataCorruption) {
+		t.Fatalf("Expected ErrDataCorruption without repair mode, got %v", err)
+	}
+
+	opts.RepairCorruption = true
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Expected repair mode to open, got %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	if recovered := db.Recovered(); len(recovered) != 1 || recovered[0].FileID != 0 || recovered[0].Offset != fileHeaderSize+30 {
+		t.Errorf("Unexpected recovery report: %v", recovered)
+	}
+	if _, err := db.Get([]byte("key1")); err != nil {
+		t.Errorf("Get key1 failed: %v", err)
+	}
+	if _, err := db.Get([]byte("key2")); err != ErrKeyNotFound {
+		t.Errorf("Expected key2 to be dropped, got %v", err)
+	}
+	if _, err := db.Get([]byte("key4")); err != nil {
+		t.Errorf("Get key4 failed: %v", err)
+	}
+}
+
 func BenchmarkPut(b *testing.B) {
 	dbDir := "bench_put_dir"
 	defer func() { _ = os.RemoveAll(dbDir) }()
@@ -537,6 +926,68 @@ func BenchmarkGet1KB(b *testing.B) {
 	}
 }
 
+func BenchmarkGetInto(b *testing.B) {
+	dbDir := "bench_get_into_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	const itemCount = 1000
+	keys := make([][]byte, itemCount)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		if err := db.Put(keys[i], []byte(fmt.Sprintf("val-%d", i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, 0, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if buf, err = db.GetInto(keys[i%itemCount], buf[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkView(b *testing.B) {
+	dbDir := "bench_view_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	const itemCount = 1000
+	keys := make([][]byte, itemCount)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		if err := db.Put(keys[i], []byte(fmt.Sprintf("val-%d", i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var n int
+	fn := func(value []byte) error {
+		n += len(value)
+		return nil
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.View(keys[i%itemCount], fn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkPutParallel(b *testing.B) {
 	dbPath := "bench_put_parallel.data"
 	defer func() { _ = os.Remove(dbPath) }()
@@ -599,12 +1050,10 @@ func BenchmarkGetOlder(b *testing.B) {
 	dbDir := "bench_get_older_dir"
 	defer func() { _ = os.RemoveAll(dbDir) }()
 
-	// Save original MaxFileSize
-	originalMax := MaxFileSize
-	MaxFileSize = 1024 * 1024 // 1MB
-	defer func() { MaxFileSize = originalMax }()
+	opts := DefaultOptions()
+	opts.SegmentSize = 1024 * 1024 // 1MB
 
-	db, err := NewDB(dbDir)
+	db, err := OpenWithOptions(dbDir, opts)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -634,11 +1083,10 @@ func BenchmarkGetOlderParallel(b *testing.B) {
 	dbDir := "bench_get_older_parallel_dir"
 	defer func() { _ = os.RemoveAll(dbDir) }()
 
-	originalMax := MaxFileSize
-	MaxFileSize = 1024 * 1024 // 1MB
-	defer func() { MaxFileSize = originalMax }()
+	opts := DefaultOptions()
+	opts.SegmentSize = 1024 * 1024 // 1MB
 
-	db, err := NewDB(dbDir)
+	db, err := OpenWithOptions(dbDir, opts)
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -665,3 +1113,246 @@ for pb.Next() {
 		}
 	})
 }
+
+func TestOpenWithOptionsValidation(t *testing.T) {
+	dbDir := "test_options_validation_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	invalid := []func(*Options){
+		func(o *Options) { o.SegmentSize = 0 },
+		func(o *Options) { o.SyncPolicy = SyncPolicy(99) },
+		func(o *Options) { o.MergeMinDeadRatio = 1.5 },
+		func(o *Options) { o.MergeMinDeadBytes = -1 },
+	}
+	for i, mutate := range invalid {
+		opts := DefaultOptions()
+		mutate(&opts)
+		if _, err := OpenWithOptions(dbDir, opts); err == nil {
+			t.Errorf("case %d: expected validation error", i)
+		}
+	}
+
+	// 検証エラー時はディレクトリを作成しない
+	if _, err := os.Stat(dbDir); !os.IsNotExist(err) {
+		t.Errorf("Directory should not be created on invalid options, stat err = %v", err)
+	}
+}
+
+func TestOptionsPersisted(t *testing.T) {
+	dbDir := "test_options_persisted_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	var logBuf strings.Builder
+	opts := DefaultOptions()
+	opts.SegmentSize = 4096
+	opts.Logger = log.New(&logBuf, "", 0)
+
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Close()
+
+	if _, err := os.Stat(filepath.Join(dbDir, optionsFileName)); err != nil {
+		t.Fatalf("OPTIONS file not written: %v", err)
+	}
+
+	// 同じオプションでの再オープンは警告なし
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	_ = db.Close()
+	if logBuf.Len() != 0 {
+		t.Errorf("Unexpected warning: %s", logBuf.String())
+	}
+
+	// SegmentSize を変更すると警告される
+	opts.SegmentSize = 8192
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	_ = db.Close()
+	if !strings.Contains(logBuf.String(), "SegmentSize changed from 4096 to 8192") {
+		t.Errorf("Expected SegmentSize warning, got %q", logBuf.String())
+	}
+}
+
+// 圧縮方式・KeyProvider の有無・BlobThreshold の変更も警告される
+func TestOptionsPersistedWarnings(t *testing.T) {
+	dbDir := "test_options_warnings_dir"
+	_ = os.RemoveAll(dbDir)
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	// 項目を記録していない古い OPTIONS からは、記録していない項目の警告を出さない
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dbDir, optionsFileName), []byte(`{"segment_size": 4096}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var logBuf strings.Builder
+	opts := DefaultOptions()
+	opts.SegmentSize = 4096
+	opts.Compression = CompressionLZ4
+	opts.Logger = log.New(&logBuf, "", 0)
+	reopen := func(want string) error {
+		t.Helper()
+		logBuf.Reset()
+		db, err := OpenWithOptions(dbDir, opts)
+		if err == nil {
+			_ = db.Close()
+		}
+		if want == "" && logBuf.Len() != 0 {
+			t.Errorf("Unexpected warning: %s", logBuf.String())
+		}
+		if want != "" && !strings.Contains(logBuf.String(), want) {
+			t.Errorf("Expected warning %q, got %q", want, logBuf.String())
+		}
+		return err
+	}
+
+	if err := reopen(""); err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	opts.Compression = CompressionFlate
+	if err := reopen("Compression changed from lz4 to flate"); err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	opts.BlobThreshold = 1024
+	if err := reopen("BlobThreshold changed from 0 to 1024"); err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	opts.KeyProvider = testKeys(t, 1, 1)
+	if err := reopen("KeyProvider added"); err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	if err := reopen(""); err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	// 暗号化されたセグメントは開けないが、その前に警告する
+	opts.KeyProvider = nil
+	if err := reopen("KeyProvider removed"); !errors.Is(err, ErrKeyProviderRequired) {
+		t.Errorf("Expected ErrKeyProviderRequired, got %v", err)
+	}
+}
+
+func TestLoadOptions(t *testing.T) {
+	dbDir := "test_load_options_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	// OPTIONS が無ければそのまま
+	if opts, err := LoadOptions(dbDir, DefaultOptions()); err != nil || opts.SegmentSize != DefaultSegmentSize {
+		t.Fatalf("LoadOptions without OPTIONS = %+v, %v", opts, err)
+	}
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 4096
+	opts.Compression = CompressionFlate
+	opts.BlobThreshold = 128
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Close()
+
+	loaded, err := LoadOptions(dbDir, DefaultOptions())
+	if err != nil {
+		t.Fatalf("LoadOptions failed: %v", err)
+	}
+	if loaded.SegmentSize != 4096 || loaded.Compression != CompressionFlate || loaded.BlobThreshold != 128 {
+		t.Errorf("LoadOptions = SegmentSize %d, Compression %v, BlobThreshold %d", loaded.SegmentSize, loaded.Compression, loaded.BlobThreshold)
+	}
+}
+
+func TestSegmentSizePerDB(t *testing.T) {
+	smallDir := "test_segment_small_dir"
+	largeDir := "test_segment_large_dir"
+	defer func() { _ = os.RemoveAll(smallDir) }()
+	defer func() { _ = os.RemoveAll(largeDir) }()
+
+	small := DefaultOptions()
+	small.SegmentSize = 100
+	smallDB, err := OpenWithOptions(smallDir, small)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = smallDB.Close() }()
+
+	largeDB, err := NewDB(largeDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = largeDB.Close() }()
+
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if err := smallDB.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := largeDB.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	countData := func(dir string) int {
+		entries, _ := os.ReadDir(dir)
+		n := 0
+		for _, e := range entries {
+			if filepath.Ext(e.Name()) == ".data" {
+				n++
+			}
+		}
+		return n
+	}
+	if n := countData(smallDir); n < 2 {
+		t.Errorf("Expected small DB to rotate, found %d data files", n)
+	}
+	if n := countData(largeDir); n != 1 {
+		t.Errorf("Expected large DB to keep one data file, found %d", n)
+	}
+}
+
+func TestReadOnlyOptions(t *testing.T) {
+	dbDir := "test_readonly_options_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+
+	// 存在しないディレクトリは作成しない
+	if _, err := OpenWithOptions(dbDir, opts); err == nil {
+		t.Fatal("Expected error when opening missing directory read-only")
+	}
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	_ = db.Close()
+
+	ro, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open read-only: %v", err)
+	}
+	defer func() { _ = ro.Close() }()
+
+	got, err := ro.Get([]byte("key"))
+	if err != nil || string(got) != "value" {
+		t.Errorf("Get = %q, %v; want value", got, err)
+	}
+	if err := ro.Put([]byte("key"), []byte("x")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from Put, got %v", err)
+	}
+	if err := ro.Delete([]byte("key")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from Delete, got %v", err)
+	}
+	if err := ro.Merge(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly from Merge, got %v", err)
+	}
+}
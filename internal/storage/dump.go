@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// FileRecord はデータファイルまたは Hint File の 1 エントリをデコードしたものです。
+// 調査用のツール (cmd/bitcask dump など) 向けに、インデックスへ反映せずファイルの内容をそのまま表します。
+type FileRecord struct {
+	Offset     int64  // ファイル内のエントリの位置
+	Size       int64  // ファイル上のエントリのサイズ
+	CRC        uint32 // 記録されている CRC
+	CRCValid   bool   // CRC が内容と一致するか
+	Unfinished bool   // CRC 不一致のうち、PutStream が値を書き終えていないレコード (破損ではなく、どのキーにも反映されない)
+	Timestamp  int64  // 書き込み時刻 (UnixNano)
+	Flags      uint8  // レコードフラグ (FlagNames で名前に変換できます)
+	KeySize    uint32
+	ValueSize  uint32 // ファイル上の値の長さ (有効期限を含む)。Tombstone は 0
+	Tombstone  bool
+	Expiry     int64  // 有効期限 (UnixNano)。無期限なら 0
+	Key        []byte // 暗号化されたレコード (エントリ) では暗号文
+	Value      []byte // データファイルのみ。有効期限を除き、展開したユーザーの値 (バッチのマーカーはレコード数)。暗号化されたレコードでは認証タグを含む暗号文
+	// DataOffset は Hint File のみで、対応するレコードのデータファイル内の位置です。
+	DataOffset int64
+	// Blob は値を Blob File に分離したレコード (エントリ) の値の位置です。暗号化されたレコードでは読めないのでゼロ値です。
+	Blob BlobPos
+}
+
+// FlagNames はレコードフラグの名前を返します。
+func (r FileRecord) FlagNames() []string {
+	var names []string
+	if r.Flags&flagBatchBegin != 0 {
+		names = append(names, "batch-begin")
+	}
+	if r.Flags&flagBatchCommit != 0 {
+		names = append(names, "batch-commit")
+	}
+	if r.Flags&flagExpiry != 0 {
+		names = append(names, "expiry")
+	}
+	if r.Flags&flagLZ4 != 0 {
+		names = append(names, "lz4")
+	}
+	if r.Flags&flagFlate != 0 {
+		names = append(names, "flate")
+	}
+	if r.Flags&flagEncrypted != 0 {
+		names = append(names, "encrypted")
+	}
+	if r.Flags&flagBlob != 0 {
+		names = append(names, "blob")
+	}
+	if unknown := r.Flags &^ (flagBatchBegin | flagBatchCommit | flagExpiry | flagLZ4 | flagFlate | flagEncrypted | flagBlob); unknown != 0 {
+		names = append(names, fmt.Sprintf("0x%02x", unknown))
+	}
+	return names
+}
+
+// WalkDataFile はデータファイル (N.data) または Blob File (N.blob) のレコードを先頭から順に fn へ渡します。
+// ファイルヘッダは読み飛ばします (内容は ReadFileHeader で取得できます)。
+// 鍵は使わないため、暗号化されたレコードのキーと値は暗号文のまま渡します。
+// CRC 不一致のレコードは CRCValid を false にして渡し、走査を続けます。
+// ファイル末尾で途切れたレコードを検出した場合は io.ErrUnexpectedEOF を wrap したエラーを返します。
+// 開いている DB のアクティブファイルの、事前確保したゼロ埋めの末尾は読み飛ばします。
+func WalkDataFile(path string, fn func(FileRecord) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := stat.Size()
+	start, err := fileStart(path, file, fileSize)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, start, fileSize-start))
+
+	for offset := start; offset < fileSize; {
+		header := make([]byte, recordHeaderSize)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return truncatedEntry(path, offset, err)
+		}
+		h := decodeRecordHeader(header)
+		// ゼロ埋めの末尾は事前確保したアクティブファイルの未使用領域
+		if h.timestamp == 0 && h.crc == 0 && isPreallocatedTail(file, offset, fileSize) {
+			return nil
+		}
+		if offset+h.size() > fileSize {
+			return truncatedEntry(path, offset, io.ErrUnexpectedEOF)
+		}
+
+		data := make([]byte, h.size()-4)
+		copy(data[0:16], header[4:])
+		if _, err := io.ReadFull(reader, data[16:]); err != nil {
+			return truncatedEntry(path, offset, err)
+		}
+
+		rec := FileRecord{
+			Offset:    offset,
+			Size:      h.size(),
+			CRC:       h.crc,
+			CRCValid:  crc32.ChecksumIEEE(data) == h.crc,
+			Timestamp: int64(h.timestamp),
+			Flags:     h.flags,
+			KeySize:   h.keySize,
+			ValueSize: uint32(h.valueLen()),
+			Tombstone: h.isTombstone(),
+			Key:       data[16 : 16+h.keySize],
+		}
+		rec.Unfinished = !rec.CRCValid && isUnfinishedRecord(header)
+		rec.Value = data[16+h.keySize:]
+		if h.flags&flagEncrypted == 0 {
+			if expiry, value, err := splitExpiry(h, rec.Value); err == nil {
+				rec.Expiry, rec.Value = expiry, value
+			}
+			if h.flags&flagBlob != 0 {
+				if blob, err := decodeBlobPointer(rec.Value); err == nil {
+					rec.Blob = blob
+				}
+			}
+			// 展開できない (CRC 不一致などで壊れている) 値は格納されたまま渡す
+			if value, err := decompressValue(h.flags, rec.Value); err == nil {
+				rec.Value = value
+			}
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+		offset += h.size()
+	}
+	return nil
+}
+
+// WalkHintFile は Hint File (N.hint) のエントリを先頭から順に fn へ渡します。
+// CRC の扱いと途切れたエントリのエラーは WalkDataFile と同じです。
+func WalkHintFile(path string, fn func(FileRecord) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := stat.Size()
+	start, err := fileStart(path, file, fileSize)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, start, fileSize-start))
+
+	for offset := start; offset < fileSize; {
+		header := make([]byte, hintHeaderSize)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return truncatedEntry(path, offset, err)
+		}
+		h := decodeRecordHeader(header[:recordHeaderSize])
+
+		var extra int64
+		if h.hasExpiry() {
+			extra = expirySize
+		}
+		if h.flags&flagBlob != 0 {
+			extra += blobPointerSize
+		}
+		size := hintEntrySize(h)
+		if offset+size > fileSize {
+			return truncatedEntry(path, offset, io.ErrUnexpectedEOF)
+		}
+
+		data := make([]byte, size-4)
+		copy(data, header[4:])
+		if _, err := io.ReadFull(reader, data[hintHeaderSize-4:]); err != nil {
+			return truncatedEntry(path, offset, err)
+		}
+
+		rec := FileRecord{
+			Offset:     offset,
+			Size:       size,
+			CRC:        h.crc,
+			CRCValid:   crc32.ChecksumIEEE(data) == h.crc,
+			Timestamp:  int64(h.timestamp),
+			Flags:      h.flags,
+			KeySize:    h.keySize,
+			ValueSize:  uint32(h.valueLen()),
+			Tombstone:  h.isTombstone(),
+			Key:        data[hintHeaderSize-4+extra:],
+			DataOffset: int64(binary.BigEndian.Uint64(header[20:28])),
+		}
+		if h.hasExpiry() {
+			rec.Expiry = int64(binary.BigEndian.Uint64(data[hintHeaderSize-4:]))
+		}
+		if h.flags&flagBlob != 0 {
+			keyStart := hintHeaderSize - 4 + extra
+			if blob, err := decodeBlobPointer(data[keyStart-blobPointerSize : keyStart]); err == nil {
+				rec.Blob = blob
+			}
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
+
+// fileStart はファイルヘッダを検証し、最初のエントリの位置 (旧形式は 0) を返します。
+func fileStart(path string, file *os.File, fileSize int64) (int64, error) {
+	buf := make([]byte, min(fileSize, fileHeaderSize))
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		return 0, err
+	}
+	h, err := decodeFileHeader(buf)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, truncatedEntry(path, 0, err)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return h.size(), nil
+}
+
+func truncatedEntry(path string, offset int64, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%s: truncated entry at offset %d: %w", path, offset, err)
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWalkDataAndHintFile(t *testing.T) {
+	dbDir := "test_dump_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Put([]byte("a"), []byte("1"))
+	_ = db.PutWithTTL([]byte("b"), []byte("22"), time.Hour)
+	_ = db.Delete([]byte("a"))
+	b := NewBatch()
+	b.Put([]byte("c"), []byte("333"))
+	if err := db.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []FileRecord
+	dataPath := filepath.Join(dbDir, "0.data")
+	if err := WalkDataFile(dataPath, func(r FileRecord) error {
+		recs = append(recs, r)
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkDataFile failed: %v", err)
+	}
+
+	want := []struct {
+		key, value string
+		tombstone  bool
+		flags      int
+	}{
+		{"a", "1", false, 0},
+		{"b", "22", false, 1},
+		{"a", "", true, 0},
+		{"", "", false, 1}, // batch-begin
+		{"c", "333", false, 0},
+		{"", "", false, 1}, // batch-commit
+	}
+	if len(recs) != len(want) {
+		t.Fatalf("Expected %d records, got %d", len(want), len(recs))
+	}
+	offset := int64(fileHeaderSize)
+	for i, w := range want {
+		r := recs[i]
+		if !r.CRCValid || r.Offset != offset || string(r.Key) != w.key || r.Tombstone != w.tombstone || len(r.FlagNames()) != w.flags {
+			t.Errorf("record %d: unexpected %+v (flags %v)", i, r, r.FlagNames())
+		}
+		if w.value != "" && string(r.Value) != w.value {
+			t.Errorf("record %d: value %q, want %q", i, r.Value, w.value)
+		}
+		offset += r.Size
+	}
+	if recs[1].Expiry == 0 || recs[1].FlagNames()[0] != "expiry" {
+		t.Errorf("Expected expiry on record 1, got %+v", recs[1])
+	}
+
+	// CRC 不一致は報告して走査を続け、末尾の途切れはエラーにする
+	data, _ := os.ReadFile(dataPath)
+	data[recs[0].Offset+recordHeaderSize] ^= 0xff
+	data = append(data, data[:recordHeaderSize]...)
+	if err := os.WriteFile(dataPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var n, bad int
+	err = WalkDataFile(dataPath, func(r FileRecord) error {
+		n++
+		if !r.CRCValid {
+			bad++
+		}
+		return nil
+	})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected ErrUnexpectedEOF for torn tail, got %v", err)
+	}
+	if n != len(want) || bad != 1 {
+		t.Errorf("Expected %d records with 1 bad CRC, got %d with %d bad", len(want), n, bad)
+	}
+}
+
+func TestWalkHintFile(t *testing.T) {
+	dbDir := "test_dump_hint_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	_ = db.Put([]byte("a"), []byte("1"))
+	_ = db.PutWithTTL([]byte("b"), []byte("22"), time.Hour)
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+
+	hints, _ := filepath.Glob(filepath.Join(dbDir, "*.hint"))
+	if len(hints) != 1 {
+		t.Fatalf("Expected 1 hint file, got %v", hints)
+	}
+	dataPath := hints[0][:len(hints[0])-len(".hint")] + ".data"
+	var dataOffsets []int64
+	_ = WalkDataFile(dataPath, func(r FileRecord) error {
+		dataOffsets = append(dataOffsets, r.Offset)
+		return nil
+	})
+
+	var recs []FileRecord
+	if err := WalkHintFile(hints[0], func(r FileRecord) error {
+		recs = append(recs, r)
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkHintFile failed: %v", err)
+	}
+	if len(recs) != 2 || len(dataOffsets) != 2 {
+		t.Fatalf("Expected 2 hint entries and 2 records, got %d and %d", len(recs), len(dataOffsets))
+	}
+	for i, r := range recs {
+		if !r.CRCValid || r.DataOffset != dataOffsets[i] {
+			t.Errorf("hint %d: unexpected %+v", i, r)
+		}
+	}
+	if string(recs[1].Key) != "b" || recs[1].Expiry == 0 || recs[1].ValueSize != expirySize+2 {
+		t.Errorf("Expected expiry entry for b, got %+v", recs[1])
+	}
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// ファイルヘッダの形式:
+//
+//	[Magic(4)][Version(2)][Kind(1)][Flags(1)][FileID(4)][CreatedAt(8)][KeyID(4)][CRC(4)]
+//
+// 新しく作成するデータファイルと Hint File (と Blob File) は先頭にヘッダを持ち、レコード (エントリ) はその直後から始まります。
+// ヘッダ導入前のファイルはヘッダを持たず、先頭からレコードが並びます (旧形式、Version 0 として扱います)。
+// 旧形式のファイルは Merge で書き直すとヘッダ付きのセグメントになります。
+// CRC は先頭から CRC の直前までに対して計算します。
+//
+// Version 1 のヘッダは KeyID を持たない 20 バイト + CRC で、Flags は常に 0 です。
+// Version 2 で暗号化 (fileFlagEncrypted と、暗号化に使った鍵の KeyID) を追加しました。
+const (
+	fileHeaderSize   = 28
+	fileHeaderSizeV1 = 24
+
+	// formatVersion は新しく作成するファイルの形式のバージョンです。
+	formatVersion uint16 = 2
+)
+
+// fileFlagEncrypted はレコードを暗号化したファイルのヘッダフラグです (crypto.go を参照)。
+const fileFlagEncrypted uint8 = 1
+
+// fileMagic はヘッダ付きのファイルの先頭 4 バイトです。
+var fileMagic = []byte("BCSK")
+
+var (
+	// ErrUnsupportedFormat はこの実装より新しい形式のファイルを開こうとした場合のエラーです。
+	ErrUnsupportedFormat = errors.New("unsupported file format version")
+	// ErrNotBitcaskFile はヘッダが無く、先頭のレコードも読めないファイルのエラーです。
+	ErrNotBitcaskFile = errors.New("not a bitcask file")
+)
+
+// fileKindCodes はヘッダの Kind に記録する値です。
+var fileKindCodes = map[FileKind]byte{
+	FileKindData: 'D',
+	FileKindHint: 'H',
+	FileKindBlob: 'B',
+}
+
+// FileHeader はデータファイル、Hint File または Blob File のヘッダです。
+type FileHeader struct {
+	Version   uint16 // 0 はヘッダの無い旧形式 (他のフィールドも 0)
+	Kind      FileKind
+	FileID    int
+	CreatedAt int64  // 作成時刻 (UnixNano)
+	Encrypted bool   // レコードを暗号化したファイルか
+	KeyID     uint32 // 暗号化に使った鍵の ID (KeyProvider.Key に渡す)
+}
+
+// headerSize は version のヘッダのサイズです。
+func headerSize(version uint16) int64 {
+	switch version {
+	case 0:
+		return 0
+	case 1:
+		return fileHeaderSizeV1
+	}
+	return fileHeaderSize
+}
+
+// size はファイル上のヘッダのサイズ (= 最初のレコードの位置) です。
+func (h FileHeader) size() int64 {
+	return headerSize(h.Version)
+}
+
+// appendFileHeader は現在の形式のファイルヘッダをエンコードして buf に追記します。
+// encrypted の場合は keyID の鍵で暗号化するファイルとして記録します。
+func appendFileHeader(buf []byte, kind FileKind, fileID int, encrypted bool, keyID uint32) []byte {
+	start := len(buf)
+	var header [fileHeaderSize]byte
+	copy(header[0:4], fileMagic)
+	binary.BigEndian.PutUint16(header[4:6], formatVersion)
+	header[6] = fileKindCodes[kind]
+	if encrypted {
+		header[7] = fileFlagEncrypted
+	}
+	binary.BigEndian.PutUint32(header[8:12], uint32(fileID))
+	binary.BigEndian.PutUint64(header[12:20], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(header[20:24], keyID)
+
+	buf = append(buf, header[:]...)
+	crc := crc32.ChecksumIEEE(buf[start : start+fileHeaderSize-4])
+	binary.BigEndian.PutUint32(buf[start+fileHeaderSize-4:], crc)
+	return buf
+}
+
+// decodeFileHeader はファイルの先頭 (最大 fileHeaderSize バイト) からヘッダをデコードします。
+// Magic で始まらないファイルは旧形式として Version 0 のヘッダを返します。
+// Magic で始まるがヘッダの途中で終わっている場合は io.ErrUnexpectedEOF を返します。
+// 種類とファイル ID は検証しません (checkFileHeader を参照)。
+//
+// この実装より新しい Version はヘッダの長さも分からないため、CRC より先に ErrUnsupportedFormat を返します。
+func decodeFileHeader(buf []byte) (FileHeader, error) {
+	n := min(len(buf), len(fileMagic))
+	if n == 0 || !bytes.Equal(buf[:n], fileMagic[:n]) {
+		return FileHeader{}, nil
+	}
+	if len(buf) < fileHeaderSizeV1 {
+		return FileHeader{}, io.ErrUnexpectedEOF
+	}
+
+	h := FileHeader{
+		Version:   binary.BigEndian.Uint16(buf[4:6]),
+		FileID:    int(binary.BigEndian.Uint32(buf[8:12])),
+		CreatedAt: int64(binary.BigEndian.Uint64(buf[12:20])),
+	}
+	for kind, code := range fileKindCodes {
+		if buf[6] == code {
+			h.Kind = kind
+		}
+	}
+	if h.Version > formatVersion {
+		return FileHeader{}, fmt.Errorf("%w: %d.%s has version %d (supported: %d)", ErrUnsupportedFormat, h.FileID, h.Kind, h.Version, formatVersion)
+	}
+	size := max(h.size(), fileHeaderSizeV1)
+	if int64(len(buf)) < size {
+		return FileHeader{}, io.ErrUnexpectedEOF
+	}
+	if crc := crc32.ChecksumIEEE(buf[:size-4]); crc != binary.BigEndian.Uint32(buf[size-4:]) {
+		return FileHeader{}, crcError(h.Kind, h.FileID, 0, binary.BigEndian.Uint32(buf[size-4:]), crc)
+	}
+	if h.Version == 0 || h.Kind == "" {
+		return FileHeader{}, corruptionError(h.Kind, h.FileID, 0, "invalid file header")
+	}
+	if h.Version >= 2 {
+		h.Encrypted = buf[7]&fileFlagEncrypted != 0
+		h.KeyID = binary.BigEndian.Uint32(buf[20:24])
+	}
+	return h, nil
+}
+
+// checkFileHeader はヘッダが kind の fileID のファイルのものかを検証します。
+// 別のファイルをリネームしたものなどは *CorruptionError を返します。
+func checkFileHeader(h FileHeader, kind FileKind, fileID int) error {
+	if h.Version == 0 {
+		return nil
+	}
+	if h.Kind != kind || h.FileID != fileID {
+		return corruptionError(kind, fileID, 0, fmt.Sprintf("file header belongs to %d.%s", h.FileID, h.Kind))
+	}
+	return nil
+}
+
+// readFileHeader は r の先頭からヘッダを読み込み、kind の fileID のファイルのものかを検証します。
+func readFileHeader(r io.ReaderAt, size int64, kind FileKind, fileID int) (FileHeader, error) {
+	if size == 0 {
+		return FileHeader{}, nil
+	}
+	buf := make([]byte, min(size, fileHeaderSize))
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return FileHeader{}, err
+	}
+	h, err := decodeFileHeader(buf)
+	if err != nil {
+		// Kind と FileID はヘッダではなく読もうとしたファイルのものを報告する
+		var ce *CorruptionError
+		if errors.As(err, &ce) {
+			ce.Kind, ce.FileID = kind, fileID
+		}
+		return FileHeader{}, err
+	}
+	return h, checkFileHeader(h, kind, fileID)
+}
+
+// ReadFileHeader はデータファイル、Hint File または Blob File のヘッダを読み込みます。
+// ヘッダの無い旧形式のファイルは Version 0 を返します。種類とファイル ID はファイル名と照合しません。
+func ReadFileHeader(path string) (FileHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileHeader{}, err
+	}
+	defer func() { _ = f.Close() }()
+
+	buf := make([]byte, fileHeaderSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && !isTornRead(err) {
+		return FileHeader{}, err
+	}
+	h, err := decodeFileHeader(buf[:n])
+	if err != nil {
+		return FileHeader{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return h, nil
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileHeader(t *testing.T) {
+	dbDir := "test_file_header_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Put([]byte("key1"), []byte("value1"))
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	_ = db.Close()
+
+	ids, _ := listSegmentIDs(dbDir)
+	for _, id := range ids {
+		h, err := ReadFileHeader(filepath.Join(dbDir, fmt.Sprintf("%d.data", id)))
+		if err != nil || h.Version != formatVersion || h.Kind != FileKindData || h.FileID != id || h.CreatedAt == 0 {
+			t.Errorf("Unexpected header of %d.data: %+v, %v", id, h, err)
+		}
+	}
+	h, err := ReadFileHeader(filepath.Join(dbDir, fmt.Sprintf("%d.hint", ids[0])))
+	if err != nil || h.Version != formatVersion || h.Kind != FileKindHint || h.FileID != ids[0] {
+		t.Errorf("Unexpected header of %d.hint: %+v, %v", ids[0], h, err)
+	}
+
+	// 別のセグメントのファイルをリネームしたものは破損として扱う
+	last := ids[len(ids)-1]
+	if err := os.Rename(filepath.Join(dbDir, fmt.Sprintf("%d.data", last)), filepath.Join(dbDir, fmt.Sprintf("%d.data", last+1))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDB(dbDir); !errors.Is(err, ErrDataCorruption) {
+		t.Errorf("Expected ErrDataCorruption for renamed segment, got %v", err)
+	}
+	if err := os.Rename(filepath.Join(dbDir, fmt.Sprintf("%d.data", last+1)), filepath.Join(dbDir, fmt.Sprintf("%d.data", last))); err != nil {
+		t.Fatal(err)
+	}
+
+	// この実装より新しい形式のファイルは開かない
+	path := filepath.Join(dbDir, fmt.Sprintf("%d.data", ids[0]))
+	data, _ := os.ReadFile(path)
+	binary.BigEndian.PutUint16(data[4:6], formatVersion+1)
+	binary.BigEndian.PutUint32(data[fileHeaderSize-4:], crc32.ChecksumIEEE(data[:fileHeaderSize-4]))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDB(dbDir); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+func TestLegacyFileUpgrade(t *testing.T) {
+	dbDir := "test_legacy_upgrade_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	// ヘッダ導入前の形式で 0.data を作成する
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var buf []byte
+	buf = appendRecord(buf, 1, 0, []byte("key1"), []byte("value1"), false)
+	buf = appendRecord(buf, 2, 0, []byte("key2"), []byte("value2"), false)
+	buf = appendRecord(buf, 3, 0, []byte("key1"), nil, true)
+	if err := os.WriteFile(filepath.Join(dbDir, "0.data"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open legacy DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	if v, err := db.Get([]byte("key2")); err != nil || string(v) != "value2" {
+		t.Fatalf("Get key2 = %q, %v", v, err)
+	}
+	// 旧形式のアクティブファイルには旧形式のまま追記する
+	_ = db.Put([]byte("key3"), []byte("value3"))
+	if st := db.Stats(); len(st.Segments) != 1 || st.Segments[0].FormatVersion != 0 || st.Segments[0].TotalBytes != int64(len(buf))+30 {
+		t.Errorf("Unexpected legacy stats: %+v", st.Segments)
+	}
+
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	for _, seg := range db.Stats().Segments {
+		if seg.FormatVersion != formatVersion {
+			t.Errorf("Expected segment %d to be upgraded, got version %d", seg.FileID, seg.FormatVersion)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dbDir, "0.data")); !os.IsNotExist(err) {
+		t.Errorf("Expected legacy segment to be removed, got %v", err)
+	}
+	_ = db.Close()
+
+	db, err = NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen upgraded DB: %v", err)
+	}
+	for key, want := range map[string]string{"key2": "value2", "key3": "value3"} {
+		if v, err := db.Get([]byte(key)); err != nil || string(v) != want {
+			t.Errorf("Get %s = %q, %v", key, v, err)
+		}
+	}
+	if _, err := db.Get([]byte("key1")); err != ErrKeyNotFound {
+		t.Errorf("Expected key1 to stay deleted, got %v", err)
+	}
+}
+
+func TestNotBitcaskFile(t *testing.T) {
+	dbDir := "test_not_bitcask_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	junk := []byte("this is not a segment file, just some text that happens to be named 7.data\n")
+	path := filepath.Join(dbDir, "7.data")
+	if err := os.WriteFile(path, junk, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDB(dbDir); !errors.Is(err, ErrNotBitcaskFile) {
+		t.Errorf("Expected ErrNotBitcaskFile, got %v", err)
+	}
+	// 最新セグメントでも書きかけとして切り詰めない
+	if info, _ := os.Stat(path); info.Size() != int64(len(junk)) {
+		t.Errorf("Expected 7.data to be left untouched, got size %d", info.Size())
+	}
+}
+
+func TestTornFileHeader(t *testing.T) {
+	dbDir := "test_torn_header_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Put([]byte("key1"), []byte("value1"))
+	_ = db.Close()
+
+	// 新しいセグメントの作成直後、ヘッダの途中でクラッシュした状態
+	header := appendFileHeader(nil, FileKindData, 1, false, 0)
+	if err := os.WriteFile(filepath.Join(dbDir, "1.data"), header[:10], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Expected torn header to be recovered, got %v", err)
+	}
+	if recovered := db.Recovered(); len(recovered) != 1 || recovered[0].FileID != 1 || recovered[0].DroppedBytes != 10 {
+		t.Errorf("Unexpected recovery report: %v", recovered)
+	}
+	_ = db.Put([]byte("key2"), []byte("value2"))
+	_ = db.Close()
+
+	h, err := ReadFileHeader(filepath.Join(dbDir, "1.data"))
+	if err != nil || h.Version != formatVersion || h.FileID != 1 {
+		t.Errorf("Expected header to be rewritten, got %+v, %v", h, err)
+	}
+	report, err := Verify(dbDir)
+	if err != nil || !report.OK() || report.Records != 2 || report.LegacyFiles != 0 {
+		t.Errorf("Expected clean report, got %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,379 @@
+package storage
+
+import "sort"
+
+// keyIndex はキー順に並んだインメモリインデックス (KeyDir) です。
+//
+// Copy-on-Write の B-Tree で、clone() は O(1) でスナップショットを作れます。
+// clone 後はどちらの木も共有ノードを直接変更せず、変更が必要になったノードだけを
+// コピーしてから書き換えるため、イテレータは書き込みが続いていても clone 時点の内容を読めます。
+// (github.com/google/btree と同じ方式です)
+type keyIndex struct {
+	root   *indexNode
+	length int
+	cow    *cowToken
+}
+
+// cowToken はノードの所有者を表します。ノードの cow が木の cow と一致する場合のみ直接変更できます。
+type cowToken struct {
+	_ byte // ゼロサイズだとアドレスが同一になりうるため
+}
+
+type indexItem struct {
+	key string
+	pos RecordPos
+}
+
+type indexNode struct {
+	items    []indexItem
+	children []*indexNode
+	cow      *cowToken
+}
+
+const (
+	indexDegree   = 32
+	indexMaxItems = indexDegree*2 - 1
+	indexMinItems = indexDegree - 1
+)
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{cow: &cowToken{}}
+}
+
+// Len はインデックス内のキー数を返します。
+func (t *keyIndex) Len() int {
+	return t.length
+}
+
+// clone はインデックスのスナップショットを返します。
+// 以後、t と戻り値はそれぞれ独立に変更でき、互いの内容に影響しません。
+func (t *keyIndex) clone() *keyIndex {
+	out := *t
+	t.cow = &cowToken{}
+	out.cow = &cowToken{}
+	return &out
+}
+
+// get はキーの位置情報を返します。
+func (t *keyIndex) get(key string) (RecordPos, bool) {
+	n := t.root
+	for n != nil {
+		i, found := n.find(key)
+		if found {
+			return n.items[i].pos, true
+		}
+		if len(n.children) == 0 {
+			break
+		}
+		n = n.children[i]
+	}
+	return RecordPos{}, false
+}
+
+// set はキーの位置情報を登録し、上書きした場合は以前の値を返します。
+func (t *keyIndex) set(key string, pos RecordPos) (RecordPos, bool) {
+	item := indexItem{key: key, pos: pos}
+	if t.root == nil {
+		t.root = &indexNode{cow: t.cow}
+		t.root.items = append(t.root.items, item)
+		t.length++
+		return RecordPos{}, false
+	}
+
+	t.root = t.root.mutableFor(t.cow)
+	if len(t.root.items) >= indexMaxItems {
+		mid, second := t.root.split(indexMaxItems / 2)
+		oldRoot := t.root
+		t.root = &indexNode{cow: t.cow}
+		t.root.items = append(t.root.items, mid)
+		t.root.children = append(t.root.children, oldRoot, second)
+	}
+
+	old, replaced := t.root.insert(item)
+	if !replaced {
+		t.length++
+	}
+	return old.pos, replaced
+}
+
+// delete はキーを削除し、存在した場合は削除した値を返します。
+func (t *keyIndex) delete(key string) (RecordPos, bool) {
+	if t.root == nil || len(t.root.items) == 0 {
+		return RecordPos{}, false
+	}
+	t.root = t.root.mutableFor(t.cow)
+	out, removed := t.root.remove(key, removeItem)
+	if len(t.root.items) == 0 && len(t.root.children) > 0 {
+		t.root = t.root.children[0]
+	}
+	if removed {
+		t.length--
+	}
+	return out.pos, removed
+}
+
+// ascend は全キーを昇順に fn へ渡します。fn が false を返すと終了します。
+func (t *keyIndex) ascend(fn func(key string, pos RecordPos) bool) {
+	var c indexCursor
+	for c.seek(t, ""); c.valid(); c.next() {
+		item := c.item()
+		if !fn(item.key, item.pos) {
+			return
+		}
+	}
+}
+
+// find は key 以上となる最初の要素の位置と、完全一致したかを返します。
+func (n *indexNode) find(key string) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return n.items[i].key >= key
+	})
+	return i, i < len(n.items) && n.items[i].key == key
+}
+
+// mutableFor は cow が所有するノードを返します。所有者が異なる場合はコピーします。
+func (n *indexNode) mutableFor(cow *cowToken) *indexNode {
+	if n.cow == cow {
+		return n
+	}
+	out := &indexNode{cow: cow}
+	out.items = make([]indexItem, len(n.items), cap(n.items))
+	copy(out.items, n.items)
+	if len(n.children) > 0 {
+		out.children = make([]*indexNode, len(n.children), cap(n.children))
+		copy(out.children, n.children)
+	}
+	return out
+}
+
+func (n *indexNode) mutableChild(i int) *indexNode {
+	c := n.children[i].mutableFor(n.cow)
+	n.children[i] = c
+	return c
+}
+
+// split は i 番目の要素で分割し、その要素と右半分の新しいノードを返します。
+func (n *indexNode) split(i int) (indexItem, *indexNode) {
+	item := n.items[i]
+	next := &indexNode{cow: n.cow}
+	next.items = append(next.items, n.items[i+1:]...)
+	clear(n.items[i:])
+	n.items = n.items[:i]
+	if len(n.children) > 0 {
+		next.children = append(next.children, n.children[i+1:]...)
+		clear(n.children[i+1:])
+		n.children = n.children[:i+1]
+	}
+	return item, next
+}
+
+// maybeSplitChild は子ノードが満杯なら分割し、分割したかを返します。
+func (n *indexNode) maybeSplitChild(i int) bool {
+	if len(n.children[i].items) < indexMaxItems {
+		return false
+	}
+	first := n.mutableChild(i)
+	item, second := first.split(indexMaxItems / 2)
+	n.items = insertAt(n.items, i, item)
+	n.children = insertAt(n.children, i+1, second)
+	return true
+}
+
+func (n *indexNode) insert(item indexItem) (indexItem, bool) {
+	i, found := n.find(item.key)
+	if found {
+		old := n.items[i]
+		n.items[i] = item
+		return old, true
+	}
+	if len(n.children) == 0 {
+		n.items = insertAt(n.items, i, item)
+		return indexItem{}, false
+	}
+	if n.maybeSplitChild(i) {
+		inTree := n.items[i]
+		switch {
+		case item.key < inTree.key:
+			// 左側の子へ
+		case item.key > inTree.key:
+			i++
+		default:
+			n.items[i] = item
+			return inTree, true
+		}
+	}
+	return n.mutableChild(i).insert(item)
+}
+
+type removeKind int
+
+const (
+	removeItem removeKind = iota // 指定キーを削除
+	removeMax                    // 部分木の最大要素を削除
+)
+
+func (n *indexNode) remove(key string, kind removeKind) (indexItem, bool) {
+	var i int
+	var found bool
+	switch kind {
+	case removeMax:
+		if len(n.children) == 0 {
+			out := n.items[len(n.items)-1]
+			n.items[len(n.items)-1] = indexItem{}
+			n.items = n.items[:len(n.items)-1]
+			return out, true
+		}
+		i = len(n.items)
+	case removeItem:
+		i, found = n.find(key)
+		if len(n.children) == 0 {
+			if !found {
+				return indexItem{}, false
+			}
+			out := n.items[i]
+			n.items = removeAt(n.items, i)
+			return out, true
+		}
+	}
+
+	// 子ノードが最小要素数なら、削除前に兄弟から借りるか併合して要素数を確保する
+	if len(n.children[i].items) <= indexMinItems {
+		return n.growChildAndRemove(i, key, kind)
+	}
+	child := n.mutableChild(i)
+	if found {
+		// このノードの要素を削除し、左の子の最大要素 (直前の要素) で置き換える
+		out := n.items[i]
+		n.items[i], _ = child.remove("", removeMax)
+		return out, true
+	}
+	return child.remove(key, kind)
+}
+
+func (n *indexNode) growChildAndRemove(i int, key string, kind removeKind) (indexItem, bool) {
+	switch {
+	case i > 0 && len(n.children[i-1].items) > indexMinItems:
+		// 左の兄弟から借りる
+		child := n.mutableChild(i)
+		stealFrom := n.mutableChild(i - 1)
+		stolen := stealFrom.items[len(stealFrom.items)-1]
+		stealFrom.items[len(stealFrom.items)-1] = indexItem{}
+		stealFrom.items = stealFrom.items[:len(stealFrom.items)-1]
+		child.items = insertAt(child.items, 0, n.items[i-1])
+		n.items[i-1] = stolen
+		if len(stealFrom.children) > 0 {
+			last := stealFrom.children[len(stealFrom.children)-1]
+			stealFrom.children[len(stealFrom.children)-1] = nil
+			stealFrom.children = stealFrom.children[:len(stealFrom.children)-1]
+			child.children = insertAt(child.children, 0, last)
+		}
+	case i < len(n.items) && len(n.children[i+1].items) > indexMinItems:
+		// 右の兄弟から借りる
+		child := n.mutableChild(i)
+		stealFrom := n.mutableChild(i + 1)
+		stolen := stealFrom.items[0]
+		stealFrom.items = removeAt(stealFrom.items, 0)
+		child.items = append(child.items, n.items[i])
+		n.items[i] = stolen
+		if len(stealFrom.children) > 0 {
+			first := stealFrom.children[0]
+			stealFrom.children = removeAt(stealFrom.children, 0)
+			child.children = append(child.children, first)
+		}
+	default:
+		// 右の兄弟と併合する
+		if i >= len(n.items) {
+			i--
+		}
+		child := n.mutableChild(i)
+		mergeItem := n.items[i]
+		n.items = removeAt(n.items, i)
+		mergeChild := n.children[i+1]
+		n.children = removeAt(n.children, i+1)
+		child.items = append(child.items, mergeItem)
+		child.items = append(child.items, mergeChild.items...)
+		child.children = append(child.children, mergeChild.children...)
+	}
+	return n.remove(key, kind)
+}
+
+func insertAt[T any](s []T, i int, v T) []T {
+	var zero T
+	s = append(s, zero)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func removeAt[T any](s []T, i int) []T {
+	var zero T
+	copy(s[i:], s[i+1:])
+	s[len(s)-1] = zero
+	return s[:len(s)-1]
+}
+
+// indexCursor はインデックスを昇順に走査するカーソルです。
+// 走査中に木が変更されないこと (clone 済みのスナップショットであること) が前提です。
+type indexCursor struct {
+	stack []cursorFrame
+}
+
+// cursorFrame は走査中のノードと、その中の現在位置です。
+// 内部ノードでは「children[i] を走査し終えたら items[i] を返す」ことを意味します。
+type cursorFrame struct {
+	n *indexNode
+	i int
+}
+
+// seek は key 以上となる最初の要素へ移動します。
+func (c *indexCursor) seek(t *keyIndex, key string) {
+	c.stack = c.stack[:0]
+	n := t.root
+	for n != nil {
+		i, found := n.find(key)
+		c.stack = append(c.stack, cursorFrame{n: n, i: i})
+		if found || len(n.children) == 0 {
+			break
+		}
+		n = n.children[i]
+	}
+	c.settle()
+}
+
+// next は次の要素へ移動します。
+func (c *indexCursor) next() {
+	top := &c.stack[len(c.stack)-1]
+	top.i++
+	if len(top.n.children) > 0 {
+		// 右の部分木の最小要素へ降りる
+		n := top.n.children[top.i]
+		for {
+			c.stack = append(c.stack, cursorFrame{n: n})
+			if len(n.children) == 0 {
+				break
+			}
+			n = n.children[0]
+		}
+	}
+	c.settle()
+}
+
+// settle は走査し終えたノードをスタックから取り除きます。
+func (c *indexCursor) settle() {
+	for len(c.stack) > 0 {
+		top := c.stack[len(c.stack)-1]
+		if top.i < len(top.n.items) {
+			return
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+}
+
+func (c *indexCursor) valid() bool {
+	return len(c.stack) > 0
+}
+
+func (c *indexCursor) item() indexItem {
+	top := c.stack[len(c.stack)-1]
+	return top.n.items[top.i]
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// checkIndex はインデックスの内容が期待するマップと一致し、昇順に走査できることを確認します。
+func checkIndex(t *testing.T, idx *keyIndex, want map[string]RecordPos) {
+	t.Helper()
+	if idx.Len() != len(want) {
+		t.Fatalf("Len = %d, want %d", idx.Len(), len(want))
+	}
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var got []string
+	idx.ascend(func(key string, pos RecordPos) bool {
+		if pos != want[key] {
+			t.Fatalf("key %q: pos = %v, want %v", key, pos, want[key])
+		}
+		got = append(got, key)
+		return true
+	})
+	if len(got) != len(keys) {
+		t.Fatalf("ascend visited %d keys, want %d", len(got), len(keys))
+	}
+	for i := range keys {
+		if got[i] != keys[i] {
+			t.Fatalf("ascend order mismatch at %d: %q != %q", i, got[i], keys[i])
+		}
+	}
+	for _, k := range keys {
+		if pos, ok := idx.get(k); !ok || pos != want[k] {
+			t.Fatalf("get(%q) = %v, %v", k, pos, ok)
+		}
+	}
+}
+
+func TestKeyIndexRandomOps(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	idx := newKeyIndex()
+	want := make(map[string]RecordPos)
+
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key-%05d", rng.Intn(5000))
+		if rng.Intn(3) == 0 {
+			_, existed := want[key]
+			old, removed := idx.delete(key)
+			if removed != existed || (existed && old != want[key]) {
+				t.Fatalf("delete(%q) = %v, %v; want %v, %v", key, old, removed, want[key], existed)
+			}
+			delete(want, key)
+		} else {
+			pos := RecordPos{FileID: i % 7, Offset: int64(i)}
+			prev, existed := want[key]
+			old, replaced := idx.set(key, pos)
+			if replaced != existed || (existed && old != prev) {
+				t.Fatalf("set(%q) = %v, %v; want %v, %v", key, old, replaced, prev, existed)
+			}
+			want[key] = pos
+		}
+	}
+	checkIndex(t, idx, want)
+
+	// 全削除後は空になる
+	for k := range want {
+		idx.delete(k)
+	}
+	checkIndex(t, idx, map[string]RecordPos{})
+}
+
+func TestKeyIndexCloneIsolation(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	idx := newKeyIndex()
+	want := make(map[string]RecordPos)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%05d", i)
+		idx.set(key, RecordPos{Offset: int64(i)})
+		want[key] = RecordPos{Offset: int64(i)}
+	}
+
+	snap := idx.clone()
+	snapWant := make(map[string]RecordPos, len(want))
+	for k, v := range want {
+		snapWant[k] = v
+	}
+
+	// 元の木を変更してもスナップショットは変わらない
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key-%05d", rng.Intn(4000))
+		if rng.Intn(2) == 0 {
+			idx.delete(key)
+			delete(want, key)
+		} else {
+			idx.set(key, RecordPos{FileID: 1, Offset: int64(i)})
+			want[key] = RecordPos{FileID: 1, Offset: int64(i)}
+		}
+	}
+	checkIndex(t, idx, want)
+	checkIndex(t, snap, snapWant)
+
+	// スナップショット側の変更も元の木に影響しない
+	snap.set("zzz", RecordPos{FileID: 9})
+	if _, ok := idx.get("zzz"); ok {
+		t.Error("Mutation of clone leaked into original")
+	}
+}
+
+func TestIndexCursorSeek(t *testing.T) {
+	idx := newKeyIndex()
+	for i := 0; i < 1000; i += 2 {
+		idx.set(fmt.Sprintf("%04d", i), RecordPos{Offset: int64(i)})
+	}
+
+	var c indexCursor
+	c.seek(idx, "0101")
+	if !c.valid() || c.item().key != "0102" {
+		t.Fatalf("seek(0101) positioned at %v", c.item())
+	}
+	c.seek(idx, "0500")
+	for want := 500; want < 1000; want += 2 {
+		if !c.valid() || c.item().key != fmt.Sprintf("%04d", want) {
+			t.Fatalf("expected %04d during iteration", want)
+		}
+		c.next()
+	}
+	if c.valid() {
+		t.Error("Expected cursor to be exhausted")
+	}
+	c.seek(idx, "9999")
+	if c.valid() {
+		t.Error("Expected seek past last key to be invalid")
+	}
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// ErrIteratorClosed は Close 済みのイテレータを使用した場合のエラーです。
+var ErrIteratorClosed = errors.New("iterator closed")
+
+// Iterator はキーの昇順に DB を走査します。
+//
+// 作成時点のインデックスのスナップショットを読むため、走査中に Put/Delete/Merge が
+// 行われても一貫した内容が得られます (作成後の変更は見えません)。
+// 作成時点で有効期限が切れているキーはスキップします。
+// スナップショットが参照するセグメントを保持し続けるため、使用後は必ず Close してください。
+// 閉じた DB から作成したイテレータは何も返さず、Err が ErrClosed を返します。
+//
+//	it := db.Scan([]byte("user:"))
+//	defer it.Close()
+//	for ; it.Valid(); it.Next() {
+//		value, err := it.Value()
+//		...
+//	}
+type Iterator struct {
+	db       *DB
+	index    *keyIndex
+	segments map[int]*segment
+	blobs    map[int]*segment // 値を分離したキーの Blob File
+	cursor   indexCursor
+	lower    []byte // 下限 (含む)。nil なら先頭から
+	upper    []byte // 上限 (含まない)。nil なら末尾まで
+	now      int64  // 作成時刻 (UnixNano)。有効期限の判定に使う
+	err      error
+	closed   bool
+}
+
+// NewIterator は全キーを走査するイテレータを返します。先頭のキーに位置づけられています。
+func (d *DB) NewIterator() *Iterator {
+	return d.newIterator(nil, nil)
+}
+
+// Scan は prefix で始まるキーを走査するイテレータを返します。
+func (d *DB) Scan(prefix []byte) *Iterator {
+	return d.newIterator(prefix, prefixEnd(prefix))
+}
+
+// Range は start 以上 end 未満のキーを走査するイテレータを返します。
+// start が nil なら先頭から、end が nil なら末尾までを対象とします。
+func (d *DB) Range(start, end []byte) *Iterator {
+	return d.newIterator(start, end)
+}
+
+func (d *DB) newIterator(lower, upper []byte) *Iterator {
+	// clone は元の木の所有トークンを差し替えるため書き込みロックが必要 (O(1) なので短時間)
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return &Iterator{db: d, err: ErrClosed}
+	}
+	index := d.keyDir.clone()
+	segments := make(map[int]*segment, len(d.olderFiles)+1)
+	for id, seg := range d.olderFiles {
+		if seg.acquire() {
+			segments[id] = seg
+		}
+	}
+	if d.activeSeg != nil && d.activeSeg.acquire() {
+		segments[d.activeFileID] = d.activeSeg
+	}
+	blobs := make(map[int]*segment, len(d.blobFiles)+1)
+	for id, seg := range d.blobFiles {
+		if seg.acquire() {
+			blobs[id] = seg
+		}
+	}
+	if d.blobSeg != nil && d.blobSeg.acquire() {
+		blobs[d.blobFileID] = d.blobSeg
+	}
+	d.mu.Unlock()
+
+	it := &Iterator{
+		db:       d,
+		index:    index,
+		segments: segments,
+		blobs:    blobs,
+		lower:    cloneBytes(lower),
+		upper:    cloneBytes(upper),
+		now:      time.Now().UnixNano(),
+	}
+	it.Seek(nil)
+	return it
+}
+
+// Seek は key 以上となる最初のキーへ移動し、Valid() を返します。
+// key が下限より小さい場合は下限へ移動します。
+func (it *Iterator) Seek(key []byte) bool {
+	if it.closed {
+		return false
+	}
+	if it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+		key = it.lower
+	}
+	it.cursor.seek(it.index, string(key))
+	it.skipExpired()
+	return it.Valid()
+}
+
+// Valid はイテレータが有効なキーを指しているかを返します。
+func (it *Iterator) Valid() bool {
+	if it.closed || it.err != nil || !it.cursor.valid() {
+		return false
+	}
+	return it.upper == nil || it.cursor.item().key < string(it.upper)
+}
+
+// Next は次のキーへ移動し、Valid() を返します。
+func (it *Iterator) Next() bool {
+	if !it.Valid() {
+		return false
+	}
+	it.cursor.next()
+	it.skipExpired()
+	return it.Valid()
+}
+
+// skipExpired は有効期限の切れたキーを読み飛ばします。
+func (it *Iterator) skipExpired() {
+	for it.cursor.valid() && it.cursor.item().pos.expired(it.now) {
+		it.cursor.next()
+	}
+}
+
+// Key は現在のキーを返します。Valid() が false の場合は nil です。
+func (it *Iterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return []byte(it.cursor.item().key)
+}
+
+// Value は現在のキーの値を読み込みます。
+func (it *Iterator) Value() ([]byte, error) {
+	if it.closed {
+		return nil, ErrIteratorClosed
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+	if !it.Valid() {
+		return nil, ErrKeyNotFound
+	}
+	item := it.cursor.item()
+	files := it.segments
+	if item.pos.Blob.valid() {
+		files = it.blobs
+	}
+	pos := valuePos(item.pos)
+	seg, ok := files[pos.FileID]
+	if !ok {
+		if it.db.view.Load() == nil {
+			it.err = ErrClosed
+		} else if item.pos.Blob.valid() {
+			it.err = corruptionError(FileKindBlob, pos.FileID, pos.Offset, "index refers to a missing blob file")
+		} else {
+			it.err = corruptionError(FileKindData, pos.FileID, pos.Offset, "index refers to a missing segment")
+		}
+		return nil, it.err
+	}
+	value, err := readValueAt(seg, pos, []byte(item.key))
+	if err != nil {
+		it.err = err
+		return nil, err
+	}
+	return value, nil
+}
+
+// Err は走査中に発生したエラーを返します。
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close はイテレータが保持するセグメントの参照を解放します。複数回呼んでも安全です。
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	var firstErr error
+	for _, files := range []map[int]*segment{it.segments, it.blobs} {
+		for _, seg := range files {
+			if err := seg.release(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	it.segments = nil
+	it.blobs = nil
+	it.index = nil
+	return firstErr
+}
+
+// prefixEnd は prefix で始まる全キーより大きい最小のキーを返します。
+// そのようなキーが無い (prefix が空または 0xff のみ) 場合は nil です。
+func prefixEnd(prefix []byte) []byte {
+	end := cloneBytes(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func collectKeys(t *testing.T, it *Iterator) []string {
+	t.Helper()
+	defer func() { _ = it.Close() }()
+	var keys []string
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Iterator error: %v", err)
+	}
+	return keys
+}
+
+func TestIteratorOrderAndScan(t *testing.T) {
+	dbDir := "test_iterator_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	for _, k := range []string{"user:3", "item:1", "user:1", "user:2", "order:9", "user:10"} {
+		if err := db.Put([]byte(k), []byte("v-"+k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = db.Delete([]byte("user:2"))
+
+	got := collectKeys(t, db.NewIterator())
+	want := []string{"item:1", "order:9", "user:1", "user:10", "user:3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("NewIterator = %v, want %v", got, want)
+	}
+
+	got = collectKeys(t, db.Scan([]byte("user:")))
+	want = []string{"user:1", "user:10", "user:3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Scan = %v, want %v", got, want)
+	}
+
+	got = collectKeys(t, db.Range([]byte("order"), []byte("user:10")))
+	want = []string{"order:9", "user:1"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Range = %v, want %v", got, want)
+	}
+
+	// Seek と Value
+	it := db.NewIterator()
+	defer func() { _ = it.Close() }()
+	if !it.Seek([]byte("user:2")) || string(it.Key()) != "user:3" {
+		t.Fatalf("Seek(user:2) positioned at %q", it.Key())
+	}
+	if val, err := it.Value(); err != nil || string(val) != "v-user:3" {
+		t.Errorf("Value = %q, %v", val, err)
+	}
+	if it.Next() {
+		t.Errorf("Expected end of iteration, got %q", it.Key())
+	}
+	_ = it.Close()
+	if _, err := it.Value(); err != ErrIteratorClosed {
+		t.Errorf("Expected ErrIteratorClosed, got %v", err)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := []struct {
+		prefix []byte
+		want   []byte
+	}{
+		{[]byte("abc"), []byte("abd")},
+		{[]byte{'a', 0xff}, []byte{'b'}},
+		{[]byte{0xff, 0xff}, nil},
+		{nil, nil},
+	}
+	for _, c := range cases {
+		if got := prefixEnd(c.prefix); string(got) != string(c.want) || (got == nil) != (c.want == nil) {
+			t.Errorf("prefixEnd(%q) = %q, want %q", c.prefix, got, c.want)
+		}
+	}
+}
+
+func TestIteratorSnapshot(t *testing.T) {
+	dbDir := "test_iterator_snapshot_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 256
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if err := db.Put(key, []byte(fmt.Sprintf("old-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := db.NewIterator()
+	defer func() { _ = it.Close() }()
+
+	// イテレータ作成後の書き込み・ローテーション・マージは見えない
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if i%2 == 0 {
+			_ = db.Delete(key)
+		} else {
+			_ = db.Put(key, []byte(fmt.Sprintf("new-%d", i)))
+		}
+	}
+	_ = db.Put([]byte("key-999"), []byte("added"))
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+
+	n := 0
+	for ; it.Valid(); it.Next() {
+		want := fmt.Sprintf("key-%03d", n)
+		if string(it.Key()) != want {
+			t.Fatalf("Key = %q, want %q", it.Key(), want)
+		}
+		val, err := it.Value()
+		if err != nil {
+			t.Fatalf("Value(%s) failed: %v", want, err)
+		}
+		if string(val) != fmt.Sprintf("old-%d", n) {
+			t.Errorf("Value(%s) = %q, want old value", want, val)
+		}
+		n++
+	}
+	if n != 50 {
+		t.Errorf("Iterated %d keys, want 50", n)
+	}
+
+	// 新しいイテレータは最新の状態を見る
+	got := collectKeys(t, db.Scan([]byte("key-")))
+	if len(got) != 26 || got[len(got)-1] != "key-999" {
+		t.Errorf("Unexpected keys after updates: %v", got)
+	}
+}
+
+func TestIteratorErrors(t *testing.T) {
+	dbDir := "test_iterator_errors_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Put([]byte("a"), []byte("1"))
+
+	// スナップショットにセグメントが無ければ、位置付きの CorruptionError
+	it := db.NewIterator()
+	seg := it.segments[db.activeFileID]
+	delete(it.segments, db.activeFileID)
+	_, err = it.Value()
+	var ce *CorruptionError
+	if !errors.As(err, &ce) || ce.FileID != db.activeFileID || ce.Kind != FileKindData || !errors.Is(err, ErrDataCorruption) {
+		t.Errorf("Value with a missing segment = %v, want CorruptionError for segment %d", err, db.activeFileID)
+	}
+	if it.Err() != err {
+		t.Errorf("Err = %v, want %v", it.Err(), err)
+	}
+	_ = seg.release()
+	_ = it.Close()
+
+	// 閉じた DB から作成したイテレータ
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	it = db.NewIterator()
+	defer func() { _ = it.Close() }()
+	if it.Valid() || it.Key() != nil {
+		t.Errorf("Iterator on a closed DB yielded key %q", it.Key())
+	}
+	if !errors.Is(it.Err(), ErrClosed) {
+		t.Errorf("Err on a closed DB = %v, want ErrClosed", it.Err())
+	}
+	if _, err := it.Value(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Value on a closed DB = %v, want ErrClosed", err)
+	}
+}
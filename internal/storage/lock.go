@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockFileName はデータディレクトリの使用中を示すロックファイル名です。
+const lockFileName = "LOCK"
+
+// ErrDatabaseLocked は他のプロセス (または同じプロセス内の別の DB) がディレクトリを使用中の場合のエラーです。
+var ErrDatabaseLocked = errors.New("database is locked by another process")
+
+// dirLock はデータディレクトリの LOCK ファイルに対する advisory lock (flock) です。
+// 書き込み可能なオープンは排他ロック、read-only のオープンは共有ロックを取得するため、
+// 書き込みプロセスは 1 つだけ、read-only のプロセスは書き込みプロセスが無い間だけ複数開けます。
+// ロックはファイルを閉じると (プロセスが異常終了した場合も) 解放されます。
+type dirLock struct {
+	f *os.File
+}
+
+// acquireDirLock は LOCK ファイルのロックを取得します。待たずに失敗した場合は ErrDatabaseLocked を返します。
+// read-only ではファイルを作成しないため、LOCK が無い (一度も書き込み用に開かれていない) 場合は nil を返します。
+func acquireDirLock(dirPath string, shared bool) (*dirLock, error) {
+	path := filepath.Join(dirPath, lockFileName)
+	how := syscall.LOCK_EX
+	var f *os.File
+	var err error
+	if shared {
+		how = syscall.LOCK_SH
+		f, err = os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+	} else {
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrDatabaseLocked, dirPath)
+		}
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	return &dirLock{f: f}, nil
+}
+
+// release はロックを解放します。nil に対して呼んでも安全です。
+func (l *dirLock) release() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close() // Close で flock も解放される
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirectoryLock(t *testing.T) {
+	dbDir := "test_lock_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Put([]byte("key"), []byte("value"))
+
+	// 書き込み用に開いている間は、書き込み用・read-only のどちらも開けない
+	if db2, err := NewDB(dbDir); !errors.Is(err, ErrDatabaseLocked) {
+		if db2 != nil {
+			_ = db2.Close()
+		}
+		t.Fatalf("Expected ErrDatabaseLocked, got %v", err)
+	}
+	roOpts := DefaultOptions()
+	roOpts.ReadOnly = true
+	if ro, err := OpenWithOptions(dbDir, roOpts); !errors.Is(err, ErrDatabaseLocked) {
+		if ro != nil {
+			_ = ro.Close()
+		}
+		t.Fatalf("Expected ErrDatabaseLocked for read-only open, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// read-only は共有ロックなので同時に複数開ける
+	ro1, err := OpenWithOptions(dbDir, roOpts)
+	if err != nil {
+		t.Fatalf("Failed to open read-only: %v", err)
+	}
+	defer func() { _ = ro1.Close() }()
+	ro2, err := OpenWithOptions(dbDir, roOpts)
+	if err != nil {
+		t.Fatalf("Failed to open second read-only: %v", err)
+	}
+	if v, err := ro2.Get([]byte("key")); err != nil || string(v) != "value" {
+		t.Errorf("Expected value, got %q, %v", v, err)
+	}
+
+	// read-only が開いている間は書き込み用に開けない
+	if db3, err := NewDB(dbDir); !errors.Is(err, ErrDatabaseLocked) {
+		if db3 != nil {
+			_ = db3.Close()
+		}
+		t.Fatalf("Expected ErrDatabaseLocked while read-only is open, got %v", err)
+	}
+
+	_ = ro1.Close()
+	_ = ro2.Close()
+
+	// 全て閉じればロックは解放される
+	db4, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen after Close: %v", err)
+	}
+	_ = db4.Close()
+}
+
+func TestDirectoryLockReleasedOnOpenError(t *testing.T) {
+	dbDir := "test_lock_open_error_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Close()
+
+	// 壊れた MERGE マニフェストでオープンを失敗させる
+	if err := os.WriteFile(filepath.Join(dbDir, mergeManifestFileName), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDB(dbDir); err == nil {
+		t.Fatal("Expected open to fail with a broken merge manifest")
+	}
+	_ = os.Remove(filepath.Join(dbDir, mergeManifestFileName))
+
+	db, err = NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Expected lock to be released after failed open, got %v", err)
+	}
+	_ = db.Close()
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// LZ4 ブロック形式の圧縮・展開 (フレーム形式のヘッダやチェックサムは持たない)。
+//
+// ブロックはシーケンスの並びで、各シーケンスは
+//
+//	[Token(1)][LiteralLength 拡張][Literals][Offset(2, little endian)][MatchLength 拡張]
+//
+// です。Token の上位 4 bit がリテラル長、下位 4 bit が一致長 - 4 で、15 の場合は後続の
+// バイトを 255 未満の値が出るまで加算します。最後のシーケンスはリテラルのみで終わります。
+// 展開には元の長さが必要なため、呼び出し側で別に記録します。
+const (
+	lz4MinMatch     = 4
+	lz4HashLog      = 14
+	lz4MaxOffset    = 1<<16 - 1
+	lz4LastLiterals = 5  // ブロック末尾の 5 バイトは必ずリテラル
+	lz4MFLimit      = 12 // 最後の一致はブロック末尾の 12 バイトより前から始まる
+)
+
+var errLZ4Corrupt = errors.New("lz4: corrupt block")
+
+// lz4Tables は圧縮に使うハッシュテーブルを使い回します。
+var lz4Tables = sync.Pool{
+	New: func() any { return new([1 << lz4HashLog]int32) },
+}
+
+// lz4Compress は src を圧縮して dst に追記します。
+func lz4Compress(dst, src []byte) []byte {
+	n := len(src)
+	anchor := 0
+	if n > lz4MFLimit {
+		table := lz4Tables.Get().(*[1 << lz4HashLog]int32)
+		defer lz4Tables.Put(table)
+		clear(table[:])
+
+		limit := n - lz4MFLimit
+		for i := 0; i < limit; {
+			seq := binary.LittleEndian.Uint32(src[i:])
+			h := (seq * 2654435761) >> (32 - lz4HashLog)
+			ref := int(table[h]) - 1 // 0 は未使用
+			table[h] = int32(i + 1)
+			if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+				i++
+				continue
+			}
+
+			// 一致を前後に伸ばす (末尾の lz4LastLiterals バイトは含めない)
+			length := lz4MinMatch
+			for i+length < n-lz4LastLiterals && src[ref+length] == src[i+length] {
+				length++
+			}
+			for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+				i--
+				ref--
+				length++
+			}
+
+			dst = lz4AppendLiterals(dst, src[anchor:i], length-lz4MinMatch)
+			dst = append(dst, byte(i-ref), byte((i-ref)>>8))
+			if length-lz4MinMatch >= 15 {
+				dst = lz4AppendLength(dst, length-lz4MinMatch-15)
+			}
+			i += length
+			anchor = i
+		}
+	}
+	return lz4AppendLiterals(dst, src[anchor:], 0)
+}
+
+// lz4AppendLiterals は Token とリテラルを追記します。matchLen は Token に入れる一致長 - 4 です。
+func lz4AppendLiterals(dst, literals []byte, matchLen int) []byte {
+	dst = append(dst, byte(min(len(literals), 15)<<4|min(matchLen, 15)))
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	return append(dst, literals...)
+}
+
+func lz4AppendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// lz4Decompress は src を展開して dst を埋めます。dst の長さは元の長さと一致している必要があります。
+func lz4Decompress(dst, src []byte) error {
+	si, di := 0, 0
+	readLength := func(n int) (int, bool) {
+		for {
+			if si >= len(src) {
+				return 0, false
+			}
+			b := src[si]
+			si++
+			n += int(b)
+			if b != 255 {
+				return n, true
+			}
+		}
+	}
+
+	for si < len(src) {
+		token := src[si]
+		si++
+
+		literals := int(token >> 4)
+		if literals == 15 {
+			var ok bool
+			if literals, ok = readLength(literals); !ok {
+				return errLZ4Corrupt
+			}
+		}
+		if si+literals > len(src) || di+literals > len(dst) {
+			return errLZ4Corrupt
+		}
+		copy(dst[di:], src[si:si+literals])
+		si += literals
+		di += literals
+		if si == len(src) {
+			break // 最後のシーケンス
+		}
+
+		if si+2 > len(src) {
+			return errLZ4Corrupt
+		}
+		offset := int(src[si]) | int(src[si+1])<<8
+		si += 2
+		length := int(token & 15)
+		if length == 15 {
+			var ok bool
+			if length, ok = readLength(length); !ok {
+				return errLZ4Corrupt
+			}
+		}
+		length += lz4MinMatch
+		if offset == 0 || offset > di || di+length > len(dst) {
+			return errLZ4Corrupt
+		}
+		if offset >= length {
+			copy(dst[di:di+length], dst[di-offset:])
+		} else {
+			// 重なりのあるコピーは 1 バイトずつ (直前の出力を繰り返す)
+			for k := 0; k < length; k++ {
+				dst[di+k] = dst[di-offset+k]
+			}
+		}
+		di += length
+	}
+	if di != len(dst) {
+		return errLZ4Corrupt
+	}
+	return nil
+}
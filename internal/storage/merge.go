@@ -0,0 +1,637 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Merge の一時ファイルとマニフェストのファイル名です。
+// 一時ファイルは出力セグメントごとに merge-<ID>.data / merge-<ID>.hint を作成します。
+const (
+	mergeTempPrefix       = "merge-"
+	mergeManifestFileName = "MERGE"
+)
+
+// ErrMergeInProgress は read-only で開く際に、書き込みプロセスの Merge が差し替え中 (または中断された状態)
+// だった場合のエラーです。書き込みプロセスが差し替えを終えれば (中断の場合は書き込み用に一度開けば) 解消します。
+var ErrMergeInProgress = errors.New("merge in progress")
+
+// mergeManifest は差し替え中の Merge の内容を記録します。
+// MERGE ファイルが存在する間は、一時ファイルを Outputs の ID にリネームして Inputs のファイルを
+// 削除する処理が途中である可能性があり、次回オープン時に最後まで実行されます。
+type mergeManifest struct {
+	Inputs  []int `json:"inputs"`
+	Outputs []int `json:"outputs"`
+}
+
+// testHookMergeCopied はテスト用のフックで、コピー完了後・差し替え前 (ロックなし) に呼ばれます。
+var testHookMergeCopied func()
+
+// mergedEntry は Merge でコピーしたレコードの移動元と移動先です。
+type mergedEntry struct {
+	key     string
+	oldPos  RecordPos
+	newPos  RecordPos
+	expired bool // 期限切れのためコピーせずに破棄したレコード
+}
+
+func mergeTempPath(dirPath string, id int, ext string) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%s%d.%s", mergeTempPrefix, id, ext))
+}
+
+// maxMergeOutputs は入力の合計サイズから出力セグメント数の上限を見積もります。
+// 出力は SegmentSize を超える直前で次のセグメントに切り替えるため、隣り合う 2 つの出力の合計は
+// 必ず SegmentSize を超えます。したがってレコードをそのままコピーする限り、出力数は
+// 2*inputBytes/SegmentSize + 2 を超えません。MergeRecompress で展開したレコードは入力より大きくなり得るため、
+// copyLiveRecords は上限に達したら最後の出力セグメントに SegmentSize を超えて書き続けます。
+func maxMergeOutputs(inputBytes, segmentSize int64) int {
+	return int(2*inputBytes/segmentSize) + 2
+}
+
+// Merge はアクティブファイルを含む全データファイルの有効なレコードを書き直し、不要な領域を解放します。
+//
+// d.mu を保持するのは開始時のスナップショット取得と、最後の差し替えの間だけです。
+//  1. (ロック) アクティブファイルをローテーションし、不変になった全セグメントとインデックスのスナップショットを取得
+//  2. (ロックなし) スナップショット上で有効なレコードを SegmentSize ごとの一時ファイルへコピー
+//  3. (ロック) 新しいセグメントに差し替え、コピー中に上書きされなかったキーだけ位置を更新
+//
+// 出力セグメントの ID は入力の最大 ID (ローテーション前のアクティブファイル) の直後から割り当て、
+// 新しいアクティブファイルはその上限 (maxMergeOutputs) の先に作成します。
+// これにより ID の順序 (= 復旧時の適用順) は「マージ結果 < マージ中以降の書き込み」に保たれます。
+// コピー中も Get/Put/Delete は通常どおり実行できます。
+// Options.MergeRecompress が true の場合は、コピーするレコードを現在の圧縮方式で圧縮し直します。
+func (d *DB) Merge() error {
+	d.mergeMu.Lock()
+	defer d.mergeMu.Unlock()
+
+	// 1. マージ対象のスナップショット
+	d.mu.Lock()
+	if d.opts.ReadOnly {
+		d.mu.Unlock()
+		return &ReadOnlyError{Op: "merge"}
+	}
+	if d.closed {
+		d.mu.Unlock()
+		return ErrClosed
+	}
+	if len(d.olderFiles) == 0 && d.writeOffset == d.activeSeg.header.size() {
+		d.mu.Unlock()
+		return nil // マージするものがない
+	}
+
+	var inputBytes int64
+	for _, seg := range d.olderFiles {
+		inputBytes += seg.reader.Size()
+	}
+	inputBytes += d.writeOffset
+	firstOutputID := d.activeFileID + 1
+	lastOutputID := firstOutputID + maxMergeOutputs(inputBytes, d.opts.SegmentSize) - 1
+	if err := d.newActiveFile(lastOutputID + 1); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+
+	inputs := make(map[int]*segment, len(d.olderFiles))
+	var mergeIDs []int
+	for id, seg := range d.olderFiles {
+		if seg.acquire() {
+			inputs[id] = seg
+			mergeIDs = append(mergeIDs, id)
+		}
+	}
+	snapshot := d.keyDir.clone()
+	d.mergeInputs = inputs
+	d.mu.Unlock()
+	sort.Ints(mergeIDs)
+	defer func() {
+		d.mu.Lock()
+		d.mergeInputs = nil
+		d.mu.Unlock()
+	}()
+
+	// コピーが終わるまで入力セグメントを閉じさせない
+	defer func() {
+		for _, seg := range inputs {
+			_ = seg.release()
+		}
+	}()
+
+	// 2. 一時ファイルへのコピー (ロックなし)
+	committed := false
+	defer func() {
+		// エラーパス用クリーンアップ。マニフェストを書いた後は次回オープン時の復旧に必要なので残す
+		if !committed {
+			_ = removeMergeTempFiles(d.dirPath)
+		}
+	}()
+
+	entries, outputIDs, err := d.copyLiveRecords(snapshot, inputs, firstOutputID, lastOutputID)
+	if err != nil {
+		return err
+	}
+	if testHookMergeCopied != nil {
+		testHookMergeCopied()
+	}
+
+	// 3. 差し替え (ロック)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return ErrClosed
+	}
+	// 差し替えた状態を公開してから入力セグメントの参照を解放する (途中で失敗した場合も公開する)
+	defer d.publishSegmentsLocked()
+
+	// マニフェストを書いた時点でマージは確定する。以降にクラッシュしても次回オープン時に完了させる
+	manifest := mergeManifest{Inputs: mergeIDs, Outputs: outputIDs}
+	if err := writeMergeManifest(d.dirPath, manifest); err != nil {
+		return err
+	}
+	committed = true
+
+	for _, id := range mergeIDs {
+		// Get やイテレータが参照中なら、Reader は最後の参照の解放時に閉じられる
+		d.retireSegment(d.olderFiles[id])
+		delete(d.olderFiles, id)
+	}
+
+	// 一時ファイルのリネームと古いファイルの削除
+	if err := completeMerge(d.dirPath, manifest); err != nil {
+		return err
+	}
+
+	records := make(map[int]int64, len(outputIDs))
+	for _, e := range entries {
+		if !e.expired {
+			records[e.newPos.FileID]++
+		}
+	}
+
+	// Re-open compacted files as MmapReader
+	for _, id := range outputIDs {
+		seg, err := d.openSegment(id)
+		if err != nil {
+			return err
+		}
+		d.olderFiles[id] = seg
+		d.addSegmentBytes(id, seg.reader.Size()-seg.header.size(), records[id])
+	}
+
+	// Update In-Memory Index: コピー中に上書き・削除されていないキーだけを付け替える
+	// (上書きされたキーのコピーは出力セグメント内の不要データとして計上される)
+	// 期限切れで破棄したキーはインデックスから削除する
+	for _, e := range entries {
+		if cur, ok := d.keyDir.get(e.key); ok && cur == e.oldPos {
+			if e.expired {
+				d.deleteKey(e.key)
+			} else {
+				d.setKey(e.key, e.newPos)
+			}
+		}
+	}
+
+	// 入力セグメントを参照するキーはもう無いので、計測値ごと取り除く
+	for _, id := range mergeIDs {
+		d.dropSegmentStats(id)
+	}
+
+	return nil
+}
+
+// mergeOutput は Merge が書き込み中の出力セグメント (一時ファイル) です。
+// 出力は常に現在の形式 (ファイルヘッダ付き) で書くため、旧形式のセグメントは Merge で移行されます。
+// 暗号化する場合は KeyProvider の現在の鍵で書くため、古い鍵のセグメントも Merge で移行されます。
+type mergeOutput struct {
+	id         int
+	dataFile   *os.File
+	dataWriter *bufio.Writer
+	dataCipher *fileCipher // 暗号化しない場合は nil
+	hintFile   *os.File
+	hintWriter *bufio.Writer
+	hintCipher *fileCipher
+	size       int64 // 書き込んだレコードの合計 (ファイルヘッダを含まない)
+	hintSize   int64 // 書き込んだ Hint File のエントリの合計 (ファイルヘッダを含まない)
+}
+
+// createMergeOutput は出力セグメント id の一時ファイルを作成します。keys が nil でなければ暗号化します。
+func createMergeOutput(dirPath string, id int, withHint bool, keys KeyProvider) (*mergeOutput, error) {
+	out := &mergeOutput{id: id}
+	// 一時ファイルはリネーム後の ID でヘッダを書く
+	dataHeader, dataCipher, err := createFileHeader(FileKindData, id, keys)
+	if err != nil {
+		return nil, err
+	}
+	var hintHeader []byte
+	if withHint {
+		if hintHeader, out.hintCipher, err = createFileHeader(FileKindHint, id, keys); err != nil {
+			return nil, err
+		}
+	}
+	out.dataCipher = dataCipher
+
+	out.dataFile, err = os.OpenFile(mergeTempPath(dirPath, id, "data"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	out.dataWriter = bufio.NewWriter(out.dataFile)
+	// 書き込みエラーは finish の Flush で返る
+	_, _ = out.dataWriter.Write(dataHeader)
+	if withHint {
+		out.hintFile, err = os.OpenFile(mergeTempPath(dirPath, id, "hint"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			_ = out.dataFile.Close()
+			return nil, err
+		}
+		out.hintWriter = bufio.NewWriter(out.hintFile)
+		_, _ = out.hintWriter.Write(hintHeader)
+	}
+	return out, nil
+}
+
+// offset は次に書き込むレコードのファイル内の位置です。
+func (o *mergeOutput) offset() int64 {
+	return fileHeaderSize + o.size
+}
+
+// append は平文のレコード rec を書き込み、Hint File にもエントリを追加します。
+// 暗号化する場合は書き込む位置で暗号化します。書き込んだレコードの位置とサイズを返します。
+func (o *mergeOutput) append(rec []byte, key []byte, expiry int64) (int64, int64, error) {
+	offset := o.offset()
+	// flagBlob のレコードは値の末尾が Blob File の位置 (Hint File のエントリにも書く)
+	var blob BlobPos
+	if o.hintWriter != nil && decodeRecordHeader(rec).flags&flagBlob != 0 {
+		var err error
+		if blob, err = decodeBlobPointer(rec[len(rec)-blobPointerSize:]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if o.dataCipher != nil {
+		rec = o.dataCipher.sealRecord(rec, offset)
+	}
+	if _, err := o.dataWriter.Write(rec); err != nil {
+		return 0, 0, err
+	}
+	if o.hintWriter != nil {
+		entry := appendHintRecord(nil, decodeRecordHeader(rec), offset, expiry, blob, key)
+		if o.hintCipher != nil {
+			entry = o.hintCipher.sealHintEntry(entry, fileHeaderSize+o.hintSize)
+		}
+		if _, err := o.hintWriter.Write(entry); err != nil {
+			return 0, 0, err
+		}
+		o.hintSize += int64(len(entry))
+	}
+	o.size += int64(len(rec))
+	return offset, int64(len(rec)), nil
+}
+
+// finish はバッファを書き出して fsync し、ファイルを閉じます。
+func (o *mergeOutput) finish() error {
+	err := o.dataWriter.Flush()
+	if err == nil {
+		err = o.dataFile.Sync()
+	}
+	if o.hintWriter != nil {
+		if err == nil {
+			err = o.hintWriter.Flush()
+		}
+		if err == nil {
+			err = o.hintFile.Sync()
+		}
+	}
+	o.close()
+	return err
+}
+
+func (o *mergeOutput) close() {
+	_ = o.dataFile.Close()
+	if o.hintFile != nil {
+		_ = o.hintFile.Close()
+	}
+}
+
+// copyLiveRecords はスナップショット上で inputs に含まれる有効なレコードを一時ファイルへ書き写します。
+// 出力は SegmentSize ごとに firstID から連番のセグメントに分割し、使用した ID を返します。
+// lastID より後の ID はマージ中のアクティブファイルと重なるため使わず、lastID のセグメントに書き続けます。
+func (d *DB) copyLiveRecords(snapshot *keyIndex, inputs map[int]*segment, firstID, lastID int) ([]mergedEntry, []int, error) {
+	var entries []mergedEntry
+	var outputIDs []int
+	var out *mergeOutput
+	var copyErr error
+	defer func() {
+		if out != nil {
+			out.close()
+		}
+	}()
+	now := time.Now().UnixNano()
+
+	snapshot.ascend(func(key string, pos RecordPos) bool {
+		// スナップショット以降のアクティブファイルにあるキーは対象外
+		seg, ok := inputs[pos.FileID]
+		if !ok {
+			return true
+		}
+		// 期限切れのレコードはコピーしない
+		if pos.expired(now) {
+			entries = append(entries, mergedEntry{key: key, oldPos: pos, expired: true})
+			return true
+		}
+
+		// 暗号化されたレコードは位置と鍵が変わるので、平文に戻してから書き込む位置で暗号化し直す
+		data, err := readPlainRecord(seg, pos)
+		if err != nil {
+			copyErr = err
+			return false
+		}
+		h := decodeRecordHeader(data)
+
+		// 現在の圧縮方式と異なるレコードは圧縮し直す
+		if d.opts.MergeRecompress && needsRecompress(h, d.opts.Compression, d.opts.CompressionThreshold) {
+			rewritten, err := recompressRecord(data, h, d.opts.Compression, d.opts.CompressionThreshold)
+			if err != nil {
+				copyErr = corruptionError(FileKindData, pos.FileID, pos.Offset, err.Error())
+				return false
+			}
+			data = rewritten
+		}
+		size := int64(len(data))
+		if d.opts.KeyProvider != nil {
+			size += gcmTagSize
+		}
+
+		// SegmentSize を超える場合は次の出力セグメントへ (空のセグメントには必ず書く)
+		if out != nil && out.size > 0 && out.size+size > d.opts.SegmentSize && out.id < lastID {
+			if err := out.finish(); err != nil {
+				out = nil
+				copyErr = err
+				return false
+			}
+			out = nil
+		}
+		if out == nil {
+			id := firstID + len(outputIDs)
+			o, err := createMergeOutput(d.dirPath, id, d.opts.WriteHintFiles, d.opts.KeyProvider)
+			if err != nil {
+				copyErr = err
+				return false
+			}
+			out = o
+			outputIDs = append(outputIDs, id)
+		}
+
+		offset, size, err := out.append(data, []byte(key), pos.Expiry)
+		if err != nil {
+			copyErr = err
+			return false
+		}
+		newPos := RecordPos{FileID: out.id, Offset: offset, Size: size, Expiry: pos.Expiry, Blob: pos.Blob}
+		entries = append(entries, mergedEntry{key: key, oldPos: pos, newPos: newPos})
+		return true
+	})
+	if copyErr != nil {
+		return nil, nil, copyErr
+	}
+
+	if out != nil {
+		err := out.finish()
+		out = nil
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return entries, outputIDs, nil
+}
+
+// readPlainRecord はセグメント seg の pos のレコード全体を読み込んで CRC を検証し、暗号化されていれば復号して返します。
+func readPlainRecord(seg *segment, pos RecordPos) ([]byte, error) {
+	// 値の読み出し (Header + Key + Value)
+	data := make([]byte, pos.Size)
+	if _, err := seg.reader.ReadAt(data, pos.Offset); err != nil {
+		return nil, err
+	}
+
+	// Checksum (Guardian)
+	h := decodeRecordHeader(data)
+	if h.size() != pos.Size {
+		return nil, corruptionError(seg.kind(), pos.FileID, pos.Offset, fmt.Sprintf("record size %d does not match index size %d", h.size(), pos.Size))
+	}
+	if crc := crc32.ChecksumIEEE(data[4:]); crc != h.crc {
+		return nil, crcError(seg.kind(), pos.FileID, pos.Offset, h.crc, crc)
+	}
+	if h.flags&flagEncrypted == 0 {
+		return data, nil
+	}
+	if seg.cipher == nil {
+		return nil, corruptionError(seg.kind(), pos.FileID, pos.Offset, "encrypted record in an unencrypted file")
+	}
+	plain, err := seg.cipher.decryptRecord(data, pos.Offset)
+	if err != nil {
+		return nil, corruptionError(seg.kind(), pos.FileID, pos.Offset, err.Error())
+	}
+	return plain, nil
+}
+
+// fragmentation は不要データ量と、全データに対する比率を返します。
+func (d *DB) fragmentation() (deadBytes int64, deadRatio float64) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.fragmentationLocked()
+}
+
+func (d *DB) fragmentationLocked() (deadBytes int64, deadRatio float64) {
+	deadBytes = d.stats.totalBytes - d.stats.liveBytes
+	if d.stats.totalBytes > 0 {
+		deadRatio = float64(deadBytes) / float64(d.stats.totalBytes)
+	}
+	return deadBytes, deadRatio
+}
+
+// shouldMerge は断片化が Options の閾値を超えているかを判定します。
+// MergeMinDeadRatio と MergeMinDeadBytes のうち、有効 (0 以外) な条件のどれかを超えれば true です。
+// MergeMinDeadRatio は全データ量が MergeMinTotalBytes 以上の場合にだけ判定します。
+func (d *DB) shouldMerge() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.exceedsMergeThresholdLocked()
+}
+
+func (d *DB) exceedsMergeThresholdLocked() bool {
+	deadBytes, deadRatio := d.fragmentationLocked()
+	return d.opts.exceedsMergeThreshold(d.stats.totalBytes, deadBytes, deadRatio)
+}
+
+func (o Options) exceedsMergeThreshold(totalBytes, deadBytes int64, deadRatio float64) bool {
+	if deadBytes <= 0 {
+		return false
+	}
+	if o.MergeMinDeadRatio > 0 && totalBytes >= o.MergeMinTotalBytes && deadRatio >= o.MergeMinDeadRatio {
+		return true
+	}
+	if o.MergeMinDeadBytes > 0 && deadBytes >= o.MergeMinDeadBytes {
+		return true
+	}
+	return false
+}
+
+// maybeTriggerMerge は書き込みで閾値を超えた場合に、バックグラウンドの Merge を起こします。
+// d.mu を保持した状態で呼び出します。
+func (d *DB) maybeTriggerMerge() {
+	if d.mergeTrigger == nil {
+		return
+	}
+	if !d.exceedsMergeThresholdLocked() {
+		return
+	}
+	select {
+	case d.mergeTrigger <- struct{}{}:
+	default: // 既に起こしている
+	}
+}
+
+// mergeLoop は MergeInBackground の定期チェックと、書き込み時の閾値超過による Merge を実行します。
+// 定期チェックでは不要データの多い Blob File の BlobGC も実行します。
+func (d *DB) mergeLoop(interval time.Duration) {
+	defer d.bgWG.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closeCh:
+			return
+		case <-ticker.C:
+		case <-d.mergeTrigger:
+		}
+		if d.shouldMerge() {
+			if err := d.Merge(); err != nil && !errors.Is(err, ErrClosed) {
+				d.opts.logger().Printf("bitcask: %s: background merge failed: %v", d.dirPath, err)
+			}
+		}
+		if d.shouldCollectBlobs() {
+			if err := d.BlobGC(); err != nil && !errors.Is(err, ErrClosed) {
+				d.opts.logger().Printf("bitcask: %s: background blob gc failed: %v", d.dirPath, err)
+			}
+		}
+	}
+}
+
+// writeMergeManifest は一時ファイル経由で MERGE を書き込み、ディレクトリごと永続化します。
+// 出力の一時ファイルのディレクトリエントリもここで永続化されます。
+func writeMergeManifest(dirPath string, m mergeManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dirPath, mergeManifestFileName)
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(dirPath)
+}
+
+// completeMerge はマニフェストに従ってファイルの差し替えを行い、最後に MERGE を削除します。
+// 入力と出力の ID は重ならないため、途中で中断されても同じマニフェストで再実行すれば
+// 同じ結果になります (冪等)。
+func completeMerge(dirPath string, m mergeManifest) error {
+	// 1. 一時ファイルを出力 ID にリネーム (リネーム済みのものは飛ばす)
+	for _, id := range m.Outputs {
+		for _, ext := range []string{"data", "hint"} {
+			err := os.Rename(mergeTempPath(dirPath, id, ext), filepath.Join(dirPath, fmt.Sprintf("%d.%s", id, ext)))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	if err := syncDir(dirPath); err != nil {
+		return err
+	}
+
+	// 2. 入力ファイルを削除
+	for _, id := range m.Inputs {
+		for _, ext := range []string{"data", "hint"} {
+			err := os.Remove(filepath.Join(dirPath, fmt.Sprintf("%d.%s", id, ext)))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	if err := syncDir(dirPath); err != nil {
+		return err
+	}
+
+	// 3. マニフェストを削除
+	if err := os.Remove(filepath.Join(dirPath, mergeManifestFileName)); err != nil {
+		return err
+	}
+	return syncDir(dirPath)
+}
+
+// removeMergeTempFiles は Merge の一時ファイル (merge-<ID>.data/.hint と MERGE.tmp) を削除します。
+func removeMergeTempFiles(dirPath string) error {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, mergeTempPrefix) || name == mergeManifestFileName+".tmp" {
+			if err := os.Remove(filepath.Join(dirPath, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recoverMerge はオープン時に前回中断された Merge を検出して後始末します。
+// MERGE があればマージを完了させ (ロールフォワード)、無ければ書きかけの一時ファイルを破棄します。
+func recoverMerge(dirPath string, readOnly bool) error {
+	data, err := os.ReadFile(filepath.Join(dirPath, mergeManifestFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		if readOnly {
+			return nil
+		}
+		// マニフェストが無い一時ファイルはコピー途中のもの。入力ファイルは無傷なので捨てるだけでよい
+		return removeMergeTempFiles(dirPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	// 出力のリネームや入力の削除が途中の可能性があるため、read-only では開けない
+	if readOnly {
+		return fmt.Errorf("%w: %s", ErrMergeInProgress, dirPath)
+	}
+
+	var m mergeManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("parse %s: %w", mergeManifestFileName, err)
+	}
+	return completeMerge(dirPath, m)
+}
@@ -0,0 +1,457 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMergeKeepsConcurrentWrites(t *testing.T) {
+	dbDir := "test_merge_concurrent_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 200
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	for i := 0; i < 20; i++ {
+		_ = db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("old"))
+	}
+	_ = db.Put([]byte("deleted"), []byte("old"))
+
+	// コピー完了後、差し替え前に書き込む (Merge がロックを保持していないこと)
+	testHookMergeCopied = func() {
+		if err := db.Put([]byte("key00"), []byte("new")); err != nil {
+			t.Errorf("Put during merge failed: %v", err)
+		}
+		if err := db.Delete([]byte("deleted")); err != nil {
+			t.Errorf("Delete during merge failed: %v", err)
+		}
+		if v, err := db.Get([]byte("key01")); err != nil || string(v) != "old" {
+			t.Errorf("Get during merge: got %q, %v", v, err)
+		}
+	}
+	defer func() { testHookMergeCopied = nil }()
+
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	testHookMergeCopied = nil
+
+	check := func(db *DB) {
+		t.Helper()
+		if v, err := db.Get([]byte("key00")); err != nil || string(v) != "new" {
+			t.Errorf("key00: expected new, got %q, %v", v, err)
+		}
+		if _, err := db.Get([]byte("deleted")); err != ErrKeyNotFound {
+			t.Errorf("deleted: expected ErrKeyNotFound, got %v", err)
+		}
+		for i := 1; i < 20; i++ {
+			if v, err := db.Get([]byte(fmt.Sprintf("key%02d", i))); err != nil || string(v) != "old" {
+				t.Errorf("key%02d: expected old, got %q, %v", i, v, err)
+			}
+		}
+	}
+	check(db)
+
+	_ = db.Close()
+	db2, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db2.Close() }()
+	check(db2)
+}
+
+func TestMergeWithConcurrentWriters(t *testing.T) {
+	dbDir := "test_merge_writers_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 512
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	const writers, rounds = 4, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				key := []byte(fmt.Sprintf("w%d-key%d", w, i%10))
+				if err := db.Put(key, []byte(fmt.Sprintf("%d", i))); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for merging := true; merging; {
+		select {
+		case <-done:
+			merging = false
+		default:
+			if err := db.Merge(); err != nil {
+				t.Fatalf("Merge failed: %v", err)
+			}
+		}
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+
+	for w := 0; w < writers; w++ {
+		for k := 0; k < 10; k++ {
+			key := []byte(fmt.Sprintf("w%d-key%d", w, k))
+			want := fmt.Sprintf("%d", rounds-10+k)
+			if v, err := db.Get(key); err != nil || string(v) != want {
+				t.Errorf("%s: expected %s, got %q, %v", key, want, v, err)
+			}
+		}
+	}
+}
+
+func TestBackgroundMerge(t *testing.T) {
+	dbDir := "test_background_merge_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 256
+	opts.MergeInBackground = true
+	opts.MergeCheckInterval = 10 * time.Millisecond
+	opts.MergeMinDeadRatio = 0.5
+	opts.MergeMinTotalBytes = 0
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	// 同じキーを上書きし続けて断片化させる
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte("key"), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	olderFiles := func() int {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return len(db.olderFiles)
+	}
+
+	// 不変セグメントが 1 つに統合されるまで待つ
+	deadline := time.Now().Add(5 * time.Second)
+	for olderFiles() > 1 {
+		if time.Now().After(deadline) {
+			dead, ratio := db.fragmentation()
+			t.Fatalf("Background merge did not run: dead=%d ratio=%.2f", dead, ratio)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if v, err := db.Get([]byte("key")); err != nil || string(v) != "value099" {
+		t.Errorf("Expected value099, got %q, %v", v, err)
+	}
+}
+
+func TestShouldMergeThresholds(t *testing.T) {
+	dbDir := "test_should_merge_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.MergeMinDeadRatio = 0
+	opts.MergeMinDeadBytes = 0
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	_ = db.Put([]byte("key"), []byte("value1"))
+	_ = db.Put([]byte("key"), []byte("value2"))
+
+	if db.shouldMerge() {
+		t.Error("Expected no merge when thresholds are disabled")
+	}
+	db.opts.MergeMinDeadBytes = 1
+	if !db.shouldMerge() {
+		t.Error("Expected merge when dead bytes exceed MergeMinDeadBytes")
+	}
+	db.opts.MergeMinDeadBytes = 0
+	db.opts.MergeMinDeadRatio = 0.9
+	if db.shouldMerge() {
+		t.Error("Expected no merge below MergeMinDeadRatio")
+	}
+	db.opts.MergeMinDeadRatio = 0.4
+	if db.shouldMerge() {
+		t.Error("Expected no merge below MergeMinTotalBytes")
+	}
+	db.opts.MergeMinTotalBytes = 0
+	if !db.shouldMerge() {
+		t.Error("Expected merge when dead ratio exceeds MergeMinDeadRatio")
+	}
+}
+
+func TestBackgroundMergeSkipsSmallDB(t *testing.T) {
+	dbDir := "test_background_merge_small_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.MergeInBackground = true
+	opts.MergeCheckInterval = time.Millisecond
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	// 小さな DB で 1 つのキーを上書きし続けても、デフォルトの MergeMinTotalBytes 未満なら Merge しない
+	for i := 0; i < 2000; i++ {
+		if err := db.Put([]byte("hot"), []byte(fmt.Sprintf("value%04d", i))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	db.mu.RLock()
+	activeID := db.activeFileID
+	db.mu.RUnlock()
+	if activeID != 0 {
+		t.Errorf("Expected no background merge on a small DB, active file is %d", activeID)
+	}
+	if _, ratio := db.fragmentation(); ratio < opts.MergeMinDeadRatio {
+		t.Errorf("Expected dead ratio above %v, got %.2f", opts.MergeMinDeadRatio, ratio)
+	}
+}
+
+// prepareInterruptedMerge は Merge のコピー完了直後 (マニフェスト書き込み後) にクラッシュした状態を作ります。
+func prepareInterruptedMerge(t *testing.T, dbDir string, opts Options, writeManifest bool) mergeManifest {
+	t.Helper()
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		_ = db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%02d", i)))
+	}
+	for i := 0; i < 10; i++ {
+		_ = db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("updated%02d", i)))
+	}
+
+	// Merge の手順 1, 2 を実行し、差し替え前で止める
+	db.mu.Lock()
+	firstID := db.activeFileID + 1
+	lastID := firstID + maxMergeOutputs(db.stats.totalBytes, opts.SegmentSize) - 1
+	if err := db.newActiveFile(lastID + 1); err != nil {
+		t.Fatalf("newActiveFile failed: %v", err)
+	}
+	inputs := make(map[int]*segment)
+	var m mergeManifest
+	for id, seg := range db.olderFiles {
+		inputs[id] = seg
+		m.Inputs = append(m.Inputs, id)
+	}
+	snapshot := db.keyDir.clone()
+	db.mu.Unlock()
+	sort.Ints(m.Inputs)
+
+	if _, m.Outputs, err = db.copyLiveRecords(snapshot, inputs, firstID, lastID); err != nil {
+		t.Fatalf("copyLiveRecords failed: %v", err)
+	}
+	if len(m.Outputs) < 2 {
+		t.Fatalf("Expected multiple output segments, got %v", m.Outputs)
+	}
+	if writeManifest {
+		if err := writeMergeManifest(dbDir, m); err != nil {
+			t.Fatalf("writeMergeManifest failed: %v", err)
+		}
+	}
+	_ = db.Close()
+	return m
+}
+
+func checkMergeRecovered(t *testing.T, dbDir string, opts Options) {
+	t.Helper()
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	for i := 0; i < 20; i++ {
+		want := fmt.Sprintf("value%02d", i)
+		if i < 10 {
+			want = fmt.Sprintf("updated%02d", i)
+		}
+		if v, err := db.Get([]byte(fmt.Sprintf("key%02d", i))); err != nil || string(v) != want {
+			t.Errorf("key%02d: expected %s, got %q, %v", i, want, v, err)
+		}
+	}
+
+	files, _ := os.ReadDir(dbDir)
+	for _, f := range files {
+		if f.Name() == mergeManifestFileName || strings.HasPrefix(f.Name(), mergeTempPrefix) {
+			t.Errorf("Expected %s to be removed after recovery", f.Name())
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestMergeManifestRollForward(t *testing.T) {
+	dbDir := "test_merge_roll_forward_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 128
+	m := prepareInterruptedMerge(t, dbDir, opts, true)
+
+	// 出力のリネーム途中でクラッシュした状態にする
+	first := m.Outputs[0]
+	if err := os.Rename(mergeTempPath(dbDir, first, "data"), filepath.Join(dbDir, fmt.Sprintf("%d.data", first))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only ではマージを完了できないため開けない
+	roOpts := opts
+	roOpts.ReadOnly = true
+	if db, err := OpenWithOptions(dbDir, roOpts); err == nil {
+		_ = db.Close()
+		t.Fatal("Expected read-only open to fail with an unfinished merge")
+	}
+
+	checkMergeRecovered(t, dbDir, opts)
+	for _, id := range m.Inputs {
+		if fileExists(filepath.Join(dbDir, fmt.Sprintf("%d.data", id))) {
+			t.Errorf("Expected merged input %d.data to be removed", id)
+		}
+	}
+	for _, id := range m.Outputs {
+		if !fileExists(filepath.Join(dbDir, fmt.Sprintf("%d.data", id))) || !fileExists(filepath.Join(dbDir, fmt.Sprintf("%d.hint", id))) {
+			t.Errorf("Expected data and hint files for output segment %d", id)
+		}
+	}
+}
+
+func TestMergeManifestAfterRename(t *testing.T) {
+	dbDir := "test_merge_after_rename_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 128
+	m := prepareInterruptedMerge(t, dbDir, opts, true)
+
+	// 出力のリネーム後、入力の削除途中でクラッシュした状態にする
+	for _, id := range m.Outputs {
+		for _, ext := range []string{"data", "hint"} {
+			if err := os.Rename(mergeTempPath(dbDir, id, ext), filepath.Join(dbDir, fmt.Sprintf("%d.%s", id, ext))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	_ = os.Remove(filepath.Join(dbDir, fmt.Sprintf("%d.data", m.Inputs[0])))
+
+	checkMergeRecovered(t, dbDir, opts)
+	for _, id := range m.Inputs {
+		if fileExists(filepath.Join(dbDir, fmt.Sprintf("%d.data", id))) {
+			t.Errorf("Expected merged input %d.data to be removed", id)
+		}
+	}
+}
+
+func TestMergeRollbackWithoutManifest(t *testing.T) {
+	dbDir := "test_merge_rollback_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 128
+	m := prepareInterruptedMerge(t, dbDir, opts, false)
+
+	checkMergeRecovered(t, dbDir, opts)
+	for _, id := range m.Inputs {
+		if !fileExists(filepath.Join(dbDir, fmt.Sprintf("%d.data", id))) {
+			t.Errorf("Expected input %d.data to be kept", id)
+		}
+	}
+}
+
+func TestMergeSplitsOutput(t *testing.T) {
+	dbDir := "test_merge_split_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 256
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 50; i++ {
+			_ = db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%02d-%d", i, round)))
+		}
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+
+	db.mu.RLock()
+	if len(db.olderFiles) < 2 {
+		t.Errorf("Expected merge output to be split into multiple segments, got %d", len(db.olderFiles))
+	}
+	for id, seg := range db.olderFiles {
+		if seg.reader.Size()-seg.header.size() > opts.SegmentSize {
+			t.Errorf("Segment %d exceeds SegmentSize: %d", id, seg.reader.Size())
+		}
+		if id >= db.activeFileID {
+			t.Errorf("Merged segment %d must be older than active file %d", id, db.activeFileID)
+		}
+		if !fileExists(filepath.Join(dbDir, fmt.Sprintf("%d.hint", id))) {
+			t.Errorf("Expected hint file for segment %d", id)
+		}
+	}
+	db.mu.RUnlock()
+
+	// マージ後の書き込みは再起動後もマージ結果より優先される
+	_ = db.Put([]byte("key00"), []byte("after-merge"))
+	_ = db.Close()
+
+	db2, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db2.Close() }()
+	for i := 0; i < 50; i++ {
+		want := fmt.Sprintf("value%02d-2", i)
+		if i == 0 {
+			want = "after-merge"
+		}
+		if v, err := db2.Get([]byte(fmt.Sprintf("key%02d", i))); err != nil || string(v) != want {
+			t.Errorf("key%02d: expected %s, got %q, %v", i, want, v, err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DefaultSegmentSize はセグメント (N.data) のデフォルト上限サイズです。
+	DefaultSegmentSize = int64(10 * 1024 * 1024) // 10MB
+
+	// optionsFileName はオープン時のオプションを記録するファイル名です。
+	optionsFileName = "OPTIONS"
+)
+
+// SyncPolicy は書き込みをいつディスクへ fsync するかを表します。
+type SyncPolicy int
+
+const (
+	// SyncNever は書き込みごとの fsync を行いません (ローテーション時のみ)。
+	SyncNever SyncPolicy = iota
+	// SyncAlways は Put/Delete のたびに fsync します。同時に待機している書き込みは
+	// 1 回の fsync を共有します (Group Commit)。
+	SyncAlways
+	// SyncPeriodic は Options.SyncInterval ごとにバックグラウンドで fsync します。
+	SyncPeriodic
+	// SyncByBytes は未同期の書き込み量が Options.SyncBytes を超えるたびに fsync します。
+	SyncByBytes
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncNever:
+		return "never"
+	case SyncAlways:
+		return "always"
+	case SyncPeriodic:
+		return "periodic"
+	case SyncByBytes:
+		return "bytes"
+	default:
+		return fmt.Sprintf("SyncPolicy(%d)", int(p))
+	}
+}
+
+// Options は DB の動作設定です。DefaultOptions() を起点に必要な項目だけ変更してください。
+type Options struct {
+	// SegmentSize はアクティブファイルをローテーションするサイズ (bytes) です。
+	SegmentSize int64
+	// SyncPolicy は書き込みの永続化ポリシーです。
+	SyncPolicy SyncPolicy
+	// SyncInterval は SyncPeriodic での fsync 間隔です。
+	SyncInterval time.Duration
+	// SyncBytes は SyncByBytes で fsync を行う未同期書き込み量 (bytes) です。
+	SyncBytes int64
+	// ReadOnly が true の場合、ファイルを作成・変更せずに開き、書き込み系操作を拒否します。
+	// 最新セグメントを含む全セグメントを不変セグメントとして読み込み、DB.Refresh で書き込みプロセスの
+	// 追記を取り込めます。
+	ReadOnly bool
+	// NoLock が true の場合、ディレクトリのロックを取得しません。ReadOnly でのみ指定でき、
+	// 書き込みプロセスが開いている DB をサイドカーとして読む場合に使います。
+	NoLock bool
+	// UseMmap が true の場合、不変セグメントを mmap で読み込みます。
+	// アクティブファイルもセグメントサイズまで事前確保して mmap し、書き込み済みの範囲を mmap から読みます
+	// (事前確保した領域はローテーションと Close で切り詰めます)。
+	UseMmap bool
+	// RepairCorruption が true の場合、セグメントの途中で破損したレコードを検出しても
+	// オープンを失敗させず、そのセグメントを破損位置で切り詰めます (以降のレコードは失われます)。
+	// false の場合、切り詰めるのは最新セグメント末尾の書きかけレコード (後ろに正常なレコードが無いもの) のみです。
+	RepairCorruption bool
+	// LoadHintFiles が true の場合、起動時に Hint File があればデータファイルの走査を省略します。
+	LoadHintFiles bool
+	// WriteHintFiles が true の場合、Merge 時に Hint File を生成します。
+	WriteHintFiles bool
+	// MergeInBackground が true の場合、MergeCheckInterval ごと、および書き込みで閾値を超えた時点で
+	// 断片化 (Stats の DeadRatio / DeadBytes) を確認し、閾値を超えていればバックグラウンドで Merge を実行します。
+	MergeInBackground bool
+	// MergeCheckInterval はバックグラウンドマージの確認間隔です。
+	MergeCheckInterval time.Duration
+	// MergeMinDeadRatio は自動マージを起動する不要データ比率 (0.0-1.0) です。0 なら比率では判定しません。
+	MergeMinDeadRatio float64
+	// MergeMinTotalBytes は MergeMinDeadRatio で判定する全データ量 (bytes) の下限です。
+	// これより小さい DB では比率が高くても自動マージしません (小さな DB で上書きのたびに Merge しないため)。
+	MergeMinTotalBytes int64
+	// MergeMinDeadBytes は自動マージを起動する不要データ量 (bytes) です。0 なら量では判定しません。
+	MergeMinDeadBytes int64
+	// Compression は Put / Batch で書き込む値の圧縮方式です。方式はレコードごとに記録されるため、
+	// 変更しても既存のレコードはそのまま読めます。
+	Compression Compression
+	// CompressionThreshold は圧縮する値の最小サイズ (bytes) です。これより小さい値は圧縮しません。
+	CompressionThreshold int
+	// MergeRecompress が true の場合、Merge は Compression と異なる方式で格納されたレコード
+	// (圧縮の閾値以上の無圧縮の値を含む) を現在の方式で圧縮し直します。
+	// 書き直したレコードは CRC が変わるため、Version (HTTP API の ETag) も変わります。
+	MergeRecompress bool
+	// KeyProvider を指定すると、新しく作成するデータファイルと Hint File を KeyProvider.CurrentKey の鍵で
+	// 暗号化します (crypto.go を参照)。暗号化されたファイルを読むには、そのファイルの鍵を返す KeyProvider が必要です。
+	// 暗号化した DB はオープンごとに新しいセグメントへ書き込みます。既存の平文のセグメントや古い鍵のセグメントは
+	// Merge で現在の鍵で書き直されます。
+	KeyProvider KeyProvider
+	// BlobThreshold 以上の大きさ (bytes) の値は、データファイルではなく Blob File (N.blob) に書き込み、
+	// データファイルにはその位置だけを持つレコードを書きます (キーと値の分離)。Merge は Blob File を書き直さないため、
+	// 大きな値を含む DB でも Merge のコストが有効なキーの数に比例します。0 なら分離しません。
+	// 変更しても既存のレコードはそのまま読めます。
+	BlobThreshold int
+	// BlobGCMinDeadRatio は BlobGC が書き直す Blob File の不要データ比率 (0.0-1.0) です。
+	// MergeInBackground の場合は、この比率を超えた Blob File があればバックグラウンドで BlobGC も実行します。
+	BlobGCMinDeadRatio float64
+	// Logger は警告の出力先です。nil の場合は log.Default() を使います。
+	Logger *log.Logger
+}
+
+// DefaultOptions はデフォルト設定を返します。
+func DefaultOptions() Options {
+	return Options{
+		SegmentSize:    DefaultSegmentSize,
+		SyncPolicy:     SyncNever,
+		SyncInterval:   time.Second,
+		SyncBytes:      1024 * 1024,
+		UseMmap:        true,
+		LoadHintFiles:  true,
+		WriteHintFiles: true,
+
+		MergeCheckInterval: time.Minute,
+		MergeMinDeadRatio:  0.5,
+		MergeMinTotalBytes: DefaultSegmentSize,
+
+		CompressionThreshold: DefaultCompressionThreshold,
+
+		BlobGCMinDeadRatio: 0.5,
+	}
+}
+
+// validate はオプションの整合性を検証します。
+func (o Options) validate() error {
+	if o.SegmentSize <= 0 {
+		return fmt.Errorf("invalid options: SegmentSize must be positive, got %d", o.SegmentSize)
+	}
+	switch o.SyncPolicy {
+	case SyncNever, SyncAlways:
+	case SyncPeriodic:
+		if o.SyncInterval <= 0 {
+			return fmt.Errorf("invalid options: SyncInterval must be positive for SyncPeriodic, got %v", o.SyncInterval)
+		}
+	case SyncByBytes:
+		if o.SyncBytes <= 0 {
+			return fmt.Errorf("invalid options: SyncBytes must be positive for SyncByBytes, got %d", o.SyncBytes)
+		}
+	default:
+		return fmt.Errorf("invalid options: unknown SyncPolicy %d", int(o.SyncPolicy))
+	}
+	if o.NoLock && !o.ReadOnly {
+		return errors.New("invalid options: NoLock requires ReadOnly")
+	}
+	if o.MergeMinDeadRatio < 0 || o.MergeMinDeadRatio > 1 {
+		return fmt.Errorf("invalid options: MergeMinDeadRatio must be within [0, 1], got %v", o.MergeMinDeadRatio)
+	}
+	if o.MergeInBackground && o.MergeCheckInterval <= 0 {
+		return fmt.Errorf("invalid options: MergeCheckInterval must be positive for MergeInBackground, got %v", o.MergeCheckInterval)
+	}
+	if o.MergeMinDeadBytes < 0 {
+		return fmt.Errorf("invalid options: MergeMinDeadBytes must not be negative, got %d", o.MergeMinDeadBytes)
+	}
+	if o.MergeMinTotalBytes < 0 {
+		return fmt.Errorf("invalid options: MergeMinTotalBytes must not be negative, got %d", o.MergeMinTotalBytes)
+	}
+	switch o.Compression {
+	case CompressionNone, CompressionLZ4, CompressionFlate:
+	default:
+		return fmt.Errorf("invalid options: unknown Compression %d", int(o.Compression))
+	}
+	if o.CompressionThreshold < 0 {
+		return fmt.Errorf("invalid options: CompressionThreshold must not be negative, got %d", o.CompressionThreshold)
+	}
+	if o.BlobThreshold < 0 {
+		return fmt.Errorf("invalid options: BlobThreshold must not be negative, got %d", o.BlobThreshold)
+	}
+	if o.BlobGCMinDeadRatio < 0 || o.BlobGCMinDeadRatio > 1 {
+		return fmt.Errorf("invalid options: BlobGCMinDeadRatio must be within [0, 1], got %v", o.BlobGCMinDeadRatio)
+	}
+	return nil
+}
+
+func (o Options) logger() *log.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return log.Default()
+}
+
+// persistedOptions はディレクトリに記録するオプションのサブセットです。
+// 再オープン時に前回の値と比較し、互換性に影響する変更を警告します。
+// 文字列の項目は、それを記録していない古い OPTIONS では空になるため比較しません。
+type persistedOptions struct {
+	SegmentSize   int64  `json:"segment_size"`
+	Compression   string `json:"compression,omitempty"`
+	Encryption    string `json:"encryption,omitempty"` // KeyProvider の有無 ("none" または "aes-256-gcm")
+	BlobThreshold int    `json:"blob_threshold"`
+}
+
+const (
+	encryptionNone   = "none"
+	encryptionAESGCM = "aes-256-gcm"
+)
+
+func (o Options) persisted() persistedOptions {
+	encryption := encryptionNone
+	if o.KeyProvider != nil {
+		encryption = encryptionAESGCM
+	}
+	return persistedOptions{
+		SegmentSize:   o.SegmentSize,
+		Compression:   o.Compression.String(),
+		Encryption:    encryption,
+		BlobThreshold: o.BlobThreshold,
+	}
+}
+
+// readPersistedOptions は記録済みオプションを読み込みます。ファイルが無ければ nil を返します。
+func readPersistedOptions(dirPath string) (*persistedOptions, error) {
+	data, err := os.ReadFile(filepath.Join(dirPath, optionsFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var p persistedOptions
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", optionsFileName, err)
+	}
+	return &p, nil
+}
+
+// LoadOptions は dirPath の OPTIONS に記録された SegmentSize / Compression / BlobThreshold を opts に反映して返します。
+// 既存のディレクトリを開くツールが、ディレクトリの設定を既定値で上書きしないために使います。
+// OPTIONS が無い場合や、古い OPTIONS に記録されていない項目は opts の値のままです。
+func LoadOptions(dirPath string, opts Options) (Options, error) {
+	p, err := readPersistedOptions(dirPath)
+	if err != nil || p == nil {
+		return opts, err
+	}
+	if p.SegmentSize > 0 {
+		opts.SegmentSize = p.SegmentSize
+	}
+	if p.Compression != "" {
+		c, err := ParseCompression(p.Compression)
+		if err != nil {
+			return opts, fmt.Errorf("%s: %w", optionsFileName, err)
+		}
+		opts.Compression = c
+	}
+	opts.BlobThreshold = p.BlobThreshold
+	return opts, nil
+}
+
+// writePersistedOptions は一時ファイル経由で OPTIONS を書き換えます。
+func writePersistedOptions(dirPath string, p persistedOptions) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dirPath, optionsFileName)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(dirPath)
+}
+
+// incompatibleChanges は前回のオプションから変化した項目の説明を返します。
+func (p persistedOptions) incompatibleChanges(prev persistedOptions) []string {
+	var changes []string
+	if p.SegmentSize != prev.SegmentSize {
+		changes = append(changes, fmt.Sprintf("SegmentSize changed from %d to %d (existing segments keep their size)", prev.SegmentSize, p.SegmentSize))
+	}
+	if prev.Compression != "" && p.Compression != prev.Compression {
+		changes = append(changes, fmt.Sprintf("Compression changed from %s to %s (existing records keep their codec until Merge with MergeRecompress)", prev.Compression, p.Compression))
+	}
+	if prev.Encryption != "" && p.Encryption != prev.Encryption {
+		if p.Encryption == encryptionNone {
+			changes = append(changes, "KeyProvider removed (encrypted segments cannot be read without it)")
+		} else {
+			changes = append(changes, "KeyProvider added (existing segments stay unencrypted until Merge and BlobGC rewrite them)")
+		}
+	}
+	if p.BlobThreshold != prev.BlobThreshold {
+		changes = append(changes, fmt.Sprintf("BlobThreshold changed from %d to %d (existing values stay where they were written)", prev.BlobThreshold, p.BlobThreshold))
+	}
+	return changes
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"io"
 	"os"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -13,6 +14,12 @@ type Reader interface {
 	Size() int64
 }
 
+// sliceReader is implemented by readers that can expose their contents without
+// copying. The returned slice is read-only and stays valid until the reader is closed.
+type sliceReader interface {
+	Slice(off, n int64) ([]byte, error)
+}
+
 // DiskReader wraps a standard *os.File.
 type DiskReader struct {
 	f *os.File
@@ -87,6 +94,14 @@ func (m *MmapReader) ReadAt(b []byte, off int64) (int, error) {
 	return len(b), nil
 }
 
+// Slice returns the n bytes at off from the mapping without copying.
+func (m *MmapReader) Slice(off, n int64) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > m.size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return m.data[off : off+n : off+n], nil
+}
+
 func (m *MmapReader) Close() error {
 	if m.data != nil {
 		if err := syscall.Munmap(m.data); err != nil {
@@ -99,3 +114,65 @@ func (m *MmapReader) Close() error {
 func (m *MmapReader) Size() int64 {
 	return m.size
 }
+
+// ActiveMmapReader maps the preallocated active segment for reads.
+// The writer appends to the file with pwrite and advances the committed length with
+// Commit; reads are served from the mapping and never go past the committed length.
+// The mapping does not own the file: Close only unmaps it, and the DB closes the
+// active *os.File itself.
+type ActiveMmapReader struct {
+	data      []byte
+	committed atomic.Int64
+}
+
+// NewActiveMmapReader maps the first length bytes of f, of which committed bytes
+// are readable. The file must already be at least length bytes long.
+func NewActiveMmapReader(f *os.File, length, committed int64) (*ActiveMmapReader, error) {
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(length), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	m := &ActiveMmapReader{data: data}
+	m.committed.Store(committed)
+	return m, nil
+}
+
+func (m *ActiveMmapReader) ReadAt(b []byte, off int64) (int, error) {
+	size := m.committed.Load()
+	if off < 0 || off >= size {
+		return 0, io.EOF
+	}
+	if off+int64(len(b)) > size {
+		n := copy(b, m.data[off:size])
+		return n, io.EOF
+	}
+	copy(b, m.data[off:off+int64(len(b))])
+	return len(b), nil
+}
+
+// Slice returns the n committed bytes at off from the mapping without copying.
+func (m *ActiveMmapReader) Slice(off, n int64) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > m.committed.Load() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return m.data[off : off+n : off+n], nil
+}
+
+func (m *ActiveMmapReader) Close() error {
+	return syscall.Munmap(m.data)
+}
+
+// Size returns the committed length.
+func (m *ActiveMmapReader) Size() int64 {
+	return m.committed.Load()
+}
+
+// Cap returns the mapped length.
+func (m *ActiveMmapReader) Cap() int64 {
+	return int64(len(m.data))
+}
+
+// Commit makes the first size bytes readable. size must not exceed Cap.
+func (m *ActiveMmapReader) Commit(size int64) {
+	m.committed.Store(size)
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ReadOnlyError は read-only で開いた DB に対する書き込み系操作のエラーです。
+// errors.Is(err, ErrReadOnly) で判定できます。
+type ReadOnlyError struct {
+	Op string // 拒否した操作 ("put", "delete", "write", "expire", "merge")
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, ErrReadOnly)
+}
+
+func (e *ReadOnlyError) Unwrap() error {
+	return ErrReadOnly
+}
+
+// listSegmentIDs はディレクトリ内のデータファイル (N.data) の ID を昇順で返します。
+func listSegmentIDs(dirPath string) ([]int, error) {
+	return listFileIDs(dirPath, ".data")
+}
+
+// listFileIDs はディレクトリ内の拡張子 ext のファイル (N.ext) の ID を昇順で返します。
+func listFileIDs(dirPath, ext string) ([]int, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileIDs []int
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ext) {
+			name := strings.TrimSuffix(entry.Name(), ext)
+			id, err := strconv.Atoi(name)
+			if err == nil {
+				fileIDs = append(fileIDs, id)
+			}
+		}
+	}
+	sort.Ints(fileIDs)
+	return fileIDs, nil
+}
+
+// Refresh は read-only で開いた DB に、書き込みプロセスがその後に追記したレコードと
+// 新しいセグメントを取り込みます。書き込み用に開いた DB では何もしません。
+//
+// 通常は前回読み込んだ位置以降だけを読み込みます。書き込みプロセスの Merge でセグメントが
+// 置き換えられていた場合はインデックスを作り直します。書き込み途中のレコードは次回の Refresh で
+// 取り込まれます。Merge の差し替え中は ErrMergeInProgress を返すので、時間をおいて再実行してください。
+// 書き込みプロセスの BlobGC と重なった場合、書き直された値は次回の Refresh まで読めないことがあります。
+// 書き込みプロセスと並行して開くには Options.NoLock を指定します。
+func (d *DB) Refresh() error {
+	if !d.opts.ReadOnly {
+		return nil
+	}
+	d.mergeMu.Lock()
+	defer d.mergeMu.Unlock()
+
+	if _, err := os.Stat(filepath.Join(d.dirPath, mergeManifestFileName)); err == nil {
+		return fmt.Errorf("%w: %s", ErrMergeInProgress, d.dirPath)
+	}
+	ids, err := listSegmentIDs(d.dirPath)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	defer d.publishSegmentsLocked()
+
+	if d.segmentsReplaced(ids) {
+		if err := d.reloadLocked(ids); err != nil {
+			return err
+		}
+		return d.loadBlobFiles()
+	}
+	for i, id := range ids {
+		if err := d.refreshSegment(id, i == len(ids)-1); err != nil {
+			return err
+		}
+	}
+	// 取り込んだレコードが参照する値を読めるよう、Blob File はデータファイルの後に読み込む
+	return d.loadBlobFiles()
+}
+
+// segmentsReplaced は読み込み済みのセグメントが削除されたか、読み込み済みの ID より小さい
+// セグメントが追加されたか (いずれも Merge の結果) を判定します。
+func (d *DB) segmentsReplaced(ids []int) bool {
+	current := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		current[id] = true
+	}
+	maxKnown := -1
+	for id := range d.olderFiles {
+		if !current[id] {
+			return true
+		}
+		if id > maxKnown {
+			maxKnown = id
+		}
+	}
+	for _, id := range ids {
+		if _, known := d.olderFiles[id]; !known && id < maxKnown {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshSegment はセグメントの前回読み込んだ位置以降のレコードを取り込みます。
+// 読み込み済みの位置は計測値の totalBytes (read-only では書きかけの末尾を除いたサイズ) に
+// ファイルヘッダのサイズを足したものです。
+func (d *DB) refreshSegment(id int, newest bool) error {
+	path := filepath.Join(d.dirPath, fmt.Sprintf("%d.data", id))
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	var loaded int64
+	if s, ok := d.segStats[id]; ok {
+		loaded = s.totalBytes
+	}
+	old, known := d.olderFiles[id]
+	if known && info.Size() <= loaded+old.header.size() {
+		return nil
+	}
+
+	// 伸びたファイルを開き直す (Mmap のサイズは開いた時点で固定されるため)
+	seg, err := d.openSegment(id)
+	if err != nil {
+		if newest && errors.Is(err, io.ErrUnexpectedEOF) {
+			// 作成中のファイルのヘッダ。次回の Refresh で読む
+			return nil
+		}
+		return err
+	}
+	if known {
+		// Get やイテレータが参照中なら、Reader は最後の参照の解放時に閉じられる
+		d.retireSegment(old)
+	}
+	d.olderFiles[id] = seg
+	// 前回空のファイルとして読み込んでいた場合も、ここでヘッダの分を読み飛ばす
+	loaded += seg.header.size()
+	d.addSegmentBytes(id, seg.reader.Size()-loaded, 0)
+
+	if err := d.loadKeyDir(seg, loaded, newest); err != nil {
+		var bad *badRecordError
+		if newest && errors.As(err, &bad) {
+			// 書き込み中のレコード。次回の Refresh で続きから読む
+			d.addSegmentBytes(id, -(bad.size - bad.offset), 0)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// reloadLocked はインデックスとセグメントを読み込み直して置き換えます。
+// 失敗した場合は現在の状態を維持します。
+func (d *DB) reloadLocked(ids []int) error {
+	fresh := &DB{
+		dirPath:    d.dirPath,
+		olderFiles: make(map[int]*segment),
+		keyDir:     newKeyIndex(),
+		segStats:   make(map[int]*segmentStats),
+		blobLive:   make(map[int]*segmentStats),
+		opts:       d.opts,
+	}
+	release := func() {
+		for _, seg := range fresh.olderFiles {
+			_ = seg.release()
+		}
+	}
+	for i, id := range ids {
+		if err := fresh.loadFile(id, i == len(ids)-1); err != nil {
+			if err := fresh.recoverBadRecord(err, i == len(ids)-1); err != nil {
+				release()
+				return err
+			}
+		}
+	}
+
+	for _, seg := range d.olderFiles {
+		d.retireSegment(seg)
+	}
+	d.olderFiles = fresh.olderFiles
+	d.keyDir = fresh.keyDir
+	d.segStats = fresh.segStats
+	d.stats = fresh.stats
+	d.blobLive = fresh.blobLive
+	return nil
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOnlyError(t *testing.T) {
+	dbDir := "test_readonly_error_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+	ro, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open empty directory read-only: %v", err)
+	}
+
+	b := NewBatch()
+	b.Put([]byte("a"), []byte("1"))
+	for op, err := range map[string]error{
+		"put":    ro.Put([]byte("key"), []byte("value")),
+		"delete": ro.Delete([]byte("key")),
+		"write":  ro.Write(b),
+		"merge":  ro.Merge(),
+	} {
+		var roErr *ReadOnlyError
+		if !errors.As(err, &roErr) || roErr.Op != op || !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s: expected *ReadOnlyError, got %v", op, err)
+		}
+	}
+	if _, err := ro.Get([]byte("key")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	_ = ro.Close()
+
+	// Read-only ではファイルを一切作成しない
+	entries, _ := os.ReadDir(dbDir)
+	if len(entries) != 0 {
+		t.Errorf("Expected read-only open to leave the directory empty, got %d entries", len(entries))
+	}
+
+	opts.ReadOnly = false
+	opts.NoLock = true
+	if _, err := OpenWithOptions(dbDir, opts); err == nil {
+		t.Error("Expected NoLock without ReadOnly to be rejected")
+	}
+}
+
+func TestReadOnlyRefresh(t *testing.T) {
+	dbDir := "test_readonly_refresh_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 128
+	writer, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open writer: %v", err)
+	}
+	defer func() { _ = writer.Close() }()
+	_ = writer.Put([]byte("key00"), []byte("v0"))
+
+	roOpts := opts
+	roOpts.ReadOnly = true
+	roOpts.NoLock = true
+	ro, err := OpenWithOptions(dbDir, roOpts)
+	if err != nil {
+		t.Fatalf("Failed to open read-only alongside writer: %v", err)
+	}
+	defer func() { _ = ro.Close() }()
+
+	check := func(from, to int, want string) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			key := []byte(fmt.Sprintf("key%02d", i))
+			if v, err := ro.Get(key); err != nil || string(v) != want {
+				t.Errorf("%s: expected %s, got %q, %v", key, want, v, err)
+			}
+		}
+	}
+
+	// 最新セグメントへの追記とローテーションで増えたセグメントを取り込む
+	for i := 1; i < 20; i++ {
+		_ = writer.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("v1"))
+	}
+	if _, err := ro.Get([]byte("key10")); err != ErrKeyNotFound {
+		t.Errorf("Expected key10 to be invisible before Refresh, got %v", err)
+	}
+	it := ro.NewIterator()
+	defer func() { _ = it.Close() }()
+
+	if err := ro.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	check(0, 1, "v0")
+	check(1, 20, "v1")
+
+	// Merge でセグメントが置き換えられた場合はインデックスを作り直す
+	for i := 0; i < 20; i++ {
+		_ = writer.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("v2"))
+	}
+	if err := writer.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if err := ro.Refresh(); err != nil {
+		t.Fatalf("Refresh after merge failed: %v", err)
+	}
+	check(0, 20, "v2")
+	if st, wst := ro.Stats(), writer.Stats(); st.LiveBytes != wst.LiveBytes || st.TotalBytes != wst.TotalBytes {
+		t.Errorf("Read-only stats %+v differ from writer %+v", st, wst)
+	}
+
+	// Refresh 前に作ったイテレータは古いセグメントを読み続けられる
+	if !it.Valid() {
+		t.Fatal("Expected iterator to be valid")
+	}
+	if v, err := it.Value(); err != nil || string(v) != "v0" {
+		t.Errorf("Expected iterator to read v0, got %q, %v", v, err)
+	}
+}
+
+func TestReadOnlyRefreshTornRecord(t *testing.T) {
+	dbDir := "test_readonly_torn_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	writer, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open writer: %v", err)
+	}
+	_ = writer.Put([]byte("key1"), []byte("value1"))
+	_ = writer.Close()
+
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+	opts.NoLock = true
+	ro, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open read-only: %v", err)
+	}
+	defer func() { _ = ro.Close() }()
+
+	// 書き込み途中のレコードを模擬する
+	record := appendRecord(nil, 1, 0, []byte("key2"), []byte("value2"), false)
+	f, err := os.OpenFile(filepath.Join(dbDir, "0.data"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	_, _ = f.Write(record[:10])
+
+	if err := ro.Refresh(); err != nil {
+		t.Fatalf("Refresh with a partial record failed: %v", err)
+	}
+	if _, err := ro.Get([]byte("key2")); err != ErrKeyNotFound {
+		t.Errorf("Expected partial record to be invisible, got %v", err)
+	}
+
+	_, _ = f.Write(record[10:])
+	if err := ro.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if v, err := ro.Get([]byte("key2")); err != nil || string(v) != "value2" {
+		t.Errorf("Expected value2 after the record was completed, got %q, %v", v, err)
+	}
+	if v, err := ro.Get([]byte("key1")); err != nil || string(v) != "value1" {
+		t.Errorf("Expected value1, got %q, %v", v, err)
+	}
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// データファイルのレコード形式:
+//
+//	[CRC(4)][Timestamp(8)][KeySize(4)][ValueSize(4)][Key(n)][Value(m)]
+//
+// KeySize の上位 8 bit はレコードフラグ、下位 24 bit がキー長です。
+// ValueSize が tombstoneValueSize のレコードは削除 (Tombstone) で、Value を持ちません。
+// flagExpiry のレコードは Value の先頭 8 バイトに有効期限 (UnixNano) を持ちます (ValueSize に含む)。
+// flagLZ4 / flagFlate のレコードは有効期限より後ろのユーザーの値が圧縮されています (compressValue を参照)。
+// flagEncrypted のレコードは Key と Value が暗号化され、末尾に認証タグを持ちます (crypto.go を参照)。
+// flagBlob のレコードは有効期限より後ろに、値の代わりに Blob File に書いた値のレコードの位置を持ちます (blob.go を参照)。
+// CRC は Timestamp 以降 (Header[4:] + Key + Value) に対して計算します。
+// PutStream が値を書き終える前のレコードは、CRC にヘッダ (Header[4:]) だけから計算した値を持ちます (isUnfinishedRecord を参照)。
+const (
+	recordHeaderSize = 20
+	hintHeaderSize   = 28 // [CRC(4)][Ts(8)][KSz(4)][VSz(4)][Offset(8)]
+
+	maxKeySize  = 1<<24 - 1
+	keySizeMask = uint32(maxKeySize)
+
+	tombstoneValueSize = ^uint32(0) // MaxUint32
+
+	expirySize = 8
+)
+
+// レコードフラグ (KeySize の上位 8 bit)。フラグ導入前のファイルは常に 0 です。
+const (
+	// flagBatchBegin はバッチの開始マーカーです。Value にバッチ内のレコード数を持ちます。
+	flagBatchBegin uint8 = 1 << iota
+	// flagBatchCommit はバッチのコミットマーカーです。Value にバッチ内のレコード数を持ちます。
+	flagBatchCommit
+	// flagExpiry は有効期限付きのレコードです。Value の先頭 8 バイトが期限 (UnixNano) です。
+	flagExpiry
+	// flagLZ4 は値を LZ4 で圧縮したレコードです (有効期限は圧縮しません)。
+	flagLZ4
+	// flagFlate は値を flate で圧縮したレコードです (有効期限は圧縮しません)。
+	flagFlate
+	// flagEncrypted は Key と Value を暗号化したレコードです。KeySize / ValueSize は平文の長さです。
+	flagEncrypted
+	// flagBlob は値を Blob File に分離したレコードです。値の代わりに Blob File 内の位置 (blobPointerSize) を持ちます。
+	flagBlob
+)
+
+// recordHeader はデコード済みのレコードヘッダです。
+type recordHeader struct {
+	crc       uint32
+	timestamp uint64
+	keySize   uint32
+	valueSize uint32 // 生の値 (Tombstone の場合は tombstoneValueSize)
+	flags     uint8
+}
+
+func decodeRecordHeader(buf []byte) recordHeader {
+	rawKeySize := binary.BigEndian.Uint32(buf[12:16])
+	return recordHeader{
+		crc:       binary.BigEndian.Uint32(buf[0:4]),
+		timestamp: binary.BigEndian.Uint64(buf[4:12]),
+		keySize:   rawKeySize & keySizeMask,
+		valueSize: binary.BigEndian.Uint32(buf[16:20]),
+		flags:     uint8(rawKeySize >> 24),
+	}
+}
+
+func (h recordHeader) isTombstone() bool {
+	return h.valueSize == tombstoneValueSize
+}
+
+func (h recordHeader) hasExpiry() bool {
+	return h.flags&flagExpiry != 0
+}
+
+// valueLen はファイル上の Value の長さです (Tombstone は 0、有効期限を含む)。
+func (h recordHeader) valueLen() int64 {
+	if h.isTombstone() {
+		return 0
+	}
+	return int64(h.valueSize)
+}
+
+// size はヘッダを含むレコード全体のサイズです (暗号化されたレコードは認証タグを含む)。
+func (h recordHeader) size() int64 {
+	size := recordHeaderSize + int64(h.keySize) + h.valueLen()
+	if h.flags&flagEncrypted != 0 {
+		size += gcmTagSize
+	}
+	return size
+}
+
+// isUnfinishedRecord は CRC の一致しないレコードのヘッダ header が、PutStream が値を書き終える前のもの
+// (CRC をヘッダだけから計算した予約の印) かを判定します。書き終えていないレコードはどのキーにも反映されず、
+// 復旧と Verify は破損として扱わずに読み飛ばします。
+func isUnfinishedRecord(header []byte) bool {
+	h := decodeRecordHeader(header)
+	return h.size() > recordHeaderSize && h.crc == crc32.ChecksumIEEE(header[4:recordHeaderSize])
+}
+
+// encodedRecordSize はレコードをエンコードした場合のサイズを返します。
+func encodedRecordSize(key, value []byte) int64 {
+	return recordHeaderSize + int64(len(key)) + int64(len(value))
+}
+
+// appendRecord はレコードをエンコードして buf に追記します。
+// tombstone が true の場合、value は無視され削除レコードになります。
+func appendRecord(buf []byte, ts int64, flags uint8, key, value []byte, tombstone bool) []byte {
+	valSize := uint32(len(value))
+	if tombstone {
+		value = nil
+		valSize = tombstoneValueSize
+	}
+
+	start := len(buf)
+	var header [recordHeaderSize]byte
+	binary.BigEndian.PutUint64(header[4:12], uint64(ts))
+	binary.BigEndian.PutUint32(header[12:16], uint32(flags)<<24|uint32(len(key)))
+	binary.BigEndian.PutUint32(header[16:20], valSize)
+
+	buf = append(buf, header[:]...)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+
+	crc := crc32.ChecksumIEEE(buf[start+4:])
+	binary.BigEndian.PutUint32(buf[start:start+4], crc)
+	return buf
+}
+
+// appendRecordWithExpiry は有効期限 (UnixNano) 付きのレコードをエンコードして buf に追記します。
+func appendRecordWithExpiry(buf []byte, ts int64, flags uint8, key, value []byte, expiry int64) []byte {
+	v := make([]byte, expirySize+len(value))
+	binary.BigEndian.PutUint64(v[:expirySize], uint64(expiry))
+	copy(v[expirySize:], value)
+	return appendRecord(buf, ts, flags|flagExpiry, key, v, false)
+}
+
+// splitExpiry はファイル上の Value から有効期限を取り出し、残りのユーザーの値を返します。
+// 有効期限の無いレコードは expiry = 0 です。
+func splitExpiry(h recordHeader, value []byte) (expiry int64, userValue []byte, err error) {
+	if !h.hasExpiry() {
+		return 0, value, nil
+	}
+	if len(value) < expirySize {
+		return 0, nil, ErrDataCorruption
+	}
+	return int64(binary.BigEndian.Uint64(value[:expirySize])), value[expirySize:], nil
+}
+
+// appendHintRecord は Hint File のエントリをエンコードして buf に追記します。
+//
+//	[CRC(4)][Timestamp(8)][KeySize(4)][ValueSize(4)][Offset(8)][Expiry(8)][Blob(20)][Key(n)]
+//
+// h はデータファイル側のレコードヘッダ、offset はデータファイル内のレコード位置です。
+// Expiry は flagExpiry のレコードの場合のみ、Blob (レコードが持つ Blob File の位置) は flagBlob のレコードの場合のみ書き込みます。
+// flagEncrypted のエントリは Key が暗号化され、末尾に認証タグを持ちます (sealHintEntry を参照)。
+func appendHintRecord(buf []byte, h recordHeader, offset int64, expiry int64, blob BlobPos, key []byte) []byte {
+	start := len(buf)
+	var header [hintHeaderSize]byte
+	binary.BigEndian.PutUint64(header[4:12], h.timestamp)
+	binary.BigEndian.PutUint32(header[12:16], uint32(h.flags)<<24|h.keySize)
+	binary.BigEndian.PutUint32(header[16:20], h.valueSize)
+	binary.BigEndian.PutUint64(header[20:28], uint64(offset))
+
+	buf = append(buf, header[:]...)
+	if h.hasExpiry() {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(expiry))
+	}
+	if h.flags&flagBlob != 0 {
+		buf = appendBlobPointer(buf, blob)
+	}
+	buf = append(buf, key...)
+
+	crc := crc32.ChecksumIEEE(buf[start+4:])
+	binary.BigEndian.PutUint32(buf[start:start+4], crc)
+	return buf
+}
+
+// hintEntrySize は Hint File のエントリのサイズです。h はエントリの先頭 recordHeaderSize バイトのヘッダです。
+func hintEntrySize(h recordHeader) int64 {
+	size := hintHeaderSize + int64(h.keySize)
+	if h.hasExpiry() {
+		size += expirySize
+	}
+	if h.flags&flagBlob != 0 {
+		size += blobPointerSize
+	}
+	if h.flags&flagEncrypted != 0 {
+		size += gcmTagSize
+	}
+	return size
+}
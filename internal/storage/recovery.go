@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// errPreallocated は事前確保したアクティブファイルの未使用領域 (ゼロ埋めの末尾) に達したことを表します。
+// クラッシュなどで切り詰められなかったもので、データは失われていません。
+var errPreallocated = errors.New("unused preallocated space")
+
+// errUnfinishedRecord は PutStream が値を書き込み中のレコード (isUnfinishedRecord) に達したことを表します。
+// read-only で開いた DB の最新のセグメントでだけ返し、続きは値を書き終えた後の Refresh で読み込みます。
+var errUnfinishedRecord = errors.New("unfinished stream record")
+
+// TruncatedTail は復旧時に切り詰めたセグメント末尾の情報です。
+type TruncatedTail struct {
+	FileID       int
+	Offset       int64 // 最後の正常レコードの終端 (切り詰め後のサイズ)
+	DroppedBytes int64 // 破棄したバイト数
+	Reason       error // io.ErrUnexpectedEOF (書きかけ) または *CorruptionError (CRC 不一致など)
+}
+
+func (t TruncatedTail) String() string {
+	return fmt.Sprintf("segment %d: dropped %d bytes at offset %d (%v)", t.FileID, t.DroppedBytes, t.Offset, t.Reason)
+}
+
+// badRecordError は loadKeyDir がセグメント走査中に不正なレコードを検出したことを表します。
+// offset より前のレコードはインデックスに反映済みです。
+type badRecordError struct {
+	fileID int
+	offset int64 // 切り詰める位置 (不正なレコード、バッチの途中ならバッチの開始位置)
+	at     int64 // 不正なレコードの開始位置 (offset 以上)
+	size   int64 // セグメントのファイルサイズ
+	err    error // io.ErrUnexpectedEOF または *CorruptionError
+}
+
+func (e *badRecordError) Error() string {
+	return fmt.Sprintf("segment %d: bad record at offset %d: %v", e.fileID, e.offset, e.err)
+}
+
+func (e *badRecordError) Unwrap() error {
+	return e.err
+}
+
+// recoverBadRecord は不正なレコード以降を切り詰めてオープンを継続できるか判定し、実施します。
+// 最新セグメントの末尾は、不正なレコードより後ろに正常なレコードが 1 つも無ければクラッシュによる書きかけとみなして切り詰めます。
+// 後ろに正常なレコードが続く破損と、古い (不変の) セグメントの破損は、
+// Options.RepairCorruption が指定された場合のみ切り詰め、それ以外は *CorruptionError を返します。
+func (d *DB) recoverBadRecord(err error, newest bool) error {
+	var bad *badRecordError
+	if !errors.As(err, &bad) {
+		return err
+	}
+	if !d.opts.RepairCorruption {
+		if !newest {
+			return err
+		}
+		if !errors.Is(bad.err, errPreallocated) && !errors.Is(bad.err, errUnfinishedRecord) && d.hasValidRecordAfter(bad) {
+			var ce *CorruptionError
+			if errors.As(bad.err, &ce) {
+				return err
+			}
+			// ヘッダの長さが壊れて途切れたように見えるレコード
+			return &badRecordError{fileID: bad.fileID, offset: bad.offset, at: bad.at, size: bad.size,
+				err: corruptionError(FileKindData, bad.fileID, bad.at, "unreadable record is followed by valid records")}
+		}
+	}
+
+	tail := TruncatedTail{
+		FileID:       bad.fileID,
+		Offset:       bad.offset,
+		DroppedBytes: bad.size - bad.offset,
+		Reason:       bad.err,
+	}
+	// 事前確保の未使用領域と書き込み中のレコードは、復旧したものとしては報告しない
+	if !errors.Is(bad.err, errPreallocated) && !errors.Is(bad.err, errUnfinishedRecord) {
+		d.recovered = append(d.recovered, tail)
+		d.opts.logger().Printf("bitcask: %s: recovered %s", d.dirPath, tail)
+	}
+	d.addSegmentBytes(bad.fileID, -tail.DroppedBytes, 0)
+
+	// Read-only ではファイルを変更せず、正常なレコードまでをインデックスに使う
+	if d.opts.ReadOnly {
+		return nil
+	}
+
+	// Mmap を閉じてから切り詰め、再度開き直す
+	if seg, ok := d.olderFiles[bad.fileID]; ok {
+		_ = seg.release()
+		delete(d.olderFiles, bad.fileID)
+	}
+	path := filepath.Join(d.dirPath, fmt.Sprintf("%d.data", bad.fileID))
+	if err := os.Truncate(path, bad.offset); err != nil {
+		return err
+	}
+	seg, err := d.openSegment(bad.fileID)
+	if err != nil {
+		return err
+	}
+	d.olderFiles[bad.fileID] = seg
+	return nil
+}
+
+// Recovered はオープン時に切り詰めたセグメント末尾の一覧を返します。
+func (d *DB) Recovered() []TruncatedTail {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]TruncatedTail(nil), d.recovered...)
+}
+
+// hasValidRecordAfter は bad のセグメントで、不正なレコードより後ろに CRC の一致するレコードがあるかを判定します。
+// 書きかけの末尾なら後ろには何も無いので、見つかった場合はセグメントの途中の破損です。
+// 読み込みに失敗した場合は切り詰めないよう true を返します。
+func (d *DB) hasValidRecordAfter(bad *badRecordError) bool {
+	seg, ok := d.olderFiles[bad.fileID]
+	if !ok {
+		// ヘッダの途中で途切れたファイル
+		return false
+	}
+	// loadKeyDir と同様に、Read-only では mmap を経由しない
+	var r io.ReaderAt = seg.reader
+	if m, ok := seg.reader.(*MmapReader); ok && d.opts.ReadOnly {
+		r = m.f
+	}
+	next, err := nextValidRecord(r, bad.at+1, bad.size)
+	return err != nil || next < bad.size
+}
+
+// nextValidRecord は r の [from, size) で最初に CRC の一致するレコードが始まる位置を返します。見つからなければ size です。
+// レコードの境界は分からないので 1 バイトずつずらしてヘッダを読みます。
+func nextValidRecord(r io.ReaderAt, from, size int64) (int64, error) {
+	const chunk = 64 * 1024
+	buf := make([]byte, chunk+recordHeaderSize)
+	for base := from; base+recordHeaderSize <= size; base += chunk {
+		n := min(int64(len(buf)), size-base)
+		if _, err := r.ReadAt(buf[:n], base); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := int64(0); i < chunk && i+recordHeaderSize <= n; i++ {
+			h := decodeRecordHeader(buf[i:])
+			// 正常なレコードの Timestamp は 0 にならない
+			if h.timestamp == 0 || base+i+h.size() > size {
+				continue
+			}
+			var crc uint32
+			if i+h.size() <= n {
+				crc = crc32.ChecksumIEEE(buf[i+4 : i+h.size()])
+			} else {
+				hash := crc32.NewIEEE()
+				if _, err := io.Copy(hash, io.NewSectionReader(r, base+i+4, h.size()-4)); err != nil {
+					return 0, err
+				}
+				crc = hash.Sum32()
+			}
+			if crc == h.crc {
+				return base + i, nil
+			}
+		}
+	}
+	return size, nil
+}
+
+// isTornRead は読み込みエラーが途中で途切れたレコードによるものかを判定します。
+func isTornRead(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isPreallocatedTail は r の [from, to) がすべてゼロか (事前確保したアクティブファイルの未使用領域か) を判定します。
+func isPreallocatedTail(r io.ReaderAt, from, to int64) bool {
+	buf := make([]byte, 64*1024)
+	for from < to {
+		n := int64(len(buf))
+		if to-from < n {
+			n = to - from
+		}
+		if _, err := r.ReadAt(buf[:n], from); err != nil {
+			return false
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false
+			}
+		}
+		from += n
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package storage
+
+import "sync/atomic"
+
+// segment は参照カウント付きのデータファイル (N.data) または Blob File (N.blob) の読み取りハンドルです。
+//
+// DB 自身が所有者として 1 つ参照を持ち、イテレータなど DB のロック外で読み続ける利用者は
+// acquire/release で参照を追加します。最後の参照が release された時点で Reader を閉じるため、
+// Merge やローテーションでセグメントが入れ替わっても、使用中の読み取りは古いファイルから続けられます。
+type segment struct {
+	id     int
+	reader Reader
+	header FileHeader  // 旧形式のファイルは Version 0 (レコードは先頭から始まる)
+	cipher *fileCipher // 暗号化されていないファイルは nil
+	refs   atomic.Int32
+}
+
+func newSegment(id int, reader Reader) *segment {
+	s := &segment{id: id, reader: reader}
+	s.refs.Store(1)
+	return s
+}
+
+// kind はセグメントのファイルの種類 (データファイルか Blob File) です。
+func (s *segment) kind() FileKind {
+	if s.header.Kind == FileKindBlob {
+		return FileKindBlob
+	}
+	return FileKindData
+}
+
+// acquire は参照を追加します。既に閉じられている場合は false を返します。
+func (s *segment) acquire() bool {
+	for {
+		n := s.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if s.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// release は参照を解放し、最後の参照であれば Reader を閉じます。
+func (s *segment) release() error {
+	if s.refs.Add(-1) == 0 {
+		return s.reader.Close()
+	}
+	return nil
+}
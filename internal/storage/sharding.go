@@ -1,9 +1,12 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"path/filepath"
+	"time"
 )
 
 // ShardedDB wraps multiple DB instances (shards) to reduce lock contention.
@@ -15,6 +18,14 @@ type ShardedDB struct {
 // NewShardedDB creates a new ShardedDB with the specified number of shards.
 // Each shard is stored in a subdirectory "shard-N" under dirPath.
 func NewShardedDB(dirPath string, numShards int) (*ShardedDB, error) {
+	return NewShardedDBWithOptions(dirPath, numShards, DefaultOptions())
+}
+
+// NewShardedDBWithOptions is like NewShardedDB but opens every shard with opts.
+func NewShardedDBWithOptions(dirPath string, numShards int, opts Options) (*ShardedDB, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
 	if numShards <= 0 {
 		numShards = 1
 	}
@@ -24,7 +35,7 @@ func NewShardedDB(dirPath string, numShards int) (*ShardedDB, error) {
 	// Open/Create each shard
 	for i := 0; i < numShards; i++ {
 		shardPath := filepath.Join(dirPath, fmt.Sprintf("shard-%d", i))
-		db, err := NewDB(shardPath)
+		db, err := OpenWithOptions(shardPath, opts)
 		if err != nil {
 			// Cleanup already opened shards
 			for j := 0; j < i; j++ {
@@ -59,16 +70,108 @@ func (s *ShardedDB) Put(key, value []byte) error {
 	return s.getShard(key).Put(key, value)
 }
 
+// PutWithTTL delegates to the appropriate shard.
+func (s *ShardedDB) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return s.getShard(key).PutWithTTL(key, value, ttl)
+}
+
 // Get delegates to the appropriate shard.
 func (s *ShardedDB) Get(key []byte) ([]byte, error) {
 	return s.getShard(key).Get(key)
 }
 
+// Has delegates to the appropriate shard.
+func (s *ShardedDB) Has(key []byte) bool {
+	return s.getShard(key).Has(key)
+}
+
+// TTL delegates to the appropriate shard.
+func (s *ShardedDB) TTL(key []byte) (time.Duration, error) {
+	return s.getShard(key).TTL(key)
+}
+
+// Expire delegates to the appropriate shard.
+func (s *ShardedDB) Expire(key []byte, ttl time.Duration) error {
+	return s.getShard(key).Expire(key, ttl)
+}
+
 // Delete delegates to the appropriate shard.
 func (s *ShardedDB) Delete(key []byte) error {
 	return s.getShard(key).Delete(key)
 }
 
+// DeleteExisting delegates to the appropriate shard.
+func (s *ShardedDB) DeleteExisting(key []byte) (bool, error) {
+	return s.getShard(key).DeleteExisting(key)
+}
+
+// GetWithVersion delegates to the appropriate shard.
+func (s *ShardedDB) GetWithVersion(key []byte) ([]byte, Version, error) {
+	return s.getShard(key).GetWithVersion(key)
+}
+
+// Version delegates to the appropriate shard.
+func (s *ShardedDB) Version(key []byte) (Version, error) {
+	return s.getShard(key).Version(key)
+}
+
+// PutStream delegates to the appropriate shard.
+func (s *ShardedDB) PutStream(key []byte, r io.Reader, size int64) error {
+	return s.getShard(key).PutStream(key, r, size)
+}
+
+// GetReader delegates to the appropriate shard.
+func (s *ShardedDB) GetReader(key []byte) (io.ReadCloser, error) {
+	return s.getShard(key).GetReader(key)
+}
+
+// GetReaderWithVersion delegates to the appropriate shard.
+func (s *ShardedDB) GetReaderWithVersion(key []byte) (*ValueReader, Version, error) {
+	return s.getShard(key).GetReaderWithVersion(key)
+}
+
+// CompareAndPut delegates to the appropriate shard.
+func (s *ShardedDB) CompareAndPut(key, value []byte, expected Version) (Version, error) {
+	return s.getShard(key).CompareAndPut(key, value, expected)
+}
+
+// CompareAndDelete delegates to the appropriate shard.
+func (s *ShardedDB) CompareAndDelete(key []byte, expected Version) error {
+	return s.getShard(key).CompareAndDelete(key, expected)
+}
+
+// Write applies the batch atomically. All keys in the batch must map to the same
+// shard; batches spanning several shards are rejected with ErrBatchSpansShards
+// because atomicity cannot be guaranteed across independent logs.
+func (s *ShardedDB) Write(b *Batch) error {
+	if b == nil || len(b.ops) == 0 {
+		return nil
+	}
+	shard := s.getShard(b.ops[0].key)
+	for _, op := range b.ops[1:] {
+		if s.getShard(op.key) != shard {
+			return ErrBatchSpansShards
+		}
+	}
+	return shard.Write(b)
+}
+
+// ShardedStats holds per-shard fragmentation statistics and their sum.
+type ShardedStats struct {
+	Total  Stats   // Sum over all shards (Segments is left empty)
+	Shards []Stats // Indexed by shard number
+}
+
+// Stats collects Stats from every shard.
+func (s *ShardedDB) Stats() ShardedStats {
+	st := ShardedStats{Shards: make([]Stats, len(s.shards))}
+	for i, db := range s.shards {
+		st.Shards[i] = db.Stats()
+		st.Total.add(st.Shards[i])
+	}
+	return st
+}
+
 // Close closes all shards.
 func (s *ShardedDB) Close() error {
 	var firstErr error
@@ -89,3 +192,122 @@ func (s *ShardedDB) Merge() error {
 	}
 	return nil
 }
+
+// BlobGC rewrites the fragmented blob files of every shard. Like Merge, it runs sequentially.
+func (s *ShardedDB) BlobGC() error {
+	for _, db := range s.shards {
+		if err := db.BlobGC(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewIterator returns an iterator over all keys of every shard in ascending order.
+func (s *ShardedDB) NewIterator() *ShardedIterator {
+	return s.newIterator(func(db *DB) *Iterator { return db.NewIterator() })
+}
+
+// Scan returns an iterator over the keys starting with prefix across all shards.
+func (s *ShardedDB) Scan(prefix []byte) *ShardedIterator {
+	return s.newIterator(func(db *DB) *Iterator { return db.Scan(prefix) })
+}
+
+// Range returns an iterator over the keys in [start, end) across all shards.
+func (s *ShardedDB) Range(start, end []byte) *ShardedIterator {
+	return s.newIterator(func(db *DB) *Iterator { return db.Range(start, end) })
+}
+
+func (s *ShardedDB) newIterator(open func(*DB) *Iterator) *ShardedIterator {
+	it := &ShardedIterator{iters: make([]*Iterator, len(s.shards))}
+	for i, db := range s.shards {
+		it.iters[i] = open(db)
+	}
+	it.pick()
+	return it
+}
+
+// ShardedIterator merges the per-shard iterators into a single ascending key order.
+// Each shard is a consistent snapshot taken when the iterator was created, but the
+// shards are not snapshotted atomically with respect to each other.
+// Close must be called to release the underlying segments.
+type ShardedIterator struct {
+	iters []*Iterator
+	cur   int // index of the shard iterator holding the smallest key, -1 if exhausted
+}
+
+// pick selects the shard iterator with the smallest current key.
+func (it *ShardedIterator) pick() {
+	it.cur = -1
+	var min []byte
+	for i, sub := range it.iters {
+		if !sub.Valid() {
+			continue
+		}
+		if k := sub.Key(); it.cur < 0 || bytes.Compare(k, min) < 0 {
+			it.cur, min = i, k
+		}
+	}
+}
+
+// Seek moves to the first key >= key and reports whether the iterator is valid.
+func (it *ShardedIterator) Seek(key []byte) bool {
+	for _, sub := range it.iters {
+		sub.Seek(key)
+	}
+	it.pick()
+	return it.Valid()
+}
+
+// Valid reports whether the iterator points at a key.
+func (it *ShardedIterator) Valid() bool {
+	return it.cur >= 0 && it.iters[it.cur].Valid()
+}
+
+// Next advances to the next key and reports whether the iterator is valid.
+func (it *ShardedIterator) Next() bool {
+	if !it.Valid() {
+		return false
+	}
+	it.iters[it.cur].Next()
+	it.pick()
+	return it.Valid()
+}
+
+// Key returns the current key, or nil if the iterator is not valid.
+func (it *ShardedIterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.iters[it.cur].Key()
+}
+
+// Value reads the value of the current key.
+func (it *ShardedIterator) Value() ([]byte, error) {
+	if !it.Valid() {
+		return nil, ErrKeyNotFound
+	}
+	return it.iters[it.cur].Value()
+}
+
+// Err returns the first error encountered by any shard iterator.
+func (it *ShardedIterator) Err() error {
+	for _, sub := range it.iters {
+		if err := sub.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close releases all shard iterators.
+func (it *ShardedIterator) Close() error {
+	var firstErr error
+	for _, sub := range it.iters {
+		if err := sub.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	it.cur = -1
+	return firstErr
+}
@@ -96,3 +96,108 @@ func BenchmarkShardedGetParallel(b *testing.B) {
 		}
 	})
 }
+
+func TestShardedDBWithOptions(t *testing.T) {
+	dir := "test_sharded_db_options"
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 0
+	if _, err := NewShardedDBWithOptions(dir, 2, opts); err == nil {
+		t.Fatal("Expected validation error for invalid options")
+	}
+
+	opts.SegmentSize = 128
+	db, err := NewShardedDBWithOptions(dir, 2, opts)
+	if err != nil {
+		t.Fatalf("Failed to create db: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if err := db.Put(key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, shard := range db.shards {
+		if shard.opts.SegmentSize != 128 {
+			t.Errorf("shard %d: SegmentSize = %d, want 128", i, shard.opts.SegmentSize)
+		}
+	}
+}
+
+func TestShardedDBStats(t *testing.T) {
+	dir := "test_sharded_stats"
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	db, err := NewShardedDB(dir, 4)
+	if err != nil {
+		t.Fatalf("Failed to create db: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	for i := 0; i < 100; i++ {
+		_ = db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("v1"))
+	}
+	for i := 0; i < 50; i++ {
+		_ = db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("v2"))
+	}
+
+	st := db.Stats()
+	if len(st.Shards) != 4 {
+		t.Fatalf("Expected 4 shard stats, got %d", len(st.Shards))
+	}
+	var keys int
+	var dead int64
+	for _, s := range st.Shards {
+		keys += s.Keys
+		dead += s.DeadKeys
+	}
+	if st.Total.Keys != 100 || keys != 100 {
+		t.Errorf("Expected 100 keys, got total %d (sum %d)", st.Total.Keys, keys)
+	}
+	if st.Total.DeadKeys != 50 || dead != 50 {
+		t.Errorf("Expected 50 dead keys, got total %d (sum %d)", st.Total.DeadKeys, dead)
+	}
+	if st.Total.DeadRatio <= 0 || st.Total.DeadRatio >= 1 {
+		t.Errorf("Unexpected total dead ratio %v", st.Total.DeadRatio)
+	}
+}
+
+func TestShardedIterator(t *testing.T) {
+	dir := "test_sharded_iterator"
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	db, err := NewShardedDB(dir, 4)
+	if err != nil {
+		t.Fatalf("Failed to create db: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	for i := 0; i < 50; i++ {
+		_ = db.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("val-%02d", i)))
+	}
+	_ = db.Put([]byte("other"), []byte("x"))
+
+	it := db.Scan([]byte("key-"))
+	defer func() { _ = it.Close() }()
+	i := 0
+	for ; it.Valid(); it.Next() {
+		want := fmt.Sprintf("key-%02d", i)
+		if string(it.Key()) != want {
+			t.Fatalf("Expected %s, got %s", want, it.Key())
+		}
+		if v, err := it.Value(); err != nil || string(v) != fmt.Sprintf("val-%02d", i) {
+			t.Errorf("Unexpected value for %s: %q, %v", want, v, err)
+		}
+		i++
+	}
+	if i != 50 || it.Err() != nil {
+		t.Errorf("Expected 50 keys, got %d (err %v)", i, it.Err())
+	}
+
+	if !it.Seek([]byte("key-25")) || string(it.Key()) != "key-25" {
+		t.Errorf("Expected Seek to key-25, got %s", it.Key())
+	}
+}
@@ -0,0 +1,204 @@
+package storage
+
+import "sort"
+
+// segmentStats はセグメント内のレコードの計測値です。
+// 不要データ (dead) は total - live で求めます。
+type segmentStats struct {
+	totalBytes int64 // ファイルサイズ (ファイルヘッダ、バッチのマーカーや破棄済みの書きかけを除く)
+	liveBytes  int64 // インデックスが参照しているレコードの合計
+	records    int64 // キーを持つレコード数 (Tombstone を含む)
+	liveKeys   int64 // インデックスが参照しているレコード数
+}
+
+func (s *segmentStats) add(o segmentStats) {
+	s.totalBytes += o.totalBytes
+	s.liveBytes += o.liveBytes
+	s.records += o.records
+	s.liveKeys += o.liveKeys
+}
+
+func (s *segmentStats) sub(o segmentStats) {
+	s.totalBytes -= o.totalBytes
+	s.liveBytes -= o.liveBytes
+	s.records -= o.records
+	s.liveKeys -= o.liveKeys
+}
+
+// SegmentStats はセグメント (N.data) ごとの有効・不要データ量です。
+type SegmentStats struct {
+	FileID        int
+	Active        bool   // 書き込み中のアクティブファイルか
+	FormatVersion uint16 // ファイルの形式 (0 はヘッダの無い旧形式。Merge で移行されます)
+	TotalBytes    int64  // ファイルヘッダを除くサイズ
+	LiveBytes     int64
+	DeadBytes     int64 // 上書き・削除済みのレコード、Tombstone、バッチのマーカー
+	LiveKeys      int64
+	DeadKeys      int64 // 上書き・削除済みのレコードと Tombstone の数
+}
+
+// Stats は DB 全体の断片化の状況です。Merge を実行すべきかの判断に使います。
+type Stats struct {
+	Keys       int // インデックス内のキー数 (= LiveKeys)
+	TotalBytes int64
+	LiveBytes  int64
+	DeadBytes  int64
+	LiveKeys   int64
+	DeadKeys   int64
+	DeadRatio  float64 // DeadBytes / TotalBytes
+	Segments   []SegmentStats
+
+	// Blob File の計測値 (TotalBytes などとは別に集計します)
+	BlobTotalBytes int64
+	BlobLiveBytes  int64
+	BlobDeadBytes  int64
+	Blobs          []BlobStats
+}
+
+func newSegmentStats(id int, s segmentStats, active bool) SegmentStats {
+	return SegmentStats{
+		FileID:     id,
+		Active:     active,
+		TotalBytes: s.totalBytes,
+		LiveBytes:  s.liveBytes,
+		DeadBytes:  s.totalBytes - s.liveBytes,
+		LiveKeys:   s.liveKeys,
+		DeadKeys:   s.records - s.liveKeys,
+	}
+}
+
+// add は他の Stats の値を合計に加算します。セグメント ID は DB ごとに独立しているため Segments と Blobs は含めません。
+func (s *Stats) add(o Stats) {
+	s.Keys += o.Keys
+	s.TotalBytes += o.TotalBytes
+	s.LiveBytes += o.LiveBytes
+	s.DeadBytes += o.DeadBytes
+	s.LiveKeys += o.LiveKeys
+	s.DeadKeys += o.DeadKeys
+	s.BlobTotalBytes += o.BlobTotalBytes
+	s.BlobLiveBytes += o.BlobLiveBytes
+	s.BlobDeadBytes += o.BlobDeadBytes
+	s.DeadRatio = 0
+	if s.TotalBytes > 0 {
+		s.DeadRatio = float64(s.DeadBytes) / float64(s.TotalBytes)
+	}
+}
+
+// Stats は現在のセグメントごとの有効・不要データ量を返します。
+// 値は Put/Delete/Merge と起動時の復旧で随時更新されるため、ファイルの走査は行いません。
+func (d *DB) Stats() Stats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	total := newSegmentStats(-1, d.stats, false)
+	st := Stats{
+		Keys:       d.keyDir.Len(),
+		TotalBytes: total.TotalBytes,
+		LiveBytes:  total.LiveBytes,
+		DeadBytes:  total.DeadBytes,
+		LiveKeys:   total.LiveKeys,
+		DeadKeys:   total.DeadKeys,
+		Segments:   make([]SegmentStats, 0, len(d.segStats)),
+	}
+	if st.TotalBytes > 0 {
+		st.DeadRatio = float64(st.DeadBytes) / float64(st.TotalBytes)
+	}
+	for id, s := range d.segStats {
+		seg := newSegmentStats(id, *s, d.activeFile != nil && id == d.activeFileID)
+		if seg.Active {
+			seg.FormatVersion = d.activeSeg.header.Version
+		} else if older, ok := d.olderFiles[id]; ok {
+			seg.FormatVersion = older.header.Version
+		}
+		st.Segments = append(st.Segments, seg)
+	}
+	sort.Slice(st.Segments, func(i, j int) bool { return st.Segments[i].FileID < st.Segments[j].FileID })
+
+	st.Blobs = d.blobStatsLocked()
+	for _, b := range st.Blobs {
+		st.BlobTotalBytes += b.TotalBytes
+		st.BlobLiveBytes += b.LiveBytes
+		st.BlobDeadBytes += b.DeadBytes
+	}
+	return st
+}
+
+// segStat はセグメントの計測値を返します (無ければ作成します)。
+func (d *DB) segStat(id int) *segmentStats {
+	s, ok := d.segStats[id]
+	if !ok {
+		s = &segmentStats{}
+		d.segStats[id] = s
+	}
+	return s
+}
+
+// addSegmentBytes はセグメントへの追記 (または切り詰め) を計上します。
+func (d *DB) addSegmentBytes(id int, bytes, records int64) {
+	delta := segmentStats{totalBytes: bytes, records: records}
+	d.segStat(id).add(delta)
+	d.stats.add(delta)
+}
+
+// addLive はインデックスが pos を参照し始めた (sign=1) か、参照しなくなった (sign=-1) ことを計上します。
+func (d *DB) addLive(pos RecordPos, sign int64) {
+	delta := segmentStats{liveBytes: sign * pos.Size, liveKeys: sign}
+	d.segStat(pos.FileID).add(delta)
+	d.stats.add(delta)
+	if pos.Blob.valid() {
+		d.addBlobLive(pos.Blob, sign)
+	}
+}
+
+// dropSegmentStats は削除したセグメントの計測値を取り除きます。
+func (d *DB) dropSegmentStats(id int) {
+	if s, ok := d.segStats[id]; ok {
+		d.stats.sub(*s)
+		delete(d.segStats, id)
+	}
+}
+
+// addBlobLive はインデックスが Blob File の値 b を参照し始めた (sign=1) か、参照しなくなった (sign=-1) ことを計上します。
+func (d *DB) addBlobLive(b BlobPos, sign int64) {
+	s, ok := d.blobLive[b.FileID]
+	if !ok {
+		s = &segmentStats{}
+		d.blobLive[b.FileID] = s
+	}
+	s.add(segmentStats{liveBytes: sign * b.Size, liveKeys: sign})
+}
+
+// BlobStats は Blob File (N.blob) ごとの有効・不要データ量です。
+type BlobStats struct {
+	FileID     int
+	Active     bool  // 書き込み中の Blob File か (BlobGC の対象外)
+	TotalBytes int64 // ファイルヘッダを除くサイズ
+	LiveBytes  int64
+	DeadBytes  int64 // 上書き・削除された値と、書きかけで参照されない値
+	LiveValues int64 // インデックスが参照している値の数
+	DeadRatio  float64
+}
+
+// blobStatsLocked は Blob File ごとの計測値を ID の昇順で返します。d.mu を保持した状態で呼び出します。
+func (d *DB) blobStatsLocked() []BlobStats {
+	var stats []BlobStats
+	add := func(id int, total int64, active bool) {
+		var live segmentStats
+		if s, ok := d.blobLive[id]; ok {
+			live = *s
+		}
+		st := BlobStats{FileID: id, Active: active, TotalBytes: total, LiveBytes: live.liveBytes, DeadBytes: total - live.liveBytes, LiveValues: live.liveKeys}
+		if total > 0 {
+			st.DeadRatio = float64(st.DeadBytes) / float64(total)
+		}
+		stats = append(stats, st)
+	}
+	for id, seg := range d.blobFiles {
+		add(id, seg.reader.Size()-seg.header.size(), false)
+	}
+	if d.blobFile != nil {
+		add(d.blobFileID, d.blobOffset-d.blobSeg.header.size(), true)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].FileID < stats[j].FileID })
+	return stats
+}
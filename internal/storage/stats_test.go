@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// checkStatsConsistent はセグメントごとの値の合計が全体の値と一致することを確認します。
+func checkStatsConsistent(t *testing.T, st Stats) {
+	t.Helper()
+	var sum SegmentStats
+	for _, seg := range st.Segments {
+		sum.TotalBytes += seg.TotalBytes
+		sum.LiveBytes += seg.LiveBytes
+		sum.LiveKeys += seg.LiveKeys
+		sum.DeadKeys += seg.DeadKeys
+	}
+	if sum.TotalBytes != st.TotalBytes || sum.LiveBytes != st.LiveBytes || sum.LiveKeys != st.LiveKeys || sum.DeadKeys != st.DeadKeys {
+		t.Errorf("Segment stats %+v do not add up to %+v", sum, st)
+	}
+	if st.LiveKeys != int64(st.Keys) {
+		t.Errorf("Expected LiveKeys %d to equal Keys %d", st.LiveKeys, st.Keys)
+	}
+}
+
+func TestStats(t *testing.T) {
+	dbDir := "test_stats_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 128
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	recordSize := encodedRecordSize([]byte("key00"), []byte("value"))
+	for i := 0; i < 10; i++ {
+		_ = db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+	for i := 0; i < 5; i++ {
+		_ = db.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+	_ = db.Delete([]byte("key09"))
+
+	st := db.Stats()
+	checkStatsConsistent(t, st)
+	if st.Keys != 9 || st.LiveKeys != 9 {
+		t.Errorf("Expected 9 live keys, got %d", st.LiveKeys)
+	}
+	// 上書き 5 件 + 削除された key09 + Tombstone
+	if st.DeadKeys != 7 {
+		t.Errorf("Expected 7 dead keys, got %d", st.DeadKeys)
+	}
+	if st.LiveBytes != 9*recordSize {
+		t.Errorf("Expected %d live bytes, got %d", 9*recordSize, st.LiveBytes)
+	}
+	if st.DeadBytes != st.TotalBytes-st.LiveBytes || st.DeadBytes != 6*recordSize+encodedRecordSize([]byte("key09"), nil) {
+		t.Errorf("Unexpected dead bytes: %d (total %d)", st.DeadBytes, st.TotalBytes)
+	}
+	if len(st.Segments) < 2 || !st.Segments[len(st.Segments)-1].Active {
+		t.Errorf("Expected multiple segments with the last one active, got %+v", st.Segments)
+	}
+
+	// 再起動後の復旧でも同じ値になる
+	_ = db.Close()
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	reopened := db.Stats()
+	checkStatsConsistent(t, reopened)
+	if reopened.LiveBytes != st.LiveBytes || reopened.TotalBytes != st.TotalBytes || reopened.DeadKeys != st.DeadKeys {
+		t.Errorf("Stats changed after reopen: before %+v, after %+v", st, reopened)
+	}
+
+	// Merge で不要データは無くなる
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	merged := db.Stats()
+	checkStatsConsistent(t, merged)
+	if merged.DeadBytes != 0 || merged.DeadKeys != 0 || merged.LiveBytes != st.LiveBytes {
+		t.Errorf("Unexpected stats after merge: %+v", merged)
+	}
+
+	// Hint File からの復旧でも同じ値になる
+	_ = db.Close()
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	if got := db.Stats(); got.TotalBytes != merged.TotalBytes || got.LiveBytes != merged.LiveBytes || got.DeadKeys != 0 {
+		t.Errorf("Stats changed after reopen with hint files: before %+v, after %+v", merged, got)
+	}
+}
+
+func TestStatsBatch(t *testing.T) {
+	dbDir := "test_stats_batch_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	b := NewBatch()
+	b.Put([]byte("a"), []byte("1"))
+	b.Put([]byte("b"), []byte("2"))
+	b.Delete([]byte("c"))
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	st := db.Stats()
+	checkStatsConsistent(t, st)
+	if st.LiveKeys != 2 || st.DeadKeys != 1 {
+		t.Errorf("Expected 2 live and 1 dead keys, got %d and %d", st.LiveKeys, st.DeadKeys)
+	}
+	// Begin/Commit マーカーは不要データとして数える
+	want := encodedRecordSize([]byte("a"), []byte("1")) + encodedRecordSize([]byte("b"), []byte("2"))
+	if st.LiveBytes != want || st.DeadBytes <= encodedRecordSize([]byte("c"), nil) {
+		t.Errorf("Unexpected stats for batch: %+v", st)
+	}
+}
+
+func TestMergeTriggeredByWrites(t *testing.T) {
+	dbDir := "test_merge_triggered_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 256
+	opts.MergeInBackground = true
+	opts.MergeCheckInterval = time.Hour // 定期チェックではなく書き込みで起動させる
+	opts.MergeMinDeadRatio = 0
+	opts.MergeMinDeadBytes = 1024
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	for i := 0; i < 100; i++ {
+		_ = db.Put([]byte("key"), []byte(fmt.Sprintf("value%03d", i)))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().DeadBytes >= opts.MergeMinDeadBytes {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected writes to trigger a background merge, stats %+v", db.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v, err := db.Get([]byte("key")); err != nil || string(v) != "value099" {
+		t.Errorf("Expected value099, got %q, %v", v, err)
+	}
+}
@@ -0,0 +1,593 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrShortStream は PutStream の r が size バイトを読む前に終わった場合のエラーです。
+var ErrShortStream = errors.New("stream ended before the declared size")
+
+// streamChunkSize は PutStream が r から 1 回に読み込んで書き込む大きさです。
+// これ以下の値は一時ファイルを使わずにメモリに読み込んで保存します。
+const streamChunkSize = 64 * 1024
+
+// streamTempPattern は PutStream が値を書き溜める一時ファイルの名前のパターンです (os.CreateTemp 形式)。
+const streamTempPattern = "stream-*.tmp"
+
+// PutStream は r から読んだ size バイトをキーの値として保存します。SyncPolicy が fsync を要求する場合は永続化まで待ちます。
+// 値全体をメモリに読み込まず、読みながら一時ファイルへ書き込みます。r を読み終えてから d.mu を取ってアクティブファイルに
+// レコードの範囲を予約し、一時ファイルからの書き写しは d.mu の外で行うため、r の読み込みや値のコピーが遅くても
+// 他の書き込みは待たされません (streamReservation を参照)。
+// BlobThreshold 以上の値は、その値だけを持つ新しい Blob File へ d.mu の外で書き込み、d.mu は位置のレコードを追記する間だけ保持します。
+// r が size バイトより前に終わった場合は ErrShortStream (読み込みエラーはそのエラー) を返し、何も保存しません。
+//
+// 一時ファイルに書き溜めた値は圧縮しません。暗号化した DB では値を少しずつ暗号化しながら書き写し
+// (一時ファイルにはその場限りの鍵で暗号化して書き溜めます)、Put と同じ形式のレコードを作ります。
+// streamChunkSize 以下の値は、値全体を読み込んでから Put と同様に保存します。
+// アクティブファイルに書き写した値は、SyncNever 以外では SyncPolicy によらず fsync してから返します。
+func (d *DB) PutStream(key []byte, r io.Reader, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("invalid stream size %d", size)
+	}
+	if err := checkEntrySizes(len(key), size); err != nil {
+		return err
+	}
+	if d.opts.ReadOnly {
+		return &ReadOnlyError{Op: "put"}
+	}
+	if size <= streamChunkSize {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return ErrShortStream
+			}
+			return err
+		}
+		return d.Put(key, value)
+	}
+
+	var seq uint64
+	var err error
+	if d.separatesValue(size) {
+		seq, err = d.putStreamBlob(key, r, size)
+	} else {
+		seq, err = d.putStream(key, r, size)
+	}
+	if err != nil {
+		return err
+	}
+	return d.waitDurable(seq)
+}
+
+// testHookStreamReserved はテスト用のフックで、PutStream がレコードを予約した後、書き写す前 (ロックなし) に呼ばれます。
+var testHookStreamReserved func()
+
+// streamReservation は PutStream がアクティブファイルに予約したレコードの範囲です。
+//
+// 予約 (d.mu の下) ではレコードのヘッダだけを書き、書き写し (d.mu の外) では別に開いたファイルハンドルで
+// キーと値を書きます。ヘッダの CRC はヘッダだけから計算した予約の印 (isUnfinishedRecord) で、
+// レコード全体の CRC は再び d.mu を取ってから書き込み、同時にインデックスへ反映します。
+// CRC を書かなかったレコードは復旧時に読み飛ばされるので、書き写しの途中でクラッシュしても、
+// 後ろに追記された他のレコードは失われず、破損とも判定されません。
+//
+// 予約より後に同じキーへ書き込まれた場合は、予約したレコードはその書き込みより前の値として扱い、
+// CRC を書かずに捨てます (superseded)。ファイル上の順序と反映の順序を一致させるためです。
+// 書き写しの間に Merge で予約したセグメントが置き換えられた場合は、予約からやり直します。
+type streamReservation struct {
+	key        string
+	fileID     int
+	offset     int64
+	size       int64
+	head       []byte      // 予約の印の CRC を持つヘッダ
+	cipher     *fileCipher // 予約したセグメントの暗号 (暗号化しなければ nil)
+	superseded bool
+}
+
+// putStream は値を一時ファイルに書き溜めてから、アクティブファイルに予約した範囲へ書き写します。
+func (d *DB) putStream(key []byte, r io.Reader, size int64) (uint64, error) {
+	spool, err := newStreamSpool(d.dirPath, r, size, d.opts.KeyProvider != nil)
+	if err != nil {
+		return 0, err
+	}
+	defer spool.remove()
+
+	for {
+		res, err := d.reserveStream(key, size)
+		if err != nil {
+			return 0, err
+		}
+		if testHookStreamReserved != nil {
+			testHookStreamReserved()
+		}
+		done, err := d.copyStream(res, spool)
+		if done || err != nil {
+			return 0, err
+		}
+	}
+}
+
+// reserveStream はアクティブファイルに値が size バイトのレコードの範囲を予約し、予約の印のヘッダを書き込みます。
+func (d *DB) reserveStream(key []byte, size int64) (*streamReservation, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil, ErrClosed
+	}
+	recordSize := recordHeaderSize + int64(len(key)) + size + d.encryptionOverhead()
+	if err := d.ensureCapacity(recordSize); err != nil {
+		return nil, err
+	}
+	res := &streamReservation{
+		key:    string(key),
+		fileID: d.activeFileID,
+		offset: d.writeOffset,
+		size:   recordSize,
+		head:   streamRecordHeader(key, size, d.activeSeg.cipher != nil),
+		cipher: d.activeSeg.cipher,
+	}
+	if _, err := d.activeFile.WriteAt(res.head, d.writeOffset); err != nil {
+		return nil, d.discardTail(err)
+	}
+	// 予約した範囲は反映するまでどのキーからも参照されない (不要データとして計上する)
+	d.commitWrite(recordSize, 0)
+	d.writeOffset += recordSize
+
+	if d.streams == nil {
+		d.streams = make(map[string][]*streamReservation)
+	}
+	d.streams[res.key] = append(d.streams[res.key], res)
+	return res, nil
+}
+
+// copyStream は予約した範囲へ一時ファイルの値を書き写し、d.mu を取って CRC を書き込みインデックスに反映します。
+// 予約したセグメントが Merge で置き換えられていた場合は done が false で、呼び出し側は予約からやり直します。
+func (d *DB) copyStream(res *streamReservation, spool *streamSpool) (done bool, err error) {
+	f, err := os.OpenFile(filepath.Join(d.dirPath, fmt.Sprintf("%d.data", res.fileID)), os.O_WRONLY, 0)
+	var crc uint32
+	if err == nil {
+		defer func() { _ = f.Close() }()
+		crc, err = writeStreamRecord(f, res.offset, res.head, []byte(res.key), spool.reader(), spool.size, res.cipher)
+	}
+
+	done, err = d.commitStream(res, f, crc, err)
+	if done && err == nil && d.opts.SyncPolicy != SyncNever {
+		// 予約したセグメントはローテーション済みのことがあるので、アクティブファイルの fsync には任せない
+		err = f.Sync()
+	}
+	return done, err
+}
+
+// commitStream は書き写しを終えた予約を d.mu の下で確定します。copyErr は書き写しのエラーです。
+func (d *DB) commitStream(res *streamReservation, f *os.File, crc uint32, copyErr error) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	earlier := d.removeStream(res)
+	if d.closed {
+		return true, ErrClosed
+	}
+	if _, ok := d.olderFiles[res.fileID]; (!ok && res.fileID != d.activeFileID) || d.mergeInputs[res.fileID] != nil {
+		return false, nil // Merge で置き換えられた (または置き換えられる) セグメント
+	}
+	if copyErr != nil {
+		return true, copyErr
+	}
+	if res.superseded {
+		return true, nil
+	}
+	if _, err := f.WriteAt(binary.BigEndian.AppendUint32(nil, crc), res.offset); err != nil {
+		return true, err
+	}
+
+	// 先に予約した同じキーのレコードは、このレコードより前の値になる
+	for _, r := range earlier {
+		r.superseded = true
+	}
+	d.addSegmentBytes(res.fileID, 0, 1)
+	d.setKey(res.key, RecordPos{FileID: res.fileID, Offset: res.offset, Size: res.size})
+	d.publishLocked()
+
+	d.maybeTriggerMerge()
+	return true, nil
+}
+
+// removeStream は予約を書き込み中の一覧から取り除き、それより先に予約した同じキーの予約を返します。
+func (d *DB) removeStream(res *streamReservation) []*streamReservation {
+	list := d.streams[res.key]
+	var earlier []*streamReservation
+	for i, r := range list {
+		if r == res {
+			earlier = append(earlier, list[:i]...)
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(d.streams, res.key)
+	} else {
+		d.streams[res.key] = list
+	}
+	return earlier
+}
+
+// supersedeStreams は key に書き込み中の PutStream の予約 (書き込むレコードより前にある) を、上書きされたものとして扱います。
+// d.mu を保持した状態で、key の値を変更するレコードを書き込むたびに呼び出します。
+func (d *DB) supersedeStreams(key string) {
+	if len(d.streams) == 0 {
+		return
+	}
+	for _, res := range d.streams[key] {
+		res.superseded = true
+	}
+}
+
+// streamSpool は PutStream が r から読んだ値を書き溜める一時ファイルです。
+// 暗号化した DB では、平文をディスクに残さないよう、その場限りの鍵で AES-CTR により暗号化して書き込みます。
+type streamSpool struct {
+	f     *os.File
+	size  int64
+	block cipher.Block // 暗号化しなければ nil
+	iv    []byte
+}
+
+// newStreamSpool は r から size バイトを読んで一時ファイルに書き込みます。
+func newStreamSpool(dirPath string, r io.Reader, size int64, encrypt bool) (*streamSpool, error) {
+	f, err := os.CreateTemp(dirPath, streamTempPattern)
+	if err != nil {
+		return nil, err
+	}
+	s := &streamSpool{f: f, size: size}
+	var w io.Writer = f
+	if encrypt {
+		key := make([]byte, 32)
+		s.iv = make([]byte, aes.BlockSize)
+		if _, err := rand.Read(key); err != nil {
+			s.remove()
+			return nil, err
+		}
+		if _, err := rand.Read(s.iv); err != nil {
+			s.remove()
+			return nil, err
+		}
+		if s.block, err = aes.NewCipher(key); err != nil {
+			s.remove()
+			return nil, err
+		}
+		w = &ctrWriter{ctr: cipher.NewCTR(s.block, s.iv), w: f}
+	}
+	n, err := io.CopyBuffer(w, io.LimitReader(r, size), make([]byte, streamChunkSize))
+	if err == nil && n < size {
+		err = ErrShortStream
+	}
+	if err != nil {
+		s.remove()
+		return nil, err
+	}
+	return s, nil
+}
+
+// ctrWriter は cipher.StreamWriter と同様に暗号化して書き込む io.Writer です。書き込みごとにバッファを確保しません。
+type ctrWriter struct {
+	ctr cipher.Stream
+	w   io.Writer
+	buf []byte
+}
+
+func (c *ctrWriter) Write(p []byte) (int, error) {
+	if cap(c.buf) < len(p) {
+		c.buf = make([]byte, len(p))
+	}
+	out := c.buf[:len(p)]
+	c.ctr.XORKeyStream(out, p)
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// reader は書き溜めた値を先頭から読む Reader を返します。
+func (s *streamSpool) reader() io.Reader {
+	var r io.Reader = io.NewSectionReader(s.f, 0, s.size)
+	if s.block != nil {
+		r = cipher.StreamReader{S: cipher.NewCTR(s.block, s.iv), R: r}
+	}
+	return r
+}
+
+// remove は一時ファイルを閉じて削除します。
+func (s *streamSpool) remove() {
+	_ = s.f.Close()
+	_ = os.Remove(s.f.Name())
+}
+
+// putStreamBlob は値をその値だけを持つ新しい Blob File へ d.mu の外で書き込み、
+// d.mu を取ってデータファイルに位置を持つレコードを追記します。
+// 失敗した場合や位置を追記する前にクラッシュした場合、Blob File はどこからも参照されず、BlobGC で削除されます。
+func (d *DB) putStreamBlob(key []byte, r io.Reader, size int64) (uint64, error) {
+	id := d.allocBlobID()
+	offset, recordSize, err := createStreamBlob(d.dirPath, id, key, r, size, d.opts.KeyProvider, d.opts.SyncPolicy != SyncNever)
+	if err != nil {
+		_ = os.Remove(blobPath(d.dirPath, id))
+		return 0, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		_ = os.Remove(blobPath(d.dirPath, id))
+		return 0, ErrClosed
+	}
+	seg, err := d.openBlobFile(id)
+	if err != nil {
+		_ = os.Remove(blobPath(d.dirPath, id))
+		return 0, err
+	}
+	// 位置のレコードを公開する前に Blob File を読み取り側に公開する
+	d.blobFiles[id] = seg
+	d.publishSegmentsLocked()
+
+	blob := BlobPos{FileID: id, Offset: offset, Size: recordSize}
+	_, seq, err := d.putBlobPointerLocked(key, blob, 0)
+	return seq, err
+}
+
+// createStreamBlob は r から読んだ size バイトの値のレコードだけを持つ Blob File id を作成し、レコードの位置とサイズを返します。
+// keys が nil でなければ現在の鍵で暗号化します。sync が true の場合はファイルとディレクトリを fsync してから返します。
+func createStreamBlob(dirPath string, id int, key []byte, r io.Reader, size int64, keys KeyProvider, sync bool) (int64, int64, error) {
+	header, c, err := createFileHeader(FileKindBlob, id, keys)
+	if err != nil {
+		return 0, 0, err
+	}
+	file, err := os.OpenFile(blobPath(dirPath, id), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = file.Close() }()
+	offset := int64(len(header))
+	head := streamRecordHeader(key, size, c != nil)
+	if _, err := file.WriteAt(append(header, head...), 0); err != nil {
+		return 0, 0, err
+	}
+	crc, err := writeStreamRecord(file, offset, head, key, r, size, c)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := file.WriteAt(binary.BigEndian.AppendUint32(nil, crc), offset); err != nil {
+		return 0, 0, err
+	}
+	if sync {
+		if err := file.Sync(); err != nil {
+			return 0, 0, err
+		}
+		if err := syncDir(dirPath); err != nil {
+			return 0, 0, err
+		}
+	}
+	return offset, decodeRecordHeader(head).size(), nil
+}
+
+// removeStreamTempFiles は前回クラッシュした PutStream が残した一時ファイルを削除します。
+func removeStreamTempFiles(dirPath string) error {
+	names, err := filepath.Glob(filepath.Join(dirPath, streamTempPattern))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamRecordHeader は PutStream が書き込む、値が size バイトのレコードのヘッダを返します。
+// 値を書き終えるまでの印として、CRC にはヘッダだけから計算した値を入れます (isUnfinishedRecord を参照)。
+func streamRecordHeader(key []byte, size int64, encrypted bool) []byte {
+	var flags uint8
+	if encrypted {
+		flags = flagEncrypted
+	}
+	head := appendRecord(nil, time.Now().UnixNano(), flags, key, nil, false)[:recordHeaderSize]
+	binary.BigEndian.PutUint32(head[16:20], uint32(size))
+	binary.BigEndian.PutUint32(head[0:4], crc32.ChecksumIEEE(head[4:]))
+	return head
+}
+
+// writeStreamRecord は offset の位置のヘッダ head (書き込み済み) に続けて、キーと r から読んだ size バイトの値を f に書き込み、
+// レコードの CRC を返します。c が nil でなければ sealRecord と同じ形式で少しずつ暗号化しながら書き込みます。
+// CRC は呼び出し側が最後に書き込みます。失敗した場合、offset より後ろに書きかけのデータが残ります。
+func writeStreamRecord(f io.WriterAt, offset int64, head, key []byte, r io.Reader, size int64, c *fileCipher) (uint32, error) {
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(head[4:])
+	out := io.MultiWriter(io.NewOffsetWriter(f, offset+recordHeaderSize), crc)
+
+	body := out
+	var sealer *recordSealer
+	if c != nil {
+		sealer = c.newRecordSealer(out, head, offset)
+		body = sealer
+	}
+	if _, err := body.Write(key); err != nil {
+		return 0, err
+	}
+	n, err := io.CopyBuffer(body, io.LimitReader(r, size), make([]byte, streamChunkSize))
+	if err == nil && n < size {
+		err = ErrShortStream
+	}
+	if err != nil {
+		return 0, err
+	}
+	if sealer != nil {
+		if _, err := out.Write(sealer.tag()); err != nil {
+			return 0, err
+		}
+	}
+	return crc.Sum32(), nil
+}
+
+// discardTail は失敗した書き込みが writeOffset より後ろに残したデータを取り除き、err をそのまま返します。
+// 事前確保したアクティブファイルは切り詰めてから伸ばし直し、未使用領域をゼロ埋めに戻します。
+func (d *DB) discardTail(err error) error {
+	if terr := d.activeFile.Truncate(d.writeOffset); terr == nil && d.activeMap != nil {
+		_ = d.activeFile.Truncate(d.activeMap.Cap())
+	}
+	return err
+}
+
+// ValueReader は GetReader が返す、セグメントから値を順に読む io.ReadCloser です。
+// CRC はレコードの先頭から読み進めながら計算し、値を最後まで読んだ時点で検証します。
+// 不一致の場合は最後の Read が *CorruptionError (ErrDataCorruption) を返すので、それまでに読んだデータは
+// 信頼できるとは限りません。
+type ValueReader struct {
+	seg  *segment // Close まで acquire したまま保持する (nil なら閉じている)
+	r    io.Reader
+	size int64
+	crc  hash.Hash32 // nil なら検証済み (全体を読み込んでから返した値)
+	want uint32
+	pos  RecordPos
+	kind FileKind
+}
+
+// GetReader はキーに対応する値を読む io.ReadCloser を返します。値はメモリに読み込まずにセグメントから読み進め、
+// CRC は最後まで読んだ時点で検証します (ValueReader を参照)。
+// 読み込み中のセグメントは Close まで保持されるので (Merge で置き換えられても閉じられません)、必ず Close してください。
+// 圧縮・暗号化されたレコードは全体を読んで検証・展開してから返します。
+func (d *DB) GetReader(key []byte) (io.ReadCloser, error) {
+	r, _, err := d.GetReaderWithVersion(key)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetReaderWithVersion は GetReader と同様に値を読む ValueReader と、その値を書き込んだレコードの Version を返します。
+func (d *DB) GetReaderWithVersion(key []byte) (*ValueReader, Version, error) {
+	pos, seg, blob, err := d.acquireEntry(key)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	if blob == nil {
+		r, ver, err := newValueReader(seg, pos, key)
+		if err != nil {
+			_ = seg.release()
+			return nil, Version{}, err
+		}
+		return r, ver, nil
+	}
+
+	// Version はデータファイルのレコード、値は Blob File から読む (Blob File の参照は ValueReader が引き継ぐ)
+	ver, err := readVersionAt(seg, pos, key)
+	_ = seg.release()
+	if err != nil {
+		_ = blob.release()
+		return nil, Version{}, err
+	}
+	r, _, err := newValueReader(blob, valuePos(pos), key)
+	if err != nil {
+		_ = blob.release()
+		return nil, Version{}, err
+	}
+	return r, ver, nil
+}
+
+// newValueReader は acquire 済みのセグメント seg の pos のレコードの値を読む ValueReader を作ります。
+// キーと有効期限は先に読んで検証し、CRC の計算に含めます。
+// seg の参照は ValueReader が引き継ぎます (エラーの場合は呼び出し側が解放します)。
+func newValueReader(seg *segment, pos RecordPos, key []byte) (*ValueReader, Version, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := seg.reader.ReadAt(header, pos.Offset); err != nil {
+		return nil, Version{}, err
+	}
+	h := decodeRecordHeader(header)
+	if h.size() != pos.Size {
+		return nil, Version{}, corruptionError(seg.kind(), pos.FileID, pos.Offset, fmt.Sprintf("record size mismatch: index has %d, header has %d", pos.Size, h.size()))
+	}
+
+	if h.flags&(flagEncrypted|flagLZ4|flagFlate) != 0 {
+		// 復号・展開にはレコード全体が必要。読み終えたセグメントは保持しない
+		plain, value, err := readRecordAt(seg, pos, key)
+		if err != nil {
+			return nil, Version{}, err
+		}
+		_ = seg.release()
+		return &ValueReader{r: bytes.NewReader(value), size: int64(len(value))}, versionOf(plain), nil
+	}
+
+	prefixSize := int64(h.keySize)
+	if h.hasExpiry() {
+		prefixSize += expirySize
+	}
+	if prefixSize > int64(h.keySize)+h.valueLen() {
+		return nil, Version{}, corruptionError(seg.kind(), pos.FileID, pos.Offset, "value too short for expiry")
+	}
+	prefix := make([]byte, prefixSize)
+	if _, err := seg.reader.ReadAt(prefix, pos.Offset+recordHeaderSize); err != nil {
+		return nil, Version{}, err
+	}
+	if string(prefix[:h.keySize]) != string(key) {
+		return nil, Version{}, corruptionError(seg.kind(), pos.FileID, pos.Offset, fmt.Sprintf("key mismatch: expected %q, found %q", key, prefix[:h.keySize]))
+	}
+
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(header[4:])
+	_, _ = crc.Write(prefix)
+	start := pos.Offset + recordHeaderSize + prefixSize
+	size := pos.Offset + pos.Size - start
+	return &ValueReader{
+		seg:  seg,
+		r:    io.NewSectionReader(seg.reader, start, size),
+		size: size,
+		crc:  crc,
+		want: h.crc,
+		pos:  pos,
+		kind: seg.kind(),
+	}, versionOf(h), nil
+}
+
+// Size は値の長さです。
+func (v *ValueReader) Size() int64 {
+	return v.size
+}
+
+// Read は値の続きを読み込みます。値の終端で CRC が一致しない場合は io.EOF の代わりに *CorruptionError を返します。
+func (v *ValueReader) Read(p []byte) (int, error) {
+	if v.r == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := v.r.Read(p)
+	if v.crc == nil {
+		return n, err
+	}
+	_, _ = v.crc.Write(p[:n])
+	if err == io.EOF {
+		if crc := v.crc.Sum32(); crc != v.want {
+			return n, crcError(v.kind, v.pos.FileID, v.pos.Offset, v.want, crc)
+		}
+	}
+	return n, err
+}
+
+// Close はセグメントの参照を解放します。複数回呼んでも安全です。
+func (v *ValueReader) Close() error {
+	v.r = nil
+	if v.seg == nil {
+		return nil
+	}
+	seg := v.seg
+	v.seg = nil
+	return seg.release()
+}
@@ -0,0 +1,422 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestPutStreamAndGetReader(t *testing.T) {
+	dbDir := "test_stream_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 64 * 1024
+	opts.Compression = CompressionLZ4
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	blob := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(blob)
+	_ = db.Put([]byte("small"), []byte("value"))
+	if err := db.PutStream([]byte("blob"), iotest.HalfReader(bytes.NewReader(blob)), int64(len(blob))); err != nil {
+		t.Fatalf("PutStream failed: %v", err)
+	}
+	// 圧縮されたレコードも GetReader で読める
+	compressible := strings.Repeat("compressible;", 100)
+	_ = db.Put([]byte("compressed"), []byte(compressible))
+
+	readAll := func(key string) ([]byte, error) {
+		t.Helper()
+		r, err := db.GetReader([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = r.Close() }()
+		return io.ReadAll(r)
+	}
+	if got, err := readAll("blob"); err != nil || !bytes.Equal(got, blob) {
+		t.Errorf("GetReader blob returned %d bytes, %v", len(got), err)
+	}
+	if got, err := db.Get([]byte("blob")); err != nil || !bytes.Equal(got, blob) {
+		t.Errorf("Get blob failed: %v", err)
+	}
+	if got, err := readAll("compressed"); err != nil || string(got) != compressible {
+		t.Errorf("GetReader compressed = %q, %v", got, err)
+	}
+	if _, err := db.GetReader([]byte("missing")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// 途中で終わったストリームは何も保存せず、後続の書き込みも正常に続く
+	if err := db.PutStream([]byte("short"), strings.NewReader("abc"), 10); !errors.Is(err, ErrShortStream) {
+		t.Errorf("Expected ErrShortStream, got %v", err)
+	}
+	errRead := errors.New("read failed")
+	if err := db.PutStream([]byte("short"), io.MultiReader(strings.NewReader("abc"), iotest.ErrReader(errRead)), 10); !errors.Is(err, errRead) {
+		t.Errorf("Expected the read error, got %v", err)
+	}
+	if db.Has([]byte("short")) {
+		t.Error("Expected the short stream not to be stored")
+	}
+	_ = db.Put([]byte("after"), []byte("value"))
+
+	// 読み込み中の値は Merge で置き換えられても読み続けられる
+	r, ver, err := db.GetReaderWithVersion([]byte("blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := db.Version([]byte("blob")); r.Size() != int64(len(blob)) || ver != current {
+		t.Errorf("Unexpected reader size %d or version %+v", r.Size(), ver)
+	}
+	head := make([]byte, 1024)
+	if _, err := io.ReadFull(r, head); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(append(head, rest...), blob) {
+		t.Errorf("Reading across Merge failed: %v", err)
+	}
+	_ = r.Close()
+	if _, err := r.Read(head); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected os.ErrClosed after Close, got %v", err)
+	}
+	_ = db.Close()
+
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	if len(db.Recovered()) != 0 {
+		t.Errorf("Expected a clean reopen, got %v", db.Recovered())
+	}
+	for key, want := range map[string][]byte{"blob": blob, "small": []byte("value"), "after": []byte("value")} {
+		if got, err := readAll(key); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("GetReader %s after reopen failed: %v", key, err)
+		}
+	}
+	pos, _ := db.keyDir.get("blob")
+	_ = db.Close()
+
+	// 値の破損は最後まで読んだ時点で検出する
+	f, err := os.OpenFile(filepath.Join(dbDir, fmt.Sprintf("%d.data", pos.FileID)), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xFF}, pos.Offset+pos.Size-1); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	if got, err := readAll("blob"); !errors.Is(err, ErrDataCorruption) || len(got) != len(blob) {
+		t.Errorf("Expected ErrDataCorruption at the end of the value, got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestPutStreamEncrypted(t *testing.T) {
+	for name, threshold := range map[string]int{"data": 0, "blob": 1024} {
+		t.Run(name, func(t *testing.T) {
+			dbDir := "test_stream_encrypted_" + name + "_dir"
+			_ = os.RemoveAll(dbDir)
+			defer func() { _ = os.RemoveAll(dbDir) }()
+
+			opts := DefaultOptions()
+			opts.KeyProvider = testKeys(t, 1, 1)
+			opts.BlobThreshold = threshold
+			db, err := OpenWithOptions(dbDir, opts)
+			if err != nil {
+				t.Fatalf("Failed to open DB: %v", err)
+			}
+
+			// 値全体をメモリに読み込まずに暗号化する
+			const size = 8 << 20
+			secret := strings.Repeat("secret-stream;", size/14+1)[:size]
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			if err := db.PutStream([]byte("key"), strings.NewReader(secret), int64(len(secret))); err != nil {
+				t.Fatalf("PutStream failed: %v", err)
+			}
+			runtime.ReadMemStats(&after)
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/4 {
+				t.Errorf("PutStream allocated %d bytes for a %d byte value", alloc, size)
+			}
+
+			// 書き写し中の一時ファイルにも平文は残らない
+			if threshold == 0 {
+				testHookStreamReserved = func() { checkNoPlaintext(t, dbDir, "secret-stream") }
+				defer func() { testHookStreamReserved = nil }()
+				if err := db.PutStream([]byte("key2"), strings.NewReader(secret), int64(len(secret))); err != nil {
+					t.Fatalf("PutStream failed: %v", err)
+				}
+			}
+
+			r, err := db.GetReader([]byte("key"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := io.ReadAll(r); err != nil || string(got) != secret {
+				t.Errorf("GetReader returned %d bytes, %v", len(got), err)
+			}
+			_ = r.Close()
+			_ = db.Close()
+			checkNoPlaintext(t, dbDir, "secret-stream")
+
+			db, err = OpenWithOptions(dbDir, opts)
+			if err != nil {
+				t.Fatalf("Failed to reopen DB: %v", err)
+			}
+			if got, err := db.Get([]byte("key")); err != nil || string(got) != secret {
+				t.Errorf("Get after reopen returned %d bytes, %v", len(got), err)
+			}
+			_ = db.Close()
+			if report, err := Verify(dbDir); err != nil || !report.OK() {
+				t.Errorf("Verify = %+v, %v", report, err)
+			}
+		})
+	}
+}
+
+// PutStream は d.mu の外で予約した範囲へ書き写す。その間の書き込みと Merge は、ファイル上の順序どおりに反映される
+func TestPutStreamReservation(t *testing.T) {
+	dbDir := "test_stream_reservation_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	value := make([]byte, 4*streamChunkSize)
+	rand.New(rand.NewSource(1)).Read(value)
+	defer func() { testHookStreamReserved = nil }()
+
+	// 書き写しの間も d.mu は取られていない
+	testHookStreamReserved = func() {
+		locked := make(chan struct{})
+		go func() {
+			db.mu.Lock()
+			db.mu.Unlock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-time.After(5 * time.Second):
+			t.Error("d.mu was held while copying the stream")
+		}
+		_ = db.Put([]byte("other"), []byte("value"))
+	}
+	if err := db.PutStream([]byte("stream"), bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatalf("PutStream failed: %v", err)
+	}
+	if got, err := db.Get([]byte("stream")); err != nil || !bytes.Equal(got, value) {
+		t.Errorf("Get stream returned %d bytes, %v", len(got), err)
+	}
+
+	// 予約より後の同じキーへの書き込みは、PutStream より後の値として残る
+	testHookStreamReserved = func() { _ = db.Put([]byte("stream"), []byte("later")) }
+	if err := db.PutStream([]byte("stream"), bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatalf("PutStream failed: %v", err)
+	}
+	if got, err := db.Get([]byte("stream")); err != nil || string(got) != "later" {
+		t.Errorf("Get after a concurrent Put = %q, %v; want later", got, err)
+	}
+	testHookStreamReserved = func() { _ = db.Delete([]byte("stream")) }
+	if err := db.PutStream([]byte("stream"), bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatalf("PutStream failed: %v", err)
+	}
+	if db.Has([]byte("stream")) {
+		t.Error("Expected a concurrent Delete to win over the stream")
+	}
+
+	// 予約したセグメントが Merge で置き換えられたら、予約からやり直す
+	merged := 0
+	testHookStreamReserved = func() {
+		if merged++; merged == 1 {
+			if err := db.Merge(); err != nil {
+				t.Errorf("Merge failed: %v", err)
+			}
+		}
+	}
+	if err := db.PutStream([]byte("merged"), bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatalf("PutStream failed: %v", err)
+	}
+	if got, err := db.Get([]byte("merged")); merged != 2 || err != nil || !bytes.Equal(got, value) {
+		t.Errorf("Get after a concurrent Merge returned %d bytes, %v (%d reservations)", len(got), err, merged)
+	}
+	testHookStreamReserved = nil
+	_ = db.Close()
+
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	want := map[string][]byte{"merged": value, "other": []byte("value")}
+	for key, v := range want {
+		if got, err := db.Get([]byte(key)); err != nil || !bytes.Equal(got, v) {
+			t.Errorf("Get %s after reopen failed: %v", key, err)
+		}
+	}
+	if db.Has([]byte("stream")) {
+		t.Error("Expected the deleted stream to stay deleted after reopen")
+	}
+}
+
+// 書き写しの途中で止まったレコードは、後ろに他のレコードがあっても破損とせずに読み飛ばす
+func TestPutStreamUnfinishedRecord(t *testing.T) {
+	dbDir := "test_stream_unfinished_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	// 予約だけして書き写さずに閉じる (書き写し中のクラッシュと同じ状態)
+	res, err := db.reserveStream([]byte("stream"), 4*streamChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Put([]byte("after"), []byte("value"))
+	_ = db.Close()
+
+	var unfinished int
+	err = WalkDataFile(filepath.Join(dbDir, fmt.Sprintf("%d.data", res.fileID)), func(r FileRecord) error {
+		if r.Unfinished {
+			unfinished++
+		}
+		return nil
+	})
+	if err != nil || unfinished != 1 {
+		t.Errorf("WalkDataFile found %d unfinished records, %v", unfinished, err)
+	}
+	if report, err := Verify(dbDir); err != nil || !report.OK() || report.Records != 1 {
+		t.Errorf("Verify = %+v, %v; want one record and no issues", report, err)
+	}
+
+	db, err = NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	if len(db.Recovered()) != 0 {
+		t.Errorf("Expected nothing to be truncated, got %v", db.Recovered())
+	}
+	if got, err := db.Get([]byte("after")); err != nil || string(got) != "value" {
+		t.Errorf("Get after = %q, %v", got, err)
+	}
+	if db.Has([]byte("stream")) {
+		t.Error("Expected the unfinished stream not to be visible")
+	}
+	// 書き終えられなかったレコードの後ろには追記しない (read-only の DB がそこで走査を止めるため)
+	if db.activeFileID == res.fileID {
+		t.Errorf("Expected a new active file after an unfinished record in segment %d", res.fileID)
+	}
+	_ = db.Put([]byte("next"), []byte("value"))
+	_ = db.Close()
+
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+	ro, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open read-only: %v", err)
+	}
+	defer func() { _ = ro.Close() }()
+	for _, key := range []string{"after", "next"} {
+		if !ro.Has([]byte(key)) {
+			t.Errorf("Expected %s to be visible read-only", key)
+		}
+	}
+}
+
+// PutStream は r を読み終えるまで d.mu を取らないので、遅いストリームの間も他の書き込みは進む
+func TestPutStreamDoesNotBlockWriters(t *testing.T) {
+	for name, threshold := range map[string]int{"data": 0, "blob": 1024} {
+		t.Run(name, func(t *testing.T) {
+			dbDir := "test_stream_" + name + "_dir"
+			_ = os.RemoveAll(dbDir)
+			defer func() { _ = os.RemoveAll(dbDir) }()
+
+			opts := DefaultOptions()
+			opts.BlobThreshold = threshold
+			db, err := OpenWithOptions(dbDir, opts)
+			if err != nil {
+				t.Fatalf("Failed to open DB: %v", err)
+			}
+			defer func() { _ = db.Close() }()
+
+			value := make([]byte, 4*streamChunkSize)
+			rand.New(rand.NewSource(1)).Read(value)
+			pr, pw := io.Pipe()
+			done := make(chan error, 1)
+			go func() { done <- db.PutStream([]byte("stream"), pr, int64(len(value))) }()
+
+			half := len(value) / 2
+			if _, err := pw.Write(value[:half]); err != nil {
+				t.Fatal(err)
+			}
+			put := make(chan error, 1)
+			go func() { put <- db.Put([]byte("other"), []byte("value")) }()
+			select {
+			case err := <-put:
+				if err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Put was blocked by an unfinished PutStream")
+			}
+			if db.Has([]byte("stream")) {
+				t.Error("Expected the unfinished stream not to be visible")
+			}
+
+			if _, err := pw.Write(value[half:]); err != nil {
+				t.Fatal(err)
+			}
+			_ = pw.Close()
+			if err := <-done; err != nil {
+				t.Fatalf("PutStream failed: %v", err)
+			}
+			if got, err := db.Get([]byte("stream")); err != nil || !bytes.Equal(got, value) {
+				t.Errorf("Get stream returned %d bytes, %v", len(got), err)
+			}
+
+			// 途中で終わったストリームは何も保存せず、一時ファイルも残さない
+			if err := db.PutStream([]byte("short"), bytes.NewReader(value[:half]), int64(len(value))); !errors.Is(err, ErrShortStream) {
+				t.Errorf("Expected ErrShortStream, got %v", err)
+			}
+			if db.Has([]byte("short")) {
+				t.Error("Expected the short stream not to be stored")
+			}
+			if names, _ := filepath.Glob(filepath.Join(dbDir, streamTempPattern)); len(names) != 0 {
+				t.Errorf("Expected no stream temp files, got %v", names)
+			}
+			_ = db.Close()
+
+			db, err = OpenWithOptions(dbDir, opts)
+			if err != nil {
+				t.Fatalf("Failed to reopen DB: %v", err)
+			}
+			for key, want := range map[string][]byte{"stream": value, "other": []byte("value")} {
+				if got, err := db.Get([]byte(key)); err != nil || !bytes.Equal(got, want) {
+					t.Errorf("Get %s after reopen failed: %v", key, err)
+				}
+			}
+		})
+	}
+}
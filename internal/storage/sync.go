@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// groupCommit は複数の書き込みの fsync を 1 回にまとめます (Group Commit)。
+// 書き込みは d.mu の下でシーケンス番号を得てファイルへ追記し、ロック解放後に
+// waitDurable でその番号が永続化されるのを待ちます。待機者のうち 1 人がリーダーとして
+// fsync を実行し、その時点までに書き込まれた全レコードの完了をまとめて通知します。
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	synced  uint64 // fsync 済みの最大シーケンス番号
+	syncing bool   // リーダーが fsync 実行中か
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// markSynced は seq までが永続化されたことを記録し、待機者を起こします。
+func (g *groupCommit) markSynced(seq uint64) {
+	g.mu.Lock()
+	if seq > g.synced {
+		g.synced = seq
+	}
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
+
+// wait は seq が永続化されるまで待ちます。必要ならリーダーとして syncFn を実行します。
+// syncFn は fsync を行い、永続化できたシーケンス番号を返します。
+func (g *groupCommit) wait(seq uint64, syncFn func() (uint64, error)) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for g.synced < seq {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+
+		g.syncing = true
+		g.mu.Unlock()
+		synced, err := syncFn()
+		g.mu.Lock()
+		g.syncing = false
+
+		if err != nil {
+			g.cond.Broadcast()
+			return err
+		}
+		if synced > g.synced {
+			g.synced = synced
+		}
+		g.cond.Broadcast()
+	}
+	return nil
+}
+
+// waitDurable は seq までの書き込みが永続化されるのを待ちます。seq が 0 なら何もしません。
+func (d *DB) waitDurable(seq uint64) error {
+	if seq == 0 {
+		return nil
+	}
+	return d.commit.wait(seq, d.syncActiveFile)
+}
+
+// syncActiveFile は d.mu を保持せずにアクティブファイルを fsync します。
+// fsync 中も他の書き込みは追記を続けられ、それらは次の fsync でまとめて永続化されます。
+func (d *DB) syncActiveFile() (uint64, error) {
+	d.mu.RLock()
+	file, blobFile := d.activeFile, d.blobFile
+	seq := d.writeSeq
+	d.mu.RUnlock()
+
+	if file == nil {
+		return seq, nil
+	}
+	// レコードが参照する Blob File の値を先に永続化する (ローテーションで閉じられた Blob File は fsync 済み)
+	if blobFile != nil {
+		if err := blobFile.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			return 0, err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		// ローテーションや Close で閉じられた場合、閉じる前に fsync 済み (markSynced 済み)
+		if errors.Is(err, os.ErrClosed) {
+			return seq, nil
+		}
+		return 0, err
+	}
+	return seq, nil
+}
+
+// syncLoop は SyncPeriodic のバックグラウンド fsync を実行します。
+func (d *DB) syncLoop(interval time.Duration) {
+	defer d.bgWG.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closeCh:
+			return
+		case <-ticker.C:
+			d.mu.RLock()
+			seq := d.writeSeq
+			d.mu.RUnlock()
+			if err := d.waitDurable(seq); err != nil {
+				d.opts.logger().Printf("bitcask: %s: periodic sync failed: %v", d.dirPath, err)
+			}
+		}
+	}
+}
+
+// syncDir はディレクトリを fsync し、ファイルの作成・削除・リネームを永続化します。
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = dir.Close() }()
+	return dir.Sync()
+}
@@ -0,0 +1,71 @@
+package storage
+
+import "time"
+
+// NoTTL は TTL が有効期限の無いキーに対して返す値です。
+const NoTTL time.Duration = -1
+
+// Has はキーが存在するか (期限切れでないか) を公開済みのインデックスだけで判定します。Get と同様に読み取ります。
+func (d *DB) Has(key []byte) bool {
+	_, _, err := d.lookup(key)
+	return err == nil
+}
+
+// TTL はキーの残りの有効期間を返します。有効期限の無いキーは NoTTL を返します。
+// キーが存在しない (期限切れを含む) 場合は ErrKeyNotFound です。
+func (d *DB) TTL(key []byte) (time.Duration, error) {
+	_, pos, err := d.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	if pos.Expiry == 0 {
+		return NoTTL, nil
+	}
+	ttl := time.Duration(pos.Expiry - time.Now().UnixNano())
+	if ttl <= 0 {
+		return 0, ErrKeyNotFound
+	}
+	return ttl, nil
+}
+
+// Expire は既存のキーに ttl 後の有効期限を設定します。
+// 有効期限はレコードの一部なので、現在の値を新しい期限で書き直します (Blob File に分離した値は書き直しません)。
+// キーが存在しない場合は ErrKeyNotFound を返します。
+func (d *DB) Expire(key []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	seq, err := d.expire(key, time.Now().Add(ttl).UnixNano())
+	if err != nil {
+		return err
+	}
+	return d.waitDurable(seq)
+}
+
+func (d *DB) expire(key []byte, expiry int64) (uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.opts.ReadOnly {
+		return 0, &ReadOnlyError{Op: "expire"}
+	}
+	pos, ok := d.keyDir.get(string(key))
+	if !ok || pos.expired(time.Now().UnixNano()) {
+		return 0, ErrKeyNotFound
+	}
+	if pos.Blob.valid() {
+		// Blob File の値はそのままで、位置を持つレコードを新しい期限で書き直す
+		_, seq, err := d.putBlobPointerLocked(key, pos.Blob, expiry)
+		return seq, err
+	}
+	seg, err := d.segmentFor(pos)
+	if err != nil {
+		return 0, err
+	}
+	value, err := readValueAt(seg, pos, key)
+	if err != nil {
+		return 0, err
+	}
+	_, seq, err := d.putLocked(key, value, expiry)
+	return seq, err
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPutWithTTL(t *testing.T) {
+	dbDir := "test_ttl_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	if err := db.PutWithTTL([]byte("key"), []byte("value"), 0); err != ErrInvalidTTL {
+		t.Errorf("Expected ErrInvalidTTL, got %v", err)
+	}
+
+	if err := db.PutWithTTL([]byte("short"), []byte("value"), 20*time.Millisecond); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+	if err := db.PutWithTTL([]byte("long"), []byte("value"), time.Hour); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+	_ = db.PutWithTTL([]byte("persisted"), []byte("old"), 20*time.Millisecond)
+	_ = db.Put([]byte("persisted"), []byte("new")) // 通常の Put で上書きすると無期限になる
+
+	if v, err := db.Get([]byte("short")); err != nil || string(v) != "value" {
+		t.Errorf("Expected value before expiry, got %q, %v", v, err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, err := db.Get([]byte("short")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound after expiry, got %v", err)
+	}
+	for _, key := range []string{"long", "persisted"} {
+		if _, err := db.Get([]byte(key)); err != nil {
+			t.Errorf("Expected %s to be alive, got %v", key, err)
+		}
+	}
+
+	it := db.NewIterator()
+	var keys []string
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	_ = it.Close()
+	if len(keys) != 2 || keys[0] != "long" || keys[1] != "persisted" {
+		t.Errorf("Expected iterator to skip expired keys, got %v", keys)
+	}
+}
+
+func TestTTLRecovery(t *testing.T) {
+	dbDir := "test_ttl_recovery_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.PutWithTTL([]byte("short"), []byte("value"), 10*time.Millisecond)
+	_ = db.PutWithTTL([]byte("long"), []byte("value"), time.Hour)
+	b := NewBatch()
+	b.PutWithTTL([]byte("batch"), []byte("value"), 10*time.Millisecond)
+	b.PutWithTTL([]byte("invalid"), []byte("value"), -time.Second)
+	if err := db.Write(b); err != ErrInvalidTTL {
+		t.Errorf("Expected ErrInvalidTTL from batch, got %v", err)
+	}
+	b.Reset()
+	b.PutWithTTL([]byte("batch"), []byte("value"), 10*time.Millisecond)
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	longPos, _ := db.keyDir.get("long")
+	_ = db.Close()
+
+	time.Sleep(20 * time.Millisecond)
+
+	db, err = NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	// 復旧時点で期限切れのレコードはインデックスに載らない
+	for _, key := range []string{"short", "batch"} {
+		if _, ok := db.keyDir.get(key); ok {
+			t.Errorf("Expected expired key %s to be dropped on recovery", key)
+		}
+	}
+	if pos, ok := db.keyDir.get("long"); !ok || pos.Expiry != longPos.Expiry {
+		t.Errorf("Expected expiry %d to survive recovery, got %+v", longPos.Expiry, pos)
+	}
+	if st := db.Stats(); st.LiveKeys != 1 {
+		t.Errorf("Expected 1 live key after recovery, got %d", st.LiveKeys)
+	}
+}
+
+func TestTTLMerge(t *testing.T) {
+	dbDir := "test_ttl_merge_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.PutWithTTL([]byte("short"), []byte("value"), 10*time.Millisecond)
+	_ = db.PutWithTTL([]byte("long"), []byte("long-value"), time.Hour)
+	_ = db.Put([]byte("plain"), []byte("plain-value"))
+	longPos, _ := db.keyDir.get("long")
+
+	time.Sleep(20 * time.Millisecond)
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+
+	// Merge は期限切れのレコードを書き写さない
+	if _, ok := db.keyDir.get("short"); ok {
+		t.Error("Expected merge to drop the expired key from the index")
+	}
+	if st := db.Stats(); st.LiveKeys != 2 || st.DeadBytes != 0 {
+		t.Errorf("Unexpected stats after merge: %+v", st)
+	}
+	if v, err := db.Get([]byte("long")); err != nil || string(v) != "long-value" {
+		t.Errorf("Expected long-value, got %q, %v", v, err)
+	}
+	_ = db.Close()
+
+	// Hint File から有効期限を復元する
+	db, err = NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	if pos, ok := db.keyDir.get("long"); !ok || pos.Expiry != longPos.Expiry {
+		t.Errorf("Expected expiry %d from hint file, got %+v", longPos.Expiry, pos)
+	}
+	if v, err := db.Get([]byte("plain")); err != nil || string(v) != "plain-value" {
+		t.Errorf("Expected plain-value, got %q, %v", v, err)
+	}
+	if _, err := db.Get([]byte("short")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for expired key, got %v", err)
+	}
+}
+
+func TestTTLAndExpire(t *testing.T) {
+	dbDir := "test_ttl_expire_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	_ = db.Put([]byte("key"), []byte("value"))
+	if ttl, err := db.TTL([]byte("key")); err != nil || ttl != NoTTL {
+		t.Errorf("Expected NoTTL, got %v, %v", ttl, err)
+	}
+	if _, err := db.TTL([]byte("missing")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if err := db.Expire([]byte("missing"), time.Second); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound from Expire, got %v", err)
+	}
+
+	if err := db.Expire([]byte("key"), time.Hour); err != nil {
+		t.Fatalf("Expire failed: %v", err)
+	}
+	if ttl, err := db.TTL([]byte("key")); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("Expected TTL close to 1h, got %v, %v", ttl, err)
+	}
+	if v, err := db.Get([]byte("key")); err != nil || string(v) != "value" {
+		t.Errorf("Expected value to be kept by Expire, got %q, %v", v, err)
+	}
+
+	if err := db.Expire([]byte("key"), 10*time.Millisecond); err != nil {
+		t.Fatalf("Expire failed: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if db.Has([]byte("key")) {
+		t.Error("Expected Has to be false after expiry")
+	}
+	if _, err := db.TTL([]byte("key")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound after expiry, got %v", err)
+	}
+}
+
+func TestDeleteExisting(t *testing.T) {
+	dbDir := "test_delete_existing_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Put([]byte("key"), []byte("value"))
+	_ = db.PutWithTTL([]byte("expired"), []byte("value"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if deleted, err := db.DeleteExisting([]byte("key")); err != nil || !deleted {
+		t.Errorf("DeleteExisting key = %v, %v, want true", deleted, err)
+	}
+	if _, err := db.Get([]byte("key")); err != ErrKeyNotFound {
+		t.Errorf("Expected key to be deleted, got %v", err)
+	}
+	offset := db.writeOffset
+	for _, key := range []string{"key", "missing", "expired"} {
+		if deleted, err := db.DeleteExisting([]byte(key)); err != nil || deleted {
+			t.Errorf("DeleteExisting %s = %v, %v, want false", key, deleted, err)
+		}
+	}
+	if db.writeOffset != offset {
+		t.Errorf("Expected no tombstone for missing keys, write offset moved %d -> %d", offset, db.writeOffset)
+	}
+
+	_ = db.Close()
+	if _, err := db.DeleteExisting([]byte("key")); !errors.Is(err, ErrClosed) {
+		t.Errorf("DeleteExisting after Close = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,615 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	errIncompleteBatch = fmt.Errorf("%w: incomplete batch", ErrDataCorruption)
+	errOrphanCommit    = fmt.Errorf("%w: batch commit without begin", ErrDataCorruption)
+	errHintMismatch    = fmt.Errorf("%w: hint entry does not match the data record", ErrDataCorruption)
+	errHintNoData      = fmt.Errorf("%w: hint file without data file", ErrDataCorruption)
+)
+
+// VerifyIssue は Verify / Repair が検出した不正な範囲です。
+type VerifyIssue struct {
+	FileID int
+	Kind   FileKind
+	Offset int64 // 不正なレコード (バッチの場合はその先頭) の位置
+	Length int64 // 読み飛ばしたバイト数 (データファイルのみ)
+	Err    error // ErrDataCorruption または io.ErrUnexpectedEOF を wrap したエラー
+}
+
+func (i VerifyIssue) String() string {
+	s := fmt.Sprintf("%d.%s offset %d: %v", i.FileID, i.Kind, i.Offset, i.Err)
+	if i.Length > 0 {
+		s += fmt.Sprintf(" (%d bytes)", i.Length)
+	}
+	return s
+}
+
+// VerifyReport は Verify の結果です。
+type VerifyReport struct {
+	DataFiles   int
+	HintFiles   int
+	Records     int // 正常なレコード数 (Commit 済みのバッチ内のレコードを含み、マーカーは含まない)
+	HintEntries int
+	BlobFiles   int
+	BlobRecords int // Blob File の正常な値のレコード数 (参照されていない値を含む)
+	LegacyFiles int // ファイルヘッダの無い旧形式のファイル数 (Merge で移行できます)
+	Issues      []VerifyIssue
+}
+
+// OK は問題が見つからなかったかを返します。
+func (r *VerifyReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// Verify はデータディレクトリの全データファイルと Hint File、Blob File を検査し、不正なレコードを
+// ファイル ID と位置付きで報告します。Hint File の各エントリは、データファイル側の同じ位置に
+// キー・Timestamp・サイズが一致する正常なレコードがあるかを照合します。
+//
+// 鍵は使わないため、暗号化されたファイルは CRC (暗号文に対するもの) で検査し、キー・有効期限・
+// バッチのレコード数の照合は省略します。鍵の誤りや改ざんは DB のオープンや Get で検出されます。
+//
+// データファイルは不正な範囲を読み飛ばして最後まで検査します。ファイルは変更せず、
+// 書き込みプロセスが開いている間は ErrDatabaseLocked を返します。
+func Verify(dirPath string) (*VerifyReport, error) {
+	lock, err := acquireDirLock(dirPath, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.release() }()
+
+	if err := recoverMerge(dirPath, true); err != nil {
+		return nil, err
+	}
+	ids, err := listSegmentIDs(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{}
+	hasData := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		hasData[id] = true
+		report.DataFiles++
+
+		// Hint との照合用に、正常なレコードを位置ごとに記録する
+		records := make(map[int64]scannedRecord)
+		err := scanFile(FileKindData, id, filepath.Join(dirPath, fmt.Sprintf("%d.data", id)), func(f *os.File, size int64) error {
+			header, start, issue, err := verifyFileHeader(FileKindData, id, f, size)
+			if err != nil {
+				return err
+			}
+			if issue != nil {
+				report.Issues = append(report.Issues, *issue)
+			}
+			if header.Version == 0 && size > 0 {
+				report.LegacyFiles++
+			}
+			issues, err := scanSegment(id, f, size, start, func(r scannedRecord) error {
+				records[r.offset] = r
+				report.Records++
+				return nil
+			})
+			report.Issues = append(report.Issues, issues...)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		hintPath := filepath.Join(dirPath, fmt.Sprintf("%d.hint", id))
+		if _, err := os.Stat(hintPath); err != nil {
+			continue
+		}
+		report.HintFiles++
+		if err := verifyHintFile(id, hintPath, records, report); err != nil {
+			return nil, err
+		}
+	}
+
+	// データファイルの無い Hint File
+	hints, err := filepath.Glob(filepath.Join(dirPath, "*.hint"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range hints {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(path), "%d.hint", &id); err != nil || hasData[id] {
+			continue
+		}
+		report.HintFiles++
+		report.Issues = append(report.Issues, VerifyIssue{FileID: id, Kind: FileKindHint, Err: errHintNoData})
+	}
+
+	if err := verifyBlobFiles(dirPath, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// verifyBlobFiles は Blob File の各レコードの CRC を検査します。
+// 書きかけの末尾 (クラッシュで残った、参照されない値) も不正な範囲として報告します。
+func verifyBlobFiles(dirPath string, report *VerifyReport) error {
+	ids, err := listBlobIDs(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		report.BlobFiles++
+		err := scanFile(FileKindBlob, id, blobPath(dirPath, id), func(f *os.File, size int64) error {
+			_, start, issue, err := verifyFileHeader(FileKindBlob, id, f, size)
+			if err != nil {
+				return err
+			}
+			if issue != nil {
+				report.Issues = append(report.Issues, *issue)
+			}
+			issues, err := scanSegment(id, f, size, start, func(scannedRecord) error {
+				report.BlobRecords++
+				return nil
+			})
+			for _, issue := range issues {
+				issue.Kind = FileKindBlob
+				report.Issues = append(report.Issues, issue)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanFile は path を開いて fn にファイルとサイズを渡します。Verify / Repair はファイル全体をメモリに読み込まず、
+// fn の中で scanSegment などを使って 1 レコードずつ読みます。
+func scanFile(kind FileKind, id int, path string, fn func(f *os.File, size int64) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := fn(f, info.Size()); err != nil {
+		return fmt.Errorf("%d.%s: %w", id, kind, err)
+	}
+	return nil
+}
+
+// verifyFileHeader は f (サイズ size) のヘッダを検証し、最初のレコードの位置を返します。
+// 不正なヘッダは issue として返し、ヘッダの範囲 (途切れている場合はファイル全体) を読み飛ばします。
+// この実装より新しい形式のファイルは検査できないためエラーを返します。
+func verifyFileHeader(kind FileKind, id int, f io.ReaderAt, size int64) (FileHeader, int64, *VerifyIssue, error) {
+	head := make([]byte, min(size, fileHeaderSize))
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return FileHeader{}, 0, nil, err
+	}
+	header, err := decodeFileHeader(head)
+	if err == nil {
+		err = checkFileHeader(header, kind, id)
+	}
+	switch {
+	case err == nil:
+		return header, header.size(), nil, nil
+	case errors.Is(err, ErrUnsupportedFormat):
+		return FileHeader{}, 0, nil, err
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		issue := &VerifyIssue{FileID: id, Kind: kind, Length: size, Err: fmt.Errorf("truncated file header: %w", err)}
+		return FileHeader{}, size, issue, nil
+	}
+	var ce *CorruptionError
+	if errors.As(err, &ce) {
+		ce.Kind, ce.FileID = kind, id
+	}
+	return FileHeader{}, fileHeaderSize, &VerifyIssue{FileID: id, Kind: kind, Length: fileHeaderSize, Err: err}, nil
+}
+
+// verifyHintFile は Hint File の各エントリを records (同じ ID のデータファイルの正常なレコード) と照合します。
+func verifyHintFile(id int, path string, records map[int64]scannedRecord, report *VerifyReport) error {
+	var header FileHeader
+	var size int64
+	var issue *VerifyIssue
+	err := scanFile(FileKindHint, id, path, func(f *os.File, n int64) error {
+		var err error
+		size = n
+		header, _, issue, err = verifyFileHeader(FileKindHint, id, f, n)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if issue != nil {
+		// ヘッダが読めない Hint File のエントリは照合しない
+		report.Issues = append(report.Issues, *issue)
+		return nil
+	}
+	if header.Version == 0 && size > 0 {
+		report.LegacyFiles++
+	}
+
+	next := header.size() // 次のエントリの位置
+	err = WalkHintFile(path, func(e FileRecord) error {
+		report.HintEntries++
+		next = e.Offset + e.Size
+		issue := VerifyIssue{FileID: id, Kind: FileKindHint, Offset: e.Offset}
+		if !e.CRCValid {
+			issue.Err = ErrDataCorruption
+			report.Issues = append(report.Issues, issue)
+			return nil
+		}
+		r, ok := records[e.DataOffset]
+		// 暗号化されたエントリのキーと、暗号化されたレコードの有効期限は鍵なしでは比較できない
+		encrypted := e.Flags&flagEncrypted != 0
+		if !ok || (!encrypted && (string(r.key) != string(e.Key) || r.expiry != e.Expiry)) || int64(r.header.timestamp) != e.Timestamp ||
+			r.header.flags != e.Flags || r.header.isTombstone() != e.Tombstone || r.header.valueLen() != int64(e.ValueSize) {
+			issue.Err = errHintMismatch
+			report.Issues = append(report.Issues, issue)
+		}
+		return nil
+	})
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		report.Issues = append(report.Issues, VerifyIssue{FileID: id, Kind: FileKindHint, Offset: next, Err: io.ErrUnexpectedEOF})
+		return nil
+	}
+	return err
+}
+
+// scannedRecord は scanSegment が読み出した正常なレコードです。
+// 暗号化されたレコードの key は暗号文で、expiry は 0 です。
+type scannedRecord struct {
+	offset int64
+	header recordHeader
+	key    []byte
+	expiry int64
+}
+
+// readScannedRecord は br から offset のレコードを 1 つ読み、CRC を検証します (size はファイルサイズ)。
+// 値は全体を保持せずに CRC を計算し、バッチのマーカーと有効期限の判定に使う先頭 expirySize バイトだけを返します。
+// 不正な場合は理由 (io.ErrUnexpectedEOF または ErrDataCorruption) を返します。br の位置は不定になります。
+func readScannedRecord(br *bufio.Reader, offset, size int64) (scannedRecord, []byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if offset+recordHeaderSize > size {
+		return scannedRecord{}, nil, io.ErrUnexpectedEOF
+	}
+	if _, err := io.ReadFull(br, header); err != nil {
+		return scannedRecord{}, nil, err
+	}
+	h := decodeRecordHeader(header)
+	if offset+h.size() > size {
+		return scannedRecord{}, nil, io.ErrUnexpectedEOF
+	}
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(header[4:])
+	key := make([]byte, h.keySize)
+	if _, err := io.ReadFull(br, key); err != nil {
+		return scannedRecord{}, nil, err
+	}
+	_, _ = crc.Write(key)
+	rest := h.size() - recordHeaderSize - int64(h.keySize)
+	value := make([]byte, min(rest, expirySize))
+	if _, err := io.ReadFull(br, value); err != nil {
+		return scannedRecord{}, nil, err
+	}
+	_, _ = crc.Write(value)
+	if _, err := io.CopyN(crc, br, rest-int64(len(value))); err != nil {
+		return scannedRecord{}, nil, err
+	}
+	if crc.Sum32() != h.crc {
+		if isUnfinishedRecord(header) {
+			return scannedRecord{offset: offset, header: h}, nil, errUnfinishedRecord
+		}
+		return scannedRecord{}, nil, ErrDataCorruption
+	}
+	return scannedRecord{offset: offset, header: h, key: key}, value, nil
+}
+
+// scanSegment はデータファイル f (サイズ size) を start から走査し、有効になるレコード (単独のレコードと
+// Commit 済みのバッチ内のレコード) を書き込み順に fn へ渡します。ファイルは 1 レコードずつ読みます。
+//
+// 不正なレコードを見つけると、次に正常なレコードが始まる位置まで 1 バイトずつ読み飛ばして走査を続け、
+// 読み飛ばした範囲を VerifyIssue として返します。Commit まで揃わないバッチは破棄して報告します。
+// 暗号化されたバッチは Commit マーカーのレコード数を照合しません。
+// PutStream が値を書き終えていないレコード (isUnfinishedRecord) は報告せずに読み飛ばします。
+// 読み込みのエラーと fn のエラーは、それまでに見つけた issue と合わせて返します。
+func scanSegment(fileID int, f io.ReaderAt, size, start int64, fn func(scannedRecord) error) ([]VerifyIssue, error) {
+	var issues []VerifyIssue
+	var (
+		inBatch    bool
+		batchStart int64
+		pending    []scannedRecord
+	)
+	dropBatch := func() {
+		if inBatch {
+			issues = append(issues, VerifyIssue{FileID: fileID, Kind: FileKindData, Offset: batchStart, Err: errIncompleteBatch})
+		}
+		inBatch = false
+		pending = pending[:0]
+	}
+
+	br := bufio.NewReaderSize(io.NewSectionReader(f, start, size-start), 64*1024)
+	for offset := start; offset < size; {
+		r, value, err := readScannedRecord(br, offset, size)
+		if err == errUnfinishedRecord && !inBatch {
+			// PutStream が書き終えていない (書き込み中か、クラッシュで中断した) レコードは破損ではない
+			offset += r.header.size()
+			continue
+		}
+		if isTornRead(err) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil && !errors.Is(err, ErrDataCorruption) && err != io.ErrUnexpectedEOF {
+			return issues, err
+		}
+		if err != nil {
+			// ゼロ埋めの末尾は事前確保したアクティブファイルの未使用領域 (開いている DB やクラッシュ後に残る)
+			if isPreallocatedTail(f, offset, size) {
+				break
+			}
+			next, nextErr := nextValidRecord(f, offset+1, size)
+			if nextErr != nil {
+				return issues, nextErr
+			}
+			dropBatch()
+			issues = append(issues, VerifyIssue{FileID: fileID, Kind: FileKindData, Offset: offset, Length: next - offset, Err: err})
+			offset = next
+			br.Reset(io.NewSectionReader(f, offset, size-offset))
+			continue
+		}
+
+		h := r.header
+		switch {
+		case h.flags&flagBatchBegin != 0:
+			dropBatch()
+			inBatch = true
+			batchStart = offset
+
+		case h.flags&flagBatchCommit != 0:
+			if !inBatch {
+				issues = append(issues, VerifyIssue{FileID: fileID, Kind: FileKindData, Offset: offset, Err: errOrphanCommit})
+				break
+			}
+			if h.flags&flagEncrypted == 0 && (len(value) != 4 || int(binary.BigEndian.Uint32(value)) != len(pending)) {
+				dropBatch()
+				break
+			}
+			for _, r := range pending {
+				if err := fn(r); err != nil {
+					return issues, err
+				}
+			}
+			inBatch = false
+			pending = pending[:0]
+
+		default:
+			if h.flags&flagEncrypted == 0 {
+				r.expiry, _, err = splitExpiry(h, value)
+			}
+			if err != nil {
+				dropBatch()
+				issues = append(issues, VerifyIssue{FileID: fileID, Kind: FileKindData, Offset: offset, Length: h.size(), Err: err})
+				break
+			}
+			if inBatch {
+				pending = append(pending, r)
+			} else if err := fn(r); err != nil {
+				return issues, err
+			}
+		}
+		offset += h.size()
+	}
+	if inBatch {
+		issues = append(issues, VerifyIssue{FileID: fileID, Kind: FileKindData, Offset: batchStart, Err: fmt.Errorf("%w: %w", errIncompleteBatch, io.ErrUnexpectedEOF)})
+	}
+	return issues, nil
+}
+
+// RepairReport は Repair の結果です。
+type RepairReport struct {
+	Issues       []VerifyIssue // 破棄した範囲
+	Records      int           // 救出した正常なレコード数
+	Keys         int           // 書き直したキーの数
+	DroppedBytes int64         // 破棄したバイト数
+	Segments     []int         // 作成したセグメントの ID
+}
+
+// salvagedPos は Repair が書き直すレコードの位置です。
+type salvagedPos struct {
+	fileID    int
+	offset    int64
+	size      int64
+	tombstone bool
+	expiry    int64
+}
+
+// Repair はデータディレクトリの全データファイルから正常なレコードを救出し、新しいセグメントへ
+// 書き直して Hint File を作り直します。不正な範囲と Commit まで揃わないバッチは破棄します。
+//
+// 書き直しは Merge と同じく、一時ファイルを書き終えてから MERGE マニフェストで差し替えるため、
+// 途中で中断しても次のオープン (または再度の Repair) で完了します。
+// ディレクトリを排他ロックするので、DB を閉じた状態で実行してください。
+//
+// 暗号化されたセグメントを書き直すには、その鍵を返す keys が必要です。復号できないレコードは破棄します。
+// keys が nil でなければ、新しいセグメントは keys の現在の鍵で暗号化します。
+func Repair(dirPath string, keys KeyProvider) (*RepairReport, error) {
+	lock, err := acquireDirLock(dirPath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = lock.release() }()
+
+	if err := recoverMerge(dirPath, false); err != nil {
+		return nil, err
+	}
+	ids, err := listSegmentIDs(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	segmentSize := DefaultSegmentSize
+	if p, err := readPersistedOptions(dirPath); err == nil && p != nil && p.SegmentSize > 0 {
+		segmentSize = p.SegmentSize
+	}
+
+	// 1. 全セグメントを書き込み順に走査し、キーごとの最新のレコードを求める
+	report := &RepairReport{}
+	latest := make(map[string]salvagedPos)
+	ciphers := make(map[int]*fileCipher)
+	for _, id := range ids {
+		err := scanFile(FileKindData, id, filepath.Join(dirPath, fmt.Sprintf("%d.data", id)), func(f *os.File, size int64) error {
+			header, start, issue, err := verifyFileHeader(FileKindData, id, f, size)
+			if err != nil {
+				return err
+			}
+			if issue != nil {
+				report.Issues = append(report.Issues, *issue)
+			}
+			cipher, err := openFileCipher(keys, header)
+			if err != nil {
+				return err
+			}
+			ciphers[id] = cipher
+			issues, err := scanSegment(id, f, size, start, func(r scannedRecord) error {
+				if r.header.flags&flagEncrypted != 0 {
+					// キーと有効期限は復号して取り出す (認証タグの検証にレコード全体が必要)
+					rec := make([]byte, r.header.size())
+					if _, err := f.ReadAt(rec, r.offset); err != nil {
+						return err
+					}
+					body, err := recordBody(cipher, FileKindData, id, r.header, rec, r.offset)
+					if err == nil {
+						r.key = body[:r.header.keySize]
+						r.expiry, _, err = splitExpiry(r.header, body[r.header.keySize:])
+					}
+					if err != nil {
+						report.Issues = append(report.Issues, VerifyIssue{FileID: id, Kind: FileKindData, Offset: r.offset, Length: r.header.size(), Err: err})
+						return nil
+					}
+				}
+				report.Records++
+				latest[string(r.key)] = salvagedPos{fileID: id, offset: r.offset, size: r.header.size(), tombstone: r.header.isTombstone(), expiry: r.expiry}
+				return nil
+			})
+			report.Issues = append(report.Issues, issues...)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, issue := range report.Issues {
+		report.DroppedBytes += issue.Length
+	}
+	if len(ids) == 0 {
+		return report, nil
+	}
+
+	// 2. 削除・期限切れでないキーをキー順に新しいセグメントへ書き写す
+	liveKeys := make([]string, 0, len(latest))
+	now := time.Now().UnixNano()
+	for key, pos := range latest {
+		if !pos.tombstone && (pos.expiry == 0 || pos.expiry > now) {
+			liveKeys = append(liveKeys, key)
+		}
+	}
+	sort.Strings(liveKeys)
+
+	files := make(map[int]*os.File)
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	firstID := ids[len(ids)-1] + 1
+	var outputIDs []int
+	var out *mergeOutput
+	committed := false
+	defer func() {
+		if out != nil {
+			out.close()
+		}
+		if !committed {
+			_ = removeMergeTempFiles(dirPath)
+		}
+	}()
+
+	for _, key := range liveKeys {
+		pos := latest[key]
+		f, ok := files[pos.fileID]
+		if !ok {
+			if f, err = os.Open(filepath.Join(dirPath, fmt.Sprintf("%d.data", pos.fileID))); err != nil {
+				return nil, err
+			}
+			files[pos.fileID] = f
+		}
+		data := make([]byte, pos.size)
+		if _, err := f.ReadAt(data, pos.offset); err != nil {
+			return nil, err
+		}
+		// 暗号化されたレコードは平文に戻し、書き込む位置で暗号化し直す
+		if decodeRecordHeader(data).flags&flagEncrypted != 0 {
+			if data, err = ciphers[pos.fileID].decryptRecord(data, pos.offset); err != nil {
+				return nil, corruptionError(FileKindData, pos.fileID, pos.offset, err.Error())
+			}
+		}
+		size := int64(len(data))
+		if keys != nil {
+			size += gcmTagSize
+		}
+
+		if out != nil && out.size > 0 && out.size+size > segmentSize {
+			err := out.finish()
+			out = nil
+			if err != nil {
+				return nil, err
+			}
+		}
+		if out == nil {
+			id := firstID + len(outputIDs)
+			if out, err = createMergeOutput(dirPath, id, true, keys); err != nil {
+				return nil, err
+			}
+			outputIDs = append(outputIDs, id)
+		}
+		if _, _, err := out.append(data, []byte(key), pos.expiry); err != nil {
+			return nil, err
+		}
+	}
+	if out != nil {
+		err := out.finish()
+		out = nil
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 3. 古いセグメントを新しいセグメントで置き換える
+	for id, f := range files {
+		_ = f.Close()
+		delete(files, id)
+	}
+	m := mergeManifest{Inputs: ids, Outputs: outputIDs}
+	if err := writeMergeManifest(dirPath, m); err != nil {
+		return nil, err
+	}
+	committed = true
+	if err := completeMerge(dirPath, m); err != nil {
+		return nil, err
+	}
+	report.Keys = len(liveKeys)
+	report.Segments = outputIDs
+	return report, nil
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// corruptByte はファイルの offset の 1 バイトを反転します。
+func corruptByte(t *testing.T, path string, offset int64) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAndRepair(t *testing.T) {
+	dbDir := "test_verify_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 100
+
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	// 0.data: key1, key2, key3 (各 30 bytes) / 1.data 以降: key4, key5, key5 の Tombstone
+	_ = db.Put([]byte("key1"), []byte("value1"))
+	_ = db.Put([]byte("key2"), []byte("value2"))
+	_ = db.Put([]byte("key3"), []byte("value3"))
+	_ = db.Put([]byte("key4"), []byte("value4"))
+	_ = db.Put([]byte("key5"), []byte("value5"))
+	_ = db.Delete([]byte("key5"))
+	_ = db.Close()
+
+	report, err := Verify(dbDir)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !report.OK() || report.Records != 6 {
+		t.Fatalf("Expected clean report with 6 records, got %+v", report)
+	}
+
+	// 0.data の 2 番目のレコード (key2) を壊す
+	corruptByte(t, filepath.Join(dbDir, "0.data"), fileHeaderSize+30+25)
+
+	report, err = Verify(dbDir)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if len(report.Issues) != 1 {
+		t.Fatalf("Expected 1 issue, got %v", report.Issues)
+	}
+	issue := report.Issues[0]
+	if issue.FileID != 0 || issue.Kind != FileKindData || issue.Offset != fileHeaderSize+30 || issue.Length != 30 || !errors.Is(issue.Err, ErrDataCorruption) {
+		t.Errorf("Unexpected issue: %v", issue)
+	}
+	// 壊れたレコードの後ろ (key3) も読み続ける
+	if report.Records != 5 {
+		t.Errorf("Expected 5 valid records, got %d", report.Records)
+	}
+
+	// RepairCorruption 無しでは開けない
+	if _, err := OpenWithOptions(dbDir, opts); err == nil {
+		t.Fatal("Expected open to fail on corrupted segment")
+	}
+
+	repair, err := Repair(dbDir, nil)
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if len(repair.Issues) != 1 || repair.DroppedBytes != 30 || repair.Keys != 3 || len(repair.Segments) == 0 {
+		t.Errorf("Unexpected repair report: %+v", repair)
+	}
+
+	report, err = Verify(dbDir)
+	if err != nil || !report.OK() || report.HintFiles != len(repair.Segments) {
+		t.Fatalf("Expected clean report after repair, got %+v, %v", report, err)
+	}
+
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open repaired DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	for key, want := range map[string]string{"key1": "value1", "key3": "value3", "key4": "value4"} {
+		if v, err := db.Get([]byte(key)); err != nil || string(v) != want {
+			t.Errorf("Get %s = %q, %v", key, v, err)
+		}
+	}
+	for _, key := range []string{"key2", "key5"} {
+		if _, err := db.Get([]byte(key)); err != ErrKeyNotFound {
+			t.Errorf("Expected %s to be gone, got %v", key, err)
+		}
+	}
+	if _, err := Verify(dbDir); !errors.Is(err, ErrDatabaseLocked) {
+		t.Errorf("Expected ErrDatabaseLocked while open, got %v", err)
+	}
+}
+
+func TestVerifyHintMismatch(t *testing.T) {
+	dbDir := "test_verify_hint_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Put([]byte("key1"), []byte("value1"))
+	_ = db.Put([]byte("key2"), []byte("value2"))
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	_ = db.Close()
+
+	hints, _ := filepath.Glob(filepath.Join(dbDir, "*.hint"))
+	if len(hints) != 1 {
+		t.Fatalf("Expected 1 hint file, got %v", hints)
+	}
+	dataPath := hints[0][:len(hints[0])-len(".hint")] + ".data"
+
+	// データファイル側の 2 番目のレコードを壊すと、Hint の照合でも不一致になる
+	corruptByte(t, dataPath, fileHeaderSize+30+25)
+	// Hint File の末尾を途切れさせる
+	hint, _ := os.ReadFile(hints[0])
+	if err := os.Truncate(hints[0], int64(len(hint))-1); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Verify(dbDir)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	var dataIssues, hintIssues int
+	for _, issue := range report.Issues {
+		switch issue.Kind {
+		case FileKindData:
+			dataIssues++
+		case FileKindHint:
+			hintIssues++
+			if !errors.Is(issue.Err, io.ErrUnexpectedEOF) || issue.Offset == 0 {
+				t.Errorf("Unexpected hint issue: %v", issue)
+			}
+		}
+	}
+	if dataIssues != 1 || hintIssues != 1 || report.HintEntries != 1 {
+		t.Errorf("Expected 1 data issue, 1 truncated hint and 1 hint entry, got %+v", report)
+	}
+
+	// Hint のみ壊れている場合も検出する
+	corruptByte(t, dataPath, fileHeaderSize+30+25) // 元に戻す
+	hint[fileHeaderSize+20+7] ^= 0x01              // 最初のエントリの DataOffset を変える (CRC は不一致になる)
+	if err := os.WriteFile(hints[0], hint, 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = Verify(dbDir)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Kind != FileKindHint || report.Issues[0].Offset != fileHeaderSize {
+		t.Errorf("Expected 1 hint issue at the first entry, got %v", report.Issues)
+	}
+}
+
+func TestVerifyStreamsLargeFiles(t *testing.T) {
+	dbDir := "test_verify_large_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	const valueSize = 16 << 20
+	opts := DefaultOptions()
+	opts.BlobThreshold = 1024
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	big := bytes.Repeat([]byte("blob;"), valueSize/5)
+	if err := db.PutStream([]byte("big"), bytes.NewReader(big), int64(len(big))); err != nil {
+		t.Fatalf("PutStream failed: %v", err)
+	}
+	_ = db.Close()
+	// 大きな値のレコードを持つデータファイル
+	opts.BlobThreshold = 0
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	_ = db.Put([]byte("inline"), big)
+	_ = db.Close()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	report, err := Verify(dbDir)
+	runtime.ReadMemStats(&after)
+	if err != nil || !report.OK() {
+		t.Fatalf("Verify = %+v, %v", report, err)
+	}
+	if report.BlobRecords != 1 || report.Records != 2 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	// ファイル全体を読み込まず、1 レコードずつ読む
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > valueSize/4 {
+		t.Errorf("Verify allocated %d bytes for %d-byte values", alloc, valueSize)
+	}
+}
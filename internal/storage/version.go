@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrVersionMismatch は CompareAndPut / CompareAndDelete で、キーの現在の Version が期待値と異なる場合のエラーです。
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// Version はキーの現在のレコードを識別する値で、レコードの Timestamp と CRC から成ります。
+// 同じキーへ書き込むたびに変わるため、HTTP の ETag のような楽観的な条件付き更新に使えます。
+// CRC は平文のレコードに対するものです (暗号化されたレコードのファイル上の CRC は暗号文に対するもので、
+// 書き込む位置で変わるため使いません)。Merge は平文のレコードをそのままコピーするので、
+// 暗号化し直した場合も Version は変わりません。ただし MergeRecompress で圧縮し直したレコードは内容が変わるため、
+// Version も変わります。
+type Version struct {
+	Timestamp int64
+	CRC       uint32
+}
+
+// IsZero はゼロ値 (「キーが存在しない」を表す期待値) かを返します。
+func (v Version) IsZero() bool {
+	return v == Version{}
+}
+
+func versionOf(h recordHeader) Version {
+	return Version{Timestamp: int64(h.timestamp), CRC: h.crc}
+}
+
+// GetWithVersion は値と、その値を書き込んだレコードの Version を返します。Get と同様に公開済みのスナップショットから読みます。
+func (d *DB) GetWithVersion(key []byte) ([]byte, Version, error) {
+	pos, seg, blob, err := d.acquireEntry(key)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	defer func() { _ = seg.release() }()
+	if blob != nil {
+		// Version はデータファイルのレコード、値は Blob File から読む
+		defer func() { _ = blob.release() }()
+		ver, err := readVersionAt(seg, pos, key)
+		if err != nil {
+			return nil, Version{}, err
+		}
+		value, err := readValueAt(blob, valuePos(pos), key)
+		if err != nil {
+			return nil, Version{}, err
+		}
+		return value, ver, nil
+	}
+	h, value, err := readRecordAt(seg, pos, key)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	return value, versionOf(h), nil
+}
+
+// Version はキーの現在の Version を返します。暗号化されていなければ値は読まずにレコードヘッダだけを読み込みます。
+func (d *DB) Version(key []byte) (Version, error) {
+	pos, seg, err := d.acquireRecord(key)
+	if err != nil {
+		return Version{}, err
+	}
+	defer func() { _ = seg.release() }()
+	return readVersionAt(seg, pos, key)
+}
+
+// versionLocked は d.mu を保持した状態でキーの現在の Version を返します。キーが無ければ ok は false です。
+func (d *DB) versionLocked(key []byte) (ver Version, ok bool, err error) {
+	pos, ok := d.keyDir.get(string(key))
+	if !ok || pos.expired(time.Now().UnixNano()) {
+		return Version{}, false, nil
+	}
+	seg, err := d.segmentFor(pos)
+	if err != nil {
+		return Version{}, false, err
+	}
+	ver, err = readVersionAt(seg, pos, key)
+	return ver, err == nil, err
+}
+
+// readVersionAt は pos のレコードヘッダだけを読み込み、その Version を返します。
+// 暗号化されたレコードは平文の CRC が必要なため、レコード全体を読み込んで復号します。
+func readVersionAt(seg *segment, pos RecordPos, key []byte) (Version, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := seg.reader.ReadAt(header, pos.Offset); err != nil {
+		return Version{}, err
+	}
+	h := decodeRecordHeader(header)
+	if h.flags&flagEncrypted != 0 {
+		plain, _, err := storedValueAt(seg, pos, key)
+		if err != nil {
+			return Version{}, err
+		}
+		return versionOf(plain), nil
+	}
+	return versionOf(h), nil
+}
+
+// checkVersionLocked は現在の Version が expected と一致するかを検証します。
+// expected がゼロ値の場合は「キーが存在しないこと」を要求します。
+func (d *DB) checkVersionLocked(key []byte, expected Version) error {
+	current, ok, err := d.versionLocked(key)
+	if err != nil {
+		return err
+	}
+	if current != expected || ok == expected.IsZero() {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// CompareAndPut はキーの現在の Version が expected と一致する場合だけ値を保存し、新しい Version を返します。
+// expected がゼロ値の場合は、キーが存在しない (期限切れを含む) 場合だけ保存します。
+// 一致しない場合は ErrVersionMismatch を返します。
+func (d *DB) CompareAndPut(key, value []byte, expected Version) (Version, error) {
+	ver, seq, err := d.compareAndPut(key, value, expected)
+	if err != nil {
+		return Version{}, err
+	}
+	return ver, d.waitDurable(seq)
+}
+
+func (d *DB) compareAndPut(key, value []byte, expected Version) (Version, uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.opts.ReadOnly {
+		return Version{}, 0, &ReadOnlyError{Op: "put"}
+	}
+	if err := d.checkVersionLocked(key, expected); err != nil {
+		return Version{}, 0, err
+	}
+	return d.putLocked(key, value, 0)
+}
+
+// CompareAndDelete はキーの現在の Version が expected と一致する場合だけキーを削除します。
+// 一致しない場合 (キーが存在しない場合を含む) は ErrVersionMismatch を返します。
+func (d *DB) CompareAndDelete(key []byte, expected Version) error {
+	seq, err := d.compareAndDelete(key, expected)
+	if err != nil {
+		return err
+	}
+	return d.waitDurable(seq)
+}
+
+func (d *DB) compareAndDelete(key []byte, expected Version) (uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.opts.ReadOnly {
+		return 0, &ReadOnlyError{Op: "delete"}
+	}
+	if expected.IsZero() {
+		return 0, ErrVersionMismatch
+	}
+	if err := d.checkVersionLocked(key, expected); err != nil {
+		return 0, err
+	}
+	return d.deleteLocked(key)
+}
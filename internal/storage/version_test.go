@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCompareAndPut(t *testing.T) {
+	dbDir := "test_version_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	key := []byte("key")
+	if _, err := db.Version(key); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// ゼロ値は「存在しないこと」を要求する
+	v1, err := db.CompareAndPut(key, []byte("v1"), Version{})
+	if err != nil {
+		t.Fatalf("CompareAndPut (create) failed: %v", err)
+	}
+	if v1.IsZero() {
+		t.Fatal("Expected non-zero version")
+	}
+	if _, err := db.CompareAndPut(key, []byte("dup"), Version{}); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch for existing key, got %v", err)
+	}
+
+	value, ver, err := db.GetWithVersion(key)
+	if err != nil || string(value) != "v1" || ver != v1 {
+		t.Fatalf("GetWithVersion = %q, %+v, %v; want v1, %+v", value, ver, err, v1)
+	}
+	if ver, err := db.Version(key); err != nil || ver != v1 {
+		t.Errorf("Version = %+v, %v; want %+v", ver, err, v1)
+	}
+
+	v2, err := db.CompareAndPut(key, []byte("v2"), v1)
+	if err != nil {
+		t.Fatalf("CompareAndPut (update) failed: %v", err)
+	}
+	if v2 == v1 {
+		t.Error("Expected version to change on update")
+	}
+	if _, err := db.CompareAndPut(key, []byte("stale"), v1); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch for stale version, got %v", err)
+	}
+
+	// 通常の Put でも Version は変わる
+	if err := db.Put(key, []byte("v3")); err != nil {
+		t.Fatal(err)
+	}
+	v3, _ := db.Version(key)
+	if err := db.CompareAndDelete(key, v2); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch for stale delete, got %v", err)
+	}
+
+	// Merge はレコードをコピーするだけなので Version は変わらない
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if ver, err := db.Version(key); err != nil || ver != v3 {
+		t.Errorf("Version after merge = %+v, %v; want %+v", ver, err, v3)
+	}
+
+	if err := db.CompareAndDelete(key, v3); err != nil {
+		t.Fatalf("CompareAndDelete failed: %v", err)
+	}
+	if _, err := db.Get(key); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound after delete, got %v", err)
+	}
+	if err := db.CompareAndDelete(key, v3); err != ErrVersionMismatch {
+		t.Errorf("Expected ErrVersionMismatch for missing key, got %v", err)
+	}
+}
+
+// 暗号化されたレコードは Merge で書き込む位置と鍵が変わっても Version が変わらない
+func TestVersionStableAcrossEncryptedMerge(t *testing.T) {
+	dbDir := "test_version_encrypted_dir"
+	_ = os.RemoveAll(dbDir)
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.KeyProvider = testKeys(t, 1, 1)
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	key := []byte("key")
+	// 先頭に不要なレコードを置き、Merge でレコードの位置が変わるようにする
+	for i := 0; i < 10; i++ {
+		_ = db.Put(key, []byte("garbage"))
+	}
+	_ = db.Delete(key)
+	v1, err := db.CompareAndPut(key, []byte("v1"), Version{})
+	if err != nil {
+		t.Fatalf("CompareAndPut failed: %v", err)
+	}
+	if ver, err := db.Version(key); err != nil || ver != v1 {
+		t.Fatalf("Version = %+v, %v; want %+v", ver, err, v1)
+	}
+	_ = db.Close()
+
+	// 鍵をローテーションして Merge し、新しい位置・新しい鍵で暗号化し直す
+	opts.KeyProvider = testKeys(t, 2, 1, 2)
+	db, err = OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	before, _ := db.keyDir.get(string(key))
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if after, _ := db.keyDir.get(string(key)); after.FileID == before.FileID && after.Offset == before.Offset {
+		t.Fatalf("Expected merge to move the record, still at %+v", after)
+	}
+
+	if ver, err := db.Version(key); err != nil || ver != v1 {
+		t.Errorf("Version after merge = %+v, %v; want %+v", ver, err, v1)
+	}
+	if value, ver, err := db.GetWithVersion(key); err != nil || string(value) != "v1" || ver != v1 {
+		t.Errorf("GetWithVersion after merge = %q, %+v, %v; want v1, %+v", value, ver, err, v1)
+	}
+	r, ver, err := db.GetReaderWithVersion(key)
+	if err != nil || ver != v1 {
+		t.Errorf("GetReaderWithVersion after merge = %+v, %v; want %+v", ver, err, v1)
+	}
+	if r != nil {
+		_ = r.Close()
+	}
+	if _, err := db.CompareAndPut(key, []byte("v2"), v1); err != nil {
+		t.Errorf("CompareAndPut with the pre-merge version failed: %v", err)
+	}
+}
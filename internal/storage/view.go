@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"hash/maphash"
+	"sync/atomic"
+	"time"
+)
+
+// readView は Get などの読み取りが d.mu を取らずに参照する、インデックスとセグメントのスナップショットです。
+// 書き込み側が d.mu の下で作成して DB.view に公開し、公開後は変更しません。
+//
+// インデックスはコピーオンライトの keyIndex を clone したもの (index) と、それ以降の変更を記録した
+// recentIndex (recent) の組で表します。clone の後の最初の更新は変更するノード (根からの経路) をコピーするため、
+// 書き込みのたびに clone すると Put ごとにこのコピーが発生します。そこで clone はエポックごとに 1 回だけ行い
+// (foldLocked)、エポック内の書き込みは recent に追記して seq を進めたビューを公開します。
+// 読み取りは recent の中で seq 以下の最新の記録を探し、無ければ index を読みます。
+// セグメントの一覧はセグメントが入れ替わったときだけ作り直し、それ以外の公開では前のビューと共有します。
+type readView struct {
+	index    *keyIndex
+	recent   *recentIndex
+	seq      uint64           // このビューに含まれる最後の操作の番号 (recent のうち seq 以下の記録が見える)
+	segments map[int]*segment // アクティブファイルを含む
+	blobs    map[int]*segment // 書き込み中の Blob File を含む
+}
+
+// minRecentEntries はエポックあたりに recentIndex へ記録する変更数の下限です。
+// 上限はインデックスのキー数の 1/4 とこの値の大きい方で、clone 後のノードのコピー (最大で木全体) を
+// エポック内の書き込みで償却できるようにしています。
+const minRecentEntries = 1024
+
+// recentEntry はエポック内のキーの変更 1 件です。prev は同じキーの 1 つ前の操作での変更です。
+type recentEntry struct {
+	key     string
+	pos     RecordPos
+	deleted bool
+	seq     uint64
+	prev    *recentEntry
+}
+
+// recentIndex は直前の clone 以降のインデックスの変更を記録する、オープンアドレス法のハッシュ表です。
+// 書き込み (record) は d.mu を保持した 1 つの goroutine だけが行い、読み取り (get) はロックを取らずに行います。
+// スロットは空から埋まるだけで削除しないため、読み取りは空のスロットに当たった時点で探索を終えられます。
+type recentIndex struct {
+	slots    []atomic.Pointer[recentEntry]
+	seed     maphash.Seed
+	limit    int  // 記録できる変更の数 (スロット数の半分以下)
+	recorded int  // 記録した変更の数 (prev に残したものを含む)
+	full     bool // limit に達して記録をやめた (次の公開で必ず foldLocked する)
+}
+
+func newRecentIndex(keys int) *recentIndex {
+	limit := max(minRecentEntries, keys/4)
+	n := 1
+	for n < limit*2 {
+		n <<= 1
+	}
+	return &recentIndex{slots: make([]atomic.Pointer[recentEntry], n), seed: maphash.MakeSeed(), limit: limit}
+}
+
+// record は seq 番目の操作でのキーの変更を記録します。d.mu を保持した状態で呼び出します。
+// 同じ操作の中での書き直しは記録を置き換え、それより前の操作の記録は prev として残します
+// (古いビューを読んでいる読み取りが参照するため)。
+func (r *recentIndex) record(key string, pos RecordPos, deleted bool, seq uint64) {
+	if r.full {
+		return
+	}
+	if r.recorded >= r.limit {
+		r.full = true
+		return
+	}
+	mask := uint64(len(r.slots) - 1)
+	for i := maphash.String(r.seed, key) & mask; ; i = (i + 1) & mask {
+		cur := r.slots[i].Load()
+		if cur != nil && cur.key != key {
+			continue
+		}
+		e := &recentEntry{key: key, pos: pos, deleted: deleted, seq: seq, prev: cur}
+		if cur != nil && cur.seq == seq {
+			e.prev = cur.prev
+		}
+		r.slots[i].Store(e)
+		r.recorded++
+		return
+	}
+}
+
+// get は seq 以下の操作で記録されたキーの最新の変更を返します。記録が無ければ nil です。
+func (r *recentIndex) get(key string, seq uint64) *recentEntry {
+	mask := uint64(len(r.slots) - 1)
+	for i := maphash.String(r.seed, key) & mask; ; i = (i + 1) & mask {
+		e := r.slots[i].Load()
+		if e == nil {
+			return nil
+		}
+		if e.key != key {
+			continue
+		}
+		for e != nil && e.seq > seq {
+			e = e.prev
+		}
+		return e
+	}
+}
+
+// recordKey は keyDir の変更を、次に公開する操作の分として recentIndex に記録します。
+// オープン時の復元中 (まだ公開していない) は記録しません。
+func (d *DB) recordKey(key string, pos RecordPos, deleted bool) {
+	if d.recent != nil {
+		d.recent.record(key, pos, deleted, d.viewSeq+1)
+	}
+}
+
+// publishLocked はインデックスの現在の状態を読み取り側に公開します。
+// d.mu を保持した状態で、1 つの操作 (バッチ全体を含む) の変更を終えてから呼び出します。
+// 変更は recentIndex に記録済みなので seq を進めたビューを作るだけで、clone はエポックの終わり
+// (recentIndex が上限に達したとき) にだけ foldLocked で行います。
+func (d *DB) publishLocked() {
+	prev := d.view.Load()
+	if prev == nil || d.closed || d.recent.full || d.recent.recorded >= d.recent.limit {
+		d.publishSegmentsLocked()
+		return
+	}
+	d.viewSeq++
+	d.view.Store(&readView{index: prev.index, recent: d.recent, seq: d.viewSeq, segments: prev.segments, blobs: prev.blobs})
+}
+
+// publishSegmentsLocked はセグメントの一覧をインデックスと合わせて公開し、
+// retireSegment で退役させたセグメントの DB の参照を解放します。閉じた DB では何も公開しません。
+// 新しいビューを公開した後で解放するので、古いビューのセグメントを acquire できなかった Get は、
+// ビューを読み直せば必ず新しいセグメントを見つけられます。
+func (d *DB) publishSegmentsLocked() {
+	if d.closed {
+		return
+	}
+	segments := make(map[int]*segment, len(d.olderFiles)+1)
+	for id, seg := range d.olderFiles {
+		segments[id] = seg
+	}
+	if d.activeFile != nil {
+		segments[d.activeFileID] = d.activeSeg
+	}
+	blobs := make(map[int]*segment, len(d.blobFiles)+1)
+	for id, seg := range d.blobFiles {
+		blobs[id] = seg
+	}
+	if d.blobFile != nil {
+		blobs[d.blobFileID] = d.blobSeg
+	}
+	index, recent := d.foldLocked()
+	d.view.Store(&readView{index: index, recent: recent, seq: d.viewSeq, segments: segments, blobs: blobs})
+
+	for _, seg := range d.retired {
+		_ = seg.release()
+	}
+	d.retired = nil
+}
+
+// foldLocked はエポックを終え、keyDir の clone と空の recentIndex を新しいエポックの分として返します。
+func (d *DB) foldLocked() (*keyIndex, *recentIndex) {
+	d.viewSeq++
+	d.recent = newRecentIndex(d.keyDir.Len())
+	return d.keyDir.clone(), d.recent
+}
+
+// retireSegment は公開済みのビューから外すセグメントを登録します。
+// DB の参照は次の publishSegmentsLocked で解放され、参照中の Get やイテレータが無くなった時点で閉じられます。
+func (d *DB) retireSegment(seg *segment) {
+	d.retired = append(d.retired, seg)
+}
+
+// acquireRecord は公開済みのビューから key のレコードの位置と、それを含むセグメントを返します (lookup を参照)。
+// セグメントは acquire 済みなので、呼び出し側は読み終えたら release します。
+func (d *DB) acquireRecord(key []byte) (RecordPos, *segment, error) {
+	for {
+		v, pos, err := d.lookup(key)
+		if err != nil {
+			return RecordPos{}, nil, err
+		}
+		seg, ok := v.segments[pos.FileID]
+		if !ok {
+			return RecordPos{}, nil, corruptionError(FileKindData, pos.FileID, pos.Offset, "index refers to a missing segment")
+		}
+		if seg.acquire() {
+			return pos, seg, nil
+		}
+		// Merge やローテーションで解放済み。新しいビューは解放より前に公開されている
+	}
+}
+
+// acquireValue は acquireRecord と同様に、key の値を格納したレコードの位置とセグメントを返します。
+// 値を Blob File に分離したキーでは、Blob File 内の値のレコードとその Blob File を返します。
+func (d *DB) acquireValue(key []byte) (RecordPos, *segment, error) {
+	for {
+		v, pos, err := d.lookup(key)
+		if err != nil {
+			return RecordPos{}, nil, err
+		}
+		seg, err := v.valueSegment(pos)
+		if err != nil {
+			return RecordPos{}, nil, err
+		}
+		if seg.acquire() {
+			return valuePos(pos), seg, nil
+		}
+		// BlobGC やローテーションで解放済み。新しいビューは解放より前に公開されている
+	}
+}
+
+// acquireEntry は key のレコードとそのセグメントに加え、値を Blob File に分離したキーでは
+// 値のレコードを含む Blob File (分離していなければ nil) を同じビューから acquire して返します。
+func (d *DB) acquireEntry(key []byte) (RecordPos, *segment, *segment, error) {
+	for {
+		v, pos, err := d.lookup(key)
+		if err != nil {
+			return RecordPos{}, nil, nil, err
+		}
+		seg, ok := v.segments[pos.FileID]
+		if !ok {
+			return RecordPos{}, nil, nil, corruptionError(FileKindData, pos.FileID, pos.Offset, "index refers to a missing segment")
+		}
+		if !pos.Blob.valid() {
+			if seg.acquire() {
+				return pos, seg, nil, nil
+			}
+			continue
+		}
+		blob, err := v.valueSegment(pos)
+		if err != nil {
+			return RecordPos{}, nil, nil, err
+		}
+		if !seg.acquire() {
+			continue
+		}
+		if blob.acquire() {
+			return pos, seg, blob, nil
+		}
+		_ = seg.release()
+	}
+}
+
+// valueSegment は pos のキーの値を格納したセグメント (値を分離したキーでは Blob File) を返します。
+func (v *readView) valueSegment(pos RecordPos) (*segment, error) {
+	if pos.Blob.valid() {
+		seg, ok := v.blobs[pos.Blob.FileID]
+		if !ok {
+			return nil, corruptionError(FileKindBlob, pos.Blob.FileID, pos.Blob.Offset, "index refers to a missing blob file")
+		}
+		return seg, nil
+	}
+	seg, ok := v.segments[pos.FileID]
+	if !ok {
+		return nil, corruptionError(FileKindData, pos.FileID, pos.Offset, "index refers to a missing segment")
+	}
+	return seg, nil
+}
+
+// valuePos は pos のキーの値を格納したレコードの位置 (値を分離したキーでは Blob File 内の位置) を返します。
+func valuePos(pos RecordPos) RecordPos {
+	if pos.Blob.valid() {
+		return pos.Blob.recordPos()
+	}
+	return pos
+}
+
+// lookup は公開済みのビューから key の位置を、そのビューと合わせて返します。d.mu は取りません。
+// 書き込みは完了を返す前に公開されるため、呼び出し元が完了を確認した書き込みは必ず読めます。
+// 閉じた DB では ErrClosed、キーが無い (期限切れを含む) 場合は ErrKeyNotFound を返します。
+func (d *DB) lookup(key []byte) (*readView, RecordPos, error) {
+	v := d.view.Load()
+	if v == nil {
+		return nil, RecordPos{}, ErrClosed
+	}
+	var pos RecordPos
+	ok := false
+	if e := v.recent.get(string(key), v.seq); e != nil {
+		pos, ok = e.pos, !e.deleted
+	} else {
+		pos, ok = v.index.get(string(key))
+	}
+	if !ok || pos.expired(time.Now().UnixNano()) {
+		return nil, RecordPos{}, ErrKeyNotFound
+	}
+	return v, pos, nil
+}
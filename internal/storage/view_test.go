@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockFreeGetDuringWritesAndMerge(t *testing.T) {
+	dbDir := "test_lock_free_get_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	opts := DefaultOptions()
+	opts.SegmentSize = 4096 // 頻繁にローテーションさせる
+	db, err := OpenWithOptions(dbDir, opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	const numKeys = 100
+	for i := 0; i < numKeys; i++ {
+		_ = db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("key%d-0", i)))
+	}
+
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := r; !stop.Load(); i++ {
+				key := fmt.Sprintf("key%d", i%numKeys)
+				v, err := db.Get([]byte(key))
+				if err == nil && !strings.HasPrefix(string(v), key+"-") {
+					err = fmt.Errorf("unexpected value %q", v)
+				}
+				if err != nil {
+					errs <- fmt.Errorf("Get %s: %w", key, err)
+					return
+				}
+			}
+		}(r)
+	}
+
+	for gen := 1; gen <= 20; gen++ {
+		b := NewBatch()
+		for i := 0; i < numKeys; i++ {
+			b.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("key%d-%d", i, gen)))
+		}
+		if err := db.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if gen%5 == 0 {
+			if err := db.Merge(); err != nil {
+				t.Fatalf("Merge failed: %v", err)
+			}
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestLockFreeGetKeepsSegmentOpen(t *testing.T) {
+	dbDir := "test_lock_free_segment_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_ = db.Put([]byte("key1"), []byte("value1"))
+	_ = db.Put([]byte("key2"), []byte("value2"))
+	_ = db.Delete([]byte("key2"))
+
+	// Get が読み込み中のセグメントは、Merge で置き換えられても読み終えるまで閉じられない
+	pos, seg, err := db.acquireRecord([]byte("key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s/%d.data", dbDir, pos.FileID)); !os.IsNotExist(err) {
+		t.Errorf("Expected merged segment %d to be removed, got %v", pos.FileID, err)
+	}
+	if v, err := readValueAt(seg, pos, []byte("key1")); err != nil || string(v) != "value1" {
+		t.Errorf("Read from retired segment = %q, %v", v, err)
+	}
+	_ = seg.release()
+	if seg.acquire() {
+		t.Error("Expected the retired segment to be closed after the last release")
+	}
+
+	// 新しいビューでは Merge 後のセグメントから読む
+	if v, err := db.Get([]byte("key1")); err != nil || string(v) != "value1" {
+		t.Errorf("Get after merge = %q, %v", v, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("key1")); err != ErrClosed {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestGetDoesNotTakeLock(t *testing.T) {
+	dbDir := "test_view_publish_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	// エポックをまたぐ数の書き込みでも、完了した書き込みはすぐに読める
+	for i := 0; i < 3*minRecentEntries; i++ {
+		key := []byte(fmt.Sprintf("key%d", i%100))
+		if i%7 == 0 {
+			_ = db.Delete(key)
+			if _, err := db.Get(key); err != ErrKeyNotFound {
+				t.Fatalf("Get after Delete = %v; want ErrKeyNotFound", err)
+			}
+			continue
+		}
+		val := fmt.Sprintf("value%d", i)
+		if err := db.Put(key, []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := db.Get(key); err != nil || string(v) != val {
+			t.Fatalf("Get = %q, %v; want %s", v, err, val)
+		}
+	}
+
+	// 書き込み側がロックを保持していても読み取りは待たない
+	_ = db.Put([]byte("key"), []byte("value"))
+	db.mu.Lock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := db.Get([]byte("key"))
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		db.mu.Unlock()
+		t.Fatal("Get blocked while d.mu was held")
+	}
+	db.mu.Unlock()
+	if err != nil {
+		t.Errorf("Get while locked failed: %v", err)
+	}
+}
+
+func TestRecentIndexKeepsOlderViews(t *testing.T) {
+	r := newRecentIndex(0)
+	r.record("a", RecordPos{Offset: 1}, false, 1)
+	r.record("a", RecordPos{Offset: 2}, false, 2)
+	r.record("a", RecordPos{Offset: 3}, false, 2) // 同じ操作の中での書き直し
+	r.record("a", RecordPos{}, true, 3)
+
+	if e := r.get("a", 0); e != nil {
+		t.Errorf("get(seq=0) = %+v; want nil", e)
+	}
+	if e := r.get("a", 1); e == nil || e.pos.Offset != 1 {
+		t.Errorf("get(seq=1) = %+v; want offset 1", e)
+	}
+	if e := r.get("a", 2); e == nil || e.pos.Offset != 3 || e.prev.seq != 1 {
+		t.Errorf("get(seq=2) = %+v; want offset 3 replacing the same operation", e)
+	}
+	if e := r.get("a", 3); e == nil || !e.deleted {
+		t.Errorf("get(seq=3) = %+v; want a deletion", e)
+	}
+	if e := r.get("b", 3); e != nil {
+		t.Errorf("get(b) = %+v; want nil", e)
+	}
+
+	// 上限に達したら記録をやめ、次の公開で clone し直す
+	for i := r.recorded; i < r.limit; i++ {
+		r.record(fmt.Sprintf("k%d", i), RecordPos{}, false, 4)
+	}
+	r.record("extra", RecordPos{}, false, 4)
+	if !r.full || r.get("extra", 4) != nil {
+		t.Error("Expected the full table to stop recording")
+	}
+}
+
+// BenchmarkPutGetInterleaved は書き込みのたびに読み取りが挟まる場合のコストを測ります。
+func BenchmarkPutGetInterleaved(b *testing.B) {
+	dbDir := "bench_put_get_dir"
+	defer func() { _ = os.RemoveAll(dbDir) }()
+
+	db, err := NewDB(dbDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	const itemCount = 1000
+	val := []byte("value")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i%itemCount))
+		if err := db.Put(key, val); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := db.Get(key); err != nil {
+			b.Fatal(err)
+		}
+	}
+}